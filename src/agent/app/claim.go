@@ -0,0 +1,80 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/rand"
+    "net/http"
+    "time"
+)
+
+// Idle agents long-poll /tasks/claim: the orchestrator holds the request
+// until a task is scheduled for the org or the wait runs out, so a new task
+// starts at once instead of on the next poll.
+
+type claimer struct {
+    client         *http.Client
+    orchURL, token string
+    org, agentID   string
+    wait           time.Duration
+    // unknown is called when the orchestrator doesn't know the agent
+    unknown func()
+}
+
+func newClaimer(orchURL, token, org, agentID string) *claimer {
+    wait := conf.Timeouts.ClaimWait.Duration
+    // the client must outlast the wait the orchestrator holds us for
+    return &claimer{client: &http.Client{Timeout: wait + 15*time.Second}, orchURL: orchURL, token: token, org: org, agentID: agentID, wait: wait}
+}
+
+// claim returns the claimed task, or nil if none arrived during the wait.
+func (c *claimer) claim(ctx context.Context) (map[string]any, error) {
+    b, _ := json.Marshal(map[string]string{"org": c.org, "agentID": c.agentID})
+    req, _ := http.NewRequestWithContext(ctx, "POST", c.orchURL+"/tasks/claim?wait="+c.wait.String(), bytes.NewReader(b))
+    req.Header.Set("Content-Type", "application/json")
+    if c.token != "" { req.Header.Set("X-Auth-Token", c.token) }
+    resp, err := c.client.Do(req)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNotFound && c.unknown != nil { c.unknown() }
+    if resp.StatusCode >= 300 { return nil, fmt.Errorf("claim: %s", resp.Status) }
+    var claimed map[string]any
+    if err := json.NewDecoder(resp.Body).Decode(&claimed); err != nil { return nil, err }
+    if getString(claimed["id"]) == "" { return nil, nil }
+    return claimed, nil
+}
+
+// next blocks until a task is claimed, backing off with jitter on errors
+// so a fleet doesn't hammer an orchestrator that is coming back up.
+func (c *claimer) next(ctx context.Context) (map[string]any, error) {
+    backoff := time.Second
+    for {
+        start := time.Now()
+        task, err := c.claim(ctx)
+        if task != nil { return task, nil }
+        if ctx.Err() != nil { return nil, ctx.Err() }
+        var pause time.Duration
+        if err != nil {
+            pause = jitter(backoff)
+            log.Printf("claim error: %v; retrying in %s", err, pause.Round(time.Millisecond))
+            backoff = min(backoff*2, 30*time.Second)
+        } else {
+            backoff = time.Second
+            // an orchestrator without long-poll answers at once
+            if time.Since(start) < c.wait/2 { pause = jitter(5 * time.Second) }
+        }
+        select {
+        case <-time.After(pause):
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// jitter picks a duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+    return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -1,10 +1,15 @@
 #!/usr/bin/env bash
 set -euo pipefail
 mkdir -p /workspace
-PASS=${CODE_SERVER_PASSWORD:-password}
+# no fixed default: unset credentials lock the editor with random ones
+random_secret() { head -c 16 /dev/urandom | od -An -tx1 | tr -d ' \n'; }
+if [[ -z "${CODE_SERVER_PASSWORD:-}" || -z "${CODE_SERVER_TOKEN:-}" ]]; then
+	echo "CODE_SERVER_PASSWORD/CODE_SERVER_TOKEN not set; using random values, the editor won't be reachable" >&2
+fi
+PASS=${CODE_SERVER_PASSWORD:-$(random_secret)}
 export PASSWORD="$PASS"
 AUTH_HDR=${CODE_SERVER_AUTH_HEADER:-"X-Agent-Auth"}
-AUTH_TOKEN=${CODE_SERVER_TOKEN:-"password"}
+AUTH_TOKEN=${CODE_SERVER_TOKEN:-$(random_secret)}
 if command -v code-server >/dev/null 2>&1; then
 	exec code-server --bind-addr 0.0.0.0:8443 --auth password --disable-telemetry /workspace
 else
@@ -13,7 +18,7 @@ else
 import http.server, socketserver, os
 PORT=8443
 AUTH_H=os.environ.get('AUTH_HDR','X-Agent-Auth')
-AUTH_T=os.environ.get('AUTH_TOKEN','password')
+AUTH_T=os.environ['AUTH_TOKEN']
 class H(http.server.SimpleHTTPRequestHandler):
 	def do_GET(self):
 		if self.path=='/health':
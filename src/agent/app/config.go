@@ -0,0 +1,195 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "sigs.k8s.io/yaml"
+)
+
+// Config is the agent configuration: a YAML file (AGENT_CONFIG, default
+// /etc/agent/agent.yaml if it exists) with environment variables taking
+// precedence over it, so the env the deployers set always wins. See
+// configs/agent.example.yaml.
+type Config struct {
+    Org  string `json:"org"`
+    // Name fixes the agent's ID; unset, one is generated and kept in the
+    // state directory (see identity.go).
+    Name string `json:"name,omitempty"`
+    // Deployment links the agent to the deployment that started it.
+    Deployment string            `json:"deployment,omitempty"`
+    Labels     map[string]string `json:"labels,omitempty"`
+    Orchestrator struct {
+        // URLs are tried in order at startup; the first healthy one is used.
+        URLs  []string `json:"urls"`
+        Token string   `json:"token,omitempty"`
+    } `json:"orchestrator"`
+    // Workspace is the root the tasks run in; with several slots each gets
+    // slot-<n> under it.
+    Workspace          string `json:"workspace,omitempty"`
+    StateDir           string `json:"stateDir,omitempty"`
+    MaxConcurrentTasks int    `json:"maxConcurrentTasks,omitempty"`
+    Executors struct {
+        Shell     string `json:"shell,omitempty"`
+        SpecKit   string `json:"specKit,omitempty"`
+        CodingCLI string `json:"codingCLI,omitempty"`
+    } `json:"executors,omitempty"`
+    Timeouts struct {
+        Request           Duration `json:"request,omitempty"`
+        HeartbeatInterval Duration `json:"heartbeatInterval,omitempty"`
+        ClaimWait         Duration `json:"claimWait,omitempty"`
+        ShutdownGrace     Duration `json:"shutdownGrace,omitempty"`
+    } `json:"timeouts,omitempty"`
+    Tunnel struct {
+        Disabled   bool   `json:"disabled,omitempty"`
+        EditorAddr string `json:"editorAddr,omitempty"`
+    } `json:"tunnel,omitempty"`
+    LogLineMax int `json:"logLineMax,omitempty"`
+    // CodeServerPassword and Tokens are in agent.yaml files written before
+    // this config existed. code-server takes its password and token from
+    // CODE_SERVER_PASSWORD and CODE_SERVER_TOKEN, so they are read and
+    // ignored rather than failing the strict parse.
+    CodeServerPassword string            `json:"codeServerPassword,omitempty"`
+    Tokens             map[string]string `json:"tokens,omitempty"`
+}
+
+// Duration is a time.Duration written as a string ("30s", "10m") in config.
+type Duration struct{ time.Duration }
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil { return fmt.Errorf("duration must be a string like \"30s\"") }
+    v, err := time.ParseDuration(s)
+    if err != nil { return err }
+    d.Duration = v
+    return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+const defaultConfigPath = "/etc/agent/agent.yaml"
+
+// conf is the loaded configuration, set once at startup.
+var conf = defaultConfig()
+
+func defaultConfig() *Config {
+    c := &Config{MaxConcurrentTasks: 1, LogLineMax: 4096}
+    c.Executors.SpecKit = "/app/spec-kit/cli_wrapper.sh"
+    c.Executors.CodingCLI = "codex exec"
+    c.Timeouts.Request.Duration = 10 * time.Second
+    c.Timeouts.HeartbeatInterval.Duration = 10 * time.Second
+    c.Timeouts.ClaimWait.Duration = 30 * time.Second
+    c.Timeouts.ShutdownGrace.Duration = 60 * time.Second
+    c.Tunnel.EditorAddr = "127.0.0.1:8443"
+    return c
+}
+
+// loadConfig reads the config file, applies env overrides and validates
+// the result. A file named by AGENT_CONFIG must exist; the default path
+// is optional.
+func loadConfig() (*Config, error) {
+    c := defaultConfig()
+    path := os.Getenv("AGENT_CONFIG")
+    explicit := path != ""
+    if !explicit { path = defaultConfigPath }
+    b, err := os.ReadFile(path)
+    switch {
+    case err == nil:
+        if err := yaml.UnmarshalStrict([]byte(os.ExpandEnv(string(b))), c); err != nil { return nil, fmt.Errorf("parse %s: %w", path, err) }
+        if c.CodeServerPassword != "" || len(c.Tokens) > 0 { log.Printf("%s: codeServerPassword and tokens are ignored; code-server reads CODE_SERVER_PASSWORD and CODE_SERVER_TOKEN", path) }
+    case explicit || !os.IsNotExist(err):
+        return nil, fmt.Errorf("agent config: %w", err)
+    default:
+        path = "environment"
+    }
+    if err := c.applyEnv(); err != nil { return nil, err }
+    for i, u := range c.Orchestrator.URLs { c.Orchestrator.URLs[i] = strings.TrimRight(strings.TrimSpace(u), "/") }
+    if err := c.validate(); err != nil { return nil, fmt.Errorf("invalid agent config (%s):\n%w", path, err) }
+    return c, nil
+}
+
+// applyEnv overrides the file with the environment variables the agent
+// has always read.
+func (c *Config) applyEnv() error {
+    str := func(key string, dst *string) { if v := os.Getenv(key); v != "" { *dst = v } }
+    num := func(key string, dst *int) error {
+        v := os.Getenv(key)
+        if v == "" { return nil }
+        n, err := strconv.Atoi(v)
+        if err != nil { return fmt.Errorf("%s: %q is not a number", key, v) }
+        *dst = n
+        return nil
+    }
+    dur := func(key string, dst *Duration) error {
+        v := os.Getenv(key)
+        if v == "" { return nil }
+        d, err := time.ParseDuration(v)
+        if err != nil { return fmt.Errorf("%s: %q is not a duration like \"30s\"", key, v) }
+        dst.Duration = d
+        return nil
+    }
+    str("ORG_NAME", &c.Org)
+    str("AGENT_NAME", &c.Name)
+    str("AGENT_DEPLOYMENT", &c.Deployment)
+    // AGENT_LABELS is k=v pairs separated by commas
+    if v := os.Getenv("AGENT_LABELS"); v != "" {
+        c.Labels = map[string]string{}
+        for _, kv := range strings.Split(v, ",") {
+            k, val, ok := strings.Cut(strings.TrimSpace(kv), "=")
+            if !ok { return fmt.Errorf("AGENT_LABELS: %q is not key=value", kv) }
+            c.Labels[k] = val
+        }
+    }
+    // ORCHESTRATOR_URL may list several, separated by commas
+    if v := os.Getenv("ORCHESTRATOR_URL"); v != "" { c.Orchestrator.URLs = strings.Split(v, ",") }
+    str("ORCHESTRATOR_TOKEN", &c.Orchestrator.Token)
+    str("AGENT_WORKSPACE", &c.Workspace)
+    str("AGENT_STATE_DIR", &c.StateDir)
+    str("AGENT_SHELL", &c.Executors.Shell)
+    str("SPEC_KIT_CLI", &c.Executors.SpecKit)
+    str("AGENT_CODING_CLI", &c.Executors.CodingCLI)
+    if os.Getenv("AGENT_TUNNEL") == "0" { c.Tunnel.Disabled = true }
+    str("EDITOR_ADDR", &c.Tunnel.EditorAddr)
+    return errors.Join(
+        num("AGENT_MAX_CONCURRENT_TASKS", &c.MaxConcurrentTasks),
+        num("AGENT_LOG_LINE_MAX", &c.LogLineMax),
+        dur("AGENT_REQUEST_TIMEOUT", &c.Timeouts.Request),
+        dur("AGENT_HEARTBEAT_INTERVAL", &c.Timeouts.HeartbeatInterval),
+        dur("AGENT_CLAIM_WAIT", &c.Timeouts.ClaimWait),
+        dur("AGENT_SHUTDOWN_GRACE", &c.Timeouts.ShutdownGrace),
+    )
+}
+
+func (c *Config) validate() error {
+    var errs []error
+    bad := func(format string, args ...any) { errs = append(errs, fmt.Errorf(format, args...)) }
+    if strings.TrimSpace(c.Org) == "" { bad("org is required (org, or ORG_NAME)") }
+    if len(c.Orchestrator.URLs) == 0 { bad("orchestrator.urls is required (or ORCHESTRATOR_URL)") }
+    for i, u := range c.Orchestrator.URLs {
+        p, err := url.Parse(u)
+        if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" { bad("orchestrator.urls[%d]: %q is not an http(s) URL", i, u) }
+    }
+    for k := range c.Labels {
+        if strings.TrimSpace(k) == "" { bad("labels: empty key") }
+    }
+    if c.MaxConcurrentTasks < 1 { bad("maxConcurrentTasks must be at least 1") }
+    if c.LogLineMax < 1 { bad("logLineMax must be at least 1") }
+    if len(strings.Fields(c.Executors.CodingCLI)) == 0 { bad("executors.codingCLI is empty") }
+    if c.Executors.SpecKit == "" { bad("executors.specKit is empty") }
+    t := c.Timeouts
+    for _, d := range []struct {
+        name string
+        d    Duration
+    }{{"request", t.Request}, {"heartbeatInterval", t.HeartbeatInterval}, {"claimWait", t.ClaimWait}, {"shutdownGrace", t.ShutdownGrace}} {
+        if d.d.Duration <= 0 { bad("timeouts.%s must be positive", d.name) }
+    }
+    if !c.Tunnel.Disabled && c.Tunnel.EditorAddr == "" { bad("tunnel.editorAddr is required unless tunnel.disabled") }
+    return errors.Join(errs...)
+}
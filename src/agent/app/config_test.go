@@ -0,0 +1,89 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// withConfigFile points AGENT_CONFIG at a file holding yaml and clears the
+// env overrides, so only what the test sets applies.
+func withConfigFile(t *testing.T, yaml string) {
+    t.Helper()
+    for _, k := range []string{"ORG_NAME", "AGENT_NAME", "AGENT_DEPLOYMENT", "AGENT_LABELS", "ORCHESTRATOR_URL", "ORCHESTRATOR_TOKEN", "AGENT_WORKSPACE", "AGENT_STATE_DIR", "AGENT_SHELL", "SPEC_KIT_CLI", "AGENT_CODING_CLI", "AGENT_TUNNEL", "EDITOR_ADDR", "AGENT_MAX_CONCURRENT_TASKS", "AGENT_LOG_LINE_MAX", "AGENT_REQUEST_TIMEOUT", "AGENT_HEARTBEAT_INTERVAL", "AGENT_CLAIM_WAIT", "AGENT_SHUTDOWN_GRACE"} {
+        t.Setenv(k, "")
+    }
+    path := filepath.Join(t.TempDir(), "agent.yaml")
+    if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil { t.Fatal(err) }
+    t.Setenv("AGENT_CONFIG", path)
+}
+
+func TestConfigDefaults(t *testing.T) {
+    withConfigFile(t, "org: acme\norchestrator: { urls: [\"http://orch:8080/\"] }\n")
+    c, err := loadConfig()
+    if err != nil { t.Fatal(err) }
+    if c.MaxConcurrentTasks != 1 || c.LogLineMax != 4096 || c.Executors.CodingCLI != "codex exec" || c.Tunnel.EditorAddr != "127.0.0.1:8443" { t.Fatalf("defaults: %+v", c) }
+    if c.Timeouts.HeartbeatInterval.Duration != 10*time.Second || c.Timeouts.ShutdownGrace.Duration != 60*time.Second { t.Fatalf("timeouts: %+v", c.Timeouts) }
+    if c.Orchestrator.URLs[0] != "http://orch:8080" { t.Fatalf("url not trimmed: %q", c.Orchestrator.URLs) }
+}
+
+func TestConfigEnvOverridesFile(t *testing.T) {
+    withConfigFile(t, `org: acme
+name: from-file
+labels: { gpu: "true" }
+orchestrator:
+  urls: ["http://file:8080"]
+  token: ${TEST_AGENT_TOKEN}
+maxConcurrentTasks: 2
+timeouts: { claimWait: 5s }
+`)
+    t.Setenv("TEST_AGENT_TOKEN", "expanded")
+    t.Setenv("AGENT_NAME", "from-env")
+    t.Setenv("ORCHESTRATOR_URL", "http://a:1,http://b:2")
+    t.Setenv("AGENT_LABELS", "region=us, tier=fast")
+    t.Setenv("AGENT_CLAIM_WAIT", "1m")
+    t.Setenv("AGENT_TUNNEL", "0")
+    c, err := loadConfig()
+    if err != nil { t.Fatal(err) }
+    if c.Org != "acme" || c.Name != "from-env" || c.Orchestrator.Token != "expanded" || c.MaxConcurrentTasks != 2 { t.Fatalf("config: %+v", c) }
+    if strings.Join(c.Orchestrator.URLs, " ") != "http://a:1 http://b:2" { t.Fatalf("urls: %q", c.Orchestrator.URLs) }
+    if len(c.Labels) != 2 || c.Labels["region"] != "us" || c.Labels["tier"] != "fast" { t.Fatalf("labels: %v", c.Labels) }
+    if c.Timeouts.ClaimWait.Duration != time.Minute || !c.Tunnel.Disabled { t.Fatalf("claimWait=%s tunnel=%+v", c.Timeouts.ClaimWait, c.Tunnel) }
+
+    t.Setenv("AGENT_MAX_CONCURRENT_TASKS", "many")
+    if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "AGENT_MAX_CONCURRENT_TASKS") { t.Fatalf("bad env number: %v", err) }
+}
+
+func TestConfigValidation(t *testing.T) {
+    withConfigFile(t, `org: ""
+orchestrator: { urls: ["ftp://orch", "http://"] }
+maxConcurrentTasks: -1
+executors: { codingCLI: " " }
+timeouts: { request: 0s }
+tunnel: { editorAddr: "" }
+`)
+    _, err := loadConfig()
+    if err == nil { t.Fatal("invalid config accepted") }
+    for _, want := range []string{"org is required", "orchestrator.urls[0]", "orchestrator.urls[1]", "maxConcurrentTasks", "executors.codingCLI is empty", "timeouts.request must be positive", "tunnel.editorAddr"} {
+        if !strings.Contains(err.Error(), want) { t.Errorf("missing %q in:\n%v", want, err) }
+    }
+
+    withConfigFile(t, "org: acme\norchestrator: { urls: [\"http://orch\"] }\nworkspaces: /tmp\n")
+    if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "workspaces") { t.Fatalf("unknown key: %v", err) }
+    withConfigFile(t, "org: acme\norchestrator: { urls: [\"http://orch\"] }\ntimeouts: { request: 10 }\n")
+    if _, err := loadConfig(); err == nil { t.Fatal("numeric duration accepted") }
+
+    t.Setenv("AGENT_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+    if _, err := loadConfig(); err == nil { t.Fatal("missing AGENT_CONFIG file accepted") }
+}
+
+func TestConfigAcceptsBaselineKeys(t *testing.T) {
+    // the agent.yaml shipped before the config had a schema
+    withConfigFile(t, "org: acme\ncodeServerPassword: password\ntokens:\n  agent: agent-secret\n")
+    t.Setenv("ORCHESTRATOR_URL", "http://orch:8080")
+    c, err := loadConfig()
+    if err != nil { t.Fatalf("baseline config rejected: %v", err) }
+    if c.Org != "acme" || c.Orchestrator.Token != "" { t.Fatalf("config: %+v", c) }
+}
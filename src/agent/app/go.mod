@@ -1,3 +1,13 @@
 module agent
 
 go 1.22
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/hashicorp/yamux v0.1.1
+	sigs.k8s.io/yaml v1.3.0
+)
+
+require github.com/creack/pty v1.1.21
+
+require gopkg.in/yaml.v2 v2.4.0 // indirect
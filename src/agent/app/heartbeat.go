@@ -0,0 +1,189 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Heartbeats run for the agent's whole lifetime, not just between tasks,
+// so the orchestrator can tell a busy agent from a dead one. Each carries
+// the tasks in progress with their phase and, when the tool reports it,
+// percent and step.
+
+// progressPrefix marks a progress line on a tool's stdout:
+// "::progress <percent> [step]" or "::progress - <step>" for a step only.
+const progressPrefix = "::progress "
+
+type taskProgress struct {
+    TaskID  string `json:"taskId"`
+    Phase   string `json:"phase,omitempty"`
+    Percent *int   `json:"percent,omitempty"`
+    Step    string `json:"step,omitempty"`
+}
+
+// heldTask is a task in progress as reported when the agent registers
+// again, with what the orchestrator needs to recreate it. A finished task
+// stays held until its final update has been delivered, so an
+// orchestrator that restarted meanwhile still has the task to close.
+type heldTask struct {
+    taskProgress
+    Kind string `json:"kind,omitempty"`
+    Text string `json:"text"`
+    // Status is set once the task is finished, to the status of the final
+    // update not yet delivered; the orchestrator closes the task with it
+    Status string `json:"status,omitempty"`
+    // cancel stops the task's tools if the orchestrator rejects the task
+    cancel context.CancelFunc
+}
+
+// agentStatus is what the next heartbeat reports.
+type agentStatus struct {
+    mu    sync.Mutex
+    tasks map[string]*heldTask
+    // rejected are running tasks the orchestrator no longer assigns to
+    // this agent; they are cancelled and not reported on
+    rejected map[string]bool
+    // beat asks for a heartbeat now, e.g. on a phase change
+    beat chan struct{}
+}
+
+func newAgentStatus() *agentStatus {
+    return &agentStatus{tasks: map[string]*heldTask{}, rejected: map[string]bool{}, beat: make(chan struct{}, 1)}
+}
+
+func (s *agentStatus) poke() {
+    select { case s.beat <- struct{}{}: default: }
+}
+
+// start tracks a claimed task; cancel, if set, stops it when rejected.
+func (s *agentStatus) start(id, kind, text string, cancel context.CancelFunc) {
+    s.mu.Lock()
+    s.tasks[id] = &heldTask{taskProgress: taskProgress{TaskID: id, Phase: "claimed"}, Kind: kind, Text: text, cancel: cancel}
+    s.mu.Unlock()
+    s.poke()
+}
+
+// phase moves a task to a new phase, clearing progress from the last one.
+func (s *agentStatus) phase(id, phase string) {
+    s.mu.Lock()
+    if p, ok := s.tasks[id]; ok { p.taskProgress = taskProgress{TaskID: id, Phase: phase} }
+    s.mu.Unlock()
+    s.poke()
+}
+
+func (s *agentStatus) progress(id string, percent *int, step string) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    if p, ok := s.tasks[id]; ok {
+        if percent != nil { p.Percent = percent }
+        if step != "" { p.Step = step }
+    }
+}
+
+// done marks a task finished with status; heartbeats no longer report it,
+// but it is held until the outbox has delivered the update.
+func (s *agentStatus) done(id, status string) {
+    s.mu.Lock()
+    if p, ok := s.tasks[id]; ok { p.Status = status }
+    s.mu.Unlock()
+    s.poke()
+}
+
+// settled releases a task once the outbox has delivered (or given up on)
+// its final update.
+func (s *agentStatus) settled(m outboxMsg) {
+    if m.Path != "/tasks/update" { return }
+    var u struct{ ID, Status string }
+    if json.Unmarshal(m.Body, &u) != nil || u.Status == "running" { return }
+    s.mu.Lock()
+    delete(s.tasks, u.ID)
+    s.mu.Unlock()
+}
+
+// reject drops tasks the orchestrator finished or gave to another agent
+// meanwhile: they are no longer held, and running ones are cancelled.
+func (s *agentStatus) reject(ids []string) {
+    s.mu.Lock()
+    for _, id := range ids {
+        p, ok := s.tasks[id]
+        if !ok { continue }
+        delete(s.tasks, id)
+        if p.Status != "" { continue }
+        s.rejected[id] = true
+        if p.cancel != nil { p.cancel() }
+    }
+    s.mu.Unlock()
+    s.poke()
+}
+
+// isRejected reports whether a running task was rejected.
+func (s *agentStatus) isRejected(id string) bool {
+    s.mu.Lock(); defer s.mu.Unlock()
+    return s.rejected[id]
+}
+
+// forget clears a rejected task once its slot has stopped.
+func (s *agentStatus) forget(id string) {
+    s.mu.Lock()
+    delete(s.rejected, id)
+    s.mu.Unlock()
+}
+
+func (s *agentStatus) snapshot() (status string, tasks []taskProgress) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    tasks = []taskProgress{}
+    for _, p := range s.tasks {
+        if p.Status == "" { tasks = append(tasks, p.taskProgress) }
+    }
+    if len(tasks) == 0 { return "idle", tasks }
+    return "running", tasks
+}
+
+func (s *agentStatus) held() []heldTask {
+    s.mu.Lock(); defer s.mu.Unlock()
+    held := []heldTask{}
+    for _, p := range s.tasks { held = append(held, *p) }
+    return held
+}
+
+// parseProgress reads a progress line; ok is false for ordinary output.
+func parseProgress(line string) (percent *int, step string, ok bool) {
+    rest, ok := strings.CutPrefix(strings.TrimSpace(line), strings.TrimSpace(progressPrefix))
+    if !ok || (rest != "" && rest[0] != ' ') { return nil, "", false }
+    pct, step, _ := strings.Cut(strings.TrimSpace(rest), " ")
+    if n, err := strconv.Atoi(strings.TrimSuffix(pct, "%")); err == nil {
+        n = min(max(n, 0), 100)
+        percent = &n
+    } else if pct != "-" {
+        return nil, "", false
+    }
+    return percent, strings.TrimSpace(step), true
+}
+
+// runHeartbeats posts heartbeats until ctx ends: every
+// timeouts.heartbeatInterval, and at once whenever the status changes.
+// An orchestrator that has forgotten the agent (it restarted) answers 404,
+// and the agent registers again with the tasks it is running.
+func runHeartbeats(ctx context.Context, reg *registration, st *agentStatus) {
+    t := time.NewTicker(conf.Timeouts.HeartbeatInterval.Duration)
+    defer t.Stop()
+    for {
+        status, tasks := st.snapshot()
+        hb := map[string]any{"name": reg.id.ID, "org": reg.id.Org, "deployment": reg.id.Deployment, "instance": instanceID, "capacity": reg.slots, "status": status, "tasks": tasks}
+        if postJSON(reg.client, reg.orchURL+"/agents/heartbeat", reg.token, hb) == http.StatusNotFound {
+            log.Printf("orchestrator doesn't know agent %s; registering again", reg.id.ID)
+            if err := reg.renew(); err != nil { log.Printf("register: %v", err) }
+        }
+        select {
+        case <-t.C:
+        case <-st.beat:
+        case <-ctx.Done():
+            return
+        }
+    }
+}
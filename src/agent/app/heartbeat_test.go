@@ -0,0 +1,177 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestParseProgress(t *testing.T) {
+    for _, c := range []struct {
+        line    string
+        percent string
+        step    string
+        ok      bool
+    }{
+        {"::progress 40 running tests", "40", "running tests", true},
+        {"::progress 40% running tests", "40", "running tests", true},
+        {"  ::progress 75  ", "75", "", true},
+        {"::progress 250 done", "100", "done", true},
+        {"::progress -5", "0", "", true},
+        {"::progress - linting", "", "linting", true},
+        {"::progress", "", "", false},
+        {"::progress soon", "", "", false},
+        {"::progressive 40", "", "", false},
+        {"progress 40", "", "", false},
+        {"building ::progress 40", "", "", false},
+    } {
+        pct, step, ok := parseProgress(c.line)
+        got := ""
+        if pct != nil { got = fmt.Sprint(*pct) }
+        if got != c.percent || step != c.step || ok != c.ok { t.Errorf("%q: %s %q %v, want %s %q %v", c.line, got, step, ok, c.percent, c.step, c.ok) }
+    }
+}
+
+func TestProgressReachesHeartbeat(t *testing.T) {
+    l, _, _ := newTestTaskLogger(t, 4096)
+    defer l.Close()
+    st := newAgentStatus()
+    st.start("t1", "shell", "make test", nil)
+    st.phase("t1", "run")
+    l.onProgress = func(pct *int, step string) { st.progress("t1", pct, step) }
+    out, errw := l.Writer("run", "stdout"), l.Writer("run", "stderr")
+    fmt.Fprintln(out, "::progress 30 compiling")
+    fmt.Fprintln(errw, "::progress 90 ignored on stderr")
+    fmt.Fprintln(out, "::progress - testing")
+    _, tasks := st.snapshot()
+    if len(tasks) != 1 || tasks[0].Phase != "run" || tasks[0].Percent == nil || *tasks[0].Percent != 30 || tasks[0].Step != "testing" { t.Fatalf("progress: %+v", tasks) }
+    // a new phase starts without the last one's progress
+    st.phase("t1", "pr")
+    if _, tasks := st.snapshot(); tasks[0].Percent != nil || tasks[0].Step != "" { t.Fatalf("after phase change: %+v", tasks) }
+}
+
+// heartbeatOrchestrator answers heartbeats with 404 {register:true} while
+// it doesn't know the agent, and records what is registered.
+type heartbeatOrchestrator struct {
+    mu         sync.Mutex
+    known      bool
+    beats      int
+    registered []map[string]any
+}
+
+func (f *heartbeatOrchestrator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    b, _ := io.ReadAll(r.Body)
+    var body map[string]any
+    json.Unmarshal(b, &body)
+    f.mu.Lock(); defer f.mu.Unlock()
+    switch r.URL.Path {
+    case "/agents/heartbeat":
+        f.beats++
+        if !f.known {
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, `{"error":"unknown agent","register":true}`)
+            return
+        }
+        w.WriteHeader(204)
+    case "/agents/register":
+        f.known = true
+        f.registered = append(f.registered, body)
+        json.NewEncoder(w).Encode(map[string]any{"name": body["name"], "org": body["org"]})
+    default:
+        http.Error(w, "unexpected", 500)
+    }
+}
+
+func TestHeartbeatRegistersAgain(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    conf.Timeouts.HeartbeatInterval.Duration = 20 * time.Millisecond
+    orch := &heartbeatOrchestrator{}
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+    st := newAgentStatus()
+    st.start("t1", "shell", "make test", nil)
+    reg := &registration{client: srv.Client(), orchURL: srv.URL, id: &agentIdentity{ID: "a1", Org: "acme", configured: true}, slots: 2, status: st}
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() { runHeartbeats(ctx, reg, st); close(done) }()
+
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        orch.mu.Lock()
+        beats, regs := orch.beats, len(orch.registered)
+        orch.mu.Unlock()
+        if beats >= 3 && regs == 1 { break }
+        if time.Now().After(deadline) { t.Fatalf("%d heartbeats, %d registrations", beats, regs) }
+        time.Sleep(10 * time.Millisecond)
+    }
+    cancel()
+    <-done
+    // registered once, after the first heartbeat, with the task it runs
+    orch.mu.Lock(); defer orch.mu.Unlock()
+    if len(orch.registered) != 1 { t.Fatalf("registered %d times", len(orch.registered)) }
+    got, _ := json.Marshal(orch.registered[0]["tasks"])
+    if string(got) != `[{"kind":"shell","phase":"claimed","taskId":"t1","text":"make test"}]` { t.Fatalf("registered tasks: %s", got) }
+}
+
+func TestClaimBackoff(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    conf.Timeouts.ClaimWait.Duration = 200 * time.Millisecond
+    var mu sync.Mutex
+    var at []time.Time
+    answers := []func(w http.ResponseWriter){
+        func(w http.ResponseWriter) { http.Error(w, "starting", 503) },
+        func(w http.ResponseWriter) { http.Error(w, "starting", 503) },
+        // a long poll that ran out: polled again at once
+        func(w http.ResponseWriter) { time.Sleep(200 * time.Millisecond); io.WriteString(w, "{}") },
+        func(w http.ResponseWriter) { io.WriteString(w, `{"id":"t1","text":"go"}`) },
+    }
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("wait") != "200ms" { t.Errorf("wait %q", r.URL.Query().Get("wait")) }
+        mu.Lock()
+        at = append(at, time.Now())
+        answer := answers[min(len(at), len(answers))-1]
+        mu.Unlock()
+        answer(w)
+    }))
+    defer srv.Close()
+    c := newClaimer(srv.URL, "", "acme", "a1")
+    task, err := c.next(context.Background())
+    if err != nil || getString(task["id"]) != "t1" { t.Fatalf("claimed %v: %v", task, err) }
+    mu.Lock(); defer mu.Unlock()
+    if len(at) != 4 { t.Fatalf("%d claims", len(at)) }
+    // errors back off from 1s with jitter in [d/2, d)
+    for i, want := range []time.Duration{time.Second / 2, time.Second} {
+        if gap := at[i+1].Sub(at[i]); gap < want || gap > 2*want+100*time.Millisecond { t.Errorf("pause %d: %v, want [%v, %v)", i, gap, want, 2*want) }
+    }
+    if gap := at[3].Sub(at[2]); gap > 200*time.Millisecond+100*time.Millisecond { t.Errorf("poll after an empty long poll waited %v", gap) }
+}
+
+func TestClaimUnknownAgent(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(404)
+        io.WriteString(w, `{"error":"unknown agent a1","register":true}`)
+    }))
+    defer srv.Close()
+    c := newClaimer(srv.URL, "", "acme", "a1")
+    unknown := 0
+    c.unknown = func() { unknown++ }
+    if task, err := c.claim(context.Background()); task != nil || err == nil || unknown != 1 { t.Fatalf("claim: %v %v, unknown=%d", task, err, unknown) }
+    // cancelling ends the backoff at once
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    if _, err := c.next(ctx); err != context.DeadlineExceeded || time.Since(start) > time.Second { t.Fatalf("next: %v after %v", err, time.Since(start)) }
+}
+
+func TestJitter(t *testing.T) {
+    for i := 0; i < 100; i++ {
+        if d := jitter(time.Second); d < time.Second/2 || d > time.Second { t.Fatalf("jitter(1s) = %v", d) }
+    }
+}
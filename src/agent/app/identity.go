@@ -0,0 +1,172 @@
+package main
+
+import (
+    "bytes"
+    "cmp"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// The agent's ID is generated once and kept in the state directory, so a
+// restarted pod registers as the same agent rather than a new one named
+// after its hostname. A name set in the config (name, AGENT_NAME) is used
+// as the ID instead. Every run also gets a fresh instance ID, which lets
+// the orchestrator tell a restart of this agent from a second agent using
+// the same ID.
+
+// agentIdentity is the identity.json kept in the state directory.
+type agentIdentity struct {
+    ID         string    `json:"id"`
+    Org        string    `json:"org"`
+    Deployment string    `json:"deployment,omitempty"`
+    Hostname   string    `json:"hostname,omitempty"`
+    CreatedAt  time.Time `json:"createdAt"`
+    // configured is set when the ID came from the config, which the agent
+    // must not replace on a conflict.
+    configured bool
+}
+
+func identityPath() string { return filepath.Join(agentStateDir(), "identity.json") }
+
+// loadIdentity returns the configured name, or the stored identity, or a
+// newly generated one. A stored identity for another org is replaced.
+func loadIdentity() (*agentIdentity, error) {
+    if conf.Name != "" {
+        return &agentIdentity{ID: conf.Name, Org: conf.Org, Deployment: conf.Deployment, Hostname: getHostname(), CreatedAt: time.Now().UTC(), configured: true}, nil
+    }
+    b, err := os.ReadFile(identityPath())
+    switch {
+    case err == nil:
+        var id agentIdentity
+        if err := json.Unmarshal(b, &id); err != nil || id.ID == "" { return nil, fmt.Errorf("%s is corrupt; remove it to get a new identity: %v", identityPath(), err) }
+        if id.Org == conf.Org {
+            if id.Deployment != conf.Deployment || id.Hostname != getHostname() {
+                id.Deployment, id.Hostname = conf.Deployment, getHostname()
+                if err := id.save(); err != nil { return nil, err }
+            }
+            return &id, nil
+        }
+        log.Printf("identity %s belongs to org %s; generating a new one for %s", id.ID, id.Org, conf.Org)
+    case !os.IsNotExist(err):
+        return nil, err
+    }
+    return newIdentity()
+}
+
+// newIdentity generates and stores a fresh ID, <deployment or org>-<hex>.
+func newIdentity() (*agentIdentity, error) {
+    prefix := conf.Deployment
+    if prefix == "" { prefix = conf.Org }
+    id := &agentIdentity{ID: prefix + "-" + randomHex(4), Org: conf.Org, Deployment: conf.Deployment, Hostname: getHostname(), CreatedAt: time.Now().UTC()}
+    if err := id.save(); err != nil { return nil, err }
+    log.Printf("generated agent identity %s", id.ID)
+    return id, nil
+}
+
+func (id *agentIdentity) save() error {
+    if err := os.MkdirAll(agentStateDir(), 0o755); err != nil { return err }
+    b, _ := json.MarshalIndent(id, "", "  ")
+    return writeFileSync(identityPath(), b)
+}
+
+func randomHex(n int) string {
+    b := make([]byte, n)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// instanceID identifies this run of the agent process.
+var instanceID = randomHex(8)
+
+// errIdentityConflict means another live agent holds the ID.
+type errIdentityConflict struct{ msg string }
+
+func (e *errIdentityConflict) Error() string { return e.msg }
+
+// registration is what the agent registers with; main keeps one and sends
+// it again whenever the orchestrator asks.
+type registration struct {
+    client  *http.Client
+    orchURL string
+    token   string
+    id      *agentIdentity
+    slots   int
+    // status supplies the tasks in progress, and finished ones whose final
+    // update is still queued, when registering again
+    status  *agentStatus
+    // rejected is called with the tasks the orchestrator no longer
+    // assigns to this agent
+    rejected func(ids []string)
+}
+
+func (r *registration) body() map[string]any {
+    b := map[string]any{"name": r.id.ID, "org": r.id.Org, "deployment": r.id.Deployment, "instance": instanceID, "hostname": r.id.Hostname, "labels": conf.Labels, "capacity": r.slots}
+    if r.status != nil { b["tasks"] = r.status.held() }
+    return b
+}
+
+// register registers the agent, retrying until the orchestrator answers.
+// When a generated ID turns out to be in use by another agent, a new one
+// is generated and registration tried again; a configured name that is
+// in use is an error.
+func (r *registration) register() error {
+    for attempt := 0; ; attempt++ {
+        err := r.post()
+        if c, ok := err.(*errIdentityConflict); ok {
+            if r.id.configured { return fmt.Errorf("%v; set a different name or AGENT_NAME", c) }
+            log.Printf("register: %v; generating a new identity", c)
+            id, err := newIdentity()
+            if err != nil { return err }
+            r.id = id
+            continue
+        }
+        if err == nil { return nil }
+        d := min(time.Second<<min(attempt, 5), 30*time.Second)
+        log.Printf("register: %v; retrying in %s", err, d)
+        time.Sleep(jitter(d))
+    }
+}
+
+// renew registers again under the same ID, e.g. after an orchestrator
+// restart. Unlike at startup the ID is kept on a conflict; the next
+// heartbeat tries again.
+func (r *registration) renew() error { return r.post() }
+
+func (r *registration) post() error {
+    b, _ := json.Marshal(r.body())
+    req, _ := http.NewRequest("POST", r.orchURL+"/agents/register", bytes.NewReader(b))
+    req.Header.Set("Content-Type", "application/json")
+    if r.token != "" { req.Header.Set("X-Auth-Token", r.token) }
+    resp, err := r.client.Do(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    switch {
+    case resp.StatusCode == http.StatusConflict:
+        var c struct{ Error string }
+        json.Unmarshal(body, &c)
+        if c.Error == "" { c.Error = "agent " + r.id.ID + " is already registered" }
+        return &errIdentityConflict{c.Error}
+    case resp.StatusCode >= 300:
+        return fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(body))
+    }
+    var reg struct{ Name, Org string; Resumed, Rejected []string }
+    json.Unmarshal(body, &reg)
+    log.Printf("registered as %s (org=%s deployment=%s instance=%s)", cmp.Or(reg.Name, r.id.ID), cmp.Or(reg.Org, r.id.Org), r.id.Deployment, instanceID)
+    if len(reg.Resumed) > 0 { log.Printf("orchestrator resumed tasks %v", reg.Resumed) }
+    // finished or handed to another agent while the orchestrator was away:
+    // they are stopped here and what is queued for them is dropped
+    if len(reg.Rejected) > 0 {
+        log.Printf("orchestrator no longer assigns tasks %v to this agent; cancelling them", reg.Rejected)
+        if r.rejected != nil { r.rejected(reg.Rejected) }
+    }
+    return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// useConf sets the global config for the test: org, a fixed name if
+// given, and dir as the state directory.
+func useConf(t *testing.T, dir, org, name string) {
+    t.Helper()
+    old := conf
+    c := defaultConfig()
+    c.Org, c.Name, c.StateDir = org, name, dir
+    conf = c
+    t.Cleanup(func() { conf = old })
+}
+
+func TestIdentityPersistsAndFollowsOrg(t *testing.T) {
+    dir := t.TempDir()
+    useConf(t, dir, "acme", "")
+    conf.Deployment = "agent-acme"
+    first, err := loadIdentity()
+    if err != nil { t.Fatal(err) }
+    if !strings.HasPrefix(first.ID, "agent-acme-") || first.Org != "acme" || first.configured { t.Fatalf("generated: %+v", first) }
+
+    // a restart keeps the ID and picks up a new deployment name
+    conf.Deployment = "agent-acme-v2"
+    again, err := loadIdentity()
+    if err != nil { t.Fatal(err) }
+    if again.ID != first.ID || again.Deployment != "agent-acme-v2" { t.Fatalf("after restart: %+v, was %+v", again, first) }
+    var stored agentIdentity
+    b, _ := os.ReadFile(identityPath())
+    json.Unmarshal(b, &stored)
+    if stored.ID != first.ID || stored.Deployment != "agent-acme-v2" { t.Fatalf("identity.json: %s", b) }
+
+    // moved to another org, the agent is a new one there
+    useConf(t, dir, "devrel", "")
+    other, err := loadIdentity()
+    if err != nil { t.Fatal(err) }
+    if other.ID == first.ID || other.Org != "devrel" || !strings.HasPrefix(other.ID, "devrel-") { t.Fatalf("after org change: %+v", other) }
+
+    // a configured name wins and isn't stored
+    useConf(t, dir, "devrel", "fixed-1")
+    named, _ := loadIdentity()
+    if named.ID != "fixed-1" || !named.configured { t.Fatalf("configured: %+v", named) }
+    conf.Name = ""
+    again, _ = loadIdentity()
+    if again.ID != other.ID { t.Fatalf("configured name overwrote the stored identity: %+v", again) }
+}
+
+func TestIdentityCorruptFile(t *testing.T) {
+    dir := t.TempDir()
+    useConf(t, dir, "acme", "")
+    writeFileSync(identityPath(), []byte("{"))
+    if _, err := loadIdentity(); err == nil || !strings.Contains(err.Error(), "corrupt") { t.Fatalf("corrupt identity: %v", err) }
+}
+
+// fakeRegistry answers /agents/register with 409 for names in taken.
+type fakeRegistry struct {
+    mu    sync.Mutex
+    taken map[string]bool
+    seen  []string
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var req struct{ Name, Org, Instance string }
+    b, _ := io.ReadAll(r.Body)
+    json.Unmarshal(b, &req)
+    f.mu.Lock(); defer f.mu.Unlock()
+    f.seen = append(f.seen, req.Name)
+    if f.taken[req.Name] {
+        w.WriteHeader(http.StatusConflict)
+        json.NewEncoder(w).Encode(map[string]any{"error": "agent " + req.Name + " is already registered from elsewhere"})
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]any{"name": req.Name, "org": req.Org})
+}
+
+func TestRegisterConflict(t *testing.T) {
+    dir := t.TempDir()
+    useConf(t, dir, "acme", "")
+    id, err := loadIdentity()
+    if err != nil { t.Fatal(err) }
+    orch := &fakeRegistry{taken: map[string]bool{id.ID: true}}
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+
+    // a generated ID someone else holds is replaced, and the new one stored
+    reg := &registration{client: srv.Client(), orchURL: srv.URL, id: id, slots: 1}
+    if err := reg.register(); err != nil { t.Fatal(err) }
+    if reg.id.ID == id.ID || len(orch.seen) != 2 || orch.seen[1] != reg.id.ID { t.Fatalf("registered as %s after %v", reg.id.ID, orch.seen) }
+    if stored, _ := loadIdentity(); stored.ID != reg.id.ID { t.Fatalf("new identity not stored: %s", stored.ID) }
+
+    // renewing keeps the ID and reports the conflict
+    held := reg.id.ID
+    orch.taken[held] = true
+    err = reg.renew()
+    if _, ok := err.(*errIdentityConflict); !ok || reg.id.ID != held { t.Fatalf("renew: %v (%s)", err, reg.id.ID) }
+    if !strings.Contains(err.Error(), "already registered") { t.Fatalf("conflict message: %v", err) }
+
+    // a configured name in use is an error, not replaced
+    useConf(t, dir, "acme", "fixed-1")
+    named, _ := loadIdentity()
+    orch.taken["fixed-1"] = true
+    reg = &registration{client: srv.Client(), orchURL: srv.URL, id: named, slots: 1}
+    if err := reg.register(); err == nil || !strings.Contains(err.Error(), "AGENT_NAME") || reg.id.ID != "fixed-1" { t.Fatalf("configured conflict: %v (%s)", err, reg.id.ID) }
+}
+
+func TestRegisterCancelsRejectedTasks(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    // task reports queue while the orchestrator is away; once back it
+    // has given t1 to another agent
+    orch := &fakeOrchestrator{}
+    orch.answer(func(path string) (int, string) {
+        switch path {
+        case "/agents/register":
+            return 200, `{"name":"a1","org":"acme","resumed":["t2"],"rejected":["t1"]}`
+        case "/agents/log":
+            return 204, ""
+        }
+        return 503, ""
+    })
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+    ob, err := openOutbox(t.TempDir(), srv.Client(), srv.URL, "")
+    if err != nil { t.Fatal(err) }
+    st := newAgentStatus()
+    ob.settled = st.settled
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go ob.run(ctx)
+    reject := func(ids []string) { st.reject(ids); ob.drop(ids) }
+    reg := &registration{client: srv.Client(), orchURL: srv.URL, id: &agentIdentity{ID: "a1", Org: "acme", configured: true}, slots: 2, status: st, rejected: reject}
+
+    // t1 runs in a slot; t2 finished and its final update is queued
+    started := filepath.Join(t.TempDir(), "started")
+    w := &worker{client: srv.Client(), orchURL: srv.URL, agentID: "a1", ob: ob, status: st, finishing: ctx}
+    done := make(chan struct{})
+    go func() { w.handle(ctx, map[string]any{"id": "t1", "kind": "shell", "text": "touch " + started + "; exec sleep 30"}, t.TempDir()); close(done) }()
+    st.start("t2", "shell", "make", nil)
+    st.done("t2", "completed")
+    ob.post("/tasks/update", map[string]any{"id": "t2", "status": "completed", "agent": "a1"})
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        if _, err := os.Stat(started); err == nil { break }
+        if time.Now().After(deadline) { t.Fatal("task never started") }
+        time.Sleep(20 * time.Millisecond)
+    }
+
+    // t1's first reports are queued behind t2's update
+    if p, _ := ob.pending(); len(p) < 3 { t.Fatalf("queued before reject: %v", p) }
+
+    if err := reg.renew(); err != nil { t.Fatal(err) }
+    // the rejected task's tool is stopped at once and its slot freed
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("rejected task still running")
+    }
+    if held := st.held(); len(held) != 1 || held[0].TaskID != "t2" { t.Fatalf("held after reject: %+v", held) }
+    if st.isRejected("t1") { t.Fatal("rejected task not forgotten once its slot stopped") }
+    if p, _ := ob.pending(); len(p) != 1 { t.Fatalf("queued after reject: %v", p) }
+
+    // only t2's update is left to deliver; nothing about t1 is sent
+    before := len(orch.delivered())
+    orch.answer(nil)
+    dctx, dcancel := context.WithTimeout(ctx, 10*time.Second)
+    defer dcancel()
+    if err := ob.Drain(dctx); err != nil { t.Fatalf("drain: %v", err) }
+    var sent []string
+    for _, d := range orch.delivered()[before:] {
+        if strings.HasPrefix(d, "/tasks/") { sent = append(sent, d) }
+    }
+    if len(sent) != 1 || !strings.HasPrefix(sent[0], "/tasks/update ") || !strings.Contains(sent[0], `"id":"t2"`) { t.Fatalf("sent after reject: %q", sent) }
+    if len(st.held()) != 0 { t.Fatal("t2 still held after its update was delivered") }
+}
@@ -2,75 +2,143 @@ package main
 
 import (
     "bytes"
+    "context"
     "encoding/json"
     "fmt"
+    "io"
     "log"
     "net/http"
     "os"
-    "time"
+    "os/signal"
+    "path/filepath"
+    "syscall"
 )
 
 func main() {
-    org := os.Getenv("ORG_NAME")
-    agentID := getHostname()
-    orchURL := os.Getenv("ORCHESTRATOR_URL")
-    orchTok := os.Getenv("ORCHESTRATOR_TOKEN")
-    if orchURL == "" { orchURL = "http://127.0.0.1:18080" }
-    log.Printf("agent starting for org=%s", org)
-    client := &http.Client{ Timeout: 10 * time.Second }
-    // connectivity check
-    if err := getHealth(client, orchURL); err != nil {
-        log.Printf("orchestrator health check failed: %v", err)
-    } else {
-        log.Printf("connected to orchestrator at %s", orchURL)
+    c, err := loadConfig()
+    if err != nil { log.Fatalf("%v", err) }
+    conf = c
+    orchTok := conf.Orchestrator.Token
+    ident, err := loadIdentity()
+    if err != nil { log.Fatalf("identity: %v", err) }
+    log.Printf("agent %s starting for org=%s", ident.ID, ident.Org)
+    client := &http.Client{ Timeout: conf.Timeouts.Request.Duration }
+    // connectivity check; the first healthy orchestrator wins
+    orchURL := pickOrchestrator(client, conf.Orchestrator.URLs)
+    // task status and logs are delivered through a durable outbox
+    ob, err := openOutbox(filepath.Join(agentStateDir(), "outbox"), client, orchURL, orchTok)
+    if err != nil { log.Fatalf("outbox: %v", err) }
+    // finished tasks are held until their final update is delivered; an
+    // update the orchestrator doesn't recognise prompts a heartbeat, which
+    // registers again with them
+    status := newAgentStatus()
+    ob.settled, ob.unknown = status.settled, status.poke
+    // tasks the orchestrator finished or gave to another agent meanwhile
+    // are cancelled, and their queued reports dropped
+    reject := func(ids []string) { status.reject(ids); ob.drop(ids) }
+    ob.rejected = reject
+    go ob.run(context.Background())
+    // task slots, each with its own workspace
+    slots := conf.MaxConcurrentTasks
+    workspaces, err := slotWorkspaces(slots)
+    if err != nil { log.Fatalf("workspaces: %v", err) }
+    // register; a generated ID that another agent holds is replaced here
+    reg := &registration{client: client, orchURL: orchURL, token: orchTok, id: ident, slots: slots, status: status, rejected: reject}
+    if err := reg.register(); err != nil { log.Fatalf("register: %v", err) }
+    agentID, org := reg.id.ID, reg.id.Org
+    // reverse tunnel for editor access (tunnel.disabled / AGENT_TUNNEL=0 turns it off)
+    if !conf.Tunnel.Disabled {
+        go runTunnel(orchURL, orchTok, agentID, org, conf.Tunnel.EditorAddr)
     }
-    // register once
-    postJSON(client, orchURL+"/agents/register", orchTok, map[string]any{"name": agentID, "org": org})
-    for {
-        // heartbeat idle
-        postJSON(client, orchURL+"/agents/heartbeat", orchTok, map[string]any{"name": agentID, "org": org, "status": "idle"})
-        // claim a task
-        var claimReq = map[string]string{"org": org, "agentID": agentID}
-        b,_ := json.Marshal(claimReq)
-        req, _ := http.NewRequest("POST", orchURL+"/tasks/claim", bytes.NewReader(b))
-        req.Header.Set("Content-Type","application/json")
-        if orchTok != "" { req.Header.Set("X-Auth-Token", orchTok) }
-        resp, err := client.Do(req)
-        if err != nil { log.Printf("claim error: %v", err); time.Sleep(3*time.Second); continue }
-    var claimed map[string]any
-        json.NewDecoder(resp.Body).Decode(&claimed); resp.Body.Close()
-    // detect presence of a claimed task by id field
+    // heartbeats with task progress, until the agent deregisters
+    hbCtx, stopHeartbeats := context.WithCancel(context.Background())
+    hbDone := make(chan struct{})
+    go func() { defer close(hbDone); runHeartbeats(hbCtx, reg, status) }()
+    // SIGTERM/SIGINT: stop claiming, let running tasks finish or hand them back
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+    defer stop()
+    w := &worker{client: client, orchURL: orchURL, token: orchTok, agentID: agentID, ob: ob, status: status, finishing: toolDeadline(ctx)}
+    cl := newClaimer(orchURL, orchTok, org, agentID)
+    // a claim refused for an unknown agent prompts a heartbeat, which
+    // registers again
+    cl.unknown = status.poke
+    w.runSlots(ctx, cl, workspaces)
+    log.Printf("shutting down")
+    stopHeartbeats(); <-hbDone
+    deregister(ob, client, orchURL, orchTok, agentID)
+}
+
+// handle runs one claimed task in workspace and reports its outcome. A
+// task cut short because ctx ended (shutdown) is handed back instead; one
+// the orchestrator rejects meanwhile is stopped without further reports.
+func (w *worker) handle(ctx context.Context, claimed map[string]any, workspace string) {
     taskID := getString(claimed["id"])
-    if taskID == "" {
-            time.Sleep(5*time.Second)
-            continue
-        }
     taskText := getString(claimed["text"])
-        logUpdate := func(status, line string){
-            // status
-            sr := map[string]string{"id": taskID, "status": status}
-            sb,_ := json.Marshal(sr)
-            rq,_ := http.NewRequest("POST", orchURL+"/tasks/update", bytes.NewReader(sb))
-            rq.Header.Set("Content-Type","application/json"); if orchTok != "" { rq.Header.Set("X-Auth-Token", orchTok) }
-            client.Do(rq)
-            if line != "" {
-                lr := map[string]string{"id": taskID, "line": line}
-                lb,_ := json.Marshal(lr)
-                rq2,_ := http.NewRequest("POST", orchURL+"/tasks/log", bytes.NewReader(lb))
-                rq2.Header.Set("Content-Type","application/json"); if orchTok != "" { rq2.Header.Set("X-Auth-Token", orchTok) }
-                client.Do(rq2)
-            }
+    runCtx, cancelRun := context.WithCancel(ctx)
+    defer cancelRun()
+    prCtx, cancelPR := context.WithCancel(w.finishing)
+    defer cancelPR()
+    w.status.start(taskID, getString(claimed["kind"]), taskText, func() { cancelRun(); cancelPR() })
+    // tool output and our own lines share one ordered, batched log
+    tlog := newTaskLogger(w.ob, taskID)
+    tlog.onProgress = func(percent *int, step string) { w.status.progress(taskID, percent, step) }
+    logUpdate := func(status, line string, res *Result){
+        if w.status.isRejected(taskID) { return }
+        if line != "" { tlog.Line("", line); tlog.Flush() }
+        // status, with the result once the task is done; agent lets the
+        // orchestrator refuse it if the task is no longer ours
+        sr := map[string]any{"id": taskID, "status": status, "agent": w.agentID}
+        if res != nil { sr["result"] = res.report() }
+        if status != "running" { w.status.done(taskID, status) }
+        w.ob.post("/tasks/update", sr)
+    }
+    // phase runs fn with its stdout and stderr streamed to the task log
+    phase := func(name string, fn func(stdout, stderr io.Writer) Result) Result {
+        w.status.phase(taskID, name)
+        stdout, stderr := tlog.Writer(name, "stdout"), tlog.Writer(name, "stderr")
+        res := fn(stdout, stderr)
+        stdout.Close(); stderr.Close(); tlog.Flush()
+        return res
+    }
+    logUpdate("running", "claimed task", nil)
+    w.status.phase(taskID, "context")
+    PullContext(); postJSON(w.client, w.orchURL+"/agents/log", w.token, map[string]any{"name": w.agentID, "line": "context pulled"})
+    logUpdate("running", "context pulled", nil)
+    res := phase("run", func(stdout, stderr io.Writer) Result {
+        return RunTask(runCtx, Task{ID: taskID, Kind: getString(claimed["kind"]), Text: taskText, Workspace: workspace}, stdout, stderr)
+    })
+    interrupted := res.Err != nil && ctx.Err() != nil
+    if res.Err == nil {
+        postJSON(w.client, w.orchURL+"/agents/log", w.token, map[string]any{"name": w.agentID, "line": "task executed"})
+        logUpdate("running", "task execution complete", nil)
+        // a shutdown now doesn't throw the finished run away: the PR is
+        // still opened within the tools' grace period
+        pr := phase("pr", func(stdout, stderr io.Writer) Result { return OpenPR(prCtx, workspace, stdout, stderr) })
+        if pr.Err != nil {
+            res.Err, res.ExitCode, res.Stderr = fmt.Errorf("open PR: %w", pr.Err), pr.ExitCode, pr.Stderr
+            interrupted = w.finishing.Err() != nil
         }
-    logUpdate("running", "claimed task")
-    postJSON(client, orchURL+"/agents/heartbeat", orchTok, map[string]any{"name": agentID, "org": org, "status": "running"})
-    PullContext(); postJSON(client, orchURL+"/agents/log", orchTok, map[string]any{"name": agentID, "line": "context pulled"})
-        logUpdate("running", "context pulled")
-    RunTask(taskText); postJSON(client, orchURL+"/agents/log", orchTok, map[string]any{"name": agentID, "line": "task executed"})
-        logUpdate("running", "task execution complete")
-    OpenPR(); postJSON(client, orchURL+"/agents/log", orchTok, map[string]any{"name": agentID, "line": "PR opened"})
-        logUpdate("completed", "PR opened; task done")
-    postJSON(client, orchURL+"/agents/heartbeat", orchTok, map[string]any{"name": agentID, "org": org, "status": "idle"})
     }
+    if w.status.isRejected(taskID) {
+        log.Printf("task %s stopped: the orchestrator no longer assigns it to this agent", taskID)
+        tlog.Close()
+        // log lines flushed while the tool was stopping
+        w.ob.drop([]string{taskID})
+        w.status.forget(taskID)
+        return
+    }
+    if interrupted {
+        log.Printf("task %s interrupted by shutdown: %v", taskID, res.Err)
+        logUpdate("scheduled", "agent shutting down; task handed back: "+res.Err.Error(), nil)
+    } else if res.Err != nil {
+        log.Printf("task %s failed: %v", taskID, res.Err)
+        postJSON(w.client, w.orchURL+"/agents/log", w.token, map[string]any{"name": w.agentID, "line": "task failed: " + res.Err.Error()})
+        logUpdate("failed", "task failed: "+res.Err.Error(), &res)
+    } else {
+        postJSON(w.client, w.orchURL+"/agents/log", w.token, map[string]any{"name": w.agentID, "line": "PR opened"})
+        logUpdate("completed", "PR opened; task done", &res)
+    }
+    tlog.Close()
 }
 
 func getHostname() string {
@@ -83,7 +151,8 @@ func getString(v any) string {
     return ""
 }
 
-func postJSON(client *http.Client, url, token string, body any) {
+// postJSON posts body and returns the status code, 0 if the request failed.
+func postJSON(client *http.Client, url, token string, body any) int {
     b,_ := json.Marshal(body)
     req,_ := http.NewRequest("POST", url, bytes.NewReader(b))
     req.Header.Set("Content-Type","application/json")
@@ -91,12 +160,27 @@ func postJSON(client *http.Client, url, token string, body any) {
     resp, err := client.Do(req)
     if err != nil {
         log.Printf("POST %s error: %v", url, err)
-        return
+        return 0
     }
     defer resp.Body.Close()
     if resp.StatusCode >= 300 {
         log.Printf("POST %s status: %s", url, resp.Status)
     }
+    return resp.StatusCode
+}
+
+// pickOrchestrator returns the first of urls that passes a health check,
+// or the first one if none does (the agent keeps retrying it).
+func pickOrchestrator(client *http.Client, urls []string) string {
+    for _, u := range urls {
+        err := getHealth(client, u)
+        if err == nil {
+            log.Printf("connected to orchestrator at %s", u)
+            return u
+        }
+        log.Printf("orchestrator health check failed for %s: %v", u, err)
+    }
+    return urls[0]
 }
 
 func getHealth(client *http.Client, orchURL string) error {
@@ -1,12 +1,13 @@
 package main
 
 import (
+    "context"
+    "io"
     "log"
-    "os/exec"
 )
 
-func OpenPR() {
+// OpenPR opens a PR for the changes in workspace with the radicle wrapper.
+func OpenPR(ctx context.Context, workspace string, stdout, stderr io.Writer) Result {
     log.Printf("opening PR via radicle stub")
-    cmd := exec.Command("/app/radicle/cli_wrapper.sh", "open-pr")
-    _ = cmd.Run()
+    return runCommand(ctx, workspace, stdout, stderr, "/app/radicle/cli_wrapper.sh", "open-pr")
 }
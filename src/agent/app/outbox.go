@@ -0,0 +1,296 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The outbox makes task reporting survive orchestrator restarts and agent
+// crashes: status updates and log batches are written to disk, then
+// delivered one at a time, in order, retrying with backoff until the
+// orchestrator accepts them. Each carries the outbox id and a sequence
+// number (X-Agent-Outbox, X-Agent-Seq) so a redelivery after a lost
+// response is recognised and not applied twice.
+
+const (
+    outboxIDHeader  = "X-Agent-Outbox"
+    outboxSeqHeader = "X-Agent-Seq"
+    // outboxNotFoundGrace is how long a message the orchestrator answers
+    // 404 keeps being retried while the agent registers again
+    outboxNotFoundGrace = 2 * time.Minute
+)
+
+type outboxMsg struct {
+    Seq      uint64          `json:"seq"`
+    Path     string          `json:"path"`
+    Body     json.RawMessage `json:"body"`
+    QueuedAt time.Time       `json:"queuedAt"`
+}
+
+type outbox struct {
+    dir, id       string
+    client        *http.Client
+    orchURL       string
+    token         string
+
+    mu   sync.Mutex
+    seq  uint64
+    wake chan struct{}
+    // idle is closed while nothing is queued
+    idle chan struct{}
+
+    // unknown is called when the orchestrator has no record of a task or
+    // of this agent (it restarted), so the agent registers again before
+    // the message is retried
+    unknown func()
+    // settled is called once a message has been delivered or dropped
+    settled func(outboxMsg)
+    // rejected is called with a task whose update the orchestrator
+    // refused because the task is no longer this agent's
+    rejected func(ids []string)
+    // notFound is when each message was first answered 404
+    notFound map[uint64]time.Time
+}
+
+// agentStateDir is where the agent keeps state across restarts: stateDir
+// (AGENT_STATE_DIR), else /state like the orchestrator, else a temp
+// directory. The temp directory doesn't survive a restart, so falling
+// back to it is logged (once) as a warning.
+func agentStateDir() string {
+    if conf.StateDir != "" { return conf.StateDir }
+    err := os.MkdirAll("/state", 0o755)
+    if err == nil { return "/state" }
+    dir := filepath.Join(os.TempDir(), "agent")
+    stateDirFallback.Do(func() {
+        log.Printf("WARNING: no usable state dir (%v); using %s: the agent's identity and queued reports will be lost on restart, set AGENT_STATE_DIR or mount a volume at /state", err, dir)
+    })
+    return dir
+}
+
+var stateDirFallback sync.Once
+
+// openOutbox loads or creates the outbox in dir. Messages left by a
+// previous run are delivered first.
+func openOutbox(dir string, client *http.Client, orchURL, token string) (*outbox, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil { return nil, err }
+    o := &outbox{dir: dir, client: client, orchURL: orchURL, token: token, wake: make(chan struct{}, 1), idle: make(chan struct{}), notFound: map[uint64]time.Time{}}
+    id, err := os.ReadFile(filepath.Join(dir, "id"))
+    if err != nil {
+        b := make([]byte, 8)
+        rand.Read(b)
+        id = []byte(hex.EncodeToString(b))
+        if err := writeFileSync(filepath.Join(dir, "id"), id); err != nil { return nil, err }
+    }
+    o.id = strings.TrimSpace(string(id))
+    if b, err := os.ReadFile(filepath.Join(dir, "seq")); err == nil { o.seq, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64) }
+    pending, err := o.pending()
+    if err != nil { return nil, err }
+    if n := len(pending); n > 0 {
+        o.seq = max(o.seq, pending[n-1])
+        log.Printf("outbox: %d messages from a previous run", n)
+    } else {
+        close(o.idle)
+    }
+    return o, nil
+}
+
+// pending lists queued sequence numbers in order.
+func (o *outbox) pending() ([]uint64, error) {
+    ents, err := os.ReadDir(o.dir)
+    if err != nil { return nil, err }
+    var out []uint64
+    for _, e := range ents {
+        name, ok := strings.CutSuffix(e.Name(), ".msg")
+        if !ok { continue }
+        if n, err := strconv.ParseUint(name, 10, 64); err == nil { out = append(out, n) }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+    return out, nil
+}
+
+func (o *outbox) msgPath(seq uint64) string { return filepath.Join(o.dir, fmt.Sprintf("%020d.msg", seq)) }
+
+// Post queues a POST of body to path on the orchestrator. It returns once
+// the message is on disk.
+func (o *outbox) Post(path string, body any) error {
+    b, err := json.Marshal(body)
+    if err != nil { return err }
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    seq := o.seq + 1
+    msg, _ := json.Marshal(outboxMsg{Seq: seq, Path: path, Body: b, QueuedAt: time.Now().UTC()})
+    if err := writeFileSync(o.msgPath(seq), msg); err != nil { return err }
+    o.seq = seq
+    _ = writeFileSync(filepath.Join(o.dir, "seq"), []byte(strconv.FormatUint(seq, 10)))
+    select {
+    case <-o.idle:
+        o.idle = make(chan struct{})
+    default:
+    }
+    select { case o.wake <- struct{}{}: default: }
+    return nil
+}
+
+// post queues body, falling back to a direct best-effort POST if the
+// outbox can't be written.
+func (o *outbox) post(path string, body any) {
+    if err := o.Post(path, body); err != nil {
+        log.Printf("outbox: %v; sending %s directly", err, path)
+        postJSON(o.client, o.orchURL+path, o.token, body)
+        if o.settled != nil { b, _ := json.Marshal(body); o.settled(outboxMsg{Path: path, Body: b}) }
+    }
+}
+
+// run delivers queued messages in order until ctx ends.
+func (o *outbox) run(ctx context.Context) {
+    backoff := time.Second
+    for {
+        pending, err := o.pending()
+        if err != nil { log.Printf("outbox: %v", err) }
+        if len(pending) == 0 {
+            o.mu.Lock()
+            if p, _ := o.pending(); len(p) == 0 {
+                select { case <-o.idle: default: close(o.idle) }
+            }
+            o.mu.Unlock()
+            select {
+            case <-o.wake:
+                continue
+            case <-ctx.Done():
+                return
+            }
+        }
+        for _, seq := range pending {
+            retry, err := o.deliver(seq)
+            if err == nil { backoff = time.Second; continue }
+            if !retry {
+                log.Printf("outbox: dropped message %d: %v", seq, err)
+                continue
+            }
+            log.Printf("outbox: message %d: %v; retrying in %s", seq, err, backoff)
+            select {
+            case <-time.After(backoff):
+            case <-ctx.Done():
+                return
+            }
+            backoff = min(backoff*2, 30*time.Second)
+            break
+        }
+    }
+}
+
+// deliver sends one message and removes it once accepted. retry reports
+// whether a failure is worth retrying; requests the orchestrator rejects
+// outright are dropped, as they would otherwise block the queue forever.
+// A 404 for a task update, or one asking the agent to register, is what a
+// restarted orchestrator answers until the agent has registered again
+// with its tasks, so it is retried for outboxNotFoundGrace.
+func (o *outbox) deliver(seq uint64) (retry bool, err error) {
+    b, err := os.ReadFile(o.msgPath(seq))
+    if os.IsNotExist(err) { return false, nil }
+    if err != nil { return true, err }
+    var m outboxMsg
+    if err := json.Unmarshal(b, &m); err != nil {
+        os.Remove(o.msgPath(seq))
+        return false, fmt.Errorf("corrupt message: %w", err)
+    }
+    req, _ := http.NewRequest("POST", o.orchURL+m.Path, bytes.NewReader(m.Body))
+    req.Header.Set("Content-Type", "application/json")
+    if o.token != "" { req.Header.Set("X-Auth-Token", o.token) }
+    req.Header.Set(outboxIDHeader, o.id)
+    req.Header.Set(outboxSeqHeader, strconv.FormatUint(m.Seq, 10))
+    resp, err := o.client.Do(req)
+    if err != nil { return true, err }
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+    resp.Body.Close()
+    err = fmt.Errorf("POST %s: %s", m.Path, resp.Status)
+    switch c := resp.StatusCode; {
+    case c < 300:
+        err = nil
+    case c == 404 && (m.Path == "/tasks/update" || asksToRegister(body)):
+        if o.unknown != nil { o.unknown() }
+        since, ok := o.notFound[seq]
+        if !ok { since = time.Now(); o.notFound[seq] = since }
+        if time.Since(since) < outboxNotFoundGrace { return true, err }
+    case c >= 500 || c == 401 || c == 403 || c == 408 || c == 429:
+        return true, err
+    }
+    os.Remove(o.msgPath(seq))
+    delete(o.notFound, seq)
+    if o.settled != nil { o.settled(m) }
+    if resp.StatusCode == http.StatusConflict && m.Path == "/tasks/update" && o.rejected != nil { o.rejected([]string{msgTaskID(m)}) }
+    return false, err
+}
+
+// msgTaskID is the task a /tasks/update or /tasks/log message is about.
+func msgTaskID(m outboxMsg) string {
+    var b struct{ ID string }
+    json.Unmarshal(m.Body, &b)
+    return b.ID
+}
+
+// drop removes the queued updates and log batches of tasks; what they
+// report no longer applies once the orchestrator has rejected the tasks.
+func (o *outbox) drop(ids []string) {
+    o.mu.Lock(); defer o.mu.Unlock()
+    pending, _ := o.pending()
+    n := 0
+    for _, seq := range pending {
+        b, err := os.ReadFile(o.msgPath(seq))
+        if err != nil { continue }
+        var m outboxMsg
+        if json.Unmarshal(b, &m) != nil || (m.Path != "/tasks/update" && m.Path != "/tasks/log") || !slices.Contains(ids, msgTaskID(m)) { continue }
+        if os.Remove(o.msgPath(seq)) == nil { n++ }
+    }
+    if n > 0 { log.Printf("outbox: dropped %d messages for rejected tasks %v", n, ids) }
+}
+
+// asksToRegister reports whether a response body is the orchestrator's
+// {register: true} for an agent it doesn't know.
+func asksToRegister(body []byte) bool {
+    var r struct{ Register bool }
+    return json.Unmarshal(body, &r) == nil && r.Register
+}
+
+// Drain waits until everything queued has been delivered or ctx ends.
+func (o *outbox) Drain(ctx context.Context) error {
+    o.mu.Lock()
+    idle := o.idle
+    o.mu.Unlock()
+    select {
+    case <-idle:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// writeFileSync writes via a temp file and rename so a crash never leaves
+// a partial file behind.
+func writeFileSync(path string, b []byte) error {
+    tmp := path + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil { return err }
+    _, werr := f.Write(b)
+    serr := f.Sync()
+    cerr := f.Close()
+    if werr != nil { return werr }
+    if serr != nil { return serr }
+    if cerr != nil { return cerr }
+    return os.Rename(tmp, path)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeOrchestrator records what the outbox delivers and answers with
+// status(path), 204 when nil.
+type fakeOrchestrator struct {
+    mu     sync.Mutex
+    got    []string
+    seqs   []string
+    status func(path string) (int, string)
+}
+
+func (f *fakeOrchestrator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    b, _ := io.ReadAll(r.Body)
+    f.mu.Lock()
+    status := f.status
+    f.got = append(f.got, r.URL.Path+" "+string(b))
+    f.seqs = append(f.seqs, r.Header.Get(outboxIDHeader)+"/"+r.Header.Get(outboxSeqHeader))
+    f.mu.Unlock()
+    code, body := 204, ""
+    if status != nil { code, body = status(r.URL.Path) }
+    w.WriteHeader(code)
+    io.WriteString(w, body)
+}
+
+func (f *fakeOrchestrator) answer(fn func(path string) (int, string)) {
+    f.mu.Lock(); f.status = fn; f.mu.Unlock()
+}
+
+func (f *fakeOrchestrator) delivered() []string {
+    f.mu.Lock(); defer f.mu.Unlock()
+    return append([]string(nil), f.got...)
+}
+
+func TestOutboxSeqPersistsAcrossRestarts(t *testing.T) {
+    dir := t.TempDir()
+    orch := &fakeOrchestrator{}
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+
+    ob, err := openOutbox(dir, srv.Client(), srv.URL, "")
+    if err != nil { t.Fatal(err) }
+    ob.Post("/tasks/log", map[string]string{"id": "t1", "line": "one"})
+    ob.Post("/tasks/update", map[string]string{"id": "t1", "status": "running"})
+
+    // a restart before delivery keeps the id, the queue and the sequence
+    reopened, err := openOutbox(dir, srv.Client(), srv.URL, "")
+    if err != nil { t.Fatal(err) }
+    if reopened.id != ob.id || reopened.seq != 2 { t.Fatalf("reopened id=%s seq=%d, want %s 2", reopened.id, reopened.seq, ob.id) }
+    if p, _ := reopened.pending(); len(p) != 2 { t.Fatalf("pending after reopen: %v", p) }
+    reopened.Post("/tasks/log", map[string]string{"id": "t1", "line": "two"})
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go reopened.run(ctx)
+    dctx, dcancel := context.WithTimeout(ctx, 5*time.Second)
+    defer dcancel()
+    if err := reopened.Drain(dctx); err != nil { t.Fatalf("drain: %v", err) }
+    got := orch.delivered()
+    if len(got) != 3 || got[0] != `/tasks/log {"id":"t1","line":"one"}` || got[2] != `/tasks/log {"id":"t1","line":"two"}` { t.Fatalf("delivered: %q", got) }
+    if orch.seqs[0] != ob.id+"/1" || orch.seqs[2] != ob.id+"/3" { t.Fatalf("headers: %q", orch.seqs) }
+
+    // delivered messages are gone, the sequence isn't reused
+    again, _ := openOutbox(dir, srv.Client(), srv.URL, "")
+    if p, _ := again.pending(); len(p) != 0 || again.seq != 3 { t.Fatalf("after delivery: pending=%v seq=%d", p, again.seq) }
+}
+
+func TestOutboxRetryClassification(t *testing.T) {
+    orch := &fakeOrchestrator{}
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+    ob, err := openOutbox(t.TempDir(), srv.Client(), srv.URL, "")
+    if err != nil { t.Fatal(err) }
+    unknown := 0
+    var settled []string
+    ob.unknown = func() { unknown++ }
+    ob.settled = func(m outboxMsg) { settled = append(settled, string(m.Body)) }
+
+    for _, c := range []struct {
+        path  string
+        code  int
+        body  string
+        retry bool
+    }{
+        {"/tasks/update", 500, "", true},
+        {"/tasks/update", 503, "", true},
+        {"/tasks/log", 429, "", true},
+        {"/tasks/log", 401, "", true},
+        {"/tasks/update", 404, "not found", true},
+        {"/tasks/log", 404, `{"error":"unknown agent a1","register":true}`, true},
+        {"/tasks/update", 400, "missing id/status", false},
+        {"/tasks/log", 404, "not found", false},
+        {"/tasks/log", 413, "", false},
+    } {
+        orch.answer(func(string) (int, string) { return c.code, c.body })
+        ob.Post(c.path, map[string]string{"id": "t1", "status": "completed"})
+        seq := ob.seq
+        retry, err := ob.deliver(seq)
+        if retry != c.retry || err == nil { t.Errorf("%s %d: retry=%v err=%v, want retry=%v", c.path, c.code, retry, err, c.retry) }
+        _, statErr := os.Stat(ob.msgPath(seq))
+        if kept := statErr == nil; kept != c.retry { t.Errorf("%s %d: message kept=%v", c.path, c.code, kept) }
+        os.Remove(ob.msgPath(seq))
+    }
+    if unknown != 2 { t.Fatalf("unknown hook called %d times, want 2", unknown) }
+    if len(settled) != 3 { t.Fatalf("settled %d dropped messages, want 3", len(settled)) }
+
+    // a 404 is only retried for a while
+    orch.answer(func(string) (int, string) { return 404, "not found" })
+    ob.Post("/tasks/update", map[string]string{"id": "t2", "status": "failed"})
+    ob.notFound[ob.seq] = time.Now().Add(-outboxNotFoundGrace)
+    if retry, _ := ob.deliver(ob.seq); retry { t.Fatal("404 retried past the grace period") }
+    if _, ok := ob.notFound[ob.seq]; ok { t.Fatal("notFound entry kept after dropping") }
+
+    // accepted messages are removed and settled
+    orch.answer(nil)
+    ob.Post("/tasks/update", map[string]string{"id": "t3", "status": "completed"})
+    if retry, err := ob.deliver(ob.seq); retry || err != nil { t.Fatalf("accepted: retry=%v err=%v", retry, err) }
+    if p, _ := ob.pending(); len(p) != 0 { t.Fatalf("pending: %v", p) }
+    var last struct{ ID string }
+    json.Unmarshal([]byte(settled[len(settled)-1]), &last)
+    if last.ID != "t3" { t.Fatalf("last settled: %q", settled) }
+}
+
+func TestOutboxDrain(t *testing.T) {
+    orch := &fakeOrchestrator{}
+    orch.answer(func(string) (int, string) { return 503, "" })
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+    ob, err := openOutbox(t.TempDir(), srv.Client(), srv.URL, "")
+    if err != nil { t.Fatal(err) }
+    // nothing queued: drained at once
+    if err := ob.Drain(context.Background()); err != nil { t.Fatalf("empty drain: %v", err) }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go ob.run(ctx)
+    ob.Post("/tasks/update", map[string]string{"id": "t1", "status": "completed"})
+    // the orchestrator is down: Drain gives up when its context ends
+    short, scancel := context.WithTimeout(ctx, 300*time.Millisecond)
+    defer scancel()
+    if err := ob.Drain(short); err != context.DeadlineExceeded { t.Fatalf("drain while down: %v", err) }
+    if p, _ := ob.pending(); len(p) != 1 { t.Fatalf("message lost: %v", p) }
+
+    // it comes back: the retry delivers and Drain returns
+    orch.answer(nil)
+    long, lcancel := context.WithTimeout(ctx, 10*time.Second)
+    defer lcancel()
+    if err := ob.Drain(long); err != nil { t.Fatalf("drain: %v", err) }
+    if got := orch.delivered(); got[len(got)-1] != `/tasks/update {"id":"t1","status":"completed"}` { t.Fatalf("delivered: %q", got) }
+}
+
+func TestFinishedTaskHeldUntilDelivered(t *testing.T) {
+    st := newAgentStatus()
+    st.start("t1", "code", "fix it", nil)
+    st.done("t1", "completed")
+    if _, tasks := st.snapshot(); len(tasks) != 0 { t.Fatalf("finished task still in heartbeats: %+v", tasks) }
+    if held := st.held(); len(held) != 1 || held[0].TaskID != "t1" || held[0].Status != "completed" { t.Fatalf("held before delivery: %+v", held) }
+    // registering again reports it with its final status
+    reg := &registration{id: &agentIdentity{ID: "a1", Org: "acme"}, slots: 1, status: st}
+    if b, _ := json.Marshal(reg.body()["tasks"]); !strings.Contains(string(b), `"taskId":"t1"`) || !strings.Contains(string(b), `"status":"completed"`) { t.Fatalf("register tasks: %s", b) }
+    // progress updates and log batches don't release it
+    st.settled(outboxMsg{Path: "/tasks/update", Body: json.RawMessage(`{"id":"t1","status":"running"}`)})
+    st.settled(outboxMsg{Path: "/tasks/log", Body: json.RawMessage(`{"id":"t1","line":"done"}`)})
+    if len(st.held()) != 1 { t.Fatal("released before the final update was delivered") }
+    st.settled(outboxMsg{Path: "/tasks/update", Body: json.RawMessage(`{"id":"t1","status":"completed"}`)})
+    if held := st.held(); len(held) != 0 { t.Fatalf("held after delivery: %+v", held) }
+}
+
+func TestOutboxUpdateConflict(t *testing.T) {
+    orch := &fakeOrchestrator{}
+    // the first update is refused: the task is no longer this agent's
+    refused := false
+    orch.answer(func(path string) (int, string) {
+        if path == "/tasks/update" && !refused { refused = true; return 409, `{"error":"task t1 is not assigned to a1"}` }
+        return 204, ""
+    })
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+    ob, err := openOutbox(t.TempDir(), srv.Client(), srv.URL, "")
+    if err != nil { t.Fatal(err) }
+    var rejected []string
+    ob.rejected = func(ids []string) { rejected = append(rejected, ids...); ob.drop(ids) }
+    ob.Post("/tasks/update", map[string]string{"id": "t1", "status": "running"})
+    ob.Post("/tasks/log", map[string]string{"id": "t1", "line": "late"})
+    ob.Post("/tasks/update", map[string]string{"id": "t1", "status": "completed"})
+    ob.Post("/tasks/update", map[string]string{"id": "t2", "status": "completed"})
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    go ob.run(ctx)
+    if err := ob.Drain(ctx); err != nil { t.Fatalf("drain: %v", err) }
+    // the rest of t1's reports are dropped without being sent
+    got := orch.delivered()
+    if len(rejected) != 1 || rejected[0] != "t1" || len(got) != 2 || !strings.Contains(got[1], `"id":"t2"`) { t.Fatalf("rejected %v, delivered %q", rejected, got) }
+}
@@ -1,12 +1,131 @@
 package main
 
 import (
+    "cmp"
+    "context"
+    "errors"
+    "fmt"
+    "io"
     "log"
+    "os"
     "os/exec"
+    "strings"
+    "syscall"
+    "time"
 )
 
-func RunTask(task string) {
-    log.Printf("running task via spec-kit stub: %s", task)
-    cmd := exec.Command("/app/spec-kit/cli_wrapper.sh", "new-task", task)
-    _ = cmd.Run()
+// Task is the part of a claimed task an executor needs.
+type Task struct {
+    ID   string
+    Kind string
+    Text string
+    // Workspace is the task slot's working directory.
+    Workspace string
 }
+
+// Result is the outcome of running a task. Err is set when the task failed,
+// whether the executor could not start or exited non-zero.
+type Result struct {
+    ExitCode int
+    Stderr   string
+    Duration time.Duration
+    Err      error
+}
+
+// report is the result as sent with the final /tasks/update.
+func (r Result) report() map[string]any {
+    m := map[string]any{"exitCode": r.ExitCode, "stderr": r.Stderr, "durationMs": r.Duration.Milliseconds()}
+    if r.Err != nil { m["error"] = r.Err.Error() }
+    return m
+}
+
+// Executor runs one kind of task, writing the tool's output to stdout and
+// stderr (both end up in the task log).
+type Executor interface {
+    Execute(ctx context.Context, t Task, stdout, stderr io.Writer) Result
+}
+
+const defaultTaskKind = "spec-kit"
+
+// stderrTailBytes bounds the stderr kept for the task result.
+const stderrTailBytes = 8 << 10
+
+// executors by task kind; keep in step with the orchestrator's taskKinds.
+var executors = map[string]Executor{
+    "spec-kit":   specKitExecutor{},
+    "shell":      shellExecutor{},
+    "coding-cli": codingCLIExecutor{},
+}
+
+// RunTask runs t with the executor for its kind.
+func RunTask(ctx context.Context, t Task, stdout, stderr io.Writer) Result {
+    kind := t.Kind
+    if kind == "" { kind = defaultTaskKind }
+    ex, ok := executors[kind]
+    if !ok { return Result{ExitCode: -1, Err: fmt.Errorf("no executor for task kind %q", kind)} }
+    log.Printf("running task %s (%s)", t.ID, kind)
+    return ex.Execute(ctx, t, stdout, stderr)
+}
+
+// specKitExecutor hands the task text to spec-kit (executors.specKit).
+type specKitExecutor struct{}
+
+func (specKitExecutor) Execute(ctx context.Context, t Task, stdout, stderr io.Writer) Result {
+    return runCommand(ctx, t.Workspace, stdout, stderr, conf.Executors.SpecKit, "new-task", t.Text)
+}
+
+// shellExecutor runs the task text with executors.shell (default /bin/sh) -c.
+type shellExecutor struct{}
+
+func (shellExecutor) Execute(ctx context.Context, t Task, stdout, stderr io.Writer) Result {
+    return runCommand(ctx, t.Workspace, stdout, stderr, cmp.Or(conf.Executors.Shell, "/bin/sh"), "-c", t.Text)
+}
+
+// codingCLIExecutor passes the task text as the prompt to a coding CLI.
+// executors.codingCLI is the command line to run, e.g. "codex exec" or
+// "copilot -p"; the prompt is appended as the last argument.
+type codingCLIExecutor struct{}
+
+func (codingCLIExecutor) Execute(ctx context.Context, t Task, stdout, stderr io.Writer) Result {
+    argv := strings.Fields(conf.Executors.CodingCLI)
+    if len(argv) == 0 { return Result{ExitCode: -1, Err: errors.New("no coding CLI configured (executors.codingCLI, AGENT_CODING_CLI)")} }
+    return runCommand(ctx, t.Workspace, stdout, stderr, argv[0], append(argv[1:], t.Text)...)
+}
+
+// runCommand runs a subprocess in dir, keeping the tail of its stderr for
+// the result. The tool sees dir as AGENT_WORKSPACE too.
+func runCommand(ctx context.Context, dir string, stdout, stderr io.Writer, name string, args ...string) Result {
+    start := time.Now()
+    tail := &tailBuffer{max: stderrTailBytes}
+    cmd := exec.CommandContext(ctx, name, args...)
+    // when ctx ends (shutdown) the tool gets SIGTERM to finish or
+    // checkpoint, and is killed if still running after the grace period
+    cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+    cmd.WaitDelay = toolGrace()
+    cmd.Dir = dir
+    if dir != "" { cmd.Env = append(os.Environ(), "AGENT_WORKSPACE="+dir) }
+    cmd.Stdout = stdout
+    cmd.Stderr = io.MultiWriter(stderr, tail)
+    err := cmd.Run()
+    res := Result{Stderr: tail.String(), Duration: time.Since(start)}
+    if err != nil {
+        res.ExitCode, res.Err = -1, err
+        var ee *exec.ExitError
+        if errors.As(err, &ee) { res.ExitCode, res.Err = ee.ExitCode(), fmt.Errorf("%s: %w", name, err) }
+    }
+    return res
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+    max int
+    b   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+    t.b = append(t.b, p...)
+    if len(t.b) > t.max { t.b = t.b[len(t.b)-t.max:] }
+    return len(p), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.b) }
@@ -0,0 +1,120 @@
+package main
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeTool writes an executable script standing in for a task tool.
+func fakeTool(t *testing.T, script string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "tool")
+    if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil { t.Fatal(err) }
+    return path
+}
+
+// syncBuffer is a strings.Builder safe to read while a tool writes to it.
+type syncBuffer struct {
+    mu sync.Mutex
+    b  strings.Builder
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) { s.mu.Lock(); defer s.mu.Unlock(); return s.b.Write(p) }
+
+func (s *syncBuffer) String() string { s.mu.Lock(); defer s.mu.Unlock(); return s.b.String() }
+
+func TestExecutors(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    // reports its arguments and workspace, fails when asked to
+    tool := fakeTool(t, `echo "args=$*"
+echo "ws=$AGENT_WORKSPACE pwd=$(pwd)"
+echo "from stderr" >&2
+case "$*" in *fail*) exit 4;; esac
+`)
+    for _, c := range []struct {
+        name, kind, text, specKit, codingCLI string
+        code                                 int
+        stdout, stderr, err                  string
+    }{
+        {name: "spec-kit", kind: "spec-kit", text: "add a page", specKit: tool, stdout: "args=new-task add a page", stderr: "from stderr"},
+        {name: "default kind", text: "add a page", specKit: tool, stdout: "args=new-task add a page"},
+        {name: "spec-kit fails", kind: "spec-kit", text: "fail please", specKit: tool, code: 4, stderr: "from stderr", err: "exit status 4"},
+        {name: "shell", kind: "shell", text: `echo "ws=$AGENT_WORKSPACE"; exit 3`, stdout: "ws=WS", code: 3, err: "exit status 3"},
+        {name: "coding-cli", kind: "coding-cli", text: "fix the bug", codingCLI: tool + " exec --yes", stdout: "args=exec --yes fix the bug"},
+        {name: "coding-cli fails", kind: "coding-cli", text: "fail", codingCLI: tool, code: 4, err: "exit status 4"},
+        {name: "no coding CLI", kind: "coding-cli", text: "x", code: -1, err: "no coding CLI configured"},
+        {name: "missing tool", kind: "spec-kit", text: "x", specKit: filepath.Join(t.TempDir(), "nope"), code: -1, err: "no such file"},
+        {name: "unknown kind", kind: "poetry", text: "x", code: -1, err: `no executor for task kind "poetry"`},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            conf.Executors.SpecKit, conf.Executors.CodingCLI = c.specKit, c.codingCLI
+            ws := t.TempDir()
+            var stdout, stderr strings.Builder
+            res := RunTask(context.Background(), Task{ID: "t1", Kind: c.kind, Text: c.text, Workspace: ws}, &stdout, &stderr)
+            if res.ExitCode != c.code { t.Errorf("exit code %d, want %d (%v)", res.ExitCode, c.code, res.Err) }
+            if c.err == "" && res.Err != nil { t.Errorf("unexpected error: %v", res.Err) }
+            if c.err != "" && (res.Err == nil || !strings.Contains(res.Err.Error(), c.err)) { t.Errorf("error %v, want %q", res.Err, c.err) }
+            if want := strings.ReplaceAll(c.stdout, "WS", ws); !strings.Contains(stdout.String(), want) { t.Errorf("stdout %q, want %q", stdout.String(), want) }
+            if !strings.Contains(stderr.String(), c.stderr) || !strings.Contains(res.Stderr, c.stderr) { t.Errorf("stderr %q / result %q, want %q", stderr.String(), res.Stderr, c.stderr) }
+            // tools run in the slot's workspace and are told where it is
+            if c.specKit == tool || c.codingCLI == tool {
+                if want := "ws=" + ws + " pwd=" + ws; !strings.Contains(stdout.String(), want) { t.Errorf("stdout %q, want %q", stdout.String(), want) }
+            }
+        })
+    }
+}
+
+func TestRunCommandStderrTail(t *testing.T) {
+    tool := fakeTool(t, `i=0; while [ $i -lt 2000 ]; do echo "line $i" >&2; i=$((i+1)); done; exit 1`)
+    var stderr strings.Builder
+    res := runCommand(context.Background(), t.TempDir(), &strings.Builder{}, &stderr, tool)
+    if len(res.Stderr) != stderrTailBytes || !strings.HasSuffix(res.Stderr, "line 1999\n") { t.Fatalf("tail: %d bytes ending %q", len(res.Stderr), res.Stderr[len(res.Stderr)-20:]) }
+    if !strings.HasPrefix(stderr.String(), "line 0\n") { t.Fatal("the task log lost the start of stderr") }
+}
+
+func TestRunCommandShutdown(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    conf.Timeouts.ShutdownGrace.Duration = 600 * time.Millisecond
+    for _, c := range []struct {
+        name, script, stdout, err string
+        killed                    bool
+    }{
+        // SIGTERM lets the tool checkpoint and exit on its own; the run
+        // still counts as interrupted
+        {"checkpoints", `trap 'echo checkpoint; kill $!; exit 0' TERM
+echo started
+sleep 30 >/dev/null 2>&1 &
+wait`, "checkpoint", "context canceled", false},
+        // a tool ignoring SIGTERM is killed once the grace period is over
+        {"ignores SIGTERM", `trap '' TERM
+echo started
+exec sleep 30`, "", "signal: killed", true},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            tool := fakeTool(t, c.script)
+            ctx, cancel := context.WithCancel(context.Background())
+            out := &syncBuffer{}
+            done := make(chan Result, 1)
+            go func() { done <- runCommand(ctx, t.TempDir(), out, &strings.Builder{}, tool) }()
+            deadline := time.Now().Add(5 * time.Second)
+            for !strings.Contains(out.String(), "started") {
+                if time.Now().After(deadline) { t.Fatal("tool never started") }
+                time.Sleep(10 * time.Millisecond)
+            }
+            start := time.Now()
+            cancel()
+            select {
+            case res := <-done:
+                if res.ExitCode != -1 || res.Err == nil || !strings.Contains(res.Err.Error(), c.err) || !strings.Contains(out.String(), c.stdout) { t.Fatalf("exit %d (%v), output %q", res.ExitCode, res.Err, out.String()) }
+                if took := time.Since(start); (took >= toolGrace()) != c.killed { t.Fatalf("finished after %v, grace period %v", took, toolGrace()) }
+            case <-time.After(toolGrace() + 5*time.Second):
+                t.Fatal("still running after the grace period")
+            }
+        })
+    }
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "time"
+)
+
+// On SIGTERM or SIGINT the agent stops claiming and sends SIGTERM on to
+// running tools, so they can finish or checkpoint. Tools still running
+// when the grace period ends are killed, and their tasks are handed back
+// to the orchestrator for another agent. Once queued reports are delivered
+// the agent deregisters and exits, all within AGENT_SHUTDOWN_GRACE, which
+// the deployment manifest sets to the pod's terminationGracePeriodSeconds.
+
+// shutdownReserve is kept back from the grace period for handing tasks
+// back, delivering the outbox and deregistering.
+const shutdownReserve = 10 * time.Second
+
+// shutdownGrace is timeouts.shutdownGrace (AGENT_SHUTDOWN_GRACE).
+func shutdownGrace() time.Duration { return conf.Timeouts.ShutdownGrace.Duration }
+
+// toolGrace is how long a tool may run on after SIGTERM before it is killed.
+func toolGrace() time.Duration {
+    g := shutdownGrace()
+    return max(g-shutdownReserve, g/2)
+}
+
+// toolDeadline returns a context that ends toolGrace after ctx does. Work
+// that must not be thrown away when the signal arrives, such as opening
+// the PR for a run that already succeeded, runs on it instead of being
+// stopped at once. Call it before ctx ends, so the grace period is counted
+// from the signal.
+func toolDeadline(ctx context.Context) context.Context {
+    out, cancel := context.WithCancel(context.WithoutCancel(ctx))
+    context.AfterFunc(ctx, func() { time.AfterFunc(toolGrace(), cancel) })
+    return out
+}
+
+// deregister delivers what is left in the outbox, then tells the
+// orchestrator the agent is gone. Heartbeats must have stopped, or the
+// next one would register the agent again.
+func deregister(ob *outbox, client *http.Client, orchURL, token, agentID string) {
+    ctx, cancel := context.WithTimeout(context.Background(), max(shutdownGrace()-toolGrace()-2*time.Second, time.Second))
+    defer cancel()
+    if err := ob.Drain(ctx); err != nil { log.Printf("shutdown: outbox not drained: %v", err) }
+    postJSON(client, orchURL+"/agents/deregister", token, map[string]any{"name": agentID})
+    log.Printf("deregistered %s", agentID)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// shutdownOrchestrator hands out one task, then holds claims for the
+// wait; it records task updates and the deregistration in order.
+type shutdownOrchestrator struct {
+    mu      sync.Mutex
+    claimed bool
+    calls   []string
+    // down makes updates answer 503, so reports queue in the outbox
+    down bool
+}
+
+func (f *shutdownOrchestrator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    b, _ := io.ReadAll(r.Body)
+    f.mu.Lock()
+    switch r.URL.Path {
+    case "/tasks/claim":
+        first := !f.claimed
+        f.claimed = true
+        f.mu.Unlock()
+        if first { io.WriteString(w, `{"id":"t1","kind":"shell","text":"echo started; exec sleep 30"}`); return }
+        select {
+        case <-time.After(conf.Timeouts.ClaimWait.Duration):
+        case <-r.Context().Done():
+        }
+        io.WriteString(w, "{}")
+        return
+    case "/tasks/update":
+        var u struct{ Status string }
+        json.Unmarshal(b, &u)
+        if f.down { f.mu.Unlock(); w.WriteHeader(503); return }
+        f.calls = append(f.calls, "update "+u.Status)
+    case "/agents/deregister":
+        var d struct{ Name string }
+        json.Unmarshal(b, &d)
+        f.calls = append(f.calls, "deregister "+d.Name+" token="+r.Header.Get("X-Auth-Token"))
+    case "/tasks/log":
+        if strings.Contains(string(b), "started") { f.calls = append(f.calls, "log started") }
+    }
+    f.mu.Unlock()
+    w.WriteHeader(204)
+}
+
+func (f *shutdownOrchestrator) seen(call string) bool {
+    f.mu.Lock(); defer f.mu.Unlock()
+    for _, c := range f.calls {
+        if c == call { return true }
+    }
+    return false
+}
+
+func TestShutdownHandsBackRunningTask(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    conf.Timeouts.ShutdownGrace.Duration = 20 * time.Second
+    conf.Timeouts.ClaimWait.Duration = 200 * time.Millisecond
+    orch := &shutdownOrchestrator{}
+    srv := httptest.NewServer(orch)
+    defer srv.Close()
+    ob, err := openOutbox(t.TempDir(), srv.Client(), srv.URL, "tok")
+    if err != nil { t.Fatal(err) }
+    status := newAgentStatus()
+    ob.settled = status.settled
+    go ob.run(context.Background())
+
+    // ctx stands in for the signal context main gets from SIGTERM
+    ctx, sigterm := context.WithCancel(context.Background())
+    w := &worker{client: srv.Client(), orchURL: srv.URL, token: "tok", agentID: "a1", ob: ob, status: status, finishing: toolDeadline(ctx)}
+    cl := newClaimer(srv.URL, "tok", "acme", "a1")
+    slotsDone := make(chan struct{})
+    go func() { w.runSlots(ctx, cl, []string{t.TempDir(), t.TempDir()}); close(slotsDone) }()
+
+    // the task is running once its output shows up in the task log
+    deadline := time.Now().Add(5 * time.Second)
+    for !orch.seen("log started") {
+        if time.Now().After(deadline) { t.Fatal("task never started") }
+        time.Sleep(20 * time.Millisecond)
+    }
+    orch.mu.Lock(); orch.down = true; orch.mu.Unlock()
+    sigterm()
+    // the tool gets SIGTERM at once, well within its grace period
+    select {
+    case <-slotsDone:
+    case <-time.After(5 * time.Second):
+        t.Fatal("slots still running after SIGTERM")
+    }
+    // the hand-back is queued while the orchestrator refuses updates
+    if _, tasks := status.snapshot(); len(tasks) != 0 { t.Fatalf("task still running: %+v", tasks) }
+    if held := status.held(); len(held) != 1 || held[0].Status != "scheduled" { t.Fatalf("held: %+v", held) }
+    if p, _ := ob.pending(); len(p) == 0 { t.Fatal("nothing queued") }
+
+    // deregistering waits for the outbox, so the task is back before the agent is gone
+    orch.mu.Lock(); orch.down = false; orch.mu.Unlock()
+    deregister(ob, srv.Client(), srv.URL, "tok", "a1")
+    if p, _ := ob.pending(); len(p) != 0 { t.Fatalf("outbox not drained: %v", p) }
+    if len(status.held()) != 0 { t.Fatal("task still held after its hand-back was delivered") }
+    orch.mu.Lock(); defer orch.mu.Unlock()
+    var updates []string
+    for _, c := range orch.calls {
+        if strings.HasPrefix(c, "update ") || strings.HasPrefix(c, "deregister ") { updates = append(updates, c) }
+    }
+    if got := strings.Join(updates, ", "); got != "update running, update running, update scheduled, deregister a1 token=tok" { t.Fatalf("calls: %s", got) }
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// An agent runs up to maxConcurrentTasks tasks at once, one per
+// slot. It only claims while a slot is free, and each slot has its own
+// workspace so concurrent tools never share a checkout. The capacity is
+// advertised on register and heartbeat so the orchestrator doesn't hand
+// out more than that.
+
+// slotWorkspaces returns a workspace per slot. A single slot keeps the
+// configured workspace as is; with more, each gets slot-<n> under it (or
+// under the state directory when no workspace is set).
+func slotWorkspaces(n int) ([]string, error) {
+    base := conf.Workspace
+    if n == 1 { return []string{base}, nil }
+    if base == "" { base = filepath.Join(agentStateDir(), "workspace") }
+    dirs := make([]string, n)
+    for i := range dirs {
+        dirs[i] = filepath.Join(base, fmt.Sprintf("slot-%d", i))
+        if err := os.MkdirAll(dirs[i], 0o755); err != nil { return nil, err }
+    }
+    return dirs, nil
+}
+
+// worker runs claimed tasks and reports on them.
+type worker struct {
+    client         *http.Client
+    orchURL, token string
+    agentID        string
+    ob             *outbox
+    status         *agentStatus
+    // finishing outlives the shutdown signal by the tools' grace period
+    finishing      context.Context
+}
+
+// runSlots claims a task whenever a slot is free and runs it in that
+// slot's workspace. Once ctx ends it stops claiming and returns when the
+// running tasks are done or handed back.
+func (w *worker) runSlots(ctx context.Context, claims *claimer, workspaces []string) {
+    var running sync.WaitGroup
+    defer running.Wait()
+    free := make(chan int, len(workspaces))
+    for i := range workspaces { free <- i }
+    for {
+        var slot int
+        select {
+        case slot = <-free:
+        case <-ctx.Done():
+            return
+        }
+        // claim a task, waiting on the orchestrator until one is scheduled
+        claimed, err := claims.next(ctx)
+        if err != nil {
+            free <- slot
+            if ctx.Err() != nil { return }
+            log.Printf("claim: %v", err)
+            continue
+        }
+        running.Add(1)
+        go func() {
+            defer running.Done()
+            defer func() { free <- slot }()
+            w.handle(ctx, claimed, workspaces[slot])
+        }()
+    }
+}
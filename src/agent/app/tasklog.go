@@ -0,0 +1,148 @@
+package main
+
+import (
+    "bytes"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Subprocess output is sent to /tasks/log line by line, tagged with the
+// phase of the task (run, pr) and the stream (stdout, stderr). Lines are
+// batched so a chatty tool doesn't cost one request per line, and go
+// through the outbox so none are lost while the orchestrator is away.
+
+const (
+    taskLogFlushInterval = 500 * time.Millisecond
+    taskLogBatchLines    = 100
+)
+
+type taskLogLine struct {
+    Line   string `json:"line"`
+    Stream string `json:"stream,omitempty"`
+    Phase  string `json:"phase,omitempty"`
+}
+
+// taskLogger batches lines for one task and queues them in order.
+type taskLogger struct {
+    out *outbox
+    id  string
+    max int
+    // onProgress, if set, receives progress lines from stdout
+    onProgress func(percent *int, step string)
+
+    mu      sync.Mutex
+    pending []taskLogLine
+    sendMu  sync.Mutex // one batch queued at a time, so batches stay in order
+    kick    chan struct{}
+    stop    chan struct{}
+    done    chan struct{}
+}
+
+func newTaskLogger(out *outbox, taskID string) *taskLogger {
+    // longer lines are cut and marked
+    l := &taskLogger{out: out, id: taskID, max: conf.LogLineMax,
+        kick: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+    go l.loop()
+    return l
+}
+
+func (l *taskLogger) loop() {
+    defer close(l.done)
+    t := time.NewTicker(taskLogFlushInterval)
+    defer t.Stop()
+    for {
+        select {
+        case <-t.C:
+        case <-l.kick:
+        case <-l.stop:
+            l.Flush()
+            return
+        }
+        l.Flush()
+    }
+}
+
+func (l *taskLogger) add(ln taskLogLine) {
+    l.mu.Lock()
+    l.pending = append(l.pending, ln)
+    full := len(l.pending) >= taskLogBatchLines
+    l.mu.Unlock()
+    if full {
+        select { case l.kick <- struct{}{}: default: }
+    }
+}
+
+// Line logs one line of the agent's own.
+func (l *taskLogger) Line(phase, line string) { l.add(taskLogLine{Line: line, Phase: phase}) }
+
+// Flush hands everything so far to the outbox before returning.
+func (l *taskLogger) Flush() {
+    l.sendMu.Lock(); defer l.sendMu.Unlock()
+    for {
+        l.mu.Lock()
+        n := min(len(l.pending), taskLogBatchLines)
+        batch := l.pending[:n:n]
+        l.pending = l.pending[n:]
+        l.mu.Unlock()
+        if n == 0 { return }
+        l.out.post("/tasks/log", map[string]any{"id": l.id, "lines": batch})
+    }
+}
+
+// Close flushes and stops the logger.
+func (l *taskLogger) Close() {
+    close(l.stop)
+    <-l.done
+}
+
+// Writer returns an io.Writer that splits what it is given into lines for
+// phase and stream. Call its Close to send a trailing partial line.
+func (l *taskLogger) Writer(phase, stream string) *taskLogWriter {
+    return &taskLogWriter{l: l, phase: phase, stream: stream}
+}
+
+type taskLogWriter struct {
+    l             *taskLogger
+    phase, stream string
+    mu            sync.Mutex
+    buf           []byte
+    // dropped counts bytes cut from the current line
+    dropped int
+}
+
+func (w *taskLogWriter) Write(p []byte) (int, error) {
+    w.mu.Lock(); defer w.mu.Unlock()
+    n := len(p)
+    for len(p) > 0 {
+        i := bytes.IndexByte(p, '\n')
+        chunk := p
+        if i >= 0 { chunk = p[:i] }
+        if room := w.l.max - len(w.buf); room < len(chunk) {
+            w.dropped += len(chunk) - max(room, 0)
+            chunk = chunk[:max(room, 0)]
+        }
+        w.buf = append(w.buf, chunk...)
+        if i < 0 { break }
+        w.emit()
+        p = p[i+1:]
+    }
+    return n, nil
+}
+
+func (w *taskLogWriter) emit() {
+    line := strings.TrimRight(string(w.buf), "\r")
+    if w.dropped > 0 { line += " …[" + strconv.Itoa(w.dropped) + " bytes truncated]" }
+    if w.stream == "stdout" && w.l.onProgress != nil {
+        if pct, step, ok := parseProgress(line); ok { w.l.onProgress(pct, step) }
+    }
+    w.l.add(taskLogLine{Line: line, Stream: w.stream, Phase: w.phase})
+    w.buf, w.dropped = w.buf[:0], 0
+}
+
+func (w *taskLogWriter) Close() error {
+    w.mu.Lock(); defer w.mu.Unlock()
+    if len(w.buf) > 0 || w.dropped > 0 { w.emit() }
+    return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// taskLogBatches runs the outbox until everything is delivered and returns
+// the /tasks/log bodies the orchestrator got.
+func taskLogBatches(t *testing.T, orch *fakeOrchestrator, ob *outbox) [][]taskLogLine {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    go ob.run(ctx)
+    if err := ob.Drain(ctx); err != nil { t.Fatalf("drain: %v", err) }
+    var out [][]taskLogLine
+    for _, d := range orch.delivered() {
+        path, body, _ := strings.Cut(d, " ")
+        if path != "/tasks/log" { t.Fatalf("posted to %s", path) }
+        var req struct {
+            ID    string        `json:"id"`
+            Lines []taskLogLine `json:"lines"`
+        }
+        if err := json.Unmarshal([]byte(body), &req); err != nil || req.ID != "t1" { t.Fatalf("body %s: %v", body, err) }
+        out = append(out, req.Lines)
+    }
+    return out
+}
+
+func newTestTaskLogger(t *testing.T, lineMax int) (*taskLogger, *outbox, *fakeOrchestrator) {
+    t.Helper()
+    useConf(t, t.TempDir(), "acme", "a1")
+    conf.LogLineMax = lineMax
+    orch := &fakeOrchestrator{}
+    srv := httptest.NewServer(orch)
+    t.Cleanup(srv.Close)
+    ob, err := openOutbox(t.TempDir(), srv.Client(), srv.URL, "")
+    if err != nil { t.Fatal(err) }
+    return newTaskLogger(ob, "t1"), ob, orch
+}
+
+func TestTaskLogBatches(t *testing.T) {
+    l, ob, orch := newTestTaskLogger(t, 4096)
+    w := l.Writer("run", "stdout")
+    for i := 0; i < 2*taskLogBatchLines+50; i++ { fmt.Fprintf(w, "line %d\n", i) }
+    w.Close()
+    l.Close()
+    batches := taskLogBatches(t, orch, ob)
+    // full batches are sent as soon as they fill, in order
+    if len(batches) != 3 || len(batches[0]) != taskLogBatchLines || len(batches[1]) != taskLogBatchLines || len(batches[2]) != 50 { t.Fatalf("batch sizes: %d", len(batches)) }
+    n := 0
+    for _, b := range batches {
+        for _, ln := range b {
+            if ln != (taskLogLine{Line: fmt.Sprintf("line %d", n), Stream: "stdout", Phase: "run"}) { t.Fatalf("line %d: %+v", n, ln) }
+            n++
+        }
+    }
+}
+
+func TestTaskLogLines(t *testing.T) {
+    l, ob, orch := newTestTaskLogger(t, 10)
+    out, errw := l.Writer("run", "stdout"), l.Writer("pr", "stderr")
+    // split writes, CRLF and an over-long line
+    out.Write([]byte("hel"))
+    out.Write([]byte("lo\r\nabcdefghijklmnopqrstuvwxyz\n"))
+    errw.Write([]byte("no newline"))
+    l.Line("pr", "opening PR")
+    out.Close()
+    errw.Close()
+    l.Close()
+    var got []taskLogLine
+    for _, b := range taskLogBatches(t, orch, ob) { got = append(got, b...) }
+    want := []taskLogLine{
+        {Line: "hello", Stream: "stdout", Phase: "run"},
+        {Line: "abcdefghij …[16 bytes truncated]", Stream: "stdout", Phase: "run"},
+        {Line: "opening PR", Phase: "pr"},
+        {Line: "no newline", Stream: "stderr", Phase: "pr"},
+    }
+    if fmt.Sprint(got) != fmt.Sprint(want) { t.Fatalf("lines:\n got %+v\nwant %+v", got, want) }
+}
+
+func TestTaskLogFlushesOnClose(t *testing.T) {
+    l, ob, orch := newTestTaskLogger(t, 4096)
+    l.Line("run", "only line")
+    start := time.Now()
+    // Close doesn't wait for the next tick to send a short batch
+    l.Close()
+    if took := time.Since(start); took >= taskLogFlushInterval { t.Fatalf("close took %v", took) }
+    if p, _ := ob.pending(); len(p) != 1 { t.Fatalf("queued after close: %v", p) }
+
+    // without Close, lines go out on the ticker
+    l2 := newTaskLogger(ob, "t1")
+    defer l2.Close()
+    l2.Line("run", "ticked")
+    deadline := time.Now().Add(5 * taskLogFlushInterval)
+    for {
+        if p, _ := ob.pending(); len(p) == 2 { break }
+        if time.Now().After(deadline) { t.Fatal("line never flushed") }
+        time.Sleep(20 * time.Millisecond)
+    }
+    if b := taskLogBatches(t, orch, ob); len(b) != 2 || b[0][0].Line != "only line" || b[1][0].Line != "ticked" { t.Fatalf("batches: %+v", b) }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "cmp"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "os"
+    "os/exec"
+    "strconv"
+
+    "github.com/creack/pty"
+    "github.com/gorilla/websocket"
+)
+
+// terminalPath is served on tunnel streams next to the editor: a shell in
+// a PTY over WebSocket. Binary frames carry terminal bytes both ways; text
+// frames carry JSON control messages ({"type":"resize","cols","rows"} from
+// the orchestrator, {"type":"exit","code"} when the shell ends).
+const terminalPath = "/_agent/terminal"
+
+type terminalControl struct {
+    Type string `json:"type"`
+    Cols int    `json:"cols,omitempty"`
+    Rows int    `json:"rows,omitempty"`
+    Code int    `json:"code"`
+}
+
+var terminalUpgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// terminalShell is executors.shell (AGENT_SHELL), else $SHELL, else /bin/sh.
+func terminalShell() string { return cmp.Or(conf.Executors.Shell, os.Getenv("SHELL"), "/bin/sh") }
+
+func terminalSize(v string, def int) uint16 {
+    n, err := strconv.Atoi(v)
+    if err != nil || n <= 0 || n > 1000 { return uint16(def) }
+    return uint16(n)
+}
+
+// handleTerminal starts a login shell in the workspace (or the current
+// directory) sized from ?cols=&rows=. Only the orchestrator reaches it,
+// through the tunnel, and it must present the agent's orchestrator token.
+func handleTerminal(token string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if token != "" && r.Header.Get("X-Auth-Token") != token { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+        cmd := exec.Command(terminalShell(), "-l")
+        cmd.Dir = conf.Workspace
+        cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+        size := &pty.Winsize{Cols: terminalSize(r.URL.Query().Get("cols"), 80), Rows: terminalSize(r.URL.Query().Get("rows"), 24)}
+        tty, err := pty.StartWithSize(cmd, size)
+        if err != nil { http.Error(w, err.Error(), 500); return }
+        defer tty.Close()
+        conn, err := terminalUpgrader.Upgrade(w, r, nil)
+        if err != nil { cmd.Process.Kill(); cmd.Wait(); return }
+        defer conn.Close()
+        log.Printf("terminal opened (%s, %dx%d)", cmd.Path, size.Cols, size.Rows)
+
+        go func() {
+            for {
+                typ, b, err := conn.ReadMessage()
+                if err != nil { cmd.Process.Kill(); return }
+                switch typ {
+                case websocket.BinaryMessage:
+                    tty.Write(b)
+                case websocket.TextMessage:
+                    var c terminalControl
+                    if json.Unmarshal(b, &c) == nil && c.Type == "resize" {
+                        pty.Setsize(tty, &pty.Winsize{Cols: terminalSize(strconv.Itoa(c.Cols), 80), Rows: terminalSize(strconv.Itoa(c.Rows), 24)})
+                    }
+                }
+            }
+        }()
+        buf := make([]byte, 32<<10)
+        for {
+            n, err := tty.Read(buf)
+            if n > 0 {
+                if conn.WriteMessage(websocket.BinaryMessage, buf[:n]) != nil { break }
+            }
+            if err != nil { break }
+        }
+        code := 0
+        if err := cmd.Wait(); err != nil {
+            code = -1
+            var ee *exec.ExitError
+            if errors.As(err, &ee) { code = ee.ExitCode() }
+        }
+        log.Printf("terminal closed (exit %d)", code)
+        b, _ := json.Marshal(terminalControl{Type: "exit", Code: code})
+        conn.WriteMessage(websocket.TextMessage, b)
+        conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+    }
+}
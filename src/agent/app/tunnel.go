@@ -0,0 +1,120 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/hashicorp/yamux"
+)
+
+// runTunnel keeps a reverse tunnel open to the orchestrator so it can reach
+// the editor without kubectl or inbound connectivity: a WebSocket to
+// /agents/tunnel carrying a yamux session. Each stream the orchestrator
+// opens carries HTTP: the terminal endpoint is served here and everything
+// else is proxied to editorAddr. Reconnects with backoff.
+func runTunnel(orchURL, token, name, org, editorAddr string) {
+    backoff := time.Second
+    for {
+        start := time.Now()
+        err := serveTunnel(orchURL, token, name, org, editorAddr)
+        log.Printf("tunnel closed: %v", err)
+        if time.Since(start) > time.Minute { backoff = time.Second }
+        time.Sleep(backoff)
+        backoff = min(backoff*2, 30*time.Second)
+    }
+}
+
+func serveTunnel(orchURL, token, name, org, editorAddr string) error {
+    u, err := url.Parse(orchURL)
+    if err != nil { return err }
+    switch u.Scheme {
+    case "https":
+        u.Scheme = "wss"
+    default:
+        u.Scheme = "ws"
+    }
+    u.Path = strings.TrimRight(u.Path, "/") + "/agents/tunnel"
+    u.RawQuery = url.Values{"name": {name}, "org": {org}}.Encode()
+    h := http.Header{}
+    if token != "" { h.Set("X-Auth-Token", token) }
+    conn, resp, err := websocket.DefaultDialer.Dial(u.String(), h)
+    if err != nil {
+        if resp != nil { return fmt.Errorf("dial %s: %s", u.Redacted(), resp.Status) }
+        return err
+    }
+    cfg := yamux.DefaultConfig()
+    cfg.KeepAliveInterval = 15 * time.Second
+    cfg.LogOutput = io.Discard
+    sess, err := yamux.Server(&wsConn{Conn: conn}, cfg)
+    if err != nil { conn.Close(); return err }
+    defer sess.Close()
+    log.Printf("tunnel open to %s", u.Host)
+    // the yamux session is the listener: one connection per stream
+    return (&http.Server{Handler: tunnelHandler(token, editorAddr)}).Serve(sess)
+}
+
+// tunnelHandler serves the terminal and proxies the rest to code-server,
+// keeping the Host the orchestrator set so code-server's origin check holds.
+func tunnelHandler(token, editorAddr string) http.Handler {
+    editor := &httputil.ReverseProxy{
+        Director: func(req *http.Request) {
+            req.URL.Scheme = "http"
+            req.URL.Host = editorAddr
+        },
+        Transport: &http.Transport{DialContext: (&net.Dialer{Timeout: 5 * time.Second}).DialContext},
+        ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+            log.Printf("tunnel: editor %s: %v", editorAddr, err)
+            http.Error(w, "editor unavailable", 502)
+        },
+    }
+    terminal := handleTerminal(token)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == terminalPath { terminal(w, r); return }
+        editor.ServeHTTP(w, r)
+    })
+}
+
+// wsConn adapts a WebSocket to net.Conn, one binary message per Write.
+type wsConn struct {
+    *websocket.Conn
+    r   io.Reader
+    wmu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+    for {
+        if c.r == nil {
+            typ, r, err := c.Conn.NextReader()
+            if err != nil { return 0, err }
+            if typ != websocket.BinaryMessage { continue }
+            c.r = r
+        }
+        n, err := c.r.Read(p)
+        if err == io.EOF {
+            c.r = nil
+            if n > 0 { return n, nil }
+            continue
+        }
+        return n, err
+    }
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+    c.wmu.Lock(); defer c.wmu.Unlock()
+    if err := c.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil { return 0, err }
+    return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+    if err := c.Conn.SetReadDeadline(t); err != nil { return err }
+    return c.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/hashicorp/yamux"
+)
+
+// tunnelOrchestrator accepts the agent's tunnel like the orchestrator does
+// and hands back the yamux session, from which streams to the agent open.
+func tunnelOrchestrator(t *testing.T, token string) (*httptest.Server, <-chan *yamux.Session) {
+    t.Helper()
+    sessions := make(chan *yamux.Session, 1)
+    up := websocket.Upgrader{}
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/agents/tunnel" || r.Header.Get("X-Auth-Token") != token { http.Error(w, "no", 401); return }
+        conn, err := up.Upgrade(w, r, nil)
+        if err != nil { return }
+        cfg := yamux.DefaultConfig()
+        cfg.LogOutput = io.Discard
+        sess, err := yamux.Client(&wsConn{Conn: conn}, cfg)
+        if err != nil { conn.Close(); return }
+        sessions <- sess
+    }))
+    t.Cleanup(srv.Close)
+    return srv, sessions
+}
+
+// readUntil reads terminal output until it contains want.
+func readUntil(t *testing.T, conn *websocket.Conn, want string) string {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    var out strings.Builder
+    for !strings.Contains(out.String(), want) {
+        typ, b, err := conn.ReadMessage()
+        if err != nil { t.Fatalf("waiting for %q: %v (got %q)", want, err, out.String()) }
+        if typ == websocket.BinaryMessage { out.Write(b) }
+    }
+    return out.String()
+}
+
+func TestTerminalThroughTunnel(t *testing.T) {
+    useConf(t, t.TempDir(), "acme", "a1")
+    conf.Workspace = t.TempDir()
+    conf.Executors.Shell = "/bin/sh"
+    editor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "editor %s host=%s", r.URL.Path, r.Host) }))
+    defer editor.Close()
+    orch, sessions := tunnelOrchestrator(t, "tok")
+    go serveTunnel(orch.URL, "tok", "a1", "acme", editor.Listener.Addr().String())
+    var sess *yamux.Session
+    select {
+    case sess = <-sessions:
+    case <-time.After(5 * time.Second):
+        t.Fatal("agent never opened the tunnel")
+    }
+    defer sess.Close()
+    client := &http.Client{Transport: &http.Transport{DialContext: func(context.Context, string, string) (net.Conn, error) { return sess.Open() }}}
+
+    // anything but the terminal goes to the editor, Host kept
+    resp, err := client.Get("http://localhost:8443/static/app.js")
+    if err != nil { t.Fatal(err) }
+    b, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if string(b) != "editor /static/app.js host=localhost:8443" { t.Fatalf("editor proxy: %q", b) }
+
+    // the terminal wants the agent's token
+    resp, err = client.Get("http://localhost:8443" + terminalPath)
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    if resp.StatusCode != 401 { t.Fatalf("terminal without token: %d", resp.StatusCode) }
+
+    d := websocket.Dialer{NetDialContext: func(context.Context, string, string) (net.Conn, error) { return sess.Open() }}
+    conn, _, err := d.Dial("ws://localhost:8443"+terminalPath+"?cols=100&rows=30", http.Header{"X-Auth-Token": {"tok"}})
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+    send := func(line string) {
+        if err := conn.WriteMessage(websocket.BinaryMessage, []byte(line+"\n")); err != nil { t.Fatal(err) }
+    }
+
+    // keystrokes reach the shell in the workspace, its output comes back
+    send("echo sum-$((40+2)) && pwd")
+    if out := readUntil(t, conn, conf.Workspace); !strings.Contains(out, "sum-42") { t.Fatalf("output: %q", out) }
+    send("stty size")
+    readUntil(t, conn, "30 100")
+    resize, _ := json.Marshal(terminalControl{Type: "resize", Cols: 120, Rows: 40})
+    conn.WriteMessage(websocket.TextMessage, resize)
+    send("stty size")
+    readUntil(t, conn, "40 120")
+
+    // the shell's exit code is reported before the close
+    send("exit 7")
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    for {
+        typ, b, err := conn.ReadMessage()
+        if err != nil { t.Fatalf("no exit message: %v", err) }
+        if typ != websocket.TextMessage { continue }
+        var c terminalControl
+        if json.Unmarshal(b, &c) != nil || c.Type != "exit" || c.Code != 7 { t.Fatalf("exit message: %s", b) }
+        break
+    }
+    if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) { t.Fatalf("after exit: %v", err) }
+}
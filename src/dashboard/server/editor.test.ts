@@ -2,8 +2,8 @@ import 'dotenv/config'
 import http from 'http'
 import httpProxy from 'http-proxy'
 
-// This test validates the /api/editor/open flow and the /embed/orchestrator/:port proxy by
-// standing up a stub orchestrator that exposes /agents, /agents/editor/open and /editor/proxy/:port
+// This test validates the /api/editor/open flow and the /embed/orchestrator/:agent proxy by
+// standing up a stub orchestrator that exposes /agents, /agents/editor/open and /editor/:agent
 // endpoints. The proxy target serves a simple HTML page to emulate code-server.
 
 describe('Dashboard editor embed (orchestrator-forwarded) [integration]', () => {
@@ -25,11 +25,12 @@ describe('Dashboard editor embed (orchestrator-forwarded) [integration]', () =>
     const eaddr = editorServer!.address() as any
     const editorPort = eaddr.port
 
-    // Stub orchestrator that reports one agent and proxies /editor/proxy/:port to the stub editor
+    // Stub orchestrator that reports one agent and proxies /editor/:agent to the stub editor
     orchServer = http.createServer((req, res) => {
       const u = new URL(req.url || '/', 'http://localhost')
       // auth for editor endpoints
-      const authed = req.headers['x-auth-token'] === token || !/\/agents\/editor\//.test(u.pathname)
+      const authed =
+        req.headers['x-auth-token'] === token || !/^\/(agents\/)?editor\//.test(u.pathname)
       if (!authed) {
         res.statusCode = 401
         res.setHeader('Content-Type', 'application/json')
@@ -53,9 +54,8 @@ describe('Dashboard editor embed (orchestrator-forwarded) [integration]', () =>
         res.setHeader('Content-Type', 'application/json')
         return res.end(JSON.stringify({ name: 'agent-stub', port: editorPort }))
       }
-      if (u.pathname.startsWith('/editor/proxy/')) {
+      if (u.pathname.startsWith('/editor/agent-stub/')) {
         // simulate the orchestrator's reverse-proxy: forward to local editorServer
-        // We ignore the port segment and always target our editorServer
         const proxy = httpProxy.createProxyServer({})
         proxy.web(req, res, { target: `http://127.0.0.1:${editorPort}` })
         return
@@ -92,7 +92,7 @@ describe('Dashboard editor embed (orchestrator-forwarded) [integration]', () =>
     if (editorServer) await new Promise((r) => editorServer!.close(() => r(null as any)))
   })
 
-  it('opens an editor and serves it via /embed/orchestrator/:port', async () => {
+  it('opens an editor and serves it via /embed/orchestrator/:agent', async () => {
     const org = process.env.ORG || 'acme'
     // discover agent from state
     const s = await fetch(`${base}/api/state`)
@@ -114,7 +114,7 @@ describe('Dashboard editor embed (orchestrator-forwarded) [integration]', () =>
     expect(port).toBeGreaterThan(0)
 
     // fetch embed
-    const embed = await fetch(`${base}/embed/orchestrator/${encodeURIComponent(String(port))}/`)
+    const embed = await fetch(`${base}/embed/orchestrator/${encodeURIComponent(agentName)}/`)
     expect(embed.status).toBeGreaterThanOrEqual(200)
     expect(embed.status).toBeLessThan(400)
     const html = await embed.text()
@@ -163,6 +163,23 @@ function fetchJSON(
   })
 }
 
+// Make sure an org has agents for a newly scheduled task. Orgs with a pool in
+// the orchestrator config are kept at their desired size by its reconciler,
+// so we only nudge it; other orgs get a one-off /agents/deploy.
+async function ensureAgents(org: string, headers: Record<string, string>): Promise<any> {
+  const poolURL = `${ORCH_URL}/pools/${encodeURIComponent(org)}`
+  let pooled = false
+  try {
+    await fetchJSON(poolURL, { headers })
+    pooled = true
+  } catch {}
+  if (pooled) {
+    const pool = await fetchJSON(`${poolURL}/reconcile`, { method: 'POST', headers })
+    return { ok: !pool?.lastError, managed: true, pool }
+  }
+  return fetchJSON(`${ORCH_URL}/agents/deploy`, { method: 'POST', headers, body: { org } })
+}
+
 // In-memory chats
 const chats: { global: Array<{ role: 'user' | 'assistant' | 'system'; text: string }> } = {
   global: [],
@@ -501,19 +518,16 @@ app.use('/embed/local/:port', (req, res) => {
   proxy.web(req, res, { target, changeOrigin: true, xfwd: true, headers: hdrs })
 })
 
-// Reverse proxy to embed editors forwarded inside orchestrator container
-app.use('/embed/orchestrator/:port', (req, res) => {
-  const port = Number(req.params.port)
-  if (!port || Number.isNaN(port)) return res.status(400).end('bad port')
+// Reverse proxy to agent editors served by the orchestrator at /editor/{agent}
+app.use('/embed/orchestrator/:agent', (req, res) => {
+  const agent = String(req.params.agent || '')
+  if (!agent) return res.status(400).end('missing agent')
   const orchBase = ORCH_URL.replace(/\/$/, '')
-  const target = `${orchBase}/editor/proxy/${port}`
-  const rest = req.url.replace(/^\/embed\/orchestrator\/(\d+)/, '') || '/'
+  const target = `${orchBase}/editor/${encodeURIComponent(agent)}`
+  const rest = req.url.replace(/^\/embed\/orchestrator\/[^/]+/, '') || '/'
   ;(req as any).url = rest
-  ;(req as any)._embedBase = `/embed/orchestrator/${port}`
-  const hdrs: any = Object.assign(
-    { [CS_AUTH_HEADER]: CS_AUTH_TOKEN },
-    ORCH_TOKEN ? { 'X-Auth-Token': ORCH_TOKEN } : {}
-  )
+  ;(req as any)._embedBase = `/embed/orchestrator/${encodeURIComponent(agent)}`
+  const hdrs: any = ORCH_TOKEN ? { 'X-Auth-Token': ORCH_TOKEN } : {}
   if (req.headers.origin) hdrs.origin = String(req.headers.origin)
   proxy.web(req, res, { target, changeOrigin: true, xfwd: true, headers: hdrs, secure: false })
 })
@@ -597,19 +611,17 @@ app.get('/api/chat', (req, res) => {
 app.post('/api/chat', async (req, res) => {
   const org = (req.body && req.body.org) || 'acme'
   const text = (req.body && req.body.text) || ''
+  // optional executor kind: spec-kit (default), shell or coding-cli
+  const kind = (req.body && req.body.kind) || undefined
   chats.global.push({ role: 'user', text })
   try {
     const headers: Record<string, string> = ORCH_TOKEN ? { 'X-Auth-Token': ORCH_TOKEN } : {}
-    const body = { org, task: text }
+    const body = { org, task: text, kind }
     const out = await fetchJSON(`${ORCH_URL}/schedule`, { method: 'POST', headers, body })
-    // Trigger agent deployment for this org (best-effort)
+    // Make sure the org has agents (best-effort)
     let deployResult: any = null
     try {
-      deployResult = await fetchJSON(`${ORCH_URL}/agents/deploy`, {
-        method: 'POST',
-        headers,
-        body: { org },
-      })
+      deployResult = await ensureAgents(org, headers)
     } catch (e: any) {
       deployResult = { ok: false, error: String(e?.message || e) }
       try {
@@ -705,6 +717,9 @@ app.get('/api/stream/task', (req, res) => {
   if (!id) return res.status(400).end('missing id')
   const headers: Record<string, string> = {}
   if (ORCH_TOKEN) headers['X-Auth-Token'] = ORCH_TOKEN
+  // let the orchestrator resume the stream where the browser left off
+  const lastEventId = req.headers['last-event-id']
+  if (lastEventId) headers['Last-Event-ID'] = String(lastEventId)
   const targetUrl = new URL(`${ORCH_URL}/events/tasks?id=${encodeURIComponent(id)}`)
   // forward request manually to preserve SSE
   const lib = targetUrl.protocol === 'https:' ? https : http
@@ -730,6 +745,9 @@ app.get('/api/stream/agent', (req, res) => {
   if (!name) return res.status(400).end('missing name')
   const headers: Record<string, string> = {}
   if (ORCH_TOKEN) headers['X-Auth-Token'] = ORCH_TOKEN
+  // let the orchestrator resume the stream where the browser left off
+  const lastEventId = req.headers['last-event-id']
+  if (lastEventId) headers['Last-Event-ID'] = String(lastEventId)
   const targetUrl = new URL(`${ORCH_URL}/events/agents?name=${encodeURIComponent(name)}`)
   const lib = targetUrl.protocol === 'https:' ? https : http
   const r = lib.request(
@@ -766,15 +784,13 @@ app.get('/api/chat/stream', async (req, res) => {
     const body = { org, task: text }
     const task = await fetchJSON(`${ORCH_URL}/schedule`, { method: 'POST', headers, body })
     send('task', JSON.stringify(task))
-    // Best-effort deploy an agent for this org
+    // Best-effort make sure the org has agents
     try {
-      const deploy = await fetchJSON(`${ORCH_URL}/agents/deploy`, {
-        method: 'POST',
-        headers,
-        body: { org },
-      })
+      const deploy = await ensureAgents(org, headers)
       const ok = Boolean((deploy as any)?.ok)
-      if (ok) {
+      if (ok && deploy.managed) {
+        send('message', 'Task scheduled; agent pool is managed by the orchestrator.')
+      } else if (ok) {
         send('message', 'Task scheduled; agent deployment started.')
       } else {
         send('message', 'Task scheduled; deploy returned an error.')
@@ -1533,19 +1549,16 @@ if (import.meta.url === `file://${process.argv[1]}`) {
         }
         return
       }
-      const m2 = url.pathname.match(/^\/embed\/orchestrator\/(\d+)(\/.*)?$/)
+      const m2 = url.pathname.match(/^\/embed\/orchestrator\/([^/]+)(\/.*)?$/)
       if (m2) {
-        const port = Number(m2[1])
+        const agent = decodeURIComponent(m2[1])
         const rest = m2[2] || '/'
         req.url = rest
         const orchBase = ORCH_URL.replace(/\/$/, '')
-        const target = `${orchBase}/editor/proxy/${port}`
+        const target = `${orchBase}/editor/${encodeURIComponent(agent)}`
         {
-          const wsOrigin = `http://127.0.0.1:${port}`
-          const hdrs: any = Object.assign(
-            { [CS_AUTH_HEADER]: CS_AUTH_TOKEN, origin: wsOrigin },
-            ORCH_TOKEN ? { 'X-Auth-Token': ORCH_TOKEN } : {}
-          )
+          // the orchestrator rewrites Origin for code-server
+          const hdrs: any = ORCH_TOKEN ? { 'X-Auth-Token': ORCH_TOKEN } : {}
           try {
             ;(req as any).headers['x-forwarded-proto'] = 'https'
           } catch {}
@@ -136,8 +136,8 @@ export default function App() {
     const p = a?.editorPort ?? a?.port
     if (!p) return 'about:blank'
     const via = a?.editorVia
-    if (via === 'orchestrator')
-      return `${SERVER_BASE}/embed/orchestrator/${encodeURIComponent(String(p))}/`
+    if (via === 'orchestrator' || via === 'tunnel')
+      return `${SERVER_BASE}/embed/orchestrator/${encodeURIComponent(name)}/`
     return `${SERVER_BASE}/embed/local/${encodeURIComponent(String(p))}/`
   })
   const selectedAgentPort = createMemo(() => {
@@ -274,10 +274,16 @@ export default function App() {
     es.addEventListener('agent', (e) => {
       try {
         const info = JSON.parse((e as MessageEvent).data)
-        if (info && info.ok) {
+        if (info && info.ok && info.managed) {
+          const o = info.pool?.observed || {}
+          setChatLog((prev) => [
+            ...prev,
+            `[system] agent pool: ${o.ready ?? 0}/${info.pool?.desired?.replicas ?? 0} ready`,
+          ])
+        } else if (info && info.ok) {
           setChatLog((prev) => [...prev, `[system] agent deploy started`])
         } else {
-          const err = info?.error || 'unknown error'
+          const err = info?.error || info?.pool?.lastError || 'unknown error'
           setChatLog((prev) => [
             ...prev,
             `[error] agent deploy failed: ${err}` + (info?.output ? `\n${info.output}` : ''),
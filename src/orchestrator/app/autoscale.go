@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+)
+
+// EventPoolScaled is published for every autoscaling decision.
+const EventPoolScaled = "pool.scaled"
+
+// ScaleDecision records a change of an autoscaled pool's size and why.
+type ScaleDecision struct {
+    Time    time.Time `json:"time"`
+    From    int32     `json:"from"`
+    To      int32     `json:"to"`
+    Reason  string    `json:"reason"`
+    Backlog int       `json:"backlog"` // scheduled tasks
+    Waiting int       `json:"waiting"` // of which waited past scaleUpAfter
+    Busy    int       `json:"busy"`
+    Idle    int       `json:"idle"`
+    Free    int       `json:"freeSlots"` // task slots not in use on live agents
+}
+
+// AutoscaleStatus is the current target of an autoscaled pool and the
+// decisions that led to it, most recent last.
+type AutoscaleStatus struct {
+    Replicas  int32           `json:"replicas"`
+    Backlog   int             `json:"backlog"`
+    Waiting   int             `json:"waiting"`
+    OldestAge string          `json:"oldestWait,omitempty"`
+    Decisions []ScaleDecision `json:"decisions"`
+}
+
+const scaleDecisionHistory = 50
+
+func (a AutoscaleConfig) scaleUpAfter() time.Duration {
+    if a.ScaleUpAfter.Duration > 0 { return a.ScaleUpAfter.Duration }
+    return 30 * time.Second
+}
+
+func (a AutoscaleConfig) idleTTL() time.Duration {
+    if a.IdleTTL.Duration > 0 { return a.IdleTTL.Duration }
+    return 10 * time.Minute
+}
+
+func clamp32(v, lo, hi int32) int32 {
+    if v < lo { return lo }
+    if v > hi { return hi }
+    return v
+}
+
+// autoscale works out the pool size for this pass from the org's task
+// backlog and its agents' idle time, records a decision if it changed,
+// and fills in st.Autoscale. Agents run up to their capacity in tasks, so
+// once tasks wait past scaleUpAfter the backlog is set against the free
+// slots of the live agents, and the pool grows by enough agents to take
+// the rest (assuming new agents get the pool's average capacity). It
+// shrinks by the agents idle past idleTTL while nothing is queued.
+func (r *reconciler) autoscale(org string, pc PoolConfig, members []poolMember, st *PoolStatus) int {
+    as := *pc.Autoscale
+    now := time.Now()
+
+    backlog, waiting := 0, 0
+    var oldest time.Duration
+    tasksMu.RLock()
+    for _, t := range tasks {
+        if t.Org != org || t.Status != "scheduled" { continue }
+        backlog++
+        age := now.Sub(t.CreatedAt)
+        if age >= as.scaleUpAfter() { waiting++ }
+        if age > oldest { oldest = age }
+    }
+    tasksMu.RUnlock()
+    busy, idle, expired := 0, 0, 0
+    slots, free, withSlots := 0, 0, 0
+    for _, m := range members {
+        if m.slots > 0 { withSlots++; slots += m.slots; free += max(m.slots-m.inFlight, 0) }
+        switch {
+        case m.busy:
+            busy++
+        case m.idle:
+            idle++
+            if now.Sub(m.idleSince) >= as.idleTTL() { expired++ }
+        }
+    }
+
+    r.mu.Lock()
+    state := r.scale[org]
+    if state == nil {
+        state = &AutoscaleStatus{Replicas: clamp32(pc.Replicas, as.Min, as.Max)}
+        r.scale[org] = state
+    }
+    from := state.Replicas
+    to, reason := from, ""
+    switch {
+    case from < as.Min || from > as.Max:
+        to, reason = clamp32(from, as.Min, as.Max), fmt.Sprintf("outside autoscale bounds [%d, %d]", as.Min, as.Max)
+    case waiting > 0 && backlog > free && from < as.Max:
+        perAgent := 1
+        if withSlots > 0 { perAgent = max(slots/withSlots, 1) }
+        // agents without a live registration yet (starting) count as
+        // bringing the average capacity
+        starting := max(int(from)-withSlots, 0)
+        more := (backlog - free - starting*perAgent + perAgent - 1) / perAgent
+        if more > 0 {
+            to = clamp32(from+int32(more), as.Min, as.Max)
+            reason = fmt.Sprintf("%d task(s) waiting longer than %s (oldest %s), %d free slot(s)", waiting, as.scaleUpAfter(), oldest.Round(time.Second), free)
+        }
+    case backlog == 0 && expired > 0 && from > as.Min:
+        to = clamp32(from-int32(expired), max(as.Min, int32(busy)), from)
+        if to < from { reason = fmt.Sprintf("%d agent(s) idle longer than %s", expired, as.idleTTL()) }
+    }
+    var decision *ScaleDecision
+    if reason != "" && to != from {
+        decision = &ScaleDecision{Time: now.UTC(), From: from, To: to, Reason: reason, Backlog: backlog, Waiting: waiting, Busy: busy, Idle: idle, Free: free}
+        state.Replicas = to
+        state.Decisions = append(state.Decisions, *decision)
+        if n := len(state.Decisions); n > scaleDecisionHistory { state.Decisions = state.Decisions[n-scaleDecisionHistory:] }
+    }
+    state.Backlog, state.Waiting, state.OldestAge = backlog, waiting, ""
+    if backlog > 0 { state.OldestAge = oldest.Round(time.Second).String() }
+    out := *state
+    out.Decisions = append([]ScaleDecision{}, state.Decisions...)
+    r.mu.Unlock()
+
+    st.Autoscale = &out
+    if decision != nil {
+        log.Printf("pool[%s]: scale %d -> %d: %s", org, decision.From, decision.To, decision.Reason)
+        publishEvent(EventPoolScaled, org, *decision)
+    }
+    return int(out.Replicas)
+}
+
+// taskScheduled arranges a pass for when a new task would count as
+// waiting, so scale-up doesn't depend on the reconcile interval.
+func (r *reconciler) taskScheduled(org string) {
+    pc, ok := poolOrgs()[org]
+    if !ok || pc.Autoscale == nil { return }
+    time.AfterFunc(pc.Autoscale.scaleUpAfter(), r.kick)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestPoolAutoscalesWithBacklogAndIdleTTL(t *testing.T) {
+    newServer()
+    dir := t.TempDir()
+    bin := filepath.Join(dir, "fake-agent")
+    os.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755)
+    pool := &PoolConfig{Replicas: 0, Autoscale: &AutoscaleConfig{Min: 0, Max: 3, ScaleUpAfter: Duration{50 * time.Millisecond}, IdleTTL: Duration{100 * time.Millisecond}}}
+    setConfig(&Config{Orgs: []OrgConfig{{Name: "scale-org", Deployer: backendLocal, Local: LocalDeployerConfig{Binary: bin, WorkDir: dir}, Pool: pool}}})
+    defer setConfig(&Config{})
+    d, _ := deployerFor("scale-org")
+    defer func() {
+        list, _ := d.List(context.Background(), "scale-org")
+        for _, da := range list { d.Stop(context.Background(), da.Name) }
+    }()
+    r := newReconciler()
+    ctx := context.Background()
+    pass := func() PoolStatus {
+        t.Helper()
+        st, err := r.reconcile(ctx, "scale-org", *pool)
+        if err != nil { t.Fatal(err) }
+        return st
+    }
+
+    // scaled to zero with nothing queued
+    if st := pass(); st.Autoscale == nil || st.Autoscale.Replicas != 0 || st.Observed.Agents != 0 { t.Fatalf("expected empty pool: %+v", st) }
+
+    // two tasks waiting past scaleUpAfter bring up two agents
+    tasksMu.Lock()
+    for _, id := range []string{"as-1", "as-2"} {
+        tasks[id] = Task{ID: id, Org: "scale-org", Text: "x", Status: "scheduled", CreatedAt: time.Now().Add(-time.Second)}
+    }
+    tasksMu.Unlock()
+    defer func() { tasksMu.Lock(); delete(tasks, "as-1"); delete(tasks, "as-2"); tasksMu.Unlock() }()
+    st := pass()
+    if st.Autoscale.Replicas != 2 || len(st.Pending) != 2 { t.Fatalf("expected scale up to 2: %+v", st.Autoscale) }
+    if dec := st.Autoscale.Decisions[0]; dec.From != 0 || dec.To != 2 || dec.Waiting != 2 || !strings.Contains(dec.Reason, "waiting longer than 50ms") { t.Fatalf("unexpected decision: %+v", dec) }
+    list := settle(t, r, "scale-org")
+    if len(list) != 2 { t.Fatalf("expected 2 agents, got %d", len(list)) }
+
+    // one agent takes a task, the queue drains, the other idles past the TTL
+    busy := list[0].Name
+    agentsMu.Lock()
+    a := agents[busy+"-0"]; a.Status = "running"; a.markIdle(); agents[a.Name] = a
+    agentsMu.Unlock()
+    tasksMu.Lock()
+    for _, id := range []string{"as-1", "as-2"} { tk := tasks[id]; tk.Status = "done"; tasks[id] = tk }
+    tasksMu.Unlock()
+    time.Sleep(150 * time.Millisecond)
+    st = pass()
+    if st.Autoscale.Replicas != 1 { t.Fatalf("expected scale down to 1: %+v", st.Autoscale) }
+    if list, _ := d.List(ctx, "scale-org"); len(list) != 1 || list[0].Name != busy { t.Fatalf("busy agent must survive scale-down: %+v", list) }
+
+    // once it finishes and idles too, the pool goes to zero
+    agentsMu.Lock()
+    a = agents[busy+"-0"]; a.Status = "idle"; a.markIdle(); agents[a.Name] = a
+    agentsMu.Unlock()
+    time.Sleep(150 * time.Millisecond)
+    st = pass()
+    if st.Autoscale.Replicas != 0 || len(st.Autoscale.Decisions) != 3 { t.Fatalf("expected scale to zero: %+v", st.Autoscale) }
+    if list, _ := d.List(ctx, "scale-org"); len(list) != 0 { t.Fatalf("agents left at zero: %+v", list) }
+    if dec := st.Autoscale.Decisions[2]; !strings.Contains(dec.Reason, "idle longer than 100ms") { t.Fatalf("unexpected reason: %+v", dec) }
+}
+
+func TestAutoscaleConfigParsesDurations(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "orchestrator.yaml")
+    os.WriteFile(path, []byte("orgs:\n  - name: acme\n    pool:\n      replicas: 1\n      autoscale: { min: 0, max: 5, scaleUpAfter: 45s, idleTTL: 15m }\n"), 0o644)
+    cfg, err := loadConfig(path)
+    if err != nil { t.Fatal(err) }
+    as := cfg.Orgs[0].Pool.Autoscale
+    if as.scaleUpAfter() != 45*time.Second || as.idleTTL() != 15*time.Minute || as.Max != 5 { t.Fatalf("unexpected autoscale: %+v", as) }
+    os.WriteFile(path, []byte("orgs:\n  - name: acme\n    pool: { autoscale: { min: 3, max: 2 } }\n"), 0o644)
+    if _, err := loadConfig(path); err == nil { t.Fatal("min > max accepted") }
+}
+
+func TestAutoscaleCountsFreeSlots(t *testing.T) {
+    org := uniq("slots-org")
+    pc := PoolConfig{Replicas: 1, Autoscale: &AutoscaleConfig{Min: 0, Max: 5, ScaleUpAfter: Duration{time.Millisecond}}}
+    var ids []string
+    queue := func(n int) {
+        tasksMu.Lock()
+        for i := 0; i < n; i++ {
+            id := uniq(org + "-t")
+            tasks[id] = Task{ID: id, Org: org, Text: "x", Status: "scheduled", CreatedAt: time.Now().Add(-time.Second)}
+            ids = append(ids, id)
+        }
+        tasksMu.Unlock()
+    }
+    defer func() { tasksMu.Lock(); for _, id := range ids { delete(tasks, id) }; tasksMu.Unlock() }()
+    r := newReconciler()
+    // one agent with four slots, one of them in use
+    members := []poolMember{{busy: true, slots: 4, inFlight: 1}}
+
+    // two waiting tasks fit in its free slots
+    queue(2)
+    var st PoolStatus
+    if n := r.autoscale(org, pc, members, &st); n != 1 || len(st.Autoscale.Decisions) != 0 { t.Fatalf("scaled up with free slots: %d %+v", n, st.Autoscale) }
+
+    // five don't: one more four-slot agent takes the other two
+    queue(3)
+    if n := r.autoscale(org, pc, members, &st); n != 2 { t.Fatalf("replicas=%d, want 2: %+v", n, st.Autoscale) }
+    if dec := st.Autoscale.Decisions[0]; dec.Free != 3 || dec.Backlog != 5 || !strings.Contains(dec.Reason, "3 free slot(s)") { t.Fatalf("unexpected decision: %+v", dec) }
+    // the new agent is still starting: no further scale-up for the same backlog
+    if n := r.autoscale(org, pc, members, &st); n != 2 || len(st.Autoscale.Decisions) != 1 { t.Fatalf("scaled again while starting: %d %+v", n, st.Autoscale) }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Idle agents long-poll /tasks/claim?wait=30s instead of polling every few
+// seconds: the request blocks until a task for the org is scheduled or the
+// wait runs out. Waiters sleep on a per-org channel that /schedule closes,
+// then race to claim under tasksMu, so each task goes to exactly one agent
+// and the rest go back to waiting. An agent is never handed more tasks
+// than it has slots (Agent.Capacity).
+
+// maxClaimWait caps ?wait so a claim stays well inside proxy timeouts.
+const maxClaimWait = 60 * time.Second
+
+type claimSignals struct {
+    mu   sync.Mutex
+    orgs map[string]chan struct{}
+}
+
+var claimWaiters = &claimSignals{orgs: make(map[string]chan struct{})}
+
+// wait returns a channel closed by the next notify for org. Take it before
+// looking for work so a task scheduled in between isn't missed.
+func (c *claimSignals) wait(org string) <-chan struct{} {
+    c.mu.Lock(); defer c.mu.Unlock()
+    ch, ok := c.orgs[org]
+    if !ok {
+        ch = make(chan struct{})
+        c.orgs[org] = ch
+    }
+    return ch
+}
+
+// notify wakes everyone waiting for work in org.
+func (c *claimSignals) notify(org string) {
+    c.mu.Lock(); defer c.mu.Unlock()
+    if ch, ok := c.orgs[org]; ok {
+        close(ch)
+        delete(c.orgs, org)
+    }
+}
+
+// agentCapacity is how many tasks the agent may hold at once.
+func agentCapacity(name string) int {
+    agentsMu.RLock(); defer agentsMu.RUnlock()
+    return max(agents[name].Capacity, 1)
+}
+
+// inFlightTasks counts the tasks each agent holds.
+func inFlightTasks() map[string]int {
+    tasksMu.RLock(); defer tasksMu.RUnlock()
+    held := map[string]int{}
+    for _, t := range tasks {
+        if t.Status == "running" && t.AgentID != "" { held[t.AgentID]++ }
+    }
+    return held
+}
+
+// claimTask hands the agent a scheduled task for org, preferring tasks
+// that hint this agent, unless all of the agent's slots are taken.
+func claimTask(org, agentID string) (Task, bool) {
+    capacity := agentCapacity(agentID)
+    tasksMu.Lock(); defer tasksMu.Unlock()
+    var pick *Task
+    held := 0
+    for _, t := range tasks {
+        if t.Status == "running" && t.AgentID == agentID { held++ }
+    }
+    if held >= capacity { return Task{}, false }
+    for _, t := range tasks {
+        if t.Org != org || t.Status != "scheduled" { continue }
+        if t.AgentHint == agentID { pick = &t; break }
+        if pick == nil { pick = &t }
+    }
+    if pick == nil { return Task{}, false }
+    t := *pick
+    t.Status = "running"; t.AgentID = agentID; tasks[t.ID] = t
+    publishEvent(EventTaskClaimed, t.Org, t)
+    return t, true
+}
+
+// handleClaim serves POST /tasks/claim[?wait=30s] {org, agentId}. With
+// nothing to hand out, or no free slot, it answers {"task": null}, after
+// waiting if asked.
+func handleClaim(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
+    var req struct{ Org, AgentID string }
+    if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+    if req.Org == "" || req.AgentID == "" { http.Error(w, "missing org/agentId", 400); return }
+    if !agentKnown(req.AgentID) { unknownAgent(w, req.AgentID); return }
+    var wait time.Duration
+    if v := r.URL.Query().Get("wait"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil || d < 0 { http.Error(w, "bad wait", 400); return }
+        wait = min(d, maxClaimWait)
+    }
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    for {
+        woken := claimWaiters.wait(req.Org)
+        // don't hand a task to an agent that has gone away
+        if r.Context().Err() != nil { return }
+        if t, ok := claimTask(req.Org, req.AgentID); ok { writeJSON(w, t); return }
+        if wait == 0 { writeJSON(w, map[string]any{"task": nil}); return }
+        select {
+        case <-woken:
+        case <-timer.C:
+            writeJSON(w, map[string]any{"task": nil})
+            return
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
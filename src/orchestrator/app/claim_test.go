@@ -0,0 +1,151 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "sync"
+    "testing"
+    "time"
+)
+
+func claimOver(t *testing.T, url, org, agent, wait string) (Task, time.Duration) {
+    t.Helper()
+    start := time.Now()
+    resp, err := http.Post(url+"/tasks/claim?wait="+wait, "application/json", bytes.NewBufferString(`{"org":"`+org+`","agentId":"`+agent+`"}`))
+    if err != nil { t.Error(err); return Task{}, 0 }
+    defer resp.Body.Close()
+    var got Task
+    json.NewDecoder(resp.Body).Decode(&got)
+    return got, time.Since(start)
+}
+
+// registerOver registers agent so its claims are accepted.
+func registerOver(t *testing.T, url, org, agent string) {
+    t.Helper()
+    resp, err := http.Post(url+"/agents/register", "application/json", bytes.NewBufferString(`{"name":"`+agent+`","org":"`+org+`"}`))
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    t.Cleanup(func() { agentsMu.Lock(); delete(agents, agent); agentsMu.Unlock() })
+}
+
+func TestClaimLongPollWakesOnSchedule(t *testing.T) {
+    os.Unsetenv("ORCHESTRATOR_TOKEN")
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    registerOver(t, srv.URL, "lp-acme", "a1")
+
+    // nothing to do: the claim waits out the timeout
+    if got, took := claimOver(t, srv.URL, "lp-empty", "a1", "200ms"); got.ID != "" || took < 200*time.Millisecond { t.Fatalf("empty claim: %+v after %s", got, took) }
+
+    done := make(chan Task, 1)
+    var took time.Duration
+    go func() { var got Task; got, took = claimOver(t, srv.URL, "lp-acme", "a1", "10s"); done <- got }()
+    time.Sleep(100 * time.Millisecond)
+    scheduled := time.Now()
+    resp, err := http.Post(srv.URL+"/schedule", "application/json", bytes.NewBufferString(`{"org":"lp-acme","task":"wake up"}`))
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    select {
+    case got := <-done:
+        if got.Text != "wake up" || got.AgentID != "a1" || got.Status != "running" { t.Fatalf("claimed %+v", got) }
+        if lat := time.Since(scheduled); lat > 500*time.Millisecond { t.Fatalf("woken after %s", lat) }
+        if took >= 10*time.Second { t.Fatalf("claim took %s", took) }
+        tasksMu.Lock(); delete(tasks, got.ID); tasksMu.Unlock()
+    case <-time.After(5 * time.Second):
+        t.Fatal("claim not woken by /schedule")
+    }
+}
+
+func TestClaimLongPollNoDoubleHandout(t *testing.T) {
+    os.Unsetenv("ORCHESTRATOR_TOKEN")
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+
+    const agents, scheduled = 8, 5
+    for i := 0; i < agents; i++ { registerOver(t, srv.URL, "lp-race", fmt.Sprintf("r%d", i)) }
+    var mu sync.Mutex
+    claimedBy := map[string]string{}
+    var wg sync.WaitGroup
+    for i := 0; i < agents; i++ {
+        wg.Add(1)
+        go func(agent string) {
+            defer wg.Done()
+            got, _ := claimOver(t, srv.URL, "lp-race", agent, "1s")
+            if got.ID == "" { return }
+            mu.Lock(); defer mu.Unlock()
+            if prev, dup := claimedBy[got.ID]; dup { t.Errorf("task %s handed to %s and %s", got.ID, prev, agent) }
+            claimedBy[got.ID] = agent
+        }(fmt.Sprintf("r%d", i))
+    }
+    time.Sleep(100 * time.Millisecond)
+    var ids []string
+    for i := 0; i < scheduled; i++ {
+        tasksMu.Lock()
+        id := fmt.Sprintf("lp-race-%d", i)
+        tasks[id] = Task{ID: id, Org: "lp-race", Text: "t", Status: "scheduled", CreatedAt: time.Now()}
+        tasksMu.Unlock()
+        claimWaiters.notify("lp-race")
+        ids = append(ids, id)
+    }
+    wg.Wait()
+    defer func() { tasksMu.Lock(); for _, id := range ids { delete(tasks, id) }; tasksMu.Unlock() }()
+    if len(claimedBy) != scheduled { t.Fatalf("%d of %d tasks claimed: %v", len(claimedBy), scheduled, claimedBy) }
+    tasksMu.RLock(); defer tasksMu.RUnlock()
+    for _, id := range ids {
+        if tk := tasks[id]; tk.Status != "running" || tk.AgentID != claimedBy[id] { t.Fatalf("task %s: %+v, claimed by %s", id, tk, claimedBy[id]) }
+    }
+}
+
+func TestClaimRespectsAgentCapacity(t *testing.T) {
+    os.Unsetenv("ORCHESTRATOR_TOKEN")
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    post := func(path, body string) {
+        resp, err := http.Post(srv.URL+path, "application/json", bytes.NewBufferString(body))
+        if err != nil { t.Fatal(err) }
+        resp.Body.Close()
+    }
+    post("/agents/register", `{"name":"slots-1","org":"lp-slots","capacity":2}`)
+    var ids []string
+    for i := 0; i < 3; i++ {
+        id := fmt.Sprintf("lp-slots-%d", i)
+        tasksMu.Lock(); tasks[id] = Task{ID: id, Org: "lp-slots", Text: "t", Status: "scheduled", CreatedAt: time.Now()}; tasksMu.Unlock()
+        ids = append(ids, id)
+    }
+    defer func() {
+        tasksMu.Lock(); for _, id := range ids { delete(tasks, id) }; tasksMu.Unlock()
+        agentsMu.Lock(); delete(agents, "slots-1"); agentsMu.Unlock()
+    }()
+
+    first, _ := claimOver(t, srv.URL, "lp-slots", "slots-1", "0s")
+    second, _ := claimOver(t, srv.URL, "lp-slots", "slots-1", "0s")
+    if first.ID == "" || second.ID == "" { t.Fatalf("claims within capacity: %q %q", first.ID, second.ID) }
+    // both slots taken: the third waits for one to free up
+    done := make(chan Task, 1)
+    go func() { got, _ := claimOver(t, srv.URL, "lp-slots", "slots-1", "5s"); done <- got }()
+    select {
+    case got := <-done:
+        t.Fatalf("over-assigned %+v", got)
+    case <-time.After(200 * time.Millisecond):
+    }
+
+    resp, err := http.Get(srv.URL + "/agents")
+    if err != nil { t.Fatal(err) }
+    var listed []Agent
+    json.NewDecoder(resp.Body).Decode(&listed); resp.Body.Close()
+    for _, a := range listed {
+        if a.Name == "slots-1" && (a.Capacity != 2 || a.InFlight != 2) { t.Fatalf("agent %+v", a) }
+    }
+
+    post("/tasks/update", `{"id":"`+first.ID+`","status":"completed"}`)
+    select {
+    case got := <-done:
+        if got.ID == "" || got.ID == first.ID || got.ID == second.ID { t.Fatalf("third claim %+v", got) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("claim not woken when a slot freed")
+    }
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "sigs.k8s.io/yaml"
+)
+
+// Config is the orchestrator configuration file (ORCHESTRATOR_CONFIG).
+// ${VAR} references are expanded from the environment before parsing.
+type Config struct {
+    Listen    string      `json:"listen"`
+    Peers     []string    `json:"peers,omitempty"`
+    Orgs      []OrgConfig `json:"orgs,omitempty"`
+    Dashboard struct {
+        Endpoint string `json:"endpoint"`
+    } `json:"dashboard"`
+    Security struct {
+        Token string `json:"token"`
+    } `json:"security"`
+}
+
+// OrgConfig holds per-org settings.
+type OrgConfig struct {
+    Name    string   `json:"name"`
+    Cluster string   `json:"cluster,omitempty"`
+    Labels  []string `json:"labels,omitempty"`
+    // Deployer selects the agent backend: kubernetes (default), script,
+    // local or docker.
+    Deployer string               `json:"deployer,omitempty"`
+    Local    LocalDeployerConfig  `json:"local,omitempty"`
+    Docker   DockerDeployerConfig `json:"docker,omitempty"`
+    // Pool, if set, is the desired agent pool the reconciler keeps the org at.
+    Pool *PoolConfig `json:"pool,omitempty"`
+    // Manifests overrides the rendered Kubernetes manifests (resources,
+    // node selector, securityContext user, NetworkPolicy peers).
+    Manifests ManifestConfig `json:"manifests,omitempty"`
+}
+
+// PoolConfig declares an org's agents: Replicas agents of Image with Labels
+// and Env. Each agent is its own single-replica deployment; MaxSurge bounds
+// how many extra agents may exist while replacing outdated ones (default 1).
+type PoolConfig struct {
+    Replicas int32             `json:"replicas"`
+    Image    string            `json:"image,omitempty"`
+    Labels   map[string]string `json:"labels,omitempty"`
+    Env      map[string]string `json:"env,omitempty"`
+    MaxSurge *int32            `json:"maxSurge,omitempty"`
+    // Autoscale, if set, makes Replicas only the starting size: the pool
+    // grows with the task backlog and shrinks as agents sit idle.
+    Autoscale *AutoscaleConfig `json:"autoscale,omitempty"`
+}
+
+// AutoscaleConfig bounds queue-driven scaling of a pool. Agents are added
+// when scheduled tasks have waited longer than ScaleUpAfter (default 30s)
+// and removed once idle longer than IdleTTL (default 10m), never going
+// outside [Min, Max]. Min may be zero.
+type AutoscaleConfig struct {
+    Min          int32    `json:"min"`
+    Max          int32    `json:"max"`
+    ScaleUpAfter Duration `json:"scaleUpAfter,omitempty"`
+    IdleTTL      Duration `json:"idleTTL,omitempty"`
+}
+
+// Duration is a time.Duration written as a string ("30s", "10m") in config.
+type Duration struct{ time.Duration }
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil { return fmt.Errorf("duration must be a string like \"30s\"") }
+    v, err := time.ParseDuration(s)
+    if err != nil { return err }
+    d.Duration = v
+    return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+const (
+    backendKubernetes = "kubernetes"
+    backendScript     = "script"
+    backendLocal      = "local"
+    backendDocker     = "docker"
+)
+
+var (
+    configMu  sync.RWMutex
+    orchConfig = &Config{}
+)
+
+// loadConfig reads and validates a config file. A missing path yields an
+// empty config so the orchestrator still runs with env-only settings.
+func loadConfig(path string) (*Config, error) {
+    cfg := &Config{}
+    if path == "" { return cfg, nil }
+    b, err := os.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) { return cfg, nil }
+        return nil, err
+    }
+    if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(b))), cfg); err != nil {
+        return nil, fmt.Errorf("parse %s: %w", path, err)
+    }
+    if err := cfg.validate(); err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+    return cfg, nil
+}
+
+func (c *Config) validate() error {
+    seen := map[string]bool{}
+    for i, o := range c.Orgs {
+        if strings.TrimSpace(o.Name) == "" { return fmt.Errorf("orgs[%d]: missing name", i) }
+        if seen[o.Name] { return fmt.Errorf("orgs[%d]: duplicate org %q", i, o.Name) }
+        seen[o.Name] = true
+        switch o.Deployer {
+        case "", backendKubernetes, backendScript, backendLocal, backendDocker:
+        default:
+            return fmt.Errorf("orgs[%d] (%s): unknown deployer %q", i, o.Name, o.Deployer)
+        }
+        if err := o.Manifests.validate(); err != nil { return fmt.Errorf("orgs[%d] (%s): manifests: %w", i, o.Name, err) }
+        if p := o.Pool; p != nil {
+            if p.Replicas < 0 { return fmt.Errorf("orgs[%d] (%s): pool.replicas must be >= 0", i, o.Name) }
+            if p.MaxSurge != nil && *p.MaxSurge < 0 { return fmt.Errorf("orgs[%d] (%s): pool.maxSurge must be >= 0", i, o.Name) }
+            if a := p.Autoscale; a != nil {
+                if a.Min < 0 || a.Max < 1 || a.Max < a.Min { return fmt.Errorf("orgs[%d] (%s): pool.autoscale needs 0 <= min <= max and max >= 1", i, o.Name) }
+                if a.ScaleUpAfter.Duration < 0 || a.IdleTTL.Duration < 0 { return fmt.Errorf("orgs[%d] (%s): pool.autoscale durations must be positive", i, o.Name) }
+            }
+            if o.Deployer == backendScript { return fmt.Errorf("orgs[%d] (%s): pool needs a deployer that can label agents, not script", i, o.Name) }
+        }
+    }
+    return nil
+}
+
+func setConfig(c *Config) {
+    configMu.Lock(); orchConfig = c; configMu.Unlock()
+}
+
+func currentConfig() *Config {
+    configMu.RLock(); defer configMu.RUnlock()
+    return orchConfig
+}
+
+// orgConfig returns the settings for an org, or a zero value with the name set.
+func orgConfig(org string) OrgConfig {
+    for _, o := range currentConfig().Orgs {
+        if o.Name == org { return o }
+    }
+    return OrgConfig{Name: org}
+}
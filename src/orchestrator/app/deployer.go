@@ -0,0 +1,506 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "time"
+
+    appsv1 "k8s.io/api/apps/v1"
+    corev1 "k8s.io/api/core/v1"
+    networkingv1 "k8s.io/api/networking/v1"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/labels"
+    "k8s.io/client-go/kubernetes"
+    "k8s.io/client-go/tools/clientcmd"
+)
+
+// AgentSpec describes an agent deployment independent of where it runs.
+type AgentSpec struct {
+    Org               string            `json:"org"`
+    Name              string            `json:"name,omitempty"` // generated as agent-<org>-<unix>-<random> if empty
+    Image             string            `json:"image"`
+    Replicas          int32             `json:"replicas"`
+    OrchestratorURL   string            `json:"orchestratorUrl"`
+    OrchestratorToken string            `json:"-"`
+    Labels            map[string]string `json:"labels,omitempty"`
+    Env               map[string]string `json:"env,omitempty"`
+}
+
+// DeployedResource is one object a deployer created or updated.
+type DeployedResource struct {
+    Kind      string `json:"kind"`
+    Name      string `json:"name"`
+    Namespace string `json:"namespace,omitempty"`
+    Action    string `json:"action"` // created | updated | unchanged
+}
+
+// DeployResult is the structured outcome of a deployment.
+type DeployResult struct {
+    Backend   string             `json:"backend"`
+    Org       string             `json:"org"`
+    Name      string             `json:"name"`
+    Namespace string             `json:"namespace,omitempty"`
+    Image     string             `json:"image"`
+    Resources []DeployedResource `json:"resources"`
+}
+
+// DeployedAgent is a deployment as seen by its backend. Instances are the
+// pod, container or process names, which agents register under.
+type DeployedAgent struct {
+    Name      string            `json:"name"`
+    Org       string            `json:"org"`
+    Backend   string            `json:"backend"`
+    Namespace string            `json:"namespace,omitempty"`
+    Image     string            `json:"image"`
+    Replicas  int32             `json:"replicas"`
+    Ready     int32             `json:"ready"`
+    Status    string            `json:"status"` // running | starting | stopped
+    Instances []string          `json:"instances,omitempty"`
+    Labels    map[string]string `json:"labels,omitempty"`
+    CreatedAt time.Time         `json:"createdAt"`
+}
+
+// Deployer creates and manages agents for an org. Deploy reports progress
+// to out, which ends up in the operation log. Scale sets the replica count
+// (zero keeps the deployment around); Stop removes a deployment and all of
+// its replicas.
+type Deployer interface {
+    Deploy(ctx context.Context, spec AgentSpec, out io.Writer) (DeployResult, error)
+    List(ctx context.Context, org string) ([]DeployedAgent, error)
+    Scale(ctx context.Context, name string, replicas int32) error
+    Stop(ctx context.Context, name string) error
+    Logs(ctx context.Context, name string, tail int) (string, error)
+}
+
+var (
+    errDeploymentNotFound = errors.New("deployment not found")
+    errNotSupported       = errors.New("not supported by this deployer")
+    errInvalidOrg         = errors.New("invalid org")
+)
+
+func deployedStatus(ready, replicas int32) string {
+    switch {
+    case replicas == 0:
+        return "stopped"
+    case ready >= replicas:
+        return "running"
+    default:
+        return "starting"
+    }
+}
+
+// Labels put on everything the orchestrator deploys so it can find its own
+// objects again.
+const (
+    labelManagedBy  = "app.kubernetes.io/managed-by"
+    labelName       = "app.kubernetes.io/name"
+    labelInstance   = "app.kubernetes.io/instance"
+    labelOrg        = "mvp.agents/org"
+    labelPool       = "mvp.agents/pool"      // set on agents the reconciler owns (see pools.go)
+    labelPoolHash   = "mvp.agents/pool-hash" // hash of the pool template they were created from
+    managedByValue  = "mvp-orchestrator"
+    agentNamespace  = "mvp-agents"
+    agentEditorPort = 8443
+)
+
+// normalize fills defaults shared by all backends.
+func (s AgentSpec) normalize() AgentSpec {
+    s.Org = strings.TrimSpace(s.Org)
+    s.Image = strings.TrimSpace(s.Image)
+    if s.Image == "" { s.Image = "mvp-agent:latest" }
+    // the random part keeps two deploys in the same second apart
+    if s.Name == "" { s.Name = fmt.Sprintf("agent-%s-%d-%s", s.Org, time.Now().Unix(), newID()[:4]) }
+    if s.Replicas <= 0 { s.Replicas = 1 }
+    if s.OrchestratorURL == "" {
+        s.OrchestratorURL = os.Getenv("PUBLIC_ORCHESTRATOR_URL")
+        if s.OrchestratorURL == "" { s.OrchestratorURL = "http://orchestrator.tailnet:18080" }
+    }
+    if s.OrchestratorToken == "" { s.OrchestratorToken = os.Getenv("ORCHESTRATOR_TOKEN") }
+    return s
+}
+
+func (s AgentSpec) ownerLabels() map[string]string {
+    l := map[string]string{}
+    for k, v := range s.Labels { l[k] = v }
+    l["app"] = s.Name
+    l[labelManagedBy] = managedByValue
+    l[labelName] = "mvp-agent"
+    l[labelInstance] = s.Name
+    l[labelOrg] = s.Org
+    return l
+}
+
+// envWithDefault reads an env var with a fallback, matching the script's defaults.
+func envWithDefault(key, def string) string {
+    if v := os.Getenv(key); v != "" { return v }
+    return def
+}
+
+// k8sDeployer creates agents with client-go in a per-org cluster.
+type k8sDeployer struct {
+    client    kubernetes.Interface
+    namespace string
+    // manifests and orgLabels feed renderAgentManifests (see manifests.go).
+    manifests ManifestConfig
+    orgLabels []string
+}
+
+func newK8sDeployer(client kubernetes.Interface, namespace string) *k8sDeployer {
+    if namespace == "" { namespace = agentNamespace }
+    return &k8sDeployer{client: client, namespace: namespace}
+}
+
+// orgKubeconfig returns the kubeconfig path for an org, preferring the
+// shared state dir over ~/.kube like deploy_agent_talos.sh does.
+func orgKubeconfig(org string) (string, error) {
+    home := os.Getenv("HOME"); if home == "" { home = "/root" }
+    for _, p := range []string{"/state/kube/" + org + ".config", home + "/.kube/" + org + ".config"} {
+        if _, err := os.Stat(p); err == nil { return p, nil }
+    }
+    return "", fmt.Errorf("no kubeconfig for org %s (checked /state/kube and %s/.kube)", org, home)
+}
+
+// k8sDeployerForOrg builds a deployer from the org's kubeconfig.
+func k8sDeployerForOrg(org string) (*k8sDeployer, error) {
+    path, err := orgKubeconfig(org)
+    if err != nil { return nil, err }
+    cfg, err := clientcmd.BuildConfigFromFlags("", path)
+    if err != nil { return nil, fmt.Errorf("load kubeconfig %s: %w", path, err) }
+    client, err := kubernetes.NewForConfig(cfg)
+    if err != nil { return nil, err }
+    d := newK8sDeployer(client, agentNamespace)
+    oc := orgConfig(org)
+    d.manifests, d.orgLabels = oc.Manifests, oc.Labels
+    return d, nil
+}
+
+func (d *k8sDeployer) Deploy(ctx context.Context, spec AgentSpec, out io.Writer) (DeployResult, error) {
+    spec = spec.normalize()
+    res := DeployResult{Backend: backendKubernetes, Org: spec.Org, Name: spec.Name, Namespace: d.namespace, Image: spec.Image, Resources: []DeployedResource{}}
+    record := func(kind, name, ns, action string) {
+        res.Resources = append(res.Resources, DeployedResource{Kind: kind, Name: name, Namespace: ns, Action: action})
+        fmt.Fprintf(out, "%s %s/%s\n", action, strings.ToLower(kind), name)
+    }
+    m, err := renderAgentManifests(spec, d.namespace, d.manifests, d.orgLabels, false)
+    if err != nil { return res, fmt.Errorf("render manifests: %w", err) }
+    fmt.Fprintf(out, "rendered manifests %s\n", m.Version)
+
+    // Namespace
+    ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: d.namespace}}
+    if _, err := d.client.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err == nil {
+        record("Namespace", d.namespace, "", "created")
+    } else if apierrors.IsAlreadyExists(err) {
+        record("Namespace", d.namespace, "", "unchanged")
+    } else {
+        return res, fmt.Errorf("create namespace %s: %w", d.namespace, err)
+    }
+
+    // the workload first so the rest can be owned by it and
+    // garbage-collected together
+    owner := []metav1.OwnerReference{}
+    kind, other := "Deployment", "StatefulSet"
+    if m.StatefulSet != nil {
+        kind, other = other, kind
+        action, err := applyStatefulSet(ctx, d.client, m.StatefulSet)
+        if err != nil { return res, fmt.Errorf("apply statefulset %s: %w", spec.Name, err) }
+        record(kind, spec.Name, d.namespace, action)
+        if cur, err := d.client.AppsV1().StatefulSets(d.namespace).Get(ctx, spec.Name, metav1.GetOptions{}); err == nil {
+            owner = append(owner, metav1.OwnerReference{APIVersion: "apps/v1", Kind: kind, Name: cur.Name, UID: cur.UID})
+        }
+    } else {
+        action, err := applyDeployment(ctx, d.client, m.Deployment)
+        if err != nil { return res, fmt.Errorf("apply deployment %s: %w", spec.Name, err) }
+        record(kind, spec.Name, d.namespace, action)
+        if cur, err := d.client.AppsV1().Deployments(d.namespace).Get(ctx, spec.Name, metav1.GetOptions{}); err == nil {
+            owner = append(owner, metav1.OwnerReference{APIVersion: "apps/v1", Kind: kind, Name: cur.Name, UID: cur.UID})
+        }
+    }
+    var action string
+
+    m.Secret.OwnerReferences = owner
+    if action, err = applySecret(ctx, d.client, m.Secret); err != nil { return res, fmt.Errorf("apply secret %s: %w", m.Secret.Name, err) }
+    record("Secret", m.Secret.Name, d.namespace, action)
+
+    m.Service.OwnerReferences = owner
+    if action, err = applyService(ctx, d.client, m.Service); err != nil { return res, fmt.Errorf("apply service %s: %w", m.Service.Name, err) }
+    record("Service", m.Service.Name, d.namespace, action)
+
+    if np := m.NetworkPolicy; np != nil {
+        np.OwnerReferences = owner
+        if action, err = applyNetworkPolicy(ctx, d.client, np); err != nil { return res, fmt.Errorf("apply networkpolicy %s: %w", np.Name, err) }
+        record("NetworkPolicy", np.Name, d.namespace, action)
+    }
+
+    // an agent moving between manifest versions leaves the other kind of
+    // workload behind; it goes once nothing it owned depends on it
+    if err := d.deleteWorkload(ctx, other, spec.Name); err == nil {
+        record(other, spec.Name, d.namespace, "deleted")
+    } else if err != errDeploymentNotFound {
+        return res, fmt.Errorf("delete %s %s: %w", strings.ToLower(other), spec.Name, err)
+    }
+    return res, nil
+}
+
+func (d *k8sDeployer) List(ctx context.Context, org string) ([]DeployedAgent, error) {
+    set := labels.Set{labelManagedBy: managedByValue}
+    if org != "" { set[labelOrg] = org }
+    // org comes from the request; it must be a valid label value, not
+    // more selector syntax
+    selector, err := labels.ValidatedSelectorFromSet(set)
+    if err != nil { return nil, fmt.Errorf("%w %q: %v", errInvalidOrg, org, err) }
+    sel := selector.String()
+    deps, err := d.client.AppsV1().Deployments(d.namespace).List(ctx, metav1.ListOptions{LabelSelector: sel})
+    if err != nil { return nil, err }
+    sets, err := d.client.AppsV1().StatefulSets(d.namespace).List(ctx, metav1.ListOptions{LabelSelector: sel})
+    if err != nil { return nil, err }
+    pods, err := d.client.CoreV1().Pods(d.namespace).List(ctx, metav1.ListOptions{LabelSelector: sel})
+    if err != nil { return nil, err }
+    out := make([]DeployedAgent, 0, len(deps.Items)+len(sets.Items))
+    add := func(meta metav1.ObjectMeta, replicas *int32, ready int32, pod corev1.PodSpec) {
+        da := DeployedAgent{
+            Name: meta.Name, Org: meta.Labels[labelOrg], Backend: backendKubernetes, Namespace: meta.Namespace,
+            Ready: ready, Labels: meta.Labels, CreatedAt: meta.CreationTimestamp.UTC(),
+        }
+        if replicas != nil { da.Replicas = *replicas }
+        if cs := pod.Containers; len(cs) > 0 { da.Image = cs[0].Image }
+        for _, p := range pods.Items {
+            if p.Labels[labelInstance] == meta.Name { da.Instances = append(da.Instances, p.Name) }
+        }
+        da.Status = deployedStatus(da.Ready, da.Replicas)
+        out = append(out, da)
+    }
+    for _, dep := range deps.Items { add(dep.ObjectMeta, dep.Spec.Replicas, dep.Status.ReadyReplicas, dep.Spec.Template.Spec) }
+    for _, set := range sets.Items { add(set.ObjectMeta, set.Spec.Replicas, set.Status.ReadyReplicas, set.Spec.Template.Spec) }
+    return out, nil
+}
+
+func (d *k8sDeployer) Scale(ctx context.Context, name string, replicas int32) error {
+    if replicas < 0 { return fmt.Errorf("replicas must be >= 0") }
+    sets := d.client.AppsV1().StatefulSets(d.namespace)
+    set, err := sets.Get(ctx, name, metav1.GetOptions{})
+    if err == nil && set.Labels[labelManagedBy] == managedByValue {
+        set.Spec.Replicas = &replicas
+        _, err = sets.Update(ctx, set, metav1.UpdateOptions{})
+        return err
+    }
+    if err != nil && !apierrors.IsNotFound(err) { return err }
+    api := d.client.AppsV1().Deployments(d.namespace)
+    dep, err := api.Get(ctx, name, metav1.GetOptions{})
+    if apierrors.IsNotFound(err) || (err == nil && dep.Labels[labelManagedBy] != managedByValue) { return errDeploymentNotFound }
+    if err != nil { return err }
+    dep.Spec.Replicas = &replicas
+    _, err = api.Update(ctx, dep, metav1.UpdateOptions{})
+    return err
+}
+
+// deleteWorkload deletes the StatefulSet or Deployment called name, if
+// this orchestrator created it; errDeploymentNotFound otherwise.
+func (d *k8sDeployer) deleteWorkload(ctx context.Context, kind, name string) error {
+    var meta metav1.ObjectMeta
+    var del func(metav1.DeleteOptions) error
+    switch kind {
+    case "StatefulSet":
+        api := d.client.AppsV1().StatefulSets(d.namespace)
+        set, err := api.Get(ctx, name, metav1.GetOptions{})
+        if apierrors.IsNotFound(err) { return errDeploymentNotFound }
+        if err != nil { return err }
+        meta, del = set.ObjectMeta, func(o metav1.DeleteOptions) error { return api.Delete(ctx, name, o) }
+    default:
+        api := d.client.AppsV1().Deployments(d.namespace)
+        dep, err := api.Get(ctx, name, metav1.GetOptions{})
+        if apierrors.IsNotFound(err) { return errDeploymentNotFound }
+        if err != nil { return err }
+        meta, del = dep.ObjectMeta, func(o metav1.DeleteOptions) error { return api.Delete(ctx, name, o) }
+    }
+    if meta.Labels[labelManagedBy] != managedByValue { return errDeploymentNotFound }
+    policy := metav1.DeletePropagationForeground
+    // the UID precondition keeps a workload recreated meanwhile safe
+    err := del(metav1.DeleteOptions{PropagationPolicy: &policy, Preconditions: &metav1.Preconditions{UID: &meta.UID}})
+    if apierrors.IsNotFound(err) { return errDeploymentNotFound }
+    return err
+}
+
+// Stop deletes the StatefulSet or Deployment; its Secret, Service and
+// NetworkPolicy go with it through owner references, but are deleted
+// explicitly too in case GC is slow. Like Scale it only touches workloads
+// this orchestrator created.
+func (d *k8sDeployer) Stop(ctx context.Context, name string) error {
+    err := d.deleteWorkload(ctx, "StatefulSet", name)
+    if err == errDeploymentNotFound { err = d.deleteWorkload(ctx, "Deployment", name) }
+    if err != nil { return err }
+    if err := d.client.CoreV1().Services(d.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) { return err }
+    if err := d.client.CoreV1().Secrets(d.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) { return err }
+    if err := d.client.NetworkingV1().NetworkPolicies(d.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) { return err }
+    return nil
+}
+
+func (d *k8sDeployer) Logs(ctx context.Context, name string, tail int) (string, error) {
+    pods, err := d.client.CoreV1().Pods(d.namespace).List(ctx, metav1.ListOptions{LabelSelector: labelInstance + "=" + name})
+    if err != nil { return "", err }
+    if len(pods.Items) == 0 { return "", errDeploymentNotFound }
+    var b strings.Builder
+    for _, p := range pods.Items {
+        opts := &corev1.PodLogOptions{Container: "agent"}
+        if tail > 0 { n := int64(tail); opts.TailLines = &n }
+        raw, err := d.client.CoreV1().Pods(d.namespace).GetLogs(p.Name, opts).DoRaw(ctx)
+        if err != nil { return "", fmt.Errorf("logs %s: %w", p.Name, err) }
+        for _, ln := range strings.SplitAfter(string(raw), "\n") {
+            if ln != "" { b.WriteString(p.Name + " | " + ln) }
+        }
+    }
+    return b.String(), nil
+}
+
+func applyDeployment(ctx context.Context, c kubernetes.Interface, obj *appsv1.Deployment) (string, error) {
+    api := c.AppsV1().Deployments(obj.Namespace)
+    if _, err := api.Create(ctx, obj, metav1.CreateOptions{}); err == nil {
+        return "created", nil
+    } else if !apierrors.IsAlreadyExists(err) {
+        return "", err
+    }
+    cur, err := api.Get(ctx, obj.Name, metav1.GetOptions{})
+    if err != nil { return "", err }
+    obj.ResourceVersion = cur.ResourceVersion
+    _, err = api.Update(ctx, obj, metav1.UpdateOptions{})
+    return "updated", err
+}
+
+func applyStatefulSet(ctx context.Context, c kubernetes.Interface, obj *appsv1.StatefulSet) (string, error) {
+    api := c.AppsV1().StatefulSets(obj.Namespace)
+    if _, err := api.Create(ctx, obj, metav1.CreateOptions{}); err == nil {
+        return "created", nil
+    } else if !apierrors.IsAlreadyExists(err) {
+        return "", err
+    }
+    cur, err := api.Get(ctx, obj.Name, metav1.GetOptions{})
+    if err != nil { return "", err }
+    obj.ResourceVersion = cur.ResourceVersion
+    _, err = api.Update(ctx, obj, metav1.UpdateOptions{})
+    return "updated", err
+}
+
+func applySecret(ctx context.Context, c kubernetes.Interface, obj *corev1.Secret) (string, error) {
+    api := c.CoreV1().Secrets(obj.Namespace)
+    if _, err := api.Create(ctx, obj, metav1.CreateOptions{}); err == nil {
+        return "created", nil
+    } else if !apierrors.IsAlreadyExists(err) {
+        return "", err
+    }
+    cur, err := api.Get(ctx, obj.Name, metav1.GetOptions{})
+    if err != nil { return "", err }
+    obj.ResourceVersion = cur.ResourceVersion
+    _, err = api.Update(ctx, obj, metav1.UpdateOptions{})
+    return "updated", err
+}
+
+func applyService(ctx context.Context, c kubernetes.Interface, obj *corev1.Service) (string, error) {
+    api := c.CoreV1().Services(obj.Namespace)
+    if _, err := api.Create(ctx, obj, metav1.CreateOptions{}); err == nil {
+        return "created", nil
+    } else if !apierrors.IsAlreadyExists(err) {
+        return "", err
+    }
+    cur, err := api.Get(ctx, obj.Name, metav1.GetOptions{})
+    if err != nil { return "", err }
+    obj.ResourceVersion = cur.ResourceVersion
+    // ClusterIP is immutable once assigned
+    obj.Spec.ClusterIP = cur.Spec.ClusterIP
+    _, err = api.Update(ctx, obj, metav1.UpdateOptions{})
+    return "updated", err
+}
+
+func applyNetworkPolicy(ctx context.Context, c kubernetes.Interface, obj *networkingv1.NetworkPolicy) (string, error) {
+    api := c.NetworkingV1().NetworkPolicies(obj.Namespace)
+    if _, err := api.Create(ctx, obj, metav1.CreateOptions{}); err == nil {
+        return "created", nil
+    } else if !apierrors.IsAlreadyExists(err) {
+        return "", err
+    }
+    cur, err := api.Get(ctx, obj.Name, metav1.GetOptions{})
+    if err != nil { return "", err }
+    obj.ResourceVersion = cur.ResourceVersion
+    _, err = api.Update(ctx, obj, metav1.UpdateOptions{})
+    return "updated", err
+}
+
+// scriptDeployer runs deploy_agent_talos.sh; kept as a fallback while
+// clusters move to the native deployer (AGENT_DEPLOYER=script). The script
+// puts the same owner labels on its objects, so everything but Deploy goes
+// through client-go against the org's cluster.
+type scriptDeployer struct{ script, org string }
+
+func (d scriptDeployer) native() (*k8sDeployer, error) { return k8sDeployerForOrg(d.org) }
+
+func (d scriptDeployer) List(ctx context.Context, org string) ([]DeployedAgent, error) {
+    k, err := d.native()
+    if err != nil { return nil, err }
+    return k.List(ctx, org)
+}
+
+func (d scriptDeployer) Scale(ctx context.Context, name string, replicas int32) error {
+    k, err := d.native()
+    if err != nil { return err }
+    return k.Scale(ctx, name, replicas)
+}
+
+func (d scriptDeployer) Stop(ctx context.Context, name string) error {
+    k, err := d.native()
+    if err != nil { return err }
+    return k.Stop(ctx, name)
+}
+
+func (d scriptDeployer) Logs(ctx context.Context, name string, tail int) (string, error) {
+    k, err := d.native()
+    if err != nil { return "", err }
+    return k.Logs(ctx, name, tail)
+}
+
+func (d scriptDeployer) Deploy(ctx context.Context, spec AgentSpec, out io.Writer) (DeployResult, error) {
+    spec = spec.normalize()
+    res := DeployResult{Backend: backendScript, Org: spec.Org, Image: spec.Image, Namespace: agentNamespace, Resources: []DeployedResource{}}
+    env := append(os.Environ(),
+        "ORCHESTRATOR_URL="+spec.OrchestratorURL,
+        "ORCHESTRATOR_TOKEN="+spec.OrchestratorToken,
+    )
+    // If kubeconfig is available in shared state, pass it
+    if kcfg, err := orgKubeconfig(spec.Org); err == nil { env = append(env, "KUBECONFIG="+kcfg) }
+    return res, runCommand(ctx, out, "bash", []string{d.script, spec.Org, spec.Image}, env)
+}
+
+// deployerFor picks the backend for an org from its `deployer` config
+// setting, falling back to AGENT_DEPLOYER and then the native Kubernetes
+// deployer.
+func deployerFor(org string) (Deployer, error) {
+    oc := orgConfig(org)
+    backend := oc.Deployer
+    if backend == "" { backend = os.Getenv("AGENT_DEPLOYER") }
+    switch backend {
+    case "", backendKubernetes:
+        return k8sDeployerForOrg(org)
+    case backendScript:
+        // Resolve script path relative to repository root in container
+        root := os.Getenv("WORKSPACE_DIR"); if root == "" { root = "/workspace" }
+        script := root + "/scripts/deploy_agent_talos.sh"
+        if _, err := os.Stat(script); err != nil { return nil, fmt.Errorf("deploy script not found") }
+        return scriptDeployer{script: script, org: org}, nil
+    case backendLocal:
+        return localDeployerFor(oc.Local), nil
+    case backendDocker:
+        return newDockerDeployer(oc.Docker)
+    default:
+        return nil, fmt.Errorf("unknown deployer %q for org %s", backend, org)
+    }
+}
+
+// deployAgentOp wraps a deployer as an operation.
+func deployAgentOp(d Deployer, spec AgentSpec) opFunc {
+    return func(ctx context.Context, out io.Writer) (any, error) {
+        res, err := d.Deploy(ctx, spec, out)
+        return res, err
+    }
+}
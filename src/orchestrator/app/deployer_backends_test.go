@@ -0,0 +1,292 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    appsv1 "k8s.io/api/apps/v1"
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLocalDeployerSupervisesProcesses(t *testing.T) {
+    dir := t.TempDir()
+    bin := filepath.Join(dir, "fake-agent")
+    // exits immediately on first run so the supervisor has to restart it
+    script := "#!/bin/sh\necho \"hello from $AGENT_NAME org=$ORG_NAME\"\n[ -f started ] || { touch started; exit 1; }\nsleep 30\n"
+    if err := os.WriteFile(bin, []byte(script), 0o755); err != nil { t.Fatal(err) }
+    d := &localDeployer{cfg: LocalDeployerConfig{Binary: bin, WorkDir: filepath.Join(dir, "ws"), OrchestratorURL: "http://127.0.0.1:1"}, agents: map[string]*localAgent{}}
+
+    ctx := context.Background()
+    res, err := d.Deploy(ctx, AgentSpec{Org: "acme", Name: "agent-local", Replicas: 2}, &bytes.Buffer{})
+    if err != nil { t.Fatal(err) }
+    if res.Backend != backendLocal || len(res.Resources) != 2 || res.Resources[1].Name != "agent-local-1" { t.Fatalf("unexpected result: %+v", res) }
+    if _, err := d.Deploy(ctx, AgentSpec{Org: "acme", Name: "agent-local"}, &bytes.Buffer{}); err == nil { t.Fatal("duplicate deploy should fail") }
+
+    var list []DeployedAgent
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        list, _ = d.List(ctx, "acme")
+        logs, _ := d.Logs(ctx, "agent-local", 0)
+        if len(list) == 1 && list[0].Ready == 2 && strings.Count(logs, "hello from") >= 3 { break }
+        time.Sleep(50 * time.Millisecond)
+    }
+    if len(list) != 1 || list[0].Status != "running" || len(list[0].Instances) != 2 { t.Fatalf("unexpected list: %+v", list) }
+    logs, _ := d.Logs(ctx, "agent-local", 0)
+    if !strings.Contains(logs, "agent-local-0 | hello from agent-local-0 org=acme") || !strings.Contains(logs, "restarting") { t.Fatalf("unexpected logs:\n%s", logs) }
+    if other, _ := d.List(ctx, "devrel"); len(other) != 0 { t.Fatalf("org filter ignored: %+v", other) }
+
+    if err := d.Stop(ctx, "agent-local"); err != nil { t.Fatal(err) }
+    if err := d.Stop(ctx, "agent-local"); err != errDeploymentNotFound { t.Fatalf("second stop: %v", err) }
+}
+
+func TestLocalDeployerReplicaState(t *testing.T) {
+    dir := t.TempDir()
+    bin := filepath.Join(dir, "fake-agent")
+    // opens its outbox the way the agent does: the id is made once and kept
+    script := `#!/bin/sh
+mkdir -p "$AGENT_STATE_DIR/outbox"
+[ -f "$AGENT_STATE_DIR/outbox/id" ] || echo "$AGENT_NAME" > "$AGENT_STATE_DIR/outbox/id"
+echo "outbox $(cat "$AGENT_STATE_DIR/outbox/id") in $AGENT_STATE_DIR"
+echo "workspace $AGENT_WORKSPACE"
+sleep 30
+`
+    if err := os.WriteFile(bin, []byte(script), 0o755); err != nil { t.Fatal(err) }
+    work := filepath.Join(dir, "work")
+    d := &localDeployer{cfg: LocalDeployerConfig{Binary: bin, WorkDir: work, OrchestratorURL: "http://127.0.0.1:1"}, agents: map[string]*localAgent{}}
+    ctx := context.Background()
+    if _, err := d.Deploy(ctx, AgentSpec{Org: "acme", Name: "agent-state", Replicas: 2}, &bytes.Buffer{}); err != nil { t.Fatal(err) }
+    defer d.Stop(ctx, "agent-state")
+
+    var logs string
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if logs, _ = d.Logs(ctx, "agent-state", 0); strings.Count(logs, "workspace ") == 2 { break }
+        time.Sleep(50 * time.Millisecond)
+    }
+    // two outboxes, one per replica, neither taking over the other's
+    for _, p := range []string{"agent-state-0", "agent-state-1"} {
+        state := filepath.Join(work, p, "state")
+        if !strings.Contains(logs, p+" | outbox "+p+" in "+state) { t.Fatalf("%s state:\n%s", p, logs) }
+        ws := filepath.Join(work, p, "workspace")
+        if fi, err := os.Stat(ws); err != nil || !fi.IsDir() || !strings.Contains(logs, p+" | workspace "+ws) { t.Fatalf("%s workspace:\n%s", p, logs) }
+        if b, err := os.ReadFile(filepath.Join(state, "outbox", "id")); err != nil || strings.TrimSpace(string(b)) != p { t.Fatalf("%s outbox id: %q %v", p, b, err) }
+    }
+}
+
+// fakeDockerEngine implements the few Engine API calls the deployer uses.
+type fakeDockerEngine struct {
+    mu         sync.Mutex
+    containers map[string]dockerContainer
+    env        map[string][]string
+    // volumes holds the labels of each named volume
+    volumes    map[string]map[string]string
+    mounts     map[string]string
+    pulled     []string
+}
+
+func (f *fakeDockerEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock(); defer f.mu.Unlock()
+    path := strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion)
+    switch {
+    case r.Method == "POST" && path == "/containers/create":
+        var body struct {
+            Image      string
+            Env        []string
+            Labels     map[string]string
+            HostConfig struct {
+                Mounts []struct {
+                    Type, Source, Target string
+                    VolumeOptions        struct{ Labels map[string]string }
+                }
+            }
+        }
+        json.NewDecoder(r.Body).Decode(&body)
+        if len(f.pulled) == 0 {
+            w.WriteHeader(404); json.NewEncoder(w).Encode(map[string]string{"message": "No such image: " + body.Image}); return
+        }
+        id := "c" + r.URL.Query().Get("name")
+        f.containers[id] = dockerContainer{ID: id, Names: []string{"/" + r.URL.Query().Get("name")}, Image: body.Image, State: "created", Created: time.Now().Unix(), Labels: body.Labels}
+        f.env[id] = body.Env
+        for _, m := range body.HostConfig.Mounts {
+            f.mounts[id] = m.Type + ":" + m.Source + ":" + m.Target
+            if _, ok := f.volumes[m.Source]; !ok { f.volumes[m.Source] = m.VolumeOptions.Labels }
+        }
+        json.NewEncoder(w).Encode(map[string]string{"Id": id})
+    case r.Method == "POST" && path == "/images/create":
+        f.pulled = append(f.pulled, r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag"))
+    case r.Method == "POST" && strings.HasSuffix(path, "/stop"):
+        id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/stop")
+        c := f.containers[id]; c.State = "exited"; f.containers[id] = c
+        w.WriteHeader(204)
+    case r.Method == "GET" && strings.HasSuffix(path, "/json") && strings.HasPrefix(path, "/containers/c"):
+        id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")
+        c := f.containers[id]
+        json.NewEncoder(w).Encode(map[string]any{"Config": map[string]any{"Image": c.Image, "Env": f.env[id], "Labels": c.Labels}})
+    case r.Method == "POST" && strings.HasSuffix(path, "/start"):
+        id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/start")
+        c := f.containers[id]; c.State = "running"; f.containers[id] = c
+        w.WriteHeader(204)
+    case r.Method == "GET" && path == "/containers/json":
+        var filters map[string][]string
+        json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+        out := []dockerContainer{}
+        for _, c := range f.containers {
+            ok := true
+            for _, l := range filters["label"] {
+                kv := strings.SplitN(l, "=", 2)
+                if c.Labels[kv[0]] != kv[1] { ok = false }
+            }
+            if ok { out = append(out, c) }
+        }
+        json.NewEncoder(w).Encode(out)
+    case r.Method == "GET" && strings.HasSuffix(path, "/logs"):
+        msg := []byte("agent started\n")
+        hdr := make([]byte, 8); hdr[0] = 1
+        binary.BigEndian.PutUint32(hdr[4:], uint32(len(msg)))
+        w.Write(append(hdr, msg...))
+    case r.Method == "DELETE" && strings.HasPrefix(path, "/containers/"):
+        delete(f.containers, strings.TrimPrefix(path, "/containers/"))
+        w.WriteHeader(204)
+    case r.Method == "GET" && path == "/volumes":
+        var filters map[string][]string
+        json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+        out := []map[string]string{}
+        for name, labels := range f.volumes {
+            ok := true
+            for _, l := range filters["label"] {
+                kv := strings.SplitN(l, "=", 2)
+                if labels[kv[0]] != kv[1] { ok = false }
+            }
+            if ok { out = append(out, map[string]string{"Name": name}) }
+        }
+        json.NewEncoder(w).Encode(map[string]any{"Volumes": out})
+    case r.Method == "DELETE" && strings.HasPrefix(path, "/volumes/"):
+        delete(f.volumes, strings.TrimPrefix(path, "/volumes/"))
+        w.WriteHeader(204)
+    default:
+        http.Error(w, "unexpected "+r.Method+" "+path, 500)
+    }
+}
+
+func TestDockerDeployerAgainstEngineAPI(t *testing.T) {
+    engine := &fakeDockerEngine{containers: map[string]dockerContainer{}, env: map[string][]string{}, volumes: map[string]map[string]string{}, mounts: map[string]string{}}
+    srv := httptest.NewServer(engine)
+    defer srv.Close()
+    d, err := newDockerDeployer(DockerDeployerConfig{Host: "tcp://" + strings.TrimPrefix(srv.URL, "http://"), Network: "mvp"})
+    if err != nil { t.Fatal(err) }
+    ctx := context.Background()
+    var out bytes.Buffer
+    res, err := d.Deploy(ctx, AgentSpec{Org: "acme", Name: "agent-dock", Image: "mvp-agent:dev", Replicas: 2, OrchestratorToken: "tok"}, &out)
+    if err != nil { t.Fatal(err) }
+    if len(res.Resources) != 2 || engine.pulled[0] != "mvp-agent:dev" { t.Fatalf("unexpected result %+v pulled=%v", res, engine.pulled) }
+    env := strings.Join(engine.env["cagent-dock-1"], " ")
+    if !strings.Contains(env, "AGENT_NAME=agent-dock-1") || !strings.Contains(env, "ORCHESTRATOR_URL=http://mvp-orchestrator:8080") { t.Fatalf("unexpected env: %s", env) }
+    // each replica keeps /state on its own named volume
+    if m := engine.mounts["cagent-dock-1"]; m != "volume:agent-dock-1-state:/state" { t.Fatalf("state mount: %q", m) }
+
+    list, err := d.List(ctx, "acme")
+    if err != nil { t.Fatal(err) }
+    if len(list) != 1 || list[0].Replicas != 2 || list[0].Ready != 2 || list[0].Instances[0] != "agent-dock-0" { t.Fatalf("unexpected list: %+v", list) }
+    logs, err := d.Logs(ctx, "agent-dock", 10)
+    if err != nil { t.Fatal(err) }
+    if !strings.Contains(logs, "agent-dock-0 | agent started\n") { t.Fatalf("logs not demultiplexed: %q", logs) }
+
+    // scale to zero keeps replica 0 stopped; scaling up again rebuilds from it
+    if err := d.Scale(ctx, "agent-dock", 0); err != nil { t.Fatal(err) }
+    if list, _ := d.List(ctx, "acme"); len(list) != 1 || list[0].Replicas != 0 || list[0].Status != "stopped" { t.Fatalf("after scale to 0: %+v", list) }
+    if err := d.Scale(ctx, "agent-dock", 3); err != nil { t.Fatal(err) }
+    if list, _ := d.List(ctx, "acme"); len(list) != 1 || list[0].Replicas != 3 || list[0].Ready != 3 { t.Fatalf("after scale to 3: %+v", list) }
+    if env := strings.Join(engine.env["cagent-dock-2"], " "); !strings.Contains(env, "AGENT_NAME=agent-dock-2") || !strings.Contains(env, "ORCHESTRATOR_TOKEN=tok") { t.Fatalf("scaled replica env: %s", env) }
+    // scaling down keeps the removed replica's state for a later scale-up
+    if err := d.Scale(ctx, "agent-dock", 2); err != nil { t.Fatal(err) }
+    if _, ok := engine.volumes["agent-dock-2-state"]; !ok || len(engine.volumes) != 3 { t.Fatalf("volumes after scale down: %v", engine.volumes) }
+
+    engine.volumes["other-state"] = map[string]string{labelInstance: "other"}
+    if err := d.Stop(ctx, "agent-dock"); err != nil { t.Fatal(err) }
+    if list, _ := d.List(ctx, "acme"); len(list) != 0 { t.Fatalf("containers left after stop: %+v", list) }
+    if _, ok := engine.volumes["other-state"]; !ok || len(engine.volumes) != 1 { t.Fatalf("volumes after stop: %v", engine.volumes) }
+    if err := d.Stop(ctx, "agent-dock"); err != errDeploymentNotFound { t.Fatalf("second stop: %v", err) }
+}
+
+func TestK8sDeployerListStopLogs(t *testing.T) {
+    client := fake.NewSimpleClientset()
+    d := newK8sDeployer(client, "")
+    ctx := context.Background()
+    d.Deploy(ctx, AgentSpec{Org: "acme", Name: "agent-acme-9"}, &bytes.Buffer{})
+    d.Deploy(ctx, AgentSpec{Org: "devrel", Name: "agent-devrel-9"}, &bytes.Buffer{})
+    client.CoreV1().Pods(agentNamespace).Create(ctx, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+        Name: "agent-acme-9-5d8f7c9b4-x7k2p", Namespace: agentNamespace,
+        Labels: AgentSpec{Org: "acme", Name: "agent-acme-9"}.ownerLabels(),
+    }}, metav1.CreateOptions{})
+
+    list, err := d.List(ctx, "acme")
+    if err != nil { t.Fatal(err) }
+    if len(list) != 1 || list[0].Name != "agent-acme-9" || list[0].Instances[0] != "agent-acme-9-5d8f7c9b4-x7k2p" || list[0].Status != "starting" {
+        t.Fatalf("unexpected list: %+v", list)
+    }
+    logs, err := d.Logs(ctx, "agent-acme-9", 50)
+    if err != nil { t.Fatal(err) }
+    if !strings.HasPrefix(logs, "agent-acme-9-5d8f7c9b4-x7k2p | ") { t.Fatalf("unexpected logs: %q", logs) }
+    if err := d.Stop(ctx, "agent-acme-9"); err != nil { t.Fatal(err) }
+    if _, err := client.CoreV1().Services(agentNamespace).Get(ctx, "agent-acme-9", metav1.GetOptions{}); err == nil { t.Fatal("service not removed") }
+    if err := d.Stop(ctx, "agent-acme-9"); err != errDeploymentNotFound { t.Fatalf("second stop: %v", err) }
+
+    // a Deployment someone else made in the namespace is left alone
+    client.AppsV1().Deployments(agentNamespace).Create(ctx, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "agent-sample", Namespace: agentNamespace, Labels: map[string]string{"app": "agent-sample"}}}, metav1.CreateOptions{})
+    client.CoreV1().Services(agentNamespace).Create(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "agent-sample", Namespace: agentNamespace}}, metav1.CreateOptions{})
+    if err := d.Stop(ctx, "agent-sample"); err != errDeploymentNotFound { t.Fatalf("stop unmanaged: %v", err) }
+    if err := d.Scale(ctx, "agent-sample", 0); err != errDeploymentNotFound { t.Fatalf("scale unmanaged: %v", err) }
+    if _, err := client.AppsV1().Deployments(agentNamespace).Get(ctx, "agent-sample", metav1.GetOptions{}); err != nil { t.Fatalf("unmanaged deployment deleted: %v", err) }
+    if _, err := client.CoreV1().Services(agentNamespace).Get(ctx, "agent-sample", metav1.GetOptions{}); err != nil { t.Fatalf("unmanaged service deleted: %v", err) }
+}
+
+// The images load the example config by default: it must not start pools
+// or point orgs at a local deployer.
+func TestExampleConfigDeploysNothing(t *testing.T) {
+    cfg, err := loadConfig("../configs/orchestrator.example.yaml")
+    if err != nil { t.Fatal(err) }
+    if len(cfg.Orgs) == 0 { t.Fatal("no orgs in example") }
+    for _, o := range cfg.Orgs {
+        if o.Pool != nil || o.Deployer != "" { t.Fatalf("org %s: pool %+v deployer %q", o.Name, o.Pool, o.Deployer) }
+    }
+}
+
+func TestLoadConfigSelectsDeployer(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "orchestrator.yaml")
+    t.Setenv("TEST_ORCH_TOKEN", "from-env")
+    os.WriteFile(path, []byte(`
+listen: ":8080"
+orgs:
+  - name: acme
+    deployer: local
+    local: { binary: /bin/true }
+  - name: devrel
+    deployer: docker
+    docker: { host: "tcp://127.0.0.1:2375", network: mvp }
+security:
+  token: ${TEST_ORCH_TOKEN}
+`), 0o644)
+    cfg, err := loadConfig(path)
+    if err != nil { t.Fatal(err) }
+    if cfg.Security.Token != "from-env" || cfg.Orgs[1].Docker.Network != "mvp" { t.Fatalf("unexpected config: %+v", cfg) }
+    setConfig(cfg)
+    defer setConfig(&Config{})
+    if d, err := deployerFor("acme"); err != nil { t.Fatal(err) } else if _, ok := d.(*localDeployer); !ok { t.Fatalf("acme got %T", d) }
+    if d, err := deployerFor("devrel"); err != nil { t.Fatal(err) } else if _, ok := d.(*dockerDeployer); !ok { t.Fatalf("devrel got %T", d) }
+
+    os.WriteFile(path, []byte("orgs:\n  - name: acme\n    deployer: nomad\n"), 0o644)
+    if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "unknown deployer") { t.Fatalf("expected validation error, got %v", err) }
+    if cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err != nil || len(cfg.Orgs) != 0 { t.Fatalf("missing file should give empty config: %v", err) }
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// DockerDeployerConfig configures the Docker Engine backend.
+type DockerDeployerConfig struct {
+    // Host is a Docker host URL: unix:///var/run/docker.sock (default,
+    // or DOCKER_HOST) or tcp://host:2375.
+    Host string `json:"host,omitempty"`
+    // Network to attach agent containers to, e.g. the compose network.
+    Network string `json:"network,omitempty"`
+    // OrchestratorURL is what agent containers dial; defaults to
+    // http://mvp-orchestrator:8080 (the compose service name).
+    OrchestratorURL string `json:"orchestratorUrl,omitempty"`
+}
+
+// dockerDeployer runs mvp-agent containers through the Docker Engine API.
+// Each replica is a container named <deployment>-<n>; containers carry the
+// same owner labels as Kubernetes objects so they can be listed by org.
+type dockerDeployer struct {
+    cfg    DockerDeployerConfig
+    client *http.Client
+    base   string
+}
+
+const dockerAPIVersion = "v1.41"
+
+func newDockerDeployer(cfg DockerDeployerConfig) (*dockerDeployer, error) {
+    if cfg.Host == "" { cfg.Host = envWithDefault("DOCKER_HOST", "unix:///var/run/docker.sock") }
+    if cfg.OrchestratorURL == "" { cfg.OrchestratorURL = "http://mvp-orchestrator:8080" }
+    u, err := url.Parse(cfg.Host)
+    if err != nil { return nil, fmt.Errorf("docker host %q: %w", cfg.Host, err) }
+    d := &dockerDeployer{cfg: cfg}
+    switch u.Scheme {
+    case "unix":
+        sock := u.Path
+        d.client = &http.Client{Transport: &http.Transport{
+            DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+                var dl net.Dialer
+                return dl.DialContext(ctx, "unix", sock)
+            },
+        }}
+        d.base = "http://docker"
+    case "tcp", "http":
+        d.client = &http.Client{}
+        d.base = "http://" + u.Host
+    default:
+        return nil, fmt.Errorf("docker host %q: unsupported scheme", cfg.Host)
+    }
+    return d, nil
+}
+
+// do calls the Engine API and decodes a JSON response into out (if non-nil).
+// Non-2xx responses become errors carrying the daemon's message.
+func (d *dockerDeployer) do(ctx context.Context, method, path string, body, out any) (int, error) {
+    var rd io.Reader
+    if body != nil {
+        b, err := json.Marshal(body)
+        if err != nil { return 0, err }
+        rd = bytes.NewReader(b)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, d.base+"/"+dockerAPIVersion+path, rd)
+    if err != nil { return 0, err }
+    if body != nil { req.Header.Set("Content-Type", "application/json") }
+    resp, err := d.client.Do(req)
+    if err != nil { return 0, err }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        var msg struct{ Message string `json:"message"` }
+        b, _ := io.ReadAll(resp.Body)
+        if json.Unmarshal(b, &msg) != nil || msg.Message == "" { msg.Message = strings.TrimSpace(string(b)) }
+        return resp.StatusCode, fmt.Errorf("docker %s %s: %s", method, path, msg.Message)
+    }
+    if out != nil { return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out) }
+    _, _ = io.Copy(io.Discard, resp.Body)
+    return resp.StatusCode, nil
+}
+
+type dockerContainer struct {
+    ID      string            `json:"Id"`
+    Names   []string          `json:"Names"`
+    Image   string            `json:"Image"`
+    State   string            `json:"State"`
+    Created int64             `json:"Created"`
+    Labels  map[string]string `json:"Labels"`
+}
+
+func (c dockerContainer) name() string {
+    if len(c.Names) == 0 { return c.ID }
+    return strings.TrimPrefix(c.Names[0], "/")
+}
+
+func (d *dockerDeployer) Deploy(ctx context.Context, spec AgentSpec, out io.Writer) (DeployResult, error) {
+    if spec.OrchestratorURL == "" { spec.OrchestratorURL = d.cfg.OrchestratorURL }
+    spec = spec.normalize()
+    res := DeployResult{Backend: backendDocker, Org: spec.Org, Name: spec.Name, Image: spec.Image, Resources: []DeployedResource{}}
+    for i := 0; i < int(spec.Replicas); i++ {
+        cname, err := d.create(ctx, spec, i, out)
+        if err != nil { return res, err }
+        res.Resources = append(res.Resources, DeployedResource{Kind: "Container", Name: cname, Action: "created"})
+    }
+    return res, nil
+}
+
+// stateVolume names the volume replica cname keeps /state on, so its
+// identity and outbox survive the container being recreated.
+func stateVolume(cname string) string { return cname + "-state" }
+
+// create creates and starts replica i of spec as <name>-<i>, with /state
+// on the named volume <name>-<i>-state.
+func (d *dockerDeployer) create(ctx context.Context, spec AgentSpec, i int, out io.Writer) (string, error) {
+    cname := fmt.Sprintf("%s-%d", spec.Name, i)
+    env := []string{
+        "ORG_NAME=" + spec.Org,
+        "AGENT_NAME=" + cname,
+        "AGENT_DEPLOYMENT=" + spec.Name,
+        "ORCHESTRATOR_URL=" + spec.OrchestratorURL,
+        "ORCHESTRATOR_TOKEN=" + spec.OrchestratorToken,
+        "CODE_SERVER_PASSWORD=" + codeServerSecret("CODE_SERVER_PASSWORD"),
+        "CODE_SERVER_AUTH_HEADER=" + envWithDefault("CODE_SERVER_AUTH_HEADER", "X-Agent-Auth"),
+        "CODE_SERVER_TOKEN=" + codeServerSecret("CODE_SERVER_TOKEN"),
+    }
+    for k, v := range spec.Env { env = append(env, k+"="+v) }
+    create := map[string]any{
+        "Image":    spec.Image,
+        "Hostname": cname,
+        "Env":      env,
+        "Labels":   spec.ownerLabels(),
+        "HostConfig": map[string]any{
+            "RestartPolicy": map[string]any{"Name": "unless-stopped"},
+            "NetworkMode":   d.cfg.Network,
+            "Mounts": []map[string]any{{
+                "Type": "volume", "Source": stateVolume(cname), "Target": "/state",
+                "VolumeOptions": map[string]any{"Labels": spec.ownerLabels()},
+            }},
+        },
+    }
+    var created struct{ ID string `json:"Id"` }
+    path := "/containers/create?name=" + url.QueryEscape(cname)
+    code, err := d.do(ctx, http.MethodPost, path, create, &created)
+    if code == http.StatusNotFound {
+        // image not present locally: pull it and retry once
+        fmt.Fprintf(out, "pulling image %s\n", spec.Image)
+        if err := d.pull(ctx, spec.Image); err != nil { return cname, err }
+        _, err = d.do(ctx, http.MethodPost, path, create, &created)
+    }
+    if err != nil { return cname, err }
+    if _, err := d.do(ctx, http.MethodPost, "/containers/"+created.ID+"/start", nil, nil); err != nil { return cname, err }
+    fmt.Fprintf(out, "started container %s (%s)\n", cname, shortID(created.ID))
+    return cname, nil
+}
+
+func (d *dockerDeployer) pull(ctx context.Context, image string) error {
+    ref, tag := image, "latest"
+    if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") { ref, tag = image[:i], image[i+1:] }
+    _, err := d.do(ctx, http.MethodPost, "/images/create?fromImage="+url.QueryEscape(ref)+"&tag="+url.QueryEscape(tag), nil, nil)
+    return err
+}
+
+// containers lists managed containers matching extra label filters.
+func (d *dockerDeployer) containers(ctx context.Context, labels ...string) ([]dockerContainer, error) {
+    f, _ := json.Marshal(map[string][]string{"label": append([]string{labelManagedBy + "=" + managedByValue}, labels...)})
+    var list []dockerContainer
+    _, err := d.do(ctx, http.MethodGet, "/containers/json?all=1&filters="+url.QueryEscape(string(f)), nil, &list)
+    return list, err
+}
+
+func (d *dockerDeployer) List(ctx context.Context, org string) ([]DeployedAgent, error) {
+    var filters []string
+    if org != "" { filters = append(filters, labelOrg+"="+org) }
+    list, err := d.containers(ctx, filters...)
+    if err != nil { return nil, err }
+    byName := map[string]*DeployedAgent{}
+    for _, c := range list {
+        name := c.Labels[labelInstance]
+        da := byName[name]
+        if da == nil {
+            da = &DeployedAgent{Name: name, Org: c.Labels[labelOrg], Backend: backendDocker, Image: c.Image, Labels: c.Labels, CreatedAt: time.Unix(c.Created, 0).UTC()}
+            byName[name] = da
+        }
+        // containers stopped by Scale don't count as desired replicas
+        if c.State != "exited" { da.Replicas++ }
+        if c.State == "running" { da.Ready++ }
+        da.Instances = append(da.Instances, c.name())
+    }
+    out := make([]DeployedAgent, 0, len(byName))
+    for _, da := range byName {
+        da.Status = deployedStatus(da.Ready, da.Replicas)
+        sort.Strings(da.Instances)
+        out = append(out, *da)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+    return out, nil
+}
+
+// Scale adds or removes containers from the highest index down. Scaling to
+// zero stops replica 0 instead of removing it, so the deployment (and the
+// spec its labels and env carry) survives for a later scale-up. State
+// volumes are kept, so a replica scaled back up resumes where it left off.
+func (d *dockerDeployer) Scale(ctx context.Context, name string, replicas int32) error {
+    if replicas < 0 { return fmt.Errorf("replicas must be >= 0") }
+    list, err := d.containers(ctx, labelInstance+"="+name)
+    if err != nil { return err }
+    if len(list) == 0 { return errDeploymentNotFound }
+    byIndex := map[int]dockerContainer{}
+    for _, c := range list {
+        if i, err := strconv.Atoi(strings.TrimPrefix(c.name(), name+"-")); err == nil { byIndex[i] = c }
+    }
+    for i, c := range byIndex {
+        switch {
+        case i < int(replicas) && c.State != "running":
+            if _, err := d.do(ctx, http.MethodPost, "/containers/"+c.ID+"/start", nil, nil); err != nil { return err }
+        case i >= int(replicas) && i == 0:
+            if c.State == "running" || c.State == "restarting" {
+                if _, err := d.do(ctx, http.MethodPost, "/containers/"+c.ID+"/stop", nil, nil); err != nil { return err }
+            }
+        case i >= int(replicas):
+            if _, err := d.do(ctx, http.MethodDelete, "/containers/"+c.ID+"?force=1", nil, nil); err != nil { return err }
+        }
+    }
+    if int(replicas) <= len(byIndex) { return nil }
+    spec, err := d.specFrom(ctx, list[0])
+    if err != nil { return err }
+    for i := 0; i < int(replicas); i++ {
+        if _, ok := byIndex[i]; ok { continue }
+        if _, err := d.create(ctx, spec, i, io.Discard); err != nil { return err }
+    }
+    return nil
+}
+
+// specFrom rebuilds an AgentSpec from an existing container so new
+// replicas match it.
+func (d *dockerDeployer) specFrom(ctx context.Context, c dockerContainer) (AgentSpec, error) {
+    var info struct {
+        Config struct {
+            Image  string
+            Env    []string
+            Labels map[string]string
+        }
+    }
+    if _, err := d.do(ctx, http.MethodGet, "/containers/"+c.ID+"/json", nil, &info); err != nil { return AgentSpec{}, err }
+    spec := AgentSpec{Org: c.Labels[labelOrg], Name: c.Labels[labelInstance], Image: info.Config.Image, Labels: map[string]string{}, Env: map[string]string{}}
+    for k, v := range info.Config.Labels {
+        switch k {
+        case "app", labelManagedBy, labelName, labelInstance, labelOrg:
+        default:
+            spec.Labels[k] = v
+        }
+    }
+    for _, kv := range info.Config.Env {
+        k, v, _ := strings.Cut(kv, "=")
+        switch k {
+        case "ORCHESTRATOR_URL":
+            spec.OrchestratorURL = v
+        case "ORCHESTRATOR_TOKEN":
+            spec.OrchestratorToken = v
+        case "ORG_NAME", "AGENT_NAME", "AGENT_DEPLOYMENT", "CODE_SERVER_PASSWORD", "CODE_SERVER_AUTH_HEADER", "CODE_SERVER_TOKEN":
+        default:
+            spec.Env[k] = v
+        }
+    }
+    return spec, nil
+}
+
+// Stop removes the containers and their state volumes.
+func (d *dockerDeployer) Stop(ctx context.Context, name string) error {
+    list, err := d.containers(ctx, labelInstance+"="+name)
+    if err != nil { return err }
+    if len(list) == 0 { return errDeploymentNotFound }
+    for _, c := range list {
+        if _, err := d.do(ctx, http.MethodDelete, "/containers/"+c.ID+"?force=1", nil, nil); err != nil { return err }
+    }
+    // replicas scaled away left their volumes too; the labels find them all
+    var vols struct{ Volumes []struct{ Name string } }
+    filters, _ := json.Marshal(map[string][]string{"label": {labelManagedBy + "=" + managedByValue, labelInstance + "=" + name}})
+    if _, err := d.do(ctx, http.MethodGet, "/volumes?filters="+url.QueryEscape(string(filters)), nil, &vols); err != nil { return err }
+    for _, v := range vols.Volumes {
+        if code, err := d.do(ctx, http.MethodDelete, "/volumes/"+url.PathEscape(v.Name), nil, nil); err != nil && code != http.StatusNotFound { return err }
+    }
+    return nil
+}
+
+func (d *dockerDeployer) Logs(ctx context.Context, name string, tail int) (string, error) {
+    list, err := d.containers(ctx, labelInstance+"="+name)
+    if err != nil { return "", err }
+    if len(list) == 0 { return "", errDeploymentNotFound }
+    sort.Slice(list, func(i, j int) bool { return list[i].name() < list[j].name() })
+    t := "all"
+    if tail > 0 { t = fmt.Sprint(tail) }
+    var b strings.Builder
+    for _, c := range list {
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base+"/"+dockerAPIVersion+"/containers/"+c.ID+"/logs?stdout=1&stderr=1&tail="+t, nil)
+        if err != nil { return "", err }
+        resp, err := d.client.Do(req)
+        if err != nil { return "", err }
+        raw, err := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if err != nil { return "", err }
+        if resp.StatusCode >= 300 { return "", fmt.Errorf("docker logs %s: %s", c.name(), strings.TrimSpace(string(raw))) }
+        for _, ln := range strings.SplitAfter(string(demuxDockerLogs(raw)), "\n") {
+            if ln != "" { b.WriteString(c.name() + " | " + ln) }
+        }
+    }
+    return b.String(), nil
+}
+
+// demuxDockerLogs strips the 8-byte stream headers Docker puts on logs of
+// containers without a TTY. Input that isn't multiplexed is returned as is.
+func demuxDockerLogs(raw []byte) []byte {
+    var out []byte
+    for len(raw) >= 8 {
+        if raw[0] > 2 || raw[1] != 0 || raw[2] != 0 || raw[3] != 0 { return append(out, raw...) }
+        n := int(binary.BigEndian.Uint32(raw[4:8]))
+        if 8+n > len(raw) { return append(out, raw[8:]...) }
+        out = append(out, raw[8:8+n]...)
+        raw = raw[8+n:]
+    }
+    return append(out, raw...)
+}
+
+func shortID(id string) string {
+    if len(id) > 12 { return id[:12] }
+    return id
+}
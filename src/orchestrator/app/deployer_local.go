@@ -0,0 +1,234 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// LocalDeployerConfig configures the local-process backend.
+type LocalDeployerConfig struct {
+    // Binary is the agent executable; defaults to AGENT_BINARY or "agent" on PATH.
+    Binary string `json:"binary,omitempty"`
+    // WorkDir holds a directory per replica with its workspace and agent
+    // state; defaults to <state>/local-agents.
+    WorkDir string `json:"workDir,omitempty"`
+    // OrchestratorURL is what local agents dial; defaults to http://127.0.0.1:8080.
+    OrchestratorURL string `json:"orchestratorUrl,omitempty"`
+}
+
+// localDeployer runs agents as supervised subprocesses on this host, for
+// development and CI. Crashed agents are restarted with backoff until stopped.
+type localDeployer struct {
+    cfg LocalDeployerConfig
+
+    mu     sync.Mutex
+    agents map[string]*localAgent // by deployment name
+}
+
+type localAgent struct {
+    spec    AgentSpec
+    bin     string
+    created time.Time
+    procs   []*localProc
+}
+
+// localProc is one replica. Output is kept in a bounded line buffer.
+type localProc struct {
+    name     string
+    cancel   context.CancelFunc
+    mu       sync.Mutex
+    running  bool
+    restarts int
+    lines    []string
+    partial  []byte
+}
+
+const localLogLines = 1000
+
+var (
+    localDeployersMu sync.Mutex
+    localDeployers   = make(map[string]*localDeployer) // by effective config, so orgs sharing one share supervision
+)
+
+// localDeployerFor returns the process-wide supervisor for a config.
+func localDeployerFor(cfg LocalDeployerConfig) *localDeployer {
+    if cfg.Binary == "" { cfg.Binary = envWithDefault("AGENT_BINARY", "agent") }
+    if cfg.WorkDir == "" { cfg.WorkDir = filepath.Join(stateDir(), "local-agents") }
+    if cfg.OrchestratorURL == "" { cfg.OrchestratorURL = "http://127.0.0.1:8080" }
+    localDeployersMu.Lock(); defer localDeployersMu.Unlock()
+    key := cfg.Binary + "|" + cfg.WorkDir + "|" + cfg.OrchestratorURL
+    if d, ok := localDeployers[key]; ok { return d }
+    d := &localDeployer{cfg: cfg, agents: make(map[string]*localAgent)}
+    localDeployers[key] = d
+    return d
+}
+
+func (d *localDeployer) Deploy(ctx context.Context, spec AgentSpec, out io.Writer) (DeployResult, error) {
+    if spec.OrchestratorURL == "" { spec.OrchestratorURL = d.cfg.OrchestratorURL }
+    spec = spec.normalize()
+    res := DeployResult{Backend: backendLocal, Org: spec.Org, Name: spec.Name, Image: d.cfg.Binary, Resources: []DeployedResource{}}
+    bin, err := exec.LookPath(d.cfg.Binary)
+    if err != nil { return res, fmt.Errorf("agent binary: %w", err) }
+
+    a := &localAgent{spec: spec, bin: bin, created: time.Now().UTC()}
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if _, exists := d.agents[spec.Name]; exists { return res, fmt.Errorf("local agent %s already running", spec.Name) }
+    for i := 0; i < int(spec.Replicas); i++ {
+        p, dir, err := d.startProc(a, i)
+        if err != nil { a.stopAll(); return res, err }
+        res.Resources = append(res.Resources, DeployedResource{Kind: "Process", Name: p.name, Action: "created"})
+        fmt.Fprintf(out, "started process %s (%s) in %s\n", p.name, bin, dir)
+    }
+    d.agents[spec.Name] = a
+    return res, nil
+}
+
+// startProc starts replica i of a and appends it to a.procs. Callers hold d.mu.
+func (d *localDeployer) startProc(a *localAgent, i int) (*localProc, string, error) {
+    spec := a.spec
+    pname := fmt.Sprintf("%s-%d", spec.Name, i)
+    dir := filepath.Join(d.cfg.WorkDir, pname)
+    // each replica keeps its own workspace, outbox and identity
+    ws, state := filepath.Join(dir, "workspace"), filepath.Join(dir, "state")
+    for _, p := range []string{ws, state} {
+        if err := os.MkdirAll(p, 0o755); err != nil { return nil, "", err }
+    }
+    env := append(os.Environ(),
+        "ORG_NAME="+spec.Org,
+        "AGENT_NAME="+pname,
+        "AGENT_DEPLOYMENT="+spec.Name,
+        "ORCHESTRATOR_URL="+spec.OrchestratorURL,
+        "ORCHESTRATOR_TOKEN="+spec.OrchestratorToken,
+        "AGENT_WORKSPACE="+ws,
+        "AGENT_STATE_DIR="+state,
+    )
+    for k, v := range spec.Env { env = append(env, k+"="+v) }
+    ctx, cancel := context.WithCancel(context.Background())
+    p := &localProc{name: pname, cancel: cancel}
+    a.procs = append(a.procs, p)
+    go p.supervise(ctx, a.bin, dir, env)
+    return p, dir, nil
+}
+
+func (a *localAgent) stopAll() {
+    for _, p := range a.procs { p.cancel() }
+    a.procs = nil
+}
+
+// supervise runs the process until ctx is canceled, restarting it with
+// exponential backoff (1s..30s) whenever it exits.
+func (p *localProc) supervise(ctx context.Context, bin, dir string, env []string) {
+    backoff := time.Second
+    for {
+        cmd := exec.CommandContext(ctx, bin)
+        cmd.Dir = dir
+        cmd.Env = env
+        cmd.Stdout = p
+        cmd.Stderr = p
+        start := time.Now()
+        p.setRunning(true)
+        err := cmd.Run()
+        p.setRunning(false)
+        if ctx.Err() != nil { return }
+        p.mu.Lock(); p.restarts++; p.mu.Unlock()
+        fmt.Fprintf(p, "process exited: %v; restarting in %s\n", err, backoff)
+        if time.Since(start) > time.Minute { backoff = time.Second }
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(backoff):
+        }
+        if backoff *= 2; backoff > 30*time.Second { backoff = 30 * time.Second }
+    }
+}
+
+func (p *localProc) setRunning(v bool) { p.mu.Lock(); p.running = v; p.mu.Unlock() }
+
+func (p *localProc) Write(b []byte) (int, error) {
+    p.mu.Lock(); defer p.mu.Unlock()
+    p.partial = append(p.partial, b...)
+    for {
+        i := bytes.IndexByte(p.partial, '\n')
+        if i < 0 { break }
+        p.lines = append(p.lines, string(p.partial[:i]))
+        p.partial = p.partial[i+1:]
+    }
+    if len(p.lines) > localLogLines { p.lines = p.lines[len(p.lines)-localLogLines:] }
+    return len(b), nil
+}
+
+func (d *localDeployer) List(ctx context.Context, org string) ([]DeployedAgent, error) {
+    d.mu.Lock(); defer d.mu.Unlock()
+    out := []DeployedAgent{}
+    for _, a := range d.agents {
+        if org != "" && a.spec.Org != org { continue }
+        da := DeployedAgent{Name: a.spec.Name, Org: a.spec.Org, Backend: backendLocal, Image: a.bin, Replicas: int32(len(a.procs)), Labels: a.spec.ownerLabels(), CreatedAt: a.created}
+        for _, p := range a.procs {
+            p.mu.Lock()
+            if p.running { da.Ready++ }
+            da.Instances = append(da.Instances, p.name)
+            p.mu.Unlock()
+        }
+        da.Status = deployedStatus(da.Ready, da.Replicas)
+        out = append(out, da)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+    return out, nil
+}
+
+func (d *localDeployer) Stop(ctx context.Context, name string) error {
+    d.mu.Lock()
+    a, ok := d.agents[name]
+    delete(d.agents, name)
+    d.mu.Unlock()
+    if !ok { return errDeploymentNotFound }
+    d.mu.Lock(); a.stopAll(); d.mu.Unlock()
+    return nil
+}
+
+// Scale starts or stops replicas from the highest index down. At zero the
+// deployment is kept so it can be scaled up again.
+func (d *localDeployer) Scale(ctx context.Context, name string, replicas int32) error {
+    if replicas < 0 { return fmt.Errorf("replicas must be >= 0") }
+    d.mu.Lock(); defer d.mu.Unlock()
+    a, ok := d.agents[name]
+    if !ok { return errDeploymentNotFound }
+    for len(a.procs) > int(replicas) {
+        last := a.procs[len(a.procs)-1]
+        last.cancel()
+        a.procs = a.procs[:len(a.procs)-1]
+    }
+    for i := len(a.procs); i < int(replicas); i++ {
+        if _, _, err := d.startProc(a, i); err != nil { return err }
+    }
+    a.spec.Replicas = replicas
+    return nil
+}
+
+func (d *localDeployer) Logs(ctx context.Context, name string, tail int) (string, error) {
+    d.mu.Lock()
+    a, ok := d.agents[name]
+    var procs []*localProc
+    if ok { procs = append(procs, a.procs...) }
+    d.mu.Unlock()
+    if !ok { return "", errDeploymentNotFound }
+    var b strings.Builder
+    for _, p := range procs {
+        p.mu.Lock()
+        lines := p.lines
+        if tail > 0 && len(lines) > tail { lines = lines[len(lines)-tail:] }
+        for _, ln := range lines { b.WriteString(p.name + " | " + ln + "\n") }
+        p.mu.Unlock()
+    }
+    return b.String(), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "strings"
+    "testing"
+
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestK8sDeployerCreatesLabelledResources(t *testing.T) {
+    client := fake.NewSimpleClientset()
+    d := newK8sDeployer(client, "")
+    var out bytes.Buffer
+    res, err := d.Deploy(context.Background(), AgentSpec{Org: "acme", Name: "agent-acme-1", OrchestratorURL: "http://orch:8080", OrchestratorToken: "tok", Labels: map[string]string{"tier": "gpu"}}, &out)
+    if err != nil { t.Fatal(err) }
+    if res.Backend != "kubernetes" || res.Namespace != agentNamespace || res.Image != "mvp-agent:latest" { t.Fatalf("unexpected result: %+v", res) }
+    kinds := []string{}
+    for _, r := range res.Resources { kinds = append(kinds, r.Kind+":"+r.Action) }
+    if strings.Join(kinds, ",") != "Namespace:created,StatefulSet:created,Secret:created,Service:created,NetworkPolicy:created" { t.Fatalf("unexpected resources: %v", kinds) }
+    if !strings.Contains(out.String(), "created statefulset/agent-acme-1") { t.Fatalf("progress not reported: %q", out.String()) }
+
+    ctx := context.Background()
+    dep, err := client.AppsV1().StatefulSets(agentNamespace).Get(ctx, "agent-acme-1", metav1.GetOptions{})
+    if err != nil { t.Fatal(err) }
+    if dep.Labels[labelOrg] != "acme" || dep.Labels[labelManagedBy] != managedByValue || dep.Labels["tier"] != "gpu" { t.Fatalf("missing owner labels: %v", dep.Labels) }
+    c := dep.Spec.Template.Spec.Containers[0]
+    var tokenFromSecret bool
+    for _, e := range c.Env {
+        if e.Name == "ORCHESTRATOR_TOKEN" { tokenFromSecret = e.Value == "" && e.ValueFrom != nil && e.ValueFrom.SecretKeyRef.Name == "agent-acme-1" }
+    }
+    if !tokenFromSecret { t.Fatal("token should come from the Secret, not a literal env value") }
+
+    sec, err := client.CoreV1().Secrets(agentNamespace).Get(ctx, "agent-acme-1", metav1.GetOptions{})
+    if err != nil { t.Fatal(err) }
+    if sec.StringData["ORCHESTRATOR_TOKEN"] != "tok" || len(sec.OwnerReferences) != 1 || sec.OwnerReferences[0].Kind != "StatefulSet" { t.Fatalf("unexpected secret: %+v", sec) }
+    svc, err := client.CoreV1().Services(agentNamespace).Get(ctx, "agent-acme-1", metav1.GetOptions{})
+    if err != nil { t.Fatal(err) }
+    if svc.Spec.Selector["app"] != "agent-acme-1" || svc.Spec.Ports[0].Port != agentEditorPort { t.Fatalf("unexpected service: %+v", svc.Spec) }
+}
+
+func TestK8sDeployerUpdatesExisting(t *testing.T) {
+    client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: agentNamespace}})
+    d := newK8sDeployer(client, "")
+    spec := AgentSpec{Org: "acme", Name: "agent-acme-2", Image: "mvp-agent:v1"}
+    if _, err := d.Deploy(context.Background(), spec, &bytes.Buffer{}); err != nil { t.Fatal(err) }
+    spec.Image = "mvp-agent:v2"
+    res, err := d.Deploy(context.Background(), spec, &bytes.Buffer{})
+    if err != nil { t.Fatal(err) }
+    for _, r := range res.Resources {
+        want := "updated"
+        if r.Kind == "Namespace" { want = "unchanged" }
+        if r.Action != want { t.Fatalf("%s: action %s, want %s", r.Kind, r.Action, want) }
+    }
+    dep, _ := client.AppsV1().StatefulSets(agentNamespace).Get(context.Background(), "agent-acme-2", metav1.GetOptions{})
+    if dep.Spec.Template.Spec.Containers[0].Image != "mvp-agent:v2" { t.Fatal("image not updated") }
+}
+
+func TestK8sDeployerMovesToStatefulSet(t *testing.T) {
+    client := fake.NewSimpleClientset()
+    d := newK8sDeployer(client, "")
+    ctx := context.Background()
+    spec := AgentSpec{Org: "acme", Name: "agent-acme-3"}
+    d.manifests.Version = "v1"
+    if _, err := d.Deploy(ctx, spec, &bytes.Buffer{}); err != nil { t.Fatal(err) }
+    if _, err := client.AppsV1().Deployments(agentNamespace).Get(ctx, "agent-acme-3", metav1.GetOptions{}); err != nil { t.Fatalf("v1 deployment: %v", err) }
+
+    // redeployed with v2 manifests, the Deployment is replaced
+    d.manifests.Version = "v2"
+    res, err := d.Deploy(ctx, spec, &bytes.Buffer{})
+    if err != nil { t.Fatal(err) }
+    kinds := []string{}
+    for _, r := range res.Resources { kinds = append(kinds, r.Kind+":"+r.Action) }
+    if strings.Join(kinds, ",") != "Namespace:unchanged,StatefulSet:created,Secret:updated,Service:updated,NetworkPolicy:updated,Deployment:deleted" { t.Fatalf("resources: %v", kinds) }
+    if _, err := client.AppsV1().Deployments(agentNamespace).Get(ctx, "agent-acme-3", metav1.GetOptions{}); err == nil { t.Fatal("v1 deployment left behind") }
+    sec, _ := client.CoreV1().Secrets(agentNamespace).Get(ctx, "agent-acme-3", metav1.GetOptions{})
+    if len(sec.OwnerReferences) != 1 || sec.OwnerReferences[0].Kind != "StatefulSet" { t.Fatalf("secret owners: %+v", sec.OwnerReferences) }
+
+    if list, _ := d.List(ctx, "acme"); len(list) != 1 || list[0].Name != "agent-acme-3" { t.Fatalf("list: %+v", list) }
+    if err := d.Scale(ctx, "agent-acme-3", 3); err != nil { t.Fatal(err) }
+    if set, _ := client.AppsV1().StatefulSets(agentNamespace).Get(ctx, "agent-acme-3", metav1.GetOptions{}); *set.Spec.Replicas != 3 { t.Fatalf("replicas %d", *set.Spec.Replicas) }
+    if err := d.Stop(ctx, "agent-acme-3"); err != nil { t.Fatal(err) }
+    if _, err := client.AppsV1().StatefulSets(agentNamespace).Get(ctx, "agent-acme-3", metav1.GetOptions{}); err == nil { t.Fatal("statefulset not deleted") }
+    if err := d.Stop(ctx, "agent-acme-3"); err != errDeploymentNotFound { t.Fatalf("second stop: %v", err) }
+}
+
+func TestGeneratedAgentNamesDiffer(t *testing.T) {
+    a, b := AgentSpec{Org: "acme"}.normalize(), AgentSpec{Org: "acme"}.normalize()
+    if a.Name == b.Name || !strings.HasPrefix(a.Name, "agent-acme-") { t.Fatalf("names for deploys in the same second: %q %q", a.Name, b.Name) }
+}
+
+func TestK8sDeployerListRejectsSelectorInOrg(t *testing.T) {
+    d := newK8sDeployer(fake.NewSimpleClientset(), "")
+    for _, org := range []string{"acme,tier!=gpu", "acme in (a,b)", "-acme", strings.Repeat("a", 64)} {
+        if _, err := d.List(context.Background(), org); !errors.Is(err, errInvalidOrg) { t.Errorf("List(%q): %v", org, err) }
+    }
+    if _, err := d.List(context.Background(), "acme-1"); err != nil { t.Fatalf("valid org: %v", err) }
+}
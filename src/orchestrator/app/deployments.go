@@ -0,0 +1,258 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Event types for changes made through /deployments.
+const (
+    EventDeploymentScaled  = "deployment.scaled"
+    EventDeploymentDeleted = "deployment.deleted"
+)
+
+// Deployment is a deployed agent together with the Agent records that
+// registered from it (matched on Agent.Deployment, which agents report from
+// AGENT_DEPLOYMENT).
+type Deployment struct {
+    DeployedAgent
+    Agents []Agent `json:"agents"`
+}
+
+const deploymentTimeout = 30 * time.Second
+
+// agentsByDeployment groups registered agents by the deployment they
+// reported, optionally restricted to one org.
+func agentsByDeployment(org string) map[string][]Agent {
+    agentsMu.RLock(); defer agentsMu.RUnlock()
+    out := map[string][]Agent{}
+    for _, a := range agents {
+        if a.Deployment == "" || (org != "" && a.Org != org) { continue }
+        out[a.Deployment] = append(out[a.Deployment], a)
+    }
+    for _, list := range out {
+        sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    }
+    return out
+}
+
+// knownOrgs is every org in config or with a registered agent.
+func knownOrgs() []string {
+    seen := map[string]bool{}
+    for _, o := range currentConfig().Orgs { seen[o.Name] = true }
+    agentsMu.RLock()
+    for _, a := range agents {
+        if a.Org != "" { seen[a.Org] = true }
+    }
+    agentsMu.RUnlock()
+    out := make([]string, 0, len(seen))
+    for o := range seen { out = append(out, o) }
+    sort.Strings(out)
+    return out
+}
+
+func listDeployments(ctx context.Context, org string) ([]Deployment, error) {
+    d, err := deployerFor(org)
+    if err != nil { return nil, err }
+    list, err := d.List(ctx, org)
+    if err != nil { return nil, err }
+    linked := agentsByDeployment(org)
+    out := make([]Deployment, 0, len(list))
+    for _, da := range list {
+        dep := Deployment{DeployedAgent: da, Agents: linked[da.Name]}
+        if dep.Agents == nil { dep.Agents = []Agent{} }
+        out = append(out, dep)
+    }
+    return out, nil
+}
+
+// findDeployment locates a deployment by name. Without an org it is looked
+// up through registered agents first, then by listing every known org.
+func findDeployment(ctx context.Context, name, org string) (Deployment, Deployer, error) {
+    orgs := []string{org}
+    if org == "" {
+        orgs = nil
+        agentsMu.RLock()
+        for _, a := range agents {
+            if a.Deployment == name { orgs = append(orgs, a.Org); break }
+        }
+        agentsMu.RUnlock()
+        orgs = append(orgs, knownOrgs()...)
+    }
+    tried := map[string]bool{}
+    for _, o := range orgs {
+        if tried[o] { continue }
+        tried[o] = true
+        d, err := deployerFor(o)
+        if err != nil {
+            if org != "" { return Deployment{}, nil, err }
+            continue
+        }
+        list, err := listDeployments(ctx, o)
+        if err != nil {
+            if org != "" { return Deployment{}, nil, err }
+            continue
+        }
+        for _, dep := range list {
+            if dep.Name == name { return dep, d, nil }
+        }
+    }
+    return Deployment{}, nil, errDeploymentNotFound
+}
+
+// forgetDeploymentAgents drops the Agent records of a deleted deployment
+// and closes their editor forwards.
+func forgetDeploymentAgents(name string) []string {
+    agentsMu.Lock()
+    var gone []string
+    for n, a := range agents {
+        if a.Deployment == name { gone = append(gone, n); delete(agents, n) }
+    }
+    agentsMu.Unlock()
+    for _, n := range gone { stopEditorForward(n) }
+    sort.Strings(gone)
+    return gone
+}
+
+func deploymentError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, errDeploymentNotFound):
+        http.Error(w, err.Error(), 404)
+    case errors.Is(err, errInvalidOrg):
+        http.Error(w, err.Error(), 400)
+    case errors.Is(err, errNotSupported):
+        http.Error(w, err.Error(), http.StatusNotImplemented)
+    default:
+        http.Error(w, err.Error(), 502)
+    }
+}
+
+// handleDeployments serves GET /deployments?org=. Without org every known
+// org is listed; orgs whose backend can't be reached are reported under
+// errors instead of failing the whole list.
+func handleDeployments(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
+    ctx, cancel := context.WithTimeout(r.Context(), deploymentTimeout)
+    defer cancel()
+    if org := strings.TrimSpace(r.URL.Query().Get("org")); org != "" {
+        list, err := listDeployments(ctx, org)
+        if err != nil { deploymentError(w, err); return }
+        writeJSON(w, map[string]any{"deployments": list})
+        return
+    }
+    all := []Deployment{}
+    errs := map[string]string{}
+    for _, org := range knownOrgs() {
+        list, err := listDeployments(ctx, org)
+        if err != nil { errs[org] = err.Error(); continue }
+        all = append(all, list...)
+    }
+    resp := map[string]any{"deployments": all}
+    if len(errs) > 0 { resp["errors"] = errs }
+    writeJSON(w, resp)
+}
+
+// handleDeployment serves GET/DELETE /deployments/{name}, POST
+// /deployments/{name}/scale {replicas} and GET /deployments/{name}/logs?tail=.
+// ?org= skips the lookup across orgs.
+func handleDeployment(w http.ResponseWriter, r *http.Request) {
+    p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/deployments/"), "/")
+    seg := strings.Split(p, "/")
+    name := seg[0]
+    if name == "" { handleDeployments(w, r); return }
+    action := ""
+    if len(seg) == 2 { action = seg[1] }
+    if len(seg) > 2 || (action != "" && action != "scale" && action != "logs") { http.Error(w, "not found", 404); return }
+
+    ctx, cancel := context.WithTimeout(r.Context(), deploymentTimeout)
+    defer cancel()
+    dep, d, err := findDeployment(ctx, name, strings.TrimSpace(r.URL.Query().Get("org")))
+    if err != nil { deploymentError(w, err); return }
+
+    switch {
+    case action == "" && r.Method == http.MethodGet:
+        writeJSON(w, dep)
+    case action == "" && r.Method == http.MethodDelete:
+        if err := d.Stop(ctx, name); err != nil { deploymentError(w, err); return }
+        gone := forgetDeploymentAgents(name)
+        if gone == nil { gone = []string{} }
+        publishEvent(EventDeploymentDeleted, dep.Org, map[string]any{"name": name, "org": dep.Org, "agents": gone})
+        writeJSON(w, map[string]any{"name": name, "deleted": true, "agents": gone})
+    case action == "scale" && r.Method == http.MethodPost:
+        var req struct{ Replicas *int32 `json:"replicas"` }
+        if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+        if req.Replicas == nil || *req.Replicas < 0 { http.Error(w, "missing or negative replicas", 400); return }
+        if err := d.Scale(ctx, name, *req.Replicas); err != nil { deploymentError(w, err); return }
+        publishEvent(EventDeploymentScaled, dep.Org, map[string]any{"name": name, "org": dep.Org, "from": dep.Replicas, "to": *req.Replicas})
+        if cur, _, err := findDeployment(ctx, name, dep.Org); err == nil { dep = cur }
+        writeJSON(w, dep)
+    case action == "logs" && r.Method == http.MethodGet:
+        tail := 200
+        if v := r.URL.Query().Get("tail"); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n < 0 { http.Error(w, "bad tail", 400); return }
+            tail = n
+        }
+        logs, err := d.Logs(ctx, name, tail)
+        if err != nil { deploymentError(w, err); return }
+        if strings.Contains(r.Header.Get("Accept"), "application/json") {
+            writeJSON(w, map[string]any{"name": name, "logs": logs})
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        _, _ = w.Write([]byte(logs))
+    default:
+        http.Error(w, "method", 405)
+    }
+}
+
+// handleDeploymentRender serves POST /deployments/render, a dry run that
+// returns the Kubernetes manifests /agents/deploy would apply for
+// {org, name?, image?, replicas?, labels?, env?}. "pool": true renders the
+// org's pool template instead, and "manifests" previews a different
+// manifests config in place of the org's. Secret values are redacted. ?format=yaml returns one
+// multi-document YAML stream. "warnings" flags a config that renders but
+// won't work, such as a NetworkPolicy with no internet egress.
+func handleDeploymentRender(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
+    var req struct {
+        Org, Name, Image string
+        Replicas         int32
+        Labels, Env      map[string]string
+        Pool             bool
+        Manifests        *ManifestConfig
+    }
+    if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+    req.Org = strings.TrimSpace(req.Org)
+    if req.Org == "" { http.Error(w, "missing org", 400); return }
+    oc := orgConfig(req.Org)
+    spec := AgentSpec{Org: req.Org, Name: req.Name, Image: req.Image, Replicas: req.Replicas, Labels: req.Labels, Env: req.Env}
+    if req.Pool {
+        if oc.Pool == nil { http.Error(w, "org has no pool", 404); return }
+        spec = oc.Pool.spec(req.Org)
+        if req.Name != "" { spec.Name = req.Name }
+    }
+    mc := oc.Manifests
+    if req.Manifests != nil {
+        mc = *req.Manifests
+        if err := mc.validate(); err != nil { http.Error(w, err.Error(), 400); return }
+    }
+    m, err := renderAgentManifests(spec.normalize(), agentNamespace, mc, oc.Labels, true)
+    if err != nil { http.Error(w, err.Error(), 500); return }
+    if r.URL.Query().Get("format") == "yaml" {
+        w.Header().Set("Content-Type", "application/yaml")
+        for i, d := range m.Docs {
+            if i > 0 { _, _ = w.Write([]byte("---\n")) }
+            _, _ = w.Write([]byte(d.YAML))
+        }
+        return
+    }
+    resp := map[string]any{"org": req.Org, "name": spec.Name, "version": m.Version, "manifests": m.Docs}
+    if warn := mc.withDefaults(oc.Labels).NetworkPolicy.warnings(); len(warn) > 0 { resp["warnings"] = warn }
+    writeJSON(w, resp)
+}
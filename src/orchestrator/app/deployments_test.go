@@ -0,0 +1,69 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func deploymentsRequest(t *testing.T, srv http.Handler, method, path, body string) *httptest.ResponseRecorder {
+    t.Helper()
+    rr := httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+    return rr
+}
+
+func TestDeploymentsListScaleDelete(t *testing.T) {
+    dir := t.TempDir()
+    bin := filepath.Join(dir, "fake-agent")
+    os.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755)
+    setConfig(&Config{Orgs: []OrgConfig{{Name: "dep-org", Deployer: backendLocal, Local: LocalDeployerConfig{Binary: bin, WorkDir: dir}}}})
+    defer setConfig(&Config{})
+    srv := newServer()
+
+    d, err := deployerFor("dep-org")
+    if err != nil { t.Fatal(err) }
+    if _, err := d.Deploy(context.Background(), AgentSpec{Org: "dep-org", Name: "agent-dep-org-1", Replicas: 1}, &bytes.Buffer{}); err != nil { t.Fatal(err) }
+    defer d.Stop(context.Background(), "agent-dep-org-1")
+    // the agent registers with the deployment it was started from
+    rr := deploymentsRequest(t, srv, "POST", "/agents/register", `{"name":"agent-dep-org-1-0","org":"dep-org","deployment":"agent-dep-org-1"}`)
+    if rr.Code != 200 { t.Fatalf("register: %d %s", rr.Code, rr.Body) }
+
+    var list struct{ Deployments []Deployment }
+    rr = deploymentsRequest(t, srv, "GET", "/deployments?org=dep-org", "")
+    if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil { t.Fatalf("bad json %q: %v", rr.Body, err) }
+    if len(list.Deployments) != 1 || list.Deployments[0].Backend != backendLocal || len(list.Deployments[0].Agents) != 1 || list.Deployments[0].Agents[0].Name != "agent-dep-org-1-0" {
+        t.Fatalf("unexpected list: %+v", list)
+    }
+
+    // without org the deployment is found through the registered agent
+    rr = deploymentsRequest(t, srv, "POST", "/deployments/agent-dep-org-1/scale", `{"replicas":3}`)
+    var dep Deployment
+    json.Unmarshal(rr.Body.Bytes(), &dep)
+    if rr.Code != 200 || dep.Replicas != 3 || len(dep.Instances) != 3 { t.Fatalf("scale up: %d %s", rr.Code, rr.Body) }
+    rr = deploymentsRequest(t, srv, "POST", "/deployments/agent-dep-org-1/scale", `{"replicas":0}`)
+    json.Unmarshal(rr.Body.Bytes(), &dep)
+    if rr.Code != 200 || dep.Replicas != 0 || dep.Status != "stopped" { t.Fatalf("scale to zero: %d %s", rr.Code, rr.Body) }
+    if rr := deploymentsRequest(t, srv, "POST", "/deployments/agent-dep-org-1/scale", `{}`); rr.Code != 400 { t.Fatalf("missing replicas: %d", rr.Code) }
+
+    rr = deploymentsRequest(t, srv, "DELETE", "/deployments/agent-dep-org-1?org=dep-org", "")
+    if rr.Code != 200 { t.Fatalf("delete: %d %s", rr.Code, rr.Body) }
+    agentsMu.RLock(); _, still := agents["agent-dep-org-1-0"]; agentsMu.RUnlock()
+    if still { t.Fatal("agent record kept after its deployment was deleted") }
+    if rr := deploymentsRequest(t, srv, "GET", "/deployments/agent-dep-org-1?org=dep-org", ""); rr.Code != 404 { t.Fatalf("expected 404 after delete, got %d", rr.Code) }
+}
+
+func TestEditorServiceNameUsesDeployment(t *testing.T) {
+    agentsMu.Lock()
+    agents["agent-acme-7-5d8f7c9b4-x7k2p"] = Agent{Name: "agent-acme-7-5d8f7c9b4-x7k2p", Org: "acme", Deployment: "agent-acme-7", LastSeen: time.Now()}
+    agentsMu.Unlock()
+    defer func() { agentsMu.Lock(); delete(agents, "agent-acme-7-5d8f7c9b4-x7k2p"); agentsMu.Unlock() }()
+    if got := editorServiceName("agent-acme-7-5d8f7c9b4-x7k2p"); got != "agent-acme-7" { t.Fatalf("got %q", got) }
+    if got := editorServiceName("handmade"); got != "handmade" { t.Fatalf("got %q", got) }
+}
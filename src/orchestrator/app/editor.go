@@ -0,0 +1,299 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Editors are served at /editor/{agent}/..., proxied only to the forward
+// the orchestrator opened for that agent (or straight through its tunnel).
+// Callers need the operator token or a signed link for one user of the
+// agent's editor session (see editor_sessions.go), minted by POST
+// /agents/editor/session or /editor/sessions/{agent}/share.
+
+const (
+    editorSessionParam  = "session"
+    editorSessionCookie = "editor_session"
+    editorSessionTTL    = 15 * time.Minute
+    editorSessionMaxTTL = 12 * time.Hour
+    // upstream Host/Origin seen by code-server, whose origin check would
+    // otherwise reject proxied WebSockets
+    editorUpstreamHost = "localhost:8443"
+    editorHostSuffix   = ".agent.editor"
+)
+
+var (
+    errBadEditorSession = errors.New("invalid editor session")
+    errNoEditorForward  = errors.New("no editor forward for agent")
+)
+
+var editorKey struct {
+    once sync.Once
+    key  []byte
+}
+
+// editorSigningKey signs editor sessions: EDITOR_SESSION_SECRET, or a
+// random per-process key (sessions then end with a restart).
+func editorSigningKey() []byte {
+    editorKey.once.Do(func() {
+        if k := os.Getenv("EDITOR_SESSION_SECRET"); k != "" { editorKey.key = []byte(k); return }
+        editorKey.key = make([]byte, 32)
+        _, _ = rand.Read(editorKey.key)
+    })
+    return editorKey.key
+}
+
+var codeServerSecrets struct {
+    once sync.Once
+    vals map[string]string
+}
+
+// codeServerSecret is CODE_SERVER_PASSWORD or CODE_SERVER_TOKEN for deployed
+// agents and the editor proxy. Unset, a random value is generated once and
+// kept under STATE_DIR, so agents deployed before a restart still accept the
+// proxy. There is no fixed default.
+func codeServerSecret(key string) string {
+    if v := os.Getenv(key); v != "" { return v }
+    codeServerSecrets.once.Do(func() {
+        path := filepath.Join(stateDir(), "code-server.json")
+        vals, err := loadCodeServerSecrets(path)
+        if err != nil { log.Printf("code-server secrets not persisted, agents deployed now lose the editor after a restart: %v", err) }
+        if vals == nil { vals = map[string]string{"CODE_SERVER_PASSWORD": newID() + newID(), "CODE_SERVER_TOKEN": newID() + newID()} }
+        codeServerSecrets.vals = vals
+    })
+    return codeServerSecrets.vals[key]
+}
+
+// loadCodeServerSecrets reads the generated code-server secrets at path,
+// generating and storing the missing ones.
+func loadCodeServerSecrets(path string) (map[string]string, error) {
+    vals := map[string]string{}
+    if b, err := os.ReadFile(path); err == nil {
+        if err := json.Unmarshal(b, &vals); err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+    } else if !os.IsNotExist(err) {
+        return nil, err
+    }
+    changed := false
+    for _, k := range []string{"CODE_SERVER_PASSWORD", "CODE_SERVER_TOKEN"} {
+        if vals[k] == "" { vals[k] = newID() + newID(); changed = true }
+    }
+    if !changed { return vals, nil }
+    if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil { return vals, err }
+    b, _ := json.Marshal(vals)
+    return vals, writeFileAtomic(path, b, 0o600)
+}
+
+// editorClaims bind a link to one session and user; access is checked
+// against the session on every request, so unsharing or closing the
+// session revokes the link before it expires.
+type editorClaims struct {
+    Session string `json:"s"`
+    Agent   string `json:"a"`
+    User    string `json:"u"`
+    Exp     int64  `json:"e"`
+}
+
+func signEditorSession(c editorClaims) string {
+    b, _ := json.Marshal(c)
+    payload := base64.RawURLEncoding.EncodeToString(b)
+    mac := hmac.New(sha256.New, editorSigningKey())
+    mac.Write([]byte(payload))
+    return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyEditorSession(tok, agent string, now time.Time) (editorClaims, error) {
+    var c editorClaims
+    payload, sig, ok := strings.Cut(tok, ".")
+    if !ok { return c, errBadEditorSession }
+    got, err := base64.RawURLEncoding.DecodeString(sig)
+    if err != nil { return c, errBadEditorSession }
+    mac := hmac.New(sha256.New, editorSigningKey())
+    mac.Write([]byte(payload))
+    if !hmac.Equal(got, mac.Sum(nil)) { return c, errBadEditorSession }
+    b, err := base64.RawURLEncoding.DecodeString(payload)
+    if err != nil { return c, errBadEditorSession }
+    if json.Unmarshal(b, &c) != nil || c.Agent != agent || c.User == "" || now.Unix() >= c.Exp { return editorClaims{}, errBadEditorSession }
+    return c, nil
+}
+
+// editorSessionLink signs a link into sess for user.
+func editorSessionLink(sess EditorSession, user string, ttl time.Duration) map[string]any {
+    if ttl <= 0 { ttl = editorSessionTTL }
+    if ttl > editorSessionMaxTTL { ttl = editorSessionMaxTTL }
+    exp := time.Now().Add(ttl).UTC()
+    tok := signEditorSession(editorClaims{Session: sess.ID, Agent: sess.Agent, User: user, Exp: exp.Unix()})
+    u := "/editor/" + url.PathEscape(sess.Agent) + "/?" + url.Values{editorSessionParam: {tok}}.Encode()
+    return map[string]any{"name": sess.Agent, "user": user, "url": u, "token": tok, "expiresAt": exp}
+}
+
+// operatorAuthorized applies the same rule as requireToken.
+func operatorAuthorized(r *http.Request) bool {
+    required := os.Getenv("ORCHESTRATOR_TOKEN")
+    if required == "" { return true }
+    return subtle.ConstantTimeCompare([]byte(bearerOrHeaderToken(r)), []byte(required)) == 1
+}
+
+// authorizeEditor accepts the operator token, a ?session= link (which is
+// then kept in a cookie scoped to the agent's path) or that cookie, and
+// returns who the caller is. Link holders must still be the session's
+// owner or have a share.
+func authorizeEditor(w http.ResponseWriter, r *http.Request, name string) (user string, readOnly, ok bool) {
+    if operatorAuthorized(r) { return editorUser(r), false, true }
+    tok, fromURL := r.URL.Query().Get(editorSessionParam), true
+    if tok == "" {
+        c, err := r.Cookie(editorSessionCookie)
+        if err != nil { return "", false, false }
+        tok, fromURL = c.Value, false
+    }
+    claims, err := verifyEditorSession(tok, name, time.Now())
+    if err != nil { return "", false, false }
+    readOnly, ok = editorSessions.access(name, claims.Session, claims.User)
+    if !ok { return "", false, false }
+    if fromURL {
+        http.SetCookie(w, &http.Cookie{Name: editorSessionCookie, Value: tok, Path: "/editor/" + url.PathEscape(name) + "/", HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil})
+    }
+    return claims.User, readOnly, true
+}
+
+// editorForwardPort is the local port the orchestrator opened for an agent.
+func editorForwardPort(name string) int {
+    editorMu.Lock(); defer editorMu.Unlock()
+    if pf, ok := editorPF[name]; ok { return pf.Port }
+    return 0
+}
+
+// editorTransport dials agents by name: requests carry
+// "<agent>.agent.editor" as their host, so connections are pooled per agent.
+var editorTransport = &http.Transport{
+    DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, _, _ := net.SplitHostPort(addr)
+        name := strings.TrimSuffix(host, editorHostSuffix)
+        if c, err := dialAgent(name); err == nil { return c, nil }
+        port := editorForwardPort(name)
+        if port == 0 { return nil, errNoEditorForward }
+        var d net.Dialer
+        return d.DialContext(ctx, "tcp", "127.0.0.1:"+itoa(port))
+    },
+    MaxIdleConnsPerHost: 8,
+    IdleConnTimeout:     90 * time.Second,
+}
+
+// stripEditorCredentials keeps the caller's credentials away from the agent.
+func stripEditorCredentials(req *http.Request) {
+    req.Header.Del("X-Auth-Token")
+    req.Header.Del("Authorization")
+    cookies := req.Cookies()
+    req.Header.Del("Cookie")
+    for _, c := range cookies {
+        if c.Name != editorSessionCookie { req.AddCookie(c) }
+    }
+    q := req.URL.Query()
+    if q.Has(editorSessionParam) {
+        q.Del(editorSessionParam)
+        req.URL.RawQuery = q.Encode()
+    }
+}
+
+// handleEditorProxy serves /editor/{agent}/... .
+func handleEditorProxy(w http.ResponseWriter, r *http.Request) {
+    p := strings.TrimPrefix(r.URL.Path, "/editor/")
+    seg := strings.SplitN(p, "/", 2)
+    name := seg[0]
+    if name == "" { http.Error(w, "missing agent", 404); return }
+    user, readOnly, ok := authorizeEditor(w, r, name)
+    if !ok { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+    if len(seg) == 1 {
+        // code-server uses relative asset paths
+        u := *r.URL
+        u.Path += "/"
+        http.Redirect(w, r, u.String(), http.StatusFound)
+        return
+    }
+    agentsMu.RLock()
+    a, ok := agents[name]
+    agentsMu.RUnlock()
+    if !ok { http.Error(w, "unknown agent", 404); return }
+    // read-only shares get plain page loads only; code-server's WebSocket
+    // and anything that writes are refused
+    if readOnly && ((r.Method != http.MethodGet && r.Method != http.MethodHead) || websocket.IsWebSocketUpgrade(r)) {
+        http.Error(w, "read-only share", http.StatusForbidden)
+        return
+    }
+    if _, err := editorSessions.open(name, a.Org, user); err != nil { http.Error(w, err.Error(), 502); return }
+    if tunnelFor(name) == nil && editorForwardPort(name) == 0 {
+        // the kubectl forward exited; the session outlives it
+        if _, err := ensureEditorForward(name, a.Org); err != nil { http.Error(w, err.Error(), 502); return }
+    }
+    defer editorSessions.touch(name)()
+
+    csHeader := envWithDefault("CODE_SERVER_AUTH_HEADER", "X-Agent-Auth")
+    csToken := codeServerSecret("CODE_SERVER_TOKEN")
+    rp := &httputil.ReverseProxy{
+        Transport: editorTransport,
+        Director: func(req *http.Request) {
+            req.URL.Scheme = "http"
+            req.URL.Host = name + editorHostSuffix
+            req.URL.Path = "/" + seg[1]
+            req.URL.RawPath = ""
+            req.Host = editorUpstreamHost
+            if req.Header.Get("Origin") != "" { req.Header.Set("Origin", "http://"+editorUpstreamHost) }
+            stripEditorCredentials(req)
+            req.Header.Set(csHeader, csToken)
+        },
+        // the dashboard embeds the editor in a frame
+        ModifyResponse: func(resp *http.Response) error {
+            resp.Header.Del("X-Frame-Options")
+            resp.Header.Del("Content-Security-Policy")
+            return nil
+        },
+        ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+            http.Error(w, "proxy error: "+err.Error(), 502)
+        },
+    }
+    rp.ServeHTTP(w, r)
+}
+
+// handleEditorSession serves POST /agents/editor/session {name, user?,
+// ttl?}: a signed link into the agent's editor session for user (default
+// the caller), opening the session with user as owner if there is none.
+// Other users need a share first (see /editor/sessions/{agent}/share).
+func handleEditorSession(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
+    var req struct {
+        Name, Org, User string
+        TTL             Duration
+    }
+    if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+    if req.Name == "" { http.Error(w, "missing name", 400); return }
+    if req.User = strings.TrimSpace(req.User); req.User == "" { req.User = editorUser(r) }
+    agentsMu.RLock()
+    a, ok := agents[req.Name]
+    agentsMu.RUnlock()
+    if !ok { http.Error(w, "unknown agent", 404); return }
+    if req.Org == "" { req.Org = a.Org }
+    sess, err := editorSessions.open(req.Name, req.Org, req.User)
+    if err != nil { http.Error(w, err.Error(), 502); return }
+    if _, ok := editorSessions.access(req.Name, sess.ID, req.User); !ok { http.Error(w, "user has no access to this editor session; share it first", http.StatusForbidden); return }
+    link := editorSessionLink(sess, req.User, req.TTL.Duration)
+    link["session"] = sess
+    writeJSON(w, link)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Editor sessions: one per agent whose editor is open, owned by whoever
+// opened it and shared with other users explicitly. Proxy traffic keeps a
+// session alive; the reaper closes it (and its forward) once nobody has
+// used it for editorIdleTimeout.
+
+const EventEditorClosed = "editor.closed"
+
+// EditorShare grants another user access to a session, optionally read-only.
+type EditorShare struct {
+    User     string    `json:"user"`
+    ReadOnly bool      `json:"readOnly,omitempty"`
+    AddedAt  time.Time `json:"addedAt"`
+}
+
+type EditorSession struct {
+    ID        string        `json:"id"`
+    Agent     string        `json:"agent"`
+    Org       string        `json:"org"`
+    Owner     string        `json:"owner"`
+    Shares    []EditorShare `json:"shares"`
+    CreatedAt time.Time     `json:"createdAt"`
+    LastUsed  time.Time     `json:"lastUsed"`
+    // Active counts proxied requests in flight, including open WebSockets;
+    // a session with any is never idle.
+    Active int `json:"active"`
+    // filled in by snapshots
+    Via       string    `json:"via,omitempty"`
+    Port      int       `json:"port,omitempty"`
+    IdleUntil time.Time `json:"idleUntil"`
+}
+
+type editorSessionStore struct {
+    mu      sync.Mutex
+    byAgent map[string]*EditorSession
+}
+
+var editorSessions = &editorSessionStore{byAgent: map[string]*EditorSession{}}
+
+// editorIdleTimeout is how long a session may go unused before it is
+// closed. Override with EDITOR_IDLE_TIMEOUT (Go duration).
+func editorIdleTimeout() time.Duration {
+    if d, err := time.ParseDuration(os.Getenv("EDITOR_IDLE_TIMEOUT")); err == nil && d > 0 { return d }
+    return 30 * time.Minute
+}
+
+// editorUser identifies the caller of an operator request: X-User as set by
+// a trusted front end such as the dashboard, else "operator".
+func editorUser(r *http.Request) string {
+    if u := strings.TrimSpace(r.Header.Get("X-User")); u != "" { return u }
+    return "operator"
+}
+
+func (s *editorSessionStore) snapshot(e *EditorSession) EditorSession {
+    out := *e
+    out.Shares = append([]EditorShare{}, e.Shares...)
+    out.IdleUntil = e.LastUsed.Add(editorIdleTimeout())
+    out.Port = editorForwardPort(e.Agent)
+    agentsMu.RLock()
+    out.Via = agents[e.Agent].EditorVia
+    agentsMu.RUnlock()
+    if tunnelFor(e.Agent) != nil { out.Via = "tunnel" }
+    return out
+}
+
+// open returns the agent's session, opening the editor forward and a new
+// session owned by owner if there is none.
+func (s *editorSessionStore) open(agent, org, owner string) (EditorSession, error) {
+    s.mu.Lock()
+    if _, ok := s.byAgent[agent]; ok {
+        s.mu.Unlock()
+        sess, _ := s.get(agent)
+        return sess, nil
+    }
+    s.mu.Unlock()
+    if _, err := ensureEditorForward(agent, org); err != nil { return EditorSession{}, err }
+    now := time.Now()
+    s.mu.Lock()
+    e, ok := s.byAgent[agent]
+    if !ok {
+        e = &EditorSession{ID: newID(), Agent: agent, Org: org, Owner: owner, Shares: []EditorShare{}, CreatedAt: now, LastUsed: now}
+        s.byAgent[agent] = e
+    }
+    s.mu.Unlock()
+    sess, _ := s.get(agent)
+    return sess, nil
+}
+
+func (s *editorSessionStore) get(agent string) (EditorSession, bool) {
+    s.mu.Lock()
+    e, ok := s.byAgent[agent]
+    if !ok { s.mu.Unlock(); return EditorSession{}, false }
+    cp := *e
+    s.mu.Unlock()
+    return s.snapshot(&cp), true
+}
+
+// list returns sessions, optionally for one org, oldest first.
+func (s *editorSessionStore) list(org string) []EditorSession {
+    s.mu.Lock()
+    var all []EditorSession
+    for _, e := range s.byAgent {
+        if org == "" || e.Org == org { all = append(all, *e) }
+    }
+    s.mu.Unlock()
+    out := make([]EditorSession, 0, len(all))
+    for i := range all { out = append(out, s.snapshot(&all[i])) }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+    return out
+}
+
+// access reports whether user may use the session with the given id, and
+// whether only read-only.
+func (s *editorSessionStore) access(agent, id, user string) (readOnly, ok bool) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    e, found := s.byAgent[agent]
+    if !found || (id != "" && e.ID != id) { return false, false }
+    if user == e.Owner { return false, true }
+    for _, sh := range e.Shares {
+        if sh.User == user { return sh.ReadOnly, true }
+    }
+    return false, false
+}
+
+// touch marks the session used for the duration of a proxied request.
+func (s *editorSessionStore) touch(agent string) (done func()) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    e, ok := s.byAgent[agent]
+    if !ok { return func() {} }
+    e.Active++
+    e.LastUsed = time.Now()
+    return func() {
+        s.mu.Lock(); defer s.mu.Unlock()
+        e.Active--
+        e.LastUsed = time.Now()
+    }
+}
+
+func (s *editorSessionStore) share(agent, user string, readOnly bool) (EditorSession, bool) {
+    s.mu.Lock()
+    e, ok := s.byAgent[agent]
+    if !ok { s.mu.Unlock(); return EditorSession{}, false }
+    if user != e.Owner {
+        found := false
+        for i := range e.Shares {
+            if e.Shares[i].User == user { e.Shares[i].ReadOnly = readOnly; found = true }
+        }
+        if !found { e.Shares = append(e.Shares, EditorShare{User: user, ReadOnly: readOnly, AddedAt: time.Now()}) }
+    }
+    s.mu.Unlock()
+    return s.get(agent)
+}
+
+func (s *editorSessionStore) unshare(agent, user string) bool {
+    s.mu.Lock(); defer s.mu.Unlock()
+    e, ok := s.byAgent[agent]
+    if !ok { return false }
+    for i, sh := range e.Shares {
+        if sh.User == user {
+            e.Shares = append(e.Shares[:i], e.Shares[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+// end drops the session and publishes editor.closed; the forward is left
+// to the caller (see stopEditorForward).
+func (s *editorSessionStore) end(agent, reason string) bool {
+    s.mu.Lock()
+    e, ok := s.byAgent[agent]
+    if ok { delete(s.byAgent, agent) }
+    s.mu.Unlock()
+    if ok { publishEvent(EventEditorClosed, e.Org, map[string]any{"agent": agent, "org": e.Org, "session": e.ID, "reason": reason}) }
+    return ok
+}
+
+// reap closes sessions idle for longer than the timeout.
+func (s *editorSessionStore) reap(now time.Time) []string {
+    cutoff := now.Add(-editorIdleTimeout())
+    s.mu.Lock()
+    var idle []string
+    for agent, e := range s.byAgent {
+        if e.Active == 0 && e.LastUsed.Before(cutoff) { idle = append(idle, agent) }
+    }
+    s.mu.Unlock()
+    for _, agent := range idle {
+        if s.end(agent, "idle") { stopEditorForward(agent) }
+    }
+    sort.Strings(idle)
+    return idle
+}
+
+// startEditorReaper closes idle editor sessions in the background.
+func startEditorReaper(ctx context.Context) {
+    go func() {
+        t := time.NewTicker(time.Minute)
+        defer t.Stop()
+        for {
+            select {
+            case now := <-t.C:
+                editorSessions.reap(now)
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+}
+
+// handleEditorSessions serves GET /editor/sessions?org=.
+func handleEditorSessions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
+    writeJSON(w, map[string]any{"sessions": editorSessions.list(strings.TrimSpace(r.URL.Query().Get("org"))), "idleTimeout": editorIdleTimeout().String()})
+}
+
+// handleEditorSessionByAgent serves GET/DELETE /editor/sessions/{agent},
+// POST /editor/sessions/{agent}/share {user, readOnly?, ttl?} (returns a
+// signed URL for that user) and DELETE /editor/sessions/{agent}/share?user=.
+func handleEditorSessionByAgent(w http.ResponseWriter, r *http.Request) {
+    p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/editor/sessions/"), "/")
+    seg := strings.Split(p, "/")
+    agent := seg[0]
+    if agent == "" { handleEditorSessions(w, r); return }
+    action := ""
+    if len(seg) == 2 { action = seg[1] }
+    if len(seg) > 2 || (action != "" && action != "share") { http.Error(w, "not found", 404); return }
+    sess, ok := editorSessions.get(agent)
+    if !ok { http.Error(w, "no editor session", 404); return }
+
+    switch {
+    case action == "" && r.Method == http.MethodGet:
+        writeJSON(w, sess)
+    case action == "" && r.Method == http.MethodDelete:
+        editorSessions.end(agent, "closed")
+        stopEditorForward(agent)
+        writeJSON(w, map[string]any{"agent": agent, "closed": true})
+    case action == "share" && r.Method == http.MethodPost:
+        var req struct {
+            User     string
+            ReadOnly bool
+            TTL      Duration
+        }
+        if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+        req.User = strings.TrimSpace(req.User)
+        if req.User == "" { http.Error(w, "missing user", 400); return }
+        sess, ok = editorSessions.share(agent, req.User, req.ReadOnly)
+        if !ok { http.Error(w, "no editor session", 404); return }
+        link := editorSessionLink(sess, req.User, req.TTL.Duration)
+        link["session"] = sess
+        writeJSON(w, link)
+    case action == "share" && r.Method == http.MethodDelete:
+        user := strings.TrimSpace(r.URL.Query().Get("user"))
+        if user == "" { http.Error(w, "missing user", 400); return }
+        writeJSON(w, map[string]any{"agent": agent, "user": user, "removed": editorSessions.unshare(agent, user)})
+    default:
+        http.Error(w, "method", 405)
+    }
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestEditorSessionSignature(t *testing.T) {
+    now := time.Now()
+    tok := signEditorSession(editorClaims{Session: "s1", Agent: "ed-a1", User: "alice", Exp: now.Add(time.Minute).Unix()})
+    if c, err := verifyEditorSession(tok, "ed-a1", now); err != nil || c.User != "alice" || c.Session != "s1" { t.Fatalf("claims %+v: %v", c, err) }
+    if _, err := verifyEditorSession(tok, "ed-a2", now); err == nil { t.Fatal("session accepted for another agent") }
+    if _, err := verifyEditorSession(tok, "ed-a1", now.Add(2*time.Minute)); err == nil { t.Fatal("expired session accepted") }
+    if _, err := verifyEditorSession(tok+"x", "ed-a1", now); err == nil { t.Fatal("tampered session accepted") }
+    forged := strings.Replace(tok, tok[:4], "eyJh", 1)
+    if _, err := verifyEditorSession(forged, "ed-a1", now); forged != tok && err == nil { t.Fatal("forged payload accepted") }
+}
+
+func TestCodeServerSecretsGenerated(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state", "code-server.json")
+    first, err := loadCodeServerSecrets(path)
+    if err != nil { t.Fatal(err) }
+    pass, tok := first["CODE_SERVER_PASSWORD"], first["CODE_SERVER_TOKEN"]
+    if len(pass) != 32 || len(tok) != 32 || pass == tok { t.Fatalf("generated: %v", first) }
+    // a restart reads the same secrets back
+    again, err := loadCodeServerSecrets(path)
+    if err != nil || again["CODE_SERVER_PASSWORD"] != pass || again["CODE_SERVER_TOKEN"] != tok { t.Fatalf("after restart: %v %v", again, err) }
+    if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o600 { t.Fatalf("mode %v", fi.Mode()) }
+    os.WriteFile(path, []byte("{"), 0o600)
+    if _, err := loadCodeServerSecrets(path); err == nil { t.Fatal("corrupt secrets accepted") }
+    // set in the environment, the value is used as is
+    t.Setenv("CODE_SERVER_PASSWORD", "from-env")
+    if got := codeServerSecret("CODE_SERVER_PASSWORD"); got != "from-env" { t.Fatalf("env: %q", got) }
+}
+
+func TestEditorProxyAccess(t *testing.T) {
+    t.Setenv("ORCHESTRATOR_TOKEN", "op-secret")
+    t.Setenv("CODE_SERVER_TOKEN", "cs-secret")
+    editor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "path=%s query=%s auth=%s token=%s cookie=%s", r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Agent-Auth"), r.Header.Get("X-Auth-Token"), r.Header.Get("Cookie"))
+    }))
+    defer editor.Close()
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    agentsMu.Lock(); agents["ed-a1"] = Agent{Name: "ed-a1", Org: "acme", Status: "idle"}; agentsMu.Unlock()
+    defer func() { agentsMu.Lock(); delete(agents, "ed-a1"); agentsMu.Unlock(); stopEditorForward("ed-a1") }()
+    sess := fakeTunnelAgent(t, srv.URL, "ed-a1", editor.Listener.Addr().String())
+    defer sess.Close()
+    waitFor(t, "tunnel", func() bool { return tunnelFor("ed-a1") != nil })
+
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+    get := func(path string, hdr map[string]string) (*http.Response, string) {
+        req, _ := http.NewRequest("GET", srv.URL+path, nil)
+        for k, v := range hdr { req.Header.Set(k, v) }
+        resp, err := client.Do(req)
+        if err != nil { t.Fatal(err) }
+        b, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        return resp, string(b)
+    }
+
+    if resp, _ := get("/editor/ed-a1/", nil); resp.StatusCode != 401 { t.Fatalf("anonymous access: %d", resp.StatusCode) }
+    resp, body := get("/editor/ed-a1/static/app.js?v=1", map[string]string{"X-Auth-Token": "op-secret"})
+    if resp.StatusCode != 200 || body != "path=/static/app.js query=v=1 auth=cs-secret token= cookie=" { t.Fatalf("operator access: %d %q", resp.StatusCode, body) }
+    if sess, ok := editorSessions.get("ed-a1"); !ok || sess.Owner != "operator" || sess.Via != "tunnel" { t.Fatalf("proxy should open a session: %+v", sess) }
+    if resp, _ := get("/editor/ed-a1", map[string]string{"X-Auth-Token": "op-secret"}); resp.StatusCode != 302 || resp.Header.Get("Location") != "/editor/ed-a1/" { t.Fatalf("redirect: %d %s", resp.StatusCode, resp.Header.Get("Location")) }
+    if resp, _ := get("/editor/nobody/", map[string]string{"X-Auth-Token": "op-secret"}); resp.StatusCode != 404 { t.Fatalf("unknown agent: %d", resp.StatusCode) }
+    // the old port-addressed proxy is gone
+    if resp, _ := get("/editor/proxy/10080/", map[string]string{"X-Auth-Token": "op-secret"}); resp.StatusCode != 404 { t.Fatalf("port proxy: %d", resp.StatusCode) }
+
+    // mint a session and use it without the operator token
+    req, _ := http.NewRequest("POST", srv.URL+"/agents/editor/session", strings.NewReader(`{"name":"ed-a1","ttl":"1m"}`))
+    req.Header.Set("X-Auth-Token", "op-secret")
+    sr, err := http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    var minted struct{ URL, Token, User string; ExpiresAt time.Time }
+    json.NewDecoder(sr.Body).Decode(&minted); sr.Body.Close()
+    if sr.StatusCode != 200 || minted.User != "operator" || !strings.HasPrefix(minted.URL, "/editor/ed-a1/?session=") || time.Until(minted.ExpiresAt) > time.Minute { t.Fatalf("mint: %d %+v", sr.StatusCode, minted) }
+
+    resp, body = get(minted.URL, nil)
+    if resp.StatusCode != 200 || !strings.HasPrefix(body, "path=/ query= ") { t.Fatalf("session url: %d %q", resp.StatusCode, body) }
+    var cookie *http.Cookie
+    for _, c := range resp.Cookies() {
+        if c.Name == editorSessionCookie { cookie = c }
+    }
+    if cookie == nil || cookie.Path != "/editor/ed-a1/" || !cookie.HttpOnly { t.Fatalf("session cookie: %+v", cookie) }
+    resp, body = get("/editor/ed-a1/x", map[string]string{"Cookie": editorSessionCookie + "=" + cookie.Value + "; theme=dark"})
+    if resp.StatusCode != 200 || !strings.HasSuffix(body, "cookie=theme=dark") { t.Fatalf("session cookie access: %d %q", resp.StatusCode, body) }
+    // scoped to one agent
+    if resp, _ := get("/editor/ed-a2/?session="+minted.Token, nil); resp.StatusCode != 401 { t.Fatalf("session for another agent: %d", resp.StatusCode) }
+
+    req, _ = http.NewRequest("POST", srv.URL+"/agents/editor/session", strings.NewReader(`{"name":"ed-a1"}`))
+    if sr, _ := http.DefaultClient.Do(req); sr.StatusCode != 401 { t.Fatalf("minting needs the operator token: %d", sr.StatusCode) }
+}
+
+func TestEditorSessionLifecycle(t *testing.T) {
+    t.Setenv("ORCHESTRATOR_TOKEN", "op-secret")
+    t.Setenv("EDITOR_IDLE_TIMEOUT", "1m")
+    editor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") }))
+    defer editor.Close()
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    agentsMu.Lock(); agents["ed-b1"] = Agent{Name: "ed-b1", Org: "life", Status: "idle"}; agentsMu.Unlock()
+    defer func() { agentsMu.Lock(); delete(agents, "ed-b1"); agentsMu.Unlock(); stopEditorForward("ed-b1") }()
+    sess := fakeTunnelAgent(t, srv.URL, "ed-b1", editor.Listener.Addr().String())
+    defer sess.Close()
+    waitFor(t, "tunnel", func() bool { return tunnelFor("ed-b1") != nil })
+
+    do := func(method, path, body string, hdr map[string]string) (int, string) {
+        req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+        for k, v := range hdr { req.Header.Set(k, v) }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil { t.Fatal(err) }
+        b, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        return resp.StatusCode, string(b)
+    }
+    op := map[string]string{"X-Auth-Token": "op-secret", "X-User": "alice"}
+
+    // registering doesn't open an editor any more; opening does, owned by the caller
+    if _, ok := editorSessions.get("ed-b1"); ok { t.Fatal("session opened without anyone asking") }
+    code, body := do("POST", "/agents/editor/open", `{"name":"ed-b1","org":"life"}`, op)
+    var opened struct{ Port int; Session EditorSession }
+    json.Unmarshal([]byte(body), &opened)
+    if code != 200 || opened.Port == 0 || opened.Session.Owner != "alice" || opened.Session.Agent != "ed-b1" { t.Fatalf("open: %d %s", code, body) }
+
+    // bob can't mint a link until the session is shared with him
+    if code, _ := do("POST", "/agents/editor/session", `{"name":"ed-b1","user":"bob"}`, op); code != 403 { t.Fatalf("unshared mint: %d", code) }
+    code, body = do("POST", "/editor/sessions/ed-b1/share", `{"user":"bob","readOnly":true}`, op)
+    var share struct{ URL string; Session EditorSession }
+    json.Unmarshal([]byte(body), &share)
+    if code != 200 || len(share.Session.Shares) != 1 || !share.Session.Shares[0].ReadOnly { t.Fatalf("share: %d %s", code, body) }
+    if code, _ := do("GET", share.URL, "", nil); code != 200 { t.Fatalf("read-only page load: %d", code) }
+    if code, _ := do("POST", share.URL, "{}", nil); code != 403 { t.Fatalf("read-only write: %d", code) }
+    if code, _ := do("GET", share.URL, "", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}); code != 403 { t.Fatalf("read-only websocket: %d", code) }
+    // unsharing revokes the link before it expires
+    if code, _ := do("DELETE", "/editor/sessions/ed-b1/share?user=bob", "", op); code != 200 { t.Fatalf("unshare: %d", code) }
+    if code, _ := do("GET", share.URL, "", nil); code != 401 { t.Fatalf("revoked link: %d", code) }
+
+    code, body = do("GET", "/editor/sessions?org=life", "", op)
+    var list struct{ Sessions []EditorSession }
+    json.Unmarshal([]byte(body), &list)
+    if code != 200 || len(list.Sessions) != 1 || list.Sessions[0].Owner != "alice" || list.Sessions[0].Port != opened.Port { t.Fatalf("list: %d %s", code, body) }
+    if code, _ := do("GET", "/editor/sessions", "", nil); code != 401 { t.Fatalf("listing needs the operator token: %d", code) }
+
+    // traffic keeps the session alive; idleness closes it and its forward
+    before := list.Sessions[0].LastUsed
+    time.Sleep(10 * time.Millisecond)
+    do("GET", "/editor/ed-b1/", "", op)
+    s, _ := editorSessions.get("ed-b1")
+    if !s.LastUsed.After(before) || s.Active != 0 { t.Fatalf("proxy traffic not tracked: %+v", s) }
+    if gone := editorSessions.reap(time.Now()); len(gone) != 0 { t.Fatalf("reaped a live session: %v", gone) }
+    done := editorSessions.touch("ed-b1")
+    if gone := editorSessions.reap(time.Now().Add(time.Hour)); len(gone) != 0 { t.Fatalf("reaped a session in use: %v", gone) }
+    done()
+    if gone := editorSessions.reap(time.Now().Add(time.Hour)); len(gone) != 1 || gone[0] != "ed-b1" { t.Fatalf("idle session not reaped: %v", gone) }
+    if editorForwardPort("ed-b1") != 0 { t.Fatal("forward left open after reaping") }
+    agentsMu.RLock(); a := agents["ed-b1"]; agentsMu.RUnlock()
+    if a.EditorPort != 0 { t.Fatalf("agent still advertises port %d", a.EditorPort) }
+    if code, _ := do("GET", "/editor/sessions/ed-b1", "", op); code != 404 { t.Fatalf("reaped session still listed: %d", code) }
+}
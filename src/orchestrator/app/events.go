@@ -0,0 +1,288 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Event types published on the global /events stream.
+const (
+    EventTaskScheduled     = "task.scheduled"
+    EventTaskClaimed       = "task.claimed"
+    EventTaskStatus        = "task.status"
+    EventTaskProgress      = "task.progress"
+    EventAgentRegistered   = "agent.registered"
+    EventAgentHeartbeat    = "agent.heartbeat"
+    EventAgentOffline      = "agent.offline"
+    EventAgentDeregistered = "agent.deregistered"
+    EventEditorOpened      = "editor.opened"
+    EventOperationStatus   = "operation.status"
+)
+
+// Event is a typed orchestrator state change. Data is the affected Task or
+// Agent, or a small object for editor events.
+type Event struct {
+    ID   int64     `json:"id"`
+    Type string    `json:"type"`
+    Org  string    `json:"org,omitempty"`
+    Time time.Time `json:"time"`
+    Data any       `json:"data"`
+}
+
+// eventBus assigns monotonically increasing IDs and keeps a bounded history
+// so clients reconnecting with Last-Event-ID can catch up. IDs start from
+// the boot time in microseconds, so they keep increasing across restarts
+// (and stay exact as JavaScript numbers); a resume ID from before this
+// boot, or ahead of it, is from another run of the orchestrator.
+type eventBus struct {
+    mu      sync.Mutex
+    epoch   int64 // first ID of this run
+    nextID  int64
+    history []Event
+    size    int
+    subs    map[*eventSub]struct{}
+}
+
+type eventSub struct {
+    filter eventFilter
+    ch     chan Event
+    lag    chan struct{}
+}
+
+const eventHistorySize = 1024
+
+var events = newEventBus(eventHistorySize)
+
+func newEventBus(size int) *eventBus {
+    epoch := time.Now().UnixMicro()
+    return &eventBus{epoch: epoch, nextID: epoch, size: size, subs: make(map[*eventSub]struct{})}
+}
+
+func (b *eventBus) publish(typ, org string, data any) Event {
+    b.mu.Lock(); defer b.mu.Unlock()
+    e := Event{ID: b.nextID, Type: typ, Org: org, Time: time.Now().UTC(), Data: data}
+    b.nextID++
+    b.history = append(b.history, e)
+    if len(b.history) > b.size { b.history = b.history[len(b.history)-b.size:] }
+    for s := range b.subs {
+        if !s.filter.match(e) { continue }
+        select {
+        case s.ch <- e:
+        default:
+            select { case s.lag <- struct{}{}: default: }
+        }
+    }
+    return e
+}
+
+func (b *eventBus) subscribe(f eventFilter) *eventSub {
+    s := &eventSub{filter: f, ch: make(chan Event, 256), lag: make(chan struct{}, 1)}
+    b.mu.Lock(); b.subs[s] = struct{}{}; b.mu.Unlock()
+    return s
+}
+
+func (b *eventBus) unsubscribe(s *eventSub) {
+    b.mu.Lock(); delete(b.subs, s); b.mu.Unlock()
+}
+
+// resumeFrom maps a client's Last-Event-ID to the position to replay from.
+// ok is false when id is from another run: the client restarts from the
+// beginning of this run's history, and events it missed are lost.
+func (b *eventBus) resumeFrom(id int64) (last int64, ok bool) {
+    b.mu.Lock(); defer b.mu.Unlock()
+    if id < b.epoch-1 || id >= b.nextID { return b.epoch - 1, false }
+    return id, true
+}
+
+// since returns retained events after id that match f. complete is false
+// when events after id have already been evicted from history, or id is
+// from another run.
+func (b *eventBus) since(id int64, f eventFilter) (out []Event, complete bool) {
+    b.mu.Lock(); defer b.mu.Unlock()
+    complete = id >= b.epoch-1 && id < b.nextID && (len(b.history) == 0 || b.history[0].ID <= id+1)
+    for _, e := range b.history {
+        if e.ID > id && f.match(e) { out = append(out, e) }
+    }
+    return out, complete
+}
+
+func publishEvent(typ, org string, data any) { events.publish(typ, org, data) }
+
+// eventFilter selects events by org and type. Types may end in ".*" to
+// match a whole family, e.g. "task.*".
+type eventFilter struct {
+    orgs  map[string]bool
+    types []string
+}
+
+func parseEventFilter(r *http.Request) eventFilter {
+    var f eventFilter
+    q := r.URL.Query()
+    for _, v := range splitList(q["org"]) {
+        if f.orgs == nil { f.orgs = make(map[string]bool) }
+        f.orgs[v] = true
+    }
+    f.types = splitList(q["type"])
+    return f
+}
+
+func splitList(vals []string) []string {
+    var out []string
+    for _, v := range vals {
+        for _, p := range strings.Split(v, ",") {
+            if p = strings.TrimSpace(p); p != "" { out = append(out, p) }
+        }
+    }
+    return out
+}
+
+func (f eventFilter) match(e Event) bool {
+    if f.orgs != nil && !f.orgs[e.Org] { return false }
+    if len(f.types) == 0 { return true }
+    for _, t := range f.types {
+        if t == e.Type { return true }
+        if strings.HasSuffix(t, ".*") && strings.HasPrefix(e.Type, strings.TrimSuffix(t, "*")) { return true }
+    }
+    return false
+}
+
+var wsUpgrader = websocket.Upgrader{
+    // the dashboard proxies from its own origin; access is governed by the
+    // same token rules as the rest of the API
+    CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveEvents streams the global event feed as SSE, or as WebSocket text
+// frames (one JSON event each) when the request is an upgrade.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+    f := parseEventFilter(r)
+    sub := events.subscribe(f)
+    defer events.unsubscribe(sub)
+    // without Last-Event-ID the stream starts with the next event; any ID
+    // of this run is after the start
+    last, _ := events.resumeFrom(-1)
+    resumed, restarted := false, false
+    if id, ok := lastEventID(r); ok { last, resumed = events.resumeFrom(id); restarted = !resumed }
+    if websocket.IsWebSocketUpgrade(r) {
+        serveEventsWS(w, r, sub, last, resumed || restarted)
+        return
+    }
+    flusher, ok := w.(http.Flusher); if !ok { http.Error(w, "no flusher", 500); return }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    send := func(e Event) {
+        if e.ID <= last { return }
+        b, _ := json.Marshal(e)
+        writeSSE(w, strconv.FormatInt(e.ID, 10), e.Type, string(b))
+        last = e.ID
+    }
+    catchUp := func() {
+        missed, complete := events.since(last, f)
+        if !complete { writeSSE(w, "", "lagged", fmt.Sprintf(`{"resumeFrom":%d}`, last)) }
+        for _, e := range missed { send(e) }
+    }
+    if restarted {
+        // the client's position is from an earlier run: replay this one
+        writeSSE(w, "", "lagged", fmt.Sprintf(`{"resumeFrom":%d,"restarted":true}`, last))
+        missed, _ := events.since(last, f)
+        for _, e := range missed { send(e) }
+    } else if resumed {
+        catchUp()
+    }
+    flusher.Flush()
+    keepAlive := time.NewTicker(sseKeepAlive)
+    defer keepAlive.Stop()
+    for {
+        select {
+        case e := <-sub.ch:
+            send(e); flusher.Flush()
+        case <-sub.lag:
+            writeSSE(w, "", "lagged", fmt.Sprintf(`{"resumeFrom":%d}`, last))
+            catchUp(); flusher.Flush()
+        case <-keepAlive.C:
+            fmt.Fprint(w, ": keepalive\n\n"); flusher.Flush()
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+func serveEventsWS(w http.ResponseWriter, r *http.Request, sub *eventSub, last int64, replay bool) {
+    conn, err := wsUpgrader.Upgrade(w, r, nil)
+    if err != nil { log.Printf("events ws upgrade: %v", err); return }
+    defer conn.Close()
+    // drain client frames so close and ping are handled
+    closed := make(chan struct{})
+    go func() {
+        defer close(closed)
+        for { if _, _, err := conn.ReadMessage(); err != nil { return } }
+    }()
+    send := func(e Event) error {
+        if e.ID <= last { return nil }
+        last = e.ID
+        conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+        return conn.WriteJSON(e)
+    }
+    if replay {
+        missed, _ := events.since(last, sub.filter)
+        for _, e := range missed { if send(e) != nil { return } }
+    }
+    ping := time.NewTicker(sseKeepAlive)
+    defer ping.Stop()
+    for {
+        select {
+        case e := <-sub.ch:
+            if send(e) != nil { return }
+        case <-sub.lag:
+            missed, _ := events.since(last, sub.filter)
+            for _, e := range missed { if send(e) != nil { return } }
+        case <-ping.C:
+            if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)) != nil { return }
+        case <-closed:
+            return
+        }
+    }
+}
+
+// agentOfflineAfter is how long an agent may go without a heartbeat before
+// it is marked offline. Override with AGENT_OFFLINE_AFTER (Go duration).
+func agentOfflineAfter() time.Duration {
+    if d, err := time.ParseDuration(os.Getenv("AGENT_OFFLINE_AFTER")); err == nil && d > 0 { return d }
+    return 2 * time.Minute
+}
+
+// sweepOfflineAgents marks agents whose last heartbeat is older than the
+// offline threshold and publishes agent.offline once per transition.
+func sweepOfflineAgents(now time.Time) {
+    cutoff := now.Add(-agentOfflineAfter())
+    var gone []Agent
+    agentsMu.Lock()
+    for name, a := range agents {
+        if a.Status != "offline" && a.LastSeen.Before(cutoff) {
+            a.Status = "offline"
+            agents[name] = a
+            gone = append(gone, a)
+        }
+    }
+    agentsMu.Unlock()
+    for _, a := range gone { publishEvent(EventAgentOffline, a.Org, a) }
+}
+
+// startAgentMonitor runs the offline sweep in the background.
+func startAgentMonitor() {
+    go func() {
+        t := time.NewTicker(15 * time.Second)
+        defer t.Stop()
+        for now := range t.C { sweepOfflineAgents(now) }
+    }()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestEventFilterMatch(t *testing.T) {
+    req := httptest.NewRequest("GET", "/events?org=acme&type=task.*,agent.offline", nil)
+    f := parseEventFilter(req)
+    cases := []struct{ e Event; want bool }{
+        {Event{Type: EventTaskScheduled, Org: "acme"}, true},
+        {Event{Type: EventTaskStatus, Org: "acme"}, true},
+        {Event{Type: EventAgentOffline, Org: "acme"}, true},
+        {Event{Type: EventAgentHeartbeat, Org: "acme"}, false},
+        {Event{Type: EventTaskScheduled, Org: "devrel"}, false},
+    }
+    for _, c := range cases {
+        if got := f.match(c.e); got != c.want { t.Errorf("match(%s/%s)=%v want %v", c.e.Org, c.e.Type, got, c.want) }
+    }
+    if !(eventFilter{}).match(Event{Type: "anything"}) { t.Error("empty filter should match everything") }
+}
+
+func TestEventsSSEFilteredAndResumable(t *testing.T) {
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    br := openStream(t, ctx, srv.URL+"/events?org=evt-acme&type=task.scheduled", "")
+
+    post := func(path, body string) {
+        resp, err := http.Post(srv.URL+path, "application/json", bytes.NewBufferString(body))
+        if err != nil { t.Fatal(err) }
+        resp.Body.Close()
+    }
+    post("/schedule", `{"org":"evt-other","task":"ignored"}`)
+    post("/agents/register", `{"name":"evt-a1","org":"evt-acme"}`)
+    post("/schedule", `{"org":"evt-acme","task":"one"}`)
+    post("/schedule", `{"org":"evt-acme","task":"two"}`)
+
+    evs := readEvents(t, br, 2)
+    var first, second Event
+    json.Unmarshal([]byte(evs[0].data), &first)
+    json.Unmarshal([]byte(evs[1].data), &second)
+    if evs[0].event != EventTaskScheduled || first.Org != "evt-acme" { t.Fatalf("unexpected event: %+v", evs[0]) }
+    if task, _ := second.Data.(map[string]any); task["text"] != "two" { t.Fatalf("unexpected payload: %v", second.Data) }
+
+    // resume after the first event replays the second from history
+    again := readEvents(t, openStream(t, ctx, srv.URL+"/events?org=evt-acme&type=task.scheduled", evs[0].id), 1)
+    if again[0].id != evs[1].id { t.Fatalf("resume returned id %s, want %s", again[0].id, evs[1].id) }
+}
+
+func TestEventsWebSocket(t *testing.T) {
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/events?type=agent.registered", nil)
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+    // give the server a moment to subscribe before publishing
+    time.Sleep(50 * time.Millisecond)
+    resp, err := http.Post(srv.URL+"/agents/register", "application/json", bytes.NewBufferString(`{"name":"ws-a1","org":"ws-acme"}`))
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    var e Event
+    if err := conn.ReadJSON(&e); err != nil { t.Fatal(err) }
+    if e.Type != EventAgentRegistered || e.Org != "ws-acme" { t.Fatalf("unexpected event: %+v", e) }
+}
+
+func TestSweepOfflineAgents(t *testing.T) {
+    sub := events.subscribe(eventFilter{types: []string{EventAgentOffline}})
+    defer events.unsubscribe(sub)
+    agentsMu.Lock()
+    agents["sweep-a1"] = Agent{Name: "sweep-a1", Org: "acme", Status: "idle", LastSeen: time.Now().Add(-time.Hour)}
+    agentsMu.Unlock()
+    sweepOfflineAgents(time.Now())
+    sweepOfflineAgents(time.Now())
+    select {
+    case e := <-sub.ch:
+        if a, ok := e.Data.(Agent); !ok || a.Name != "sweep-a1" { t.Fatalf("unexpected offline event: %+v", e) }
+    case <-time.After(time.Second):
+        t.Fatal("no agent.offline event")
+    }
+    select {
+    case e := <-sub.ch:
+        t.Fatalf("offline published twice: %+v", e)
+    default:
+    }
+    agentsMu.RLock(); st := agents["sweep-a1"].Status; agentsMu.RUnlock()
+    if st != "offline" { t.Fatalf("status=%s", st) }
+}
+
+func TestEventBusRestart(t *testing.T) {
+    old := newEventBus(16)
+    for i := 0; i < 3; i++ { old.publish(EventTaskStatus, "acme", i) }
+    seen := old.publish(EventTaskStatus, "acme", 3).ID
+    if last, ok := old.resumeFrom(seen); !ok || last != seen { t.Fatalf("same run: %d %v", last, ok) }
+
+    // the orchestrator restarts: IDs keep increasing past the old ones
+    time.Sleep(time.Millisecond)
+    b := newEventBus(16)
+    first := b.publish(EventTaskStatus, "acme", "after").ID
+    if first <= seen { t.Fatalf("new run's id %d not after %d", first, seen) }
+    b.publish(EventTaskStatus, "acme", "more")
+
+    // a client resuming from the old run replays all of this one, lagged
+    last, ok := b.resumeFrom(seen)
+    if ok || last != first-1 { t.Fatalf("old id resumed as %d %v", last, ok) }
+    missed, complete := b.since(seen, eventFilter{})
+    if complete || len(missed) != 2 || missed[0].ID != first { t.Fatalf("since old id: %d events complete=%v", len(missed), complete) }
+    // so does one from a run it can't place, e.g. a counter that began at 1
+    for _, id := range []int64{900, first + 100} {
+        if last, ok := b.resumeFrom(id); ok || last != first-1 { t.Fatalf("resumeFrom(%d)=%d %v", id, last, ok) }
+    }
+    if _, complete := b.since(first, eventFilter{}); !complete { t.Fatal("resume within the run reported incomplete") }
+}
+
+func TestEventsSSEResumeAcrossRestart(t *testing.T) {
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    org := uniq("evt-restart")
+    publishEvent(EventTaskScheduled, org, map[string]any{"text": "since the restart"})
+
+    // a dashboard that last saw event 900 of an earlier run
+    br := openStream(t, ctx, srv.URL+"/events?org="+org, "900")
+    evs := readEvents(t, br, 2)
+    if evs[0].event != "lagged" || !strings.Contains(evs[0].data, `"restarted":true`) { t.Fatalf("expected lagged first: %+v", evs[0]) }
+    if evs[1].event != EventTaskScheduled || !strings.Contains(evs[1].data, "since the restart") { t.Fatalf("event after restart dropped: %+v", evs[1]) }
+    publishEvent(EventTaskScheduled, org, map[string]any{"text": "live"})
+    if ev := readEvents(t, br, 1)[0]; !strings.Contains(ev.data, "live") { t.Fatalf("live event: %+v", ev) }
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "fmt"
     "encoding/json"
     "errors"
@@ -8,11 +9,10 @@ import (
     "log"
     "net"
     "net/http"
-    "net/http/httputil"
-    "net/url"
     "os"
     "os/exec"
-    "regexp"
+    "path/filepath"
+    "strconv"
     "strings"
     "sync"
     "time"
@@ -26,21 +26,84 @@ type Health struct {
 type Task struct {
     ID        string    `json:"id"`
     Org       string    `json:"org"`
+    // Kind picks the agent's executor (see taskKinds); empty means spec-kit.
+    Kind      string    `json:"kind,omitempty"`
     Text      string    `json:"text"`
     Status    string    `json:"status"`
     AgentHint string    `json:"agentHint,omitempty"`
     CreatedAt time.Time `json:"createdAt"`
     AgentID   string    `json:"agentId,omitempty"`
+    Result    *TaskResult `json:"result,omitempty"`
+    // Progress is the latest the running agent reported in its heartbeat.
+    Progress  *TaskProgress `json:"progress,omitempty"`
 }
 
+// TaskProgress is where a task is, as reported by agent heartbeats: the
+// phase (claimed, context, run, pr) and, if the tool reports it, percent
+// and step.
+type TaskProgress struct {
+    TaskID    string    `json:"taskId"`
+    Phase     string    `json:"phase,omitempty"`
+    Percent   *int      `json:"percent,omitempty"`
+    Step      string    `json:"step,omitempty"`
+    UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (p *TaskProgress) sameAs(o *TaskProgress) bool {
+    if p == nil || o == nil { return p == o }
+    samePct := (p.Percent == nil) == (o.Percent == nil) && (p.Percent == nil || *p.Percent == *o.Percent)
+    return p.Phase == o.Phase && p.Step == o.Step && samePct
+}
+
+// TaskResult is what the agent reports when a task finishes.
+type TaskResult struct {
+    ExitCode   int    `json:"exitCode"`
+    Error      string `json:"error,omitempty"`
+    // Stderr is the tail of the executor's stderr.
+    Stderr     string `json:"stderr,omitempty"`
+    DurationMs int64  `json:"durationMs"`
+}
+
+// taskKinds are the executors agents provide: spec-kit runs the task text
+// through spec-kit, shell runs it as a shell command and coding-cli passes
+// it as the prompt to a coding CLI.
+var taskKinds = map[string]bool{"spec-kit": true, "shell": true, "coding-cli": true}
+
 type Agent struct {
     Name   string            `json:"name"`
     Org    string            `json:"org"`
+    // Deployment is the backend deployment (and Service) the agent runs in,
+    // as reported by the agent from AGENT_DEPLOYMENT.
+    Deployment string        `json:"deployment,omitempty"`
     Labels map[string]string `json:"labels,omitempty"`
     Status string            `json:"status"`
     LastSeen time.Time       `json:"lastSeen"`
     EditorPort int           `json:"editorPort,omitempty"`
     EditorVia  string        `json:"editorVia,omitempty"`
+    // IdleSince is when the agent last became idle; unset while it works.
+    IdleSince *time.Time     `json:"idleSince,omitempty"`
+    // Tasks are the agent's tasks in progress, from its last heartbeat.
+    Tasks []TaskProgress     `json:"tasks,omitempty"`
+    // Capacity is how many tasks the agent runs at once (its task slots),
+    // as advertised on register and heartbeat; 0 means 1.
+    Capacity int             `json:"capacity,omitempty"`
+    // InFlight is how many tasks the agent holds, filled in by /agents.
+    InFlight int             `json:"inFlight"`
+    // Instance identifies one run of the agent process and Hostname the
+    // host it runs on; Name is the agent's persistent ID (see identity.go).
+    Instance string          `json:"instance,omitempty"`
+    Hostname string          `json:"hostname,omitempty"`
+}
+
+// markIdle keeps IdleSince in step with Status.
+func (a *Agent) markIdle() {
+    switch {
+    case a.Status != "idle":
+        a.IdleSince = nil
+    case a.IdleSince == nil:
+        t := a.LastSeen
+        a.IdleSince = &t
+    }
 }
 
 var (
@@ -50,17 +113,13 @@ var (
     agentsMu sync.RWMutex
     agents   = make(map[string]Agent)
 
-    taskLogsMu sync.RWMutex
-    taskLogs   = make(map[string][]string)
+    // durable per-task and per-agent logs (see logstore.go)
+    taskLogs  *logStore
+    agentLogs *logStore
 
-    agentLogsMu sync.RWMutex
-    agentLogs   = make(map[string][]string)
-
-    // SSE subscribers
-    taskSubsMu sync.Mutex
-    taskSubs   = make(map[string]map[chan string]struct{}) // id -> set of channels
-    agentSubsMu sync.Mutex
-    agentSubs   = make(map[string]map[chan string]struct{}) // name -> set of channels
+    // SSE subscribers by task id / agent name (see sse.go)
+    taskHub  = newLogHub()
+    agentHub = newLogHub()
     // editor port-forwards per agent
     editorMu sync.Mutex
     editorPF = make(map[string]*portFwd)
@@ -68,21 +127,24 @@ var (
 
 type portFwd struct {
     Port int
-    Cmd  *exec.Cmd
+    Cmd  *exec.Cmd    // kubectl port-forward
+    ln   net.Listener // or a listener piping into the agent's tunnel (see tunnel.go)
 }
 
-// try to find a free port in a small range
+// try to find a free port in a small range. Editor forwards listen on
+// loopback only: editorTransport is their one client, and anything else
+// reaching them would bypass the operator token and session checks.
 func pickPort() int {
     // prefer 10080..10150 to avoid common local ports
     for p := 10080; p <= 10150; p++ {
-        ln, err := net.Listen("tcp", ":"+itoa(p))
+        ln, err := net.Listen("tcp", "127.0.0.1:"+itoa(p))
         if err == nil {
             ln.Close()
             return p
         }
     }
     // fallback: random by asking OS
-    ln, err := net.Listen("tcp", ":0")
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
     if err != nil { return 0 }
     addr := ln.Addr().(*net.TCPAddr)
     port := addr.Port
@@ -93,10 +155,23 @@ func pickPort() int {
 // small helper for int->string
 func itoa(i int) string { return fmt.Sprintf("%d", i) }
 
-// ensureEditorForward starts (or returns) a kubectl port-forward to the agent's Service
+// ensureEditorForward returns a local port for the agent's editor: through
+// the agent's tunnel when it has one, else a kubectl port-forward to its
+// Service.
 func ensureEditorForward(name, org string) (int, error) {
-    svcName := deriveServiceName(name)
+    svcName := editorServiceName(name)
+    tunnel := tunnelFor(name) != nil
     editorMu.Lock()
+    if pf, ok := editorPF[name]; ok && tunnel && pf.ln == nil {
+        // a tunnel came up; retire the kubectl forward
+        editorMu.Unlock()
+        stopEditorForward(name)
+        editorMu.Lock()
+    }
+    if pf, ok := editorPF[name]; ok && pf.ln != nil {
+        editorMu.Unlock()
+        return pf.Port, nil
+    }
     if pf, ok := editorPF[name]; ok {
         port := pf.Port
         cmd := pf.Cmd
@@ -111,23 +186,19 @@ func ensureEditorForward(name, org string) (int, error) {
         if cmd != nil && cmd.Process != nil {
             _ = cmd.Process.Kill()
         }
+        setEditorPort(name, 0, "")
         editorMu.Lock()
         delete(editorPF, name)
-        if a, ok := agents[name]; ok {
-            a.EditorPort = 0
-            a.EditorVia = ""
-            agents[name] = a
-        }
-        editorMu.Unlock()
     }
     editorMu.Unlock()
+    if tunnel { return openTunnelForward(name, org) }
 
     // try a few ports until one binds and is ready
     for attempt := 0; attempt < 8; attempt++ {
         port := pickPort()
         if port == 0 { return 0, fmt.Errorf("no free port") }
-        log.Printf("opening editor forward for %s via svc/%s on :%d", name, svcName, port)
-        args := []string{"-n", "mvp-agents", "port-forward", "svc/"+svcName, itoa(port)+":8443", "--address=0.0.0.0"}
+        log.Printf("opening editor forward for %s via svc/%s on 127.0.0.1:%d", name, svcName, port)
+        args := []string{"-n", "mvp-agents", "port-forward", "svc/"+svcName, itoa(port)+":8443", "--address=127.0.0.1"}
         cmd := exec.Command("kubectl", args...)
         // capture stderr for diagnostics
         stderr, _ := cmd.StderrPipe()
@@ -161,63 +232,51 @@ func ensureEditorForward(name, org string) (int, error) {
         // success; record mapping
         editorMu.Lock()
         editorPF[name] = &portFwd{Port: port, Cmd: cmd}
-        if a, ok := agents[name]; ok {
-            a.EditorPort = port
-            a.EditorVia = "orchestrator"
-            agents[name] = a
-        }
         editorMu.Unlock()
+        setEditorPort(name, port, "orchestrator")
+        publishEvent(EventEditorOpened, org, map[string]any{"agent": name, "org": org, "port": port})
         go func(n string, c *exec.Cmd) {
             _ = c.Wait()
             editorMu.Lock()
-            if pf, ok := editorPF[n]; ok && pf.Cmd == c {
-                delete(editorPF, n)
-                if a, ok := agents[n]; ok {
-                    a.EditorPort = 0
-                    a.EditorVia = ""
-                    agents[n] = a
-                }
-            }
+            pf, ok := editorPF[n]
+            mine := ok && pf.Cmd == c
+            if mine { delete(editorPF, n) }
             editorMu.Unlock()
+            if mine { setEditorPort(n, 0, "") }
         }(name, cmd)
         return port, nil
     }
     return 0, fmt.Errorf("failed to establish port-forward for %s", name)
 }
 
-// deriveServiceName attempts to map a k8s pod name from a Deployment to the Service name created by deploy script.
-// deploy script names Deployment and Service as agent-<timestamp> (e.g., agent-1690000000)
-// Pod names look like agent-<timestamp>-<replicaset>-<podid> (e.g., agent-1690000000-68c7b795b9-6qtzm)
-func deriveServiceName(podOrAgent string) string {
-    // If it matches the pattern ending with -<rs>-<pod>, strip the last two segments
-    re := regexp.MustCompile(`^(.*)-[a-z0-9]{9,10}-[a-z0-9]{5}$`)
-    if m := re.FindStringSubmatch(podOrAgent); m != nil {
-        return m[1]
-    }
-    // Otherwise, if it looks like agent-<timestamp>-something, take first two parts
-    parts := strings.Split(podOrAgent, "-")
-    if len(parts) >= 2 && strings.HasPrefix(podOrAgent, "agent-") {
-        return parts[0] + "-" + parts[1]
-    }
-    // Fallback: return as-is
-    return podOrAgent
+// editorServiceName is the Service in front of an agent's editor: the
+// Deployment it registered from. Agents that didn't report one (deployed
+// by hand) are assumed to have a Service of their own name.
+func editorServiceName(name string) string {
+    agentsMu.RLock(); defer agentsMu.RUnlock()
+    if d := agents[name].Deployment; d != "" { return d }
+    return name
 }
 
+// stopEditorForward closes the agent's forward and ends its editor session.
 func stopEditorForward(name string) bool {
+    editorSessions.end(name, "closed")
     editorMu.Lock()
     pf, ok := editorPF[name]
     editorMu.Unlock()
-    if !ok || pf.Cmd == nil { return false }
-    // best-effort kill
-    _ = pf.Cmd.Process.Kill()
+    if !ok { return false }
+    if pf.ln != nil {
+        pf.ln.Close()
+    } else if pf.Cmd != nil && pf.Cmd.Process != nil {
+        // best-effort kill
+        _ = pf.Cmd.Process.Kill()
+    } else {
+        return false
+    }
     editorMu.Lock()
     delete(editorPF, name)
-    if a, ok := agents[name]; ok {
-        a.EditorPort = 0
-        a.EditorVia = ""
-        agents[name] = a
-    }
     editorMu.Unlock()
+    setEditorPort(name, 0, "")
     return true
 }
 
@@ -250,7 +309,23 @@ func decodeJSON[T any](r *http.Request, v *T) error {
     return json.Unmarshal(b, v)
 }
 
+// storesOnce guards the stores below: they own files under STATE_DIR and
+// the operation workers, so a second registerHandlers (tests build many
+// muxes) must share them rather than start over.
+var storesOnce sync.Once
+
+func initStores() {
+    segBytes := envInt64("LOG_SEGMENT_BYTES", defaultLogSegmentBytes)
+    taskLogs = newLogStore(filepath.Join(stateDir(), "logs", "tasks"), segBytes, retentionFromEnv)
+    agentLogs = newLogStore(filepath.Join(stateDir(), "logs", "agents"), segBytes, retentionFromEnv)
+    webhooks = newWebhookStore(filepath.Join(stateDir(), "webhooks.json"))
+    auditLogs = newLogStore(filepath.Join(stateDir(), "logs", "audit"), segBytes, retentionFromEnv)
+    operations = newOpRunner(envInt("OPERATION_WORKERS", 4), 64, newLogStore(filepath.Join(stateDir(), "logs", "operations"), segBytes, retentionFromEnv))
+}
+
 func registerHandlers(mux *http.ServeMux) {
+    storesOnce.Do(initStores)
+
     mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
         h := Health{Status: "ok", Host: hostname()}
         writeJSON(w, h)
@@ -259,6 +334,7 @@ func registerHandlers(mux *http.ServeMux) {
     // Generate kubeconfig for an org by invoking talosctl (via a Docker container) inside this orchestrator.
     // POST /kubeconfig/generate { org: string, endpoint: string }
     // Writes to /state/kube/<org>.config so both orchestrator and dashboard can read it.
+    // Runs as an operation: responds 202 with an operation id (see /operations/{id}).
     mux.HandleFunc("/kubeconfig/generate", requireToken(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
         var req struct{ Org, Endpoint string }
@@ -268,150 +344,47 @@ func registerHandlers(mux *http.ServeMux) {
         if req.Org == "" || req.Endpoint == "" {
             http.Error(w, "missing org/endpoint", 400); return
         }
-        // Ensure output dir exists
-        _ = os.MkdirAll("/state/kube", 0o755)
-        outPath := "/state/kube/" + req.Org + ".config"
-        // Allow overriding the talosctl image via env; default to a known tag
-        image := os.Getenv("TALOSCTL_IMAGE")
-        if image == "" { image = "ghcr.io/siderolabs/talosctl:v1.7.4" }
-        // docker run --rm -v /state/kube:/out ghcr.io/siderolabs/talosctl talosctl kubeconfig --endpoints <ip> --force --nodes <ip> --merge=false --force-context-name <org> --output /out/<org>.config
-        args := []string{
-            "run", "--rm",
-            "-v", "/state/kube:/out",
-            image,
-            "talosctl", "kubeconfig",
-            "--endpoints", req.Endpoint,
-            "--force",
-            "--nodes", req.Endpoint,
-            "--merge=false",
-            "--force-context-name", req.Org,
-            "--output", "/out/" + req.Org + ".config",
-        }
-        cmd := exec.Command("docker", args...)
-        // Pass through env minimally
-        cmd.Env = os.Environ()
-        out, err := cmd.CombinedOutput()
-        if err != nil {
-            code := 1
-            if ee, ok := err.(*exec.ExitError); ok { code = ee.ExitCode() }
-            w.WriteHeader(500)
-            writeJSON(w, map[string]any{
-                "ok": false,
-                "error": err.Error(),
-                "exitCode": code,
-                "output": string(out),
-            })
-            return
-        }
-        // Best effort: verify file exists
-        if _, err := os.Stat(outPath); err != nil {
-            w.WriteHeader(500)
-            writeJSON(w, map[string]any{
-                "ok": false,
-                "error": "kubeconfig not written",
-                "output": string(out),
-                "path": outPath,
-            })
-            return
-        }
-        writeJSON(w, map[string]any{"ok": true, "path": outPath})
+        acceptOperation(w, r, "kubeconfig.generate", req.Org, generateKubeconfigOp(req.Org, req.Endpoint))
     }, "ORCHESTRATOR_TOKEN"))
 
-    // Deploy an agent into the Talos org using the helper script.
-    // POST /agents/deploy { org: string, image?: string }
+    // Deploy an agent into the org's cluster (see deployer.go).
+    // POST /agents/deploy { org: string, image?: string, orchestratorUrl?: string, replicas?: int }
+    // The backend (kubernetes, script, local, docker) is chosen per org in config.
+    // Runs as an operation: responds 202 with an operation id (see /operations/{id}).
     mux.HandleFunc("/agents/deploy", requireToken(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct{ Org, Image, OrchestratorURL string }
+        var req struct{ Org, Image, OrchestratorURL string; Replicas int32 }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
         if strings.TrimSpace(req.Org) == "" { http.Error(w, "missing org", 400); return }
-        // Resolve script path relative to repository root in container
-        root := os.Getenv("WORKSPACE_DIR"); if root == "" { root = "/workspace" }
-        script := root + "/scripts/deploy_agent_talos.sh"
-        if _, err := os.Stat(script); err != nil {
-            http.Error(w, "deploy script not found", 500); return
-        }
-        orchURL := req.OrchestratorURL
-        if orchURL == "" {
-            // Default to our public base URL if present; otherwise use container host/port mapping
-            // In container, the orchestrator listens on 8080; clusters must resolve this
-            orchURL = os.Getenv("PUBLIC_ORCHESTRATOR_URL")
-            if orchURL == "" { orchURL = "http://orchestrator.tailnet:18080" }
-        }
-        token := os.Getenv("ORCHESTRATOR_TOKEN")
-        // If kubeconfig is available in shared state, pass it
-        stateKcfg := "/state/kube/" + req.Org + ".config"
-        if _, err := os.Stat(stateKcfg); err == nil {
-            os.Setenv("KUBECONFIG", stateKcfg)
-        }
-        // Prepare command
-        image := strings.TrimSpace(req.Image)
-        if image == "" { image = "mvp-agent:latest" }
-        cmd := exec.Command("bash", script, req.Org, image)
-        // Pass env that the script requires
-    cmd.Env = append(os.Environ(),
-            "ORCHESTRATOR_URL="+orchURL,
-            "ORCHESTRATOR_TOKEN="+token,
-        )
-        // Capture output for response
-        out, err := cmd.CombinedOutput()
-        if err != nil {
-            code := 1
-            if ee, ok := err.(*exec.ExitError); ok {
-                code = ee.ExitCode()
-            }
-            w.WriteHeader(500)
-            writeJSON(w, map[string]any{
-                "ok": false,
-                "error": err.Error(),
-                "exitCode": code,
-                "output": string(out),
-            })
-            return
-        }
-        writeJSON(w, map[string]any{"ok": true, "exitCode": 0, "output": string(out)})
+        d, err := deployerFor(req.Org)
+        if err != nil { http.Error(w, err.Error(), 500); return }
+        spec := AgentSpec{Org: req.Org, Image: req.Image, OrchestratorURL: req.OrchestratorURL, Replicas: req.Replicas}
+        acceptOperation(w, r, "agent.deploy", req.Org, deployAgentOp(d, spec))
     }, "ORCHESTRATOR_TOKEN"))
 
-    // Proxy endpoint to expose a local forwarded editor port over the orchestrator's HTTP port.
-    // Usage: GET /editor/proxy/{port}/... -> http://127.0.0.1:{port}/...
-    mux.HandleFunc("/editor/proxy/", func(w http.ResponseWriter, r *http.Request) {
-        // path = /editor/proxy/{port}/rest...
-        p := strings.TrimPrefix(r.URL.Path, "/editor/proxy/")
-        if p == "" { http.Error(w, "missing port", 400); return }
-        seg := strings.SplitN(p, "/", 2)
-        portStr := seg[0]
-        rest := "/"
-        if len(seg) == 2 && seg[1] != "" { rest = "/" + seg[1] }
-        // Validate port
-        if _, err := fmt.Sscanf(portStr, "%d", new(int)); err != nil {
-            http.Error(w, "bad port", 400); return
-        }
-        // Prepare reverse proxy to the locally-forwarded port
-        target, _ := url.Parse("http://127.0.0.1:" + portStr)
-        rp := httputil.NewSingleHostReverseProxy(target)
-        // Relax frame headers and leave Location/Cookies as-is; dashboard will rewrite on its side
-        rp.ModifyResponse = func(resp *http.Response) error {
-            resp.Header.Del("X-Frame-Options")
-            resp.Header.Del("Content-Security-Policy")
-            return nil
-        }
-        orig := rp.Director
-        // Optional auth header for fallback Python server
-        csHeader := os.Getenv("CODE_SERVER_AUTH_HEADER"); if csHeader == "" { csHeader = "X-Agent-Auth" }
-        csToken := os.Getenv("CODE_SERVER_TOKEN"); if csToken == "" { csToken = "password" }
-        rp.Director = func(req *http.Request) {
-            orig(req)
-            req.URL.Scheme = "http"
-            req.URL.Host = "127.0.0.1:" + portStr
-            req.URL.Path = rest
-            // Preserve query string
-            req.Host = req.URL.Host
-            req.Header.Set(csHeader, csToken)
-        }
-        rp.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
-            http.Error(w, "proxy error: "+err.Error(), 502)
-        }
-        rp.ServeHTTP(w, r)
-    })
+    // Deployed agents: list, inspect, scale, delete (see deployments.go)
+    mux.HandleFunc("/deployments", requireToken(handleDeployments, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/deployments/", requireToken(handleDeployment, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/deployments/render", requireToken(handleDeploymentRender, "ORCHESTRATOR_TOKEN"))
+
+    // Desired-state agent pools from config: status, drift, reconcile now (see pools.go)
+    mux.HandleFunc("/pools", requireToken(handlePools, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/pools/", requireToken(handlePool, "ORCHESTRATOR_TOKEN"))
+
+    // Long-running operations started by the endpoints above
+    mux.HandleFunc("/operations", requireToken(handleOperations, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/operations/", requireToken(handleOperation, "ORCHESTRATOR_TOKEN"))
+
+    // Editor by agent name, for the operator or a signed editor session (see editor.go)
+    mux.HandleFunc("/editor/", handleEditorProxy)
+    // Open editor sessions: owner, last use, shares; idle ones are reaped (see editor_sessions.go)
+    mux.HandleFunc("/editor/sessions", requireToken(handleEditorSessions, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/editor/sessions/", requireToken(handleEditorSessionByAgent, "ORCHESTRATOR_TOKEN"))
+    // Shell in an agent's workspace over WebSocket, same access as the editor;
+    // sessions are recorded to the audit store (see terminal.go)
+    mux.HandleFunc("/terminal/", handleTerminal)
+    mux.HandleFunc("/terminal/sessions", requireToken(handleTerminalSessions, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/terminal/sessions/", requireToken(handleTerminalSession, "ORCHESTRATOR_TOKEN"))
 
     mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
         peers := []string{}
@@ -425,13 +398,17 @@ func registerHandlers(mux *http.ServeMux) {
 
     mux.HandleFunc("/schedule", requireToken(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct { Org string `json:"org"`; Task string `json:"task"`; AgentHint string `json:"agentHint,omitempty"` }
+        var req struct { Org string `json:"org"`; Task string `json:"task"`; Kind string `json:"kind,omitempty"`; AgentHint string `json:"agentHint,omitempty"` }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
         if req.Org == "" || req.Task == "" { http.Error(w, "missing org/task", 400); return }
+        if req.Kind != "" && !taskKinds[req.Kind] { http.Error(w, "unknown task kind "+req.Kind, 400); return }
         id := time.Now().Format("20060102-150405.000")
-        t := Task{ID: id, Org: req.Org, Text: req.Task, Status: "scheduled", AgentHint: req.AgentHint, CreatedAt: time.Now()}
+        t := Task{ID: id, Org: req.Org, Kind: req.Kind, Text: req.Task, Status: "scheduled", AgentHint: req.AgentHint, CreatedAt: time.Now()}
         tasksMu.Lock(); tasks[id] = t; tasksMu.Unlock()
         log.Printf("scheduled task id=%s org=%s text=%q", id, req.Org, req.Task)
+        publishEvent(EventTaskScheduled, t.Org, t)
+        claimWaiters.notify(t.Org)
+        pools.taskScheduled(t.Org)
         writeJSON(w, t)
     }, "ORCHESTRATOR_TOKEN"))
 
@@ -441,104 +418,103 @@ func registerHandlers(mux *http.ServeMux) {
         for _, t := range tasks { out = append(out, t) }
         writeJSON(w, out)
     })
-    mux.HandleFunc("/tasks/claim", func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct{ Org, AgentID string }
-        if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
-        if req.Org == "" || req.AgentID == "" { http.Error(w, "missing org/agentId", 400); return }
-        // prefer tasks that hint this agent, otherwise first scheduled task for org
-        tasksMu.Lock(); defer tasksMu.Unlock()
-        // pass 1: agent-hinted
-        for id, t := range tasks {
-            if t.Org == req.Org && t.Status == "scheduled" && t.AgentHint == req.AgentID {
-                t.Status = "running"; t.AgentID = req.AgentID; tasks[id] = t
-                writeJSON(w, t); return
-            }
-        }
-        // pass 2: any scheduled
-        for id, t := range tasks {
-            if t.Org == req.Org && t.Status == "scheduled" {
-                t.Status = "running"; t.AgentID = req.AgentID; tasks[id] = t
-                writeJSON(w, t); return
-            }
-        }
-        writeJSON(w, map[string]any{"task": nil})
-    })
-    mux.HandleFunc("/tasks/update", func(w http.ResponseWriter, r *http.Request) {
+    mux.HandleFunc("/tasks/claim", handleClaim)
+    mux.HandleFunc("/tasks/update", sequenced(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct{ ID, Status, Log string }
+        // finished tasks carry their result: {id, status, agent?, result: {exitCode, error, stderr, durationMs}}
+        var req struct{ ID, Status, Log, Agent string; Result *TaskResult }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
         if req.ID == "" || req.Status == "" { http.Error(w, "missing id/status", 400); return }
         tasksMu.Lock(); defer tasksMu.Unlock()
         t, ok := tasks[req.ID]; if !ok { http.Error(w, "not found", 404); return }
-        t.Status = req.Status; tasks[req.ID] = t
+        // an agent reporting on a task handed back or given to another
+        // agent (e.g. a stale instance) must not overwrite it
+        if req.Agent != "" && req.Agent != t.AgentID {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusConflict)
+            writeJSON(w, map[string]any{"error": "task " + t.ID + " is not assigned to " + req.Agent, "agent": t.AgentID})
+            return
+        }
+        t.Status = req.Status
+        if req.Result != nil { t.Result = req.Result }
+        // an agent hands a task back (e.g. on shutdown) by rescheduling it
+        if t.Status == "scheduled" { t.AgentID, t.Progress = "", nil }
+        tasks[req.ID] = t
+        publishEvent(EventTaskStatus, t.Org, t)
+        // a task put back in the queue, or a finished one freeing its
+        // agent's slot, may let a waiting claim through
+        if t.Status != "running" { claimWaiters.notify(t.Org) }
         writeJSON(w, t)
-    })
-    mux.HandleFunc("/tasks/log", func(w http.ResponseWriter, r *http.Request) {
+    }))
+    // POST /tasks/log {id, line} or a batch {id, lines: [{line, stream?, phase?}]}
+    mux.HandleFunc("/tasks/log", sequenced(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct{ ID, Line string }
+        var req struct{ ID, Line string; Lines []taskLogLine }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
         if req.ID == "" { http.Error(w, "missing id", 400); return }
-    if req.Line != "" { appendTaskLog(req.ID, req.Line); broadcastTask(req.ID, req.Line) }
-        log.Printf("task[%s]: %s", req.ID, req.Line)
+        if len(req.Lines) > maxTaskLogBatch { http.Error(w, "too many lines", http.StatusRequestEntityTooLarge); return }
+    if req.Line != "" { taskHub.broadcast(req.ID, appendTaskLog(req.ID, req.Line)) }
+        for _, l := range req.Lines { taskHub.broadcast(req.ID, appendTaskLog(req.ID, l.String())) }
+        if req.Line != "" { log.Printf("task[%s]: %s", req.ID, req.Line) }
         w.WriteHeader(204)
-    })
+    }))
+    // GET /tasks/logs?id=&from=&limit= reads a range by byte offset; without from, the last limit lines.
     mux.HandleFunc("/tasks/logs", func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
         id := r.URL.Query().Get("id")
         if id == "" { http.Error(w, "missing id", 400); return }
-        taskLogsMu.RLock(); lines := append([]string(nil), taskLogs[id]...); taskLogsMu.RUnlock()
-        writeJSON(w, map[string]any{"id": id, "lines": lines})
+        page, err := readLogPage(taskLogs, id, r)
+        if err != nil { http.Error(w, err.Error(), 400); return }
+        writeJSON(w, map[string]any{"id": id, "lines": page.lines(), "entries": page.Entries, "start": page.Start, "end": page.End, "next": page.Next})
     })
-    // SSE: task logs
+    // SSE: task logs; resumable via Last-Event-ID
     mux.HandleFunc("/events/tasks", func(w http.ResponseWriter, r *http.Request) {
         id := r.URL.Query().Get("id")
         if id == "" { http.Error(w, "missing id", 400); return }
-        w.Header().Set("Content-Type", "text/event-stream")
-        w.Header().Set("Cache-Control", "no-cache")
-        w.Header().Set("Connection", "keep-alive")
-        flusher, ok := w.(http.Flusher); if !ok { http.Error(w, "no flusher", 500); return }
-        ch := make(chan string, 16)
-        addTaskSub(id, ch); defer removeTaskSub(id, ch)
-        // send backlog
-        taskLogsMu.RLock(); for _, ln := range taskLogs[id] { io.WriteString(w, "data: "+ln+"\n\n") }; taskLogsMu.RUnlock(); flusher.Flush()
-        notify := w.(http.CloseNotifier).CloseNotify()
-        for {
-            select {
-            case ln := <-ch:
-                io.WriteString(w, "data: "+ln+"\n\n"); flusher.Flush()
-            case <-notify:
-                return
-            }
-        }
+        serveLogStream(w, r, taskLogs, taskHub, id)
     })
     mux.HandleFunc("/agents", func(w http.ResponseWriter, r *http.Request) {
+        held := inFlightTasks()
         agentsMu.RLock(); defer agentsMu.RUnlock()
         out := make([]Agent, 0, len(agents))
-        for _, a := range agents { out = append(out, a) }
+        for _, a := range agents { a.InFlight = held[a.Name]; out = append(out, a) }
         writeJSON(w, out)
     })
-    mux.HandleFunc("/agents/register", func(w http.ResponseWriter, r *http.Request) {
+    mux.HandleFunc("/agents/register", handleAgentRegister)
+    // POST /agents/deregister {name}: the agent is shutting down. Tasks it
+    // still holds go back in the queue. It needs the token, as it releases
+    // another agent's tasks.
+    mux.HandleFunc("/agents/deregister", requireToken(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct{ Name, Org string; Labels map[string]string }
+        var req struct{ Name string }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
-        if req.Name == "" || req.Org == "" { http.Error(w, "missing name/org", 400); return }
-    a := Agent{Name: req.Name, Org: req.Org, Labels: req.Labels, Status: "idle", LastSeen: time.Now()}
-        agentsMu.Lock(); agents[req.Name] = a; agentsMu.Unlock()
-    // auto-open editor port-forward (best-effort)
-    go func(name, org string) { _, _ = ensureEditorForward(name, org) }(req.Name, req.Org)
-        writeJSON(w, a)
-    })
+        if req.Name == "" { http.Error(w, "missing name", 400); return }
+        agentsMu.Lock(); a, ok := agents[req.Name]; delete(agents, req.Name); agentsMu.Unlock()
+        if !ok { http.Error(w, "not found", 404); return }
+        released := releaseAgentTasks(req.Name)
+        publishEvent(EventAgentDeregistered, a.Org, a)
+        writeJSON(w, map[string]any{"ok": true, "released": len(released)})
+    }, "ORCHESTRATOR_TOKEN"))
+    // Reverse tunnel from the agent for editor access (WebSocket; see tunnel.go)
+    mux.HandleFunc("/agents/tunnel", requireToken(handleAgentTunnel, "ORCHESTRATOR_TOKEN"))
     mux.HandleFunc("/agents/heartbeat", func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct{ Name, Org, Status string }
+        // tasks: [{taskId, phase, percent?, step?}] for the tasks in progress
+        var req struct{ Name, Org, Status, Deployment string; Tasks []TaskProgress; Capacity int }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
         if req.Name == "" { http.Error(w, "missing name", 400); return }
-        agentsMu.Lock(); a := agents[req.Name]; a.Name = req.Name; if req.Org != "" { a.Org = req.Org }; if req.Status != "" { a.Status = req.Status }; a.LastSeen = time.Now(); agents[req.Name] = a; agentsMu.Unlock()
-        // best-effort ensure editor forward exists
-        if a.EditorPort == 0 {
-            go func(name, org string) { _, _ = ensureEditorForward(name, org) }(req.Name, req.Org)
-        }
+        now := time.Now()
+        for i := range req.Tasks { req.Tasks[i].UpdatedAt = now }
+        agentsMu.Lock(); a, ok := agents[req.Name]
+        // an orchestrator restart forgets agents; make this one register again
+        if !ok { agentsMu.Unlock(); unknownAgent(w, req.Name); return }
+        if req.Org != "" { a.Org = req.Org }; if req.Deployment != "" { a.Deployment = req.Deployment }; if req.Status != "" { a.Status = req.Status } else if a.Status == "" || a.Status == "offline" { a.Status = "idle" }; a.LastSeen = now; a.markIdle()
+        // agents that predate progress reporting send no tasks at all
+        if req.Tasks != nil { a.Tasks = req.Tasks }
+        if req.Capacity > 0 { a.Capacity = req.Capacity }
+        agents[req.Name] = a; agentsMu.Unlock()
+        publishEvent(EventAgentHeartbeat, a.Org, a)
+        recordTaskProgress(req.Name, req.Tasks)
         writeJSON(w, map[string]string{"ok":"1"})
     })
     mux.HandleFunc("/agents/log", func(w http.ResponseWriter, r *http.Request) {
@@ -546,7 +522,7 @@ func registerHandlers(mux *http.ServeMux) {
         var req struct{ Name, Line string }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
         if req.Name == "" { http.Error(w, "missing name", 400); return }
-    if req.Line != "" { appendAgentLog(req.Name, req.Line); broadcastAgent(req.Name, req.Line) }
+    if req.Line != "" { agentHub.broadcast(req.Name, appendAgentLog(req.Name, req.Line)) }
         log.Printf("agent[%s]: %s", req.Name, req.Line)
         w.WriteHeader(204)
     })
@@ -554,42 +530,34 @@ func registerHandlers(mux *http.ServeMux) {
         if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
         name := r.URL.Query().Get("name")
         if name == "" { http.Error(w, "missing name", 400); return }
-        agentLogsMu.RLock(); lines := append([]string(nil), agentLogs[name]...); agentLogsMu.RUnlock()
-        writeJSON(w, map[string]any{"name": name, "lines": lines})
+        page, err := readLogPage(agentLogs, name, r)
+        if err != nil { http.Error(w, err.Error(), 400); return }
+        writeJSON(w, map[string]any{"name": name, "lines": page.lines(), "entries": page.Entries, "start": page.Start, "end": page.End, "next": page.Next})
     })
     
-    // SSE: agent logs
+    // Global typed event stream (SSE, or WebSocket on upgrade). Filters: ?org=a,b&type=task.*,agent.offline
+    mux.HandleFunc("/events", serveEvents)
+    // SSE: agent logs; resumable via Last-Event-ID
     mux.HandleFunc("/events/agents", func(w http.ResponseWriter, r *http.Request) {
         name := r.URL.Query().Get("name")
         if name == "" { http.Error(w, "missing name", 400); return }
-        w.Header().Set("Content-Type", "text/event-stream")
-        w.Header().Set("Cache-Control", "no-cache")
-        w.Header().Set("Connection", "keep-alive")
-        flusher, ok := w.(http.Flusher); if !ok { http.Error(w, "no flusher", 500); return }
-        ch := make(chan string, 16)
-        addAgentSub(name, ch); defer removeAgentSub(name, ch)
-        // send backlog
-        agentLogsMu.RLock(); for _, ln := range agentLogs[name] { io.WriteString(w, "data: "+ln+"\n\n") }; agentLogsMu.RUnlock(); flusher.Flush()
-        notify := w.(http.CloseNotifier).CloseNotify()
-        for {
-            select {
-            case ln := <-ch:
-                io.WriteString(w, "data: "+ln+"\n\n"); flusher.Flush()
-            case <-notify:
-                return
-            }
-        }
+        serveLogStream(w, r, agentLogs, agentHub, name)
     })
+    // Outbound webhook subscriptions (see webhooks.go)
+    mux.HandleFunc("/webhooks", requireToken(handleWebhooks, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/webhooks/", requireToken(handleWebhook, "ORCHESTRATOR_TOKEN"))
     // Editor control endpoints (token-protected)
     mux.HandleFunc("/agents/editor/open", requireToken(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
-        var req struct{ Name, Org string }
+        var req struct{ Name, Org, User string }
         if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
         if req.Name == "" { http.Error(w, "missing name", 400); return }
-        port, err := ensureEditorForward(req.Name, req.Org)
+        if req.User == "" { req.User = editorUser(r) }
+        sess, err := editorSessions.open(req.Name, req.Org, req.User)
         if err != nil { http.Error(w, err.Error(), 500); return }
-        writeJSON(w, map[string]any{"name": req.Name, "port": port})
+        writeJSON(w, map[string]any{"name": req.Name, "port": sess.Port, "session": sess})
     }, "ORCHESTRATOR_TOKEN"))
+    mux.HandleFunc("/agents/editor/session", requireToken(handleEditorSession, "ORCHESTRATOR_TOKEN"))
     mux.HandleFunc("/agents/editor/close", requireToken(func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
         var req struct{ Name string }
@@ -610,44 +578,143 @@ func hostname() string {
     return h
 }
 
-func appendTaskLog(id, line string) {
-    taskLogsMu.Lock(); defer taskLogsMu.Unlock()
-    b := append(taskLogs[id], time.Now().Format(time.RFC3339)+" "+line)
-    if len(b) > 200 { b = b[len(b)-200:] }
-    taskLogs[id] = b
+// releaseAgentTasks puts the tasks an agent holds back in the queue.
+func releaseAgentTasks(agent string) []Task {
+    var released []Task
+    tasksMu.Lock()
+    for id, t := range tasks {
+        if t.AgentID != agent || t.Status != "running" { continue }
+        t.Status, t.AgentID, t.Progress = "scheduled", "", nil
+        tasks[id] = t
+        released = append(released, t)
+    }
+    tasksMu.Unlock()
+    for _, t := range released {
+        log.Printf("released task id=%s from agent %s", t.ID, agent)
+        publishEvent(EventTaskStatus, t.Org, t)
+        claimWaiters.notify(t.Org)
+    }
+    return released
+}
+
+// recordTaskProgress copies heartbeat progress onto the agent's running
+// tasks, publishing task.progress when it changes.
+func recordTaskProgress(agent string, progress []TaskProgress) {
+    var changed []Task
+    tasksMu.Lock()
+    for _, p := range progress {
+        t, ok := tasks[p.TaskID]
+        if !ok || t.AgentID != agent || t.Status != "running" { continue }
+        p := p
+        same := t.Progress.sameAs(&p)
+        t.Progress = &p
+        tasks[p.TaskID] = t
+        if !same { changed = append(changed, t) }
+    }
+    tasksMu.Unlock()
+    for _, t := range changed { publishEvent(EventTaskProgress, t.Org, t) }
 }
 
-func appendAgentLog(name, line string) {
-    agentLogsMu.Lock(); defer agentLogsMu.Unlock()
-    b := append(agentLogs[name], time.Now().Format(time.RFC3339)+" "+line)
-    if len(b) > 200 { b = b[len(b)-200:] }
-    agentLogs[name] = b
+// taskLogLine is one line of agent tool output, tagged with the task phase
+// (run, pr) and stream (stdout, stderr) it came from.
+type taskLogLine struct {
+    Line   string `json:"line"`
+    Stream string `json:"stream,omitempty"`
+    Phase  string `json:"phase,omitempty"`
 }
 
-func addTaskSub(id string, ch chan string) {
-    taskSubsMu.Lock(); defer taskSubsMu.Unlock()
-    m := taskSubs[id]; if m == nil { m = make(map[chan string]struct{}); taskSubs[id] = m }
-    m[ch] = struct{}{}
+const (
+    maxTaskLogBatch = 1000
+    maxTaskLogLine  = 16 << 10
+)
+
+// String is the line as stored: "[phase/stream] text", cut at maxTaskLogLine.
+func (l taskLogLine) String() string {
+    line := l.Line
+    if len(line) > maxTaskLogLine { line = line[:maxTaskLogLine] + " …[truncated]" }
+    tag := strings.Trim(l.Phase+"/"+l.Stream, "/")
+    if tag == "" { return line }
+    return "[" + tag + "] " + line
 }
-func removeTaskSub(id string, ch chan string) {
-    taskSubsMu.Lock(); defer taskSubsMu.Unlock()
-    if m := taskSubs[id]; m != nil { delete(m, ch) }
+
+// appendTaskLog persists a line and returns the stored entry for broadcasting.
+// If the store is unavailable the entry has no offset and is delivered live only.
+func appendTaskLog(id, line string) logEntry {
+    tasksMu.RLock(); org := tasks[id].Org; tasksMu.RUnlock()
+    e, err := taskLogs.Append(id, org, line)
+    if err != nil {
+        log.Printf("task[%s] log append: %v", id, err)
+        return logEntry{TS: time.Now().UTC(), Line: line}
+    }
+    return e
 }
-func broadcastTask(id, ln string) {
-    taskSubsMu.Lock(); m := taskSubs[id]; taskSubsMu.Unlock()
-    for ch := range m { select { case ch <- ln: default: } }
+
+func appendAgentLog(name, line string) logEntry {
+    agentsMu.RLock(); org := agents[name].Org; agentsMu.RUnlock()
+    e, err := agentLogs.Append(name, org, line)
+    if err != nil {
+        log.Printf("agent[%s] log append: %v", name, err)
+        return logEntry{TS: time.Now().UTC(), Line: line}
+    }
+    return e
 }
 
-func addAgentSub(name string, ch chan string) {
-    agentSubsMu.Lock(); defer agentSubsMu.Unlock()
-    m := agentSubs[name]; if m == nil { m = make(map[chan string]struct{}); agentSubs[name] = m }
-    m[ch] = struct{}{}
+// readLogPage serves ?from=&limit= for a log stream. Without from it returns
+// the last limit entries so existing callers keep seeing the recent tail.
+func readLogPage(store *logStore, id string, r *http.Request) (logPage, error) {
+    q := r.URL.Query()
+    limit := defaultLogReadLimit
+    if v := q.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n <= 0 { return logPage{}, fmt.Errorf("bad limit") }
+        limit = n
+    }
+    if v := q.Get("from"); v != "" {
+        from, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || from < 0 { return logPage{}, fmt.Errorf("bad from") }
+        return store.Read(id, from, limit)
+    }
+    if limit > maxLogReadLimit { limit = maxLogReadLimit }
+    entries, err := store.Tail(id, limit)
+    if err != nil { return logPage{}, err }
+    start, end := store.Bounds(id)
+    if entries == nil { entries = []logEntry{} }
+    return logPage{Start: start, End: end, Next: end, Entries: entries}, nil
 }
-func removeAgentSub(name string, ch chan string) {
-    agentSubsMu.Lock(); defer agentSubsMu.Unlock()
-    if m := agentSubs[name]; m != nil { delete(m, ch) }
+
+func (p logPage) lines() []string {
+    out := make([]string, 0, len(p.Entries))
+    for _, e := range p.Entries { out = append(out, e.String()) }
+    return out
 }
-func broadcastAgent(name, ln string) {
-    agentSubsMu.Lock(); m := agentSubs[name]; agentSubsMu.Unlock()
-    for ch := range m { select { case ch <- ln: default: } }
+
+// generateKubeconfigOp runs talosctl in a container to write /state/kube/<org>.config.
+func generateKubeconfigOp(org, endpoint string) opFunc {
+    return func(ctx context.Context, out io.Writer) (any, error) {
+        // Ensure output dir exists
+        _ = os.MkdirAll("/state/kube", 0o755)
+        outPath := "/state/kube/" + org + ".config"
+        // Allow overriding the talosctl image via env; default to a known tag
+        image := os.Getenv("TALOSCTL_IMAGE")
+        if image == "" { image = "ghcr.io/siderolabs/talosctl:v1.7.4" }
+        // docker run --rm -v /state/kube:/out ghcr.io/siderolabs/talosctl talosctl kubeconfig --endpoints <ip> --force --nodes <ip> --merge=false --force-context-name <org> --output /out/<org>.config
+        args := []string{
+            "run", "--rm",
+            "-v", "/state/kube:/out",
+            image,
+            "talosctl", "kubeconfig",
+            "--endpoints", endpoint,
+            "--force",
+            "--nodes", endpoint,
+            "--merge=false",
+            "--force-context-name", org,
+            "--output", "/out/" + org + ".config",
+        }
+        if err := runCommand(ctx, out, "docker", args, os.Environ()); err != nil { return nil, err }
+        // Best effort: verify file exists
+        if _, err := os.Stat(outPath); err != nil {
+            return map[string]any{"path": outPath}, fmt.Errorf("kubeconfig not written")
+        }
+        return map[string]any{"path": outPath}, nil
+    }
 }
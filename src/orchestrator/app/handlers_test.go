@@ -3,12 +3,37 @@ package main
 import (
     "bytes"
     "encoding/json"
+    "fmt"
     "net/http"
     "net/http/httptest"
     "os"
+    "sync/atomic"
     "testing"
+    "time"
 )
 
+func TestMain(m *testing.M) {
+    dir, err := os.MkdirTemp("", "orchestrator-state-")
+    if err != nil { panic(err) }
+    os.Setenv("STATE_DIR", dir)
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+// uniq makes key unique to this run, so tests that write to the shared
+// stores still pass with -count=N.
+func uniq(key string) string { return fmt.Sprintf("%s-%d", key, uniqSeq.Add(1)) }
+
+var uniqSeq atomic.Int64
+
+// doPost sends a POST with body to srv and records the response.
+func doPost(srv http.Handler, path, body string) *httptest.ResponseRecorder {
+    rr := httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("POST", path, bytes.NewBufferString(body)))
+    return rr
+}
+
 func newServer() *http.ServeMux {
     mux := http.NewServeMux()
     registerHandlers(mux)
@@ -50,3 +75,207 @@ func TestScheduleAuthAndValidation(t *testing.T) {
     }
     if resp["status"] != "scheduled" { t.Fatalf("unexpected status: %v", resp["status"]) }
 }
+
+func TestTaskKindAndResult(t *testing.T) {
+    srv := newServer()
+    if rr := doPost(srv, "/schedule", `{"org":"kinds","task":"make test","kind":"bogus"}`); rr.Code != 400 { t.Fatalf("unknown kind: %d", rr.Code) }
+    rr := doPost(srv, "/schedule", `{"org":"kinds","task":"make test","kind":"shell"}`)
+    if rr.Code != 200 { t.Fatalf("schedule: %d %s", rr.Code, rr.Body) }
+
+    doPost(srv, "/agents/register", `{"name":"k1","org":"kinds"}`)
+    defer func() { agentsMu.Lock(); delete(agents, "k1"); agentsMu.Unlock() }()
+    var claimed Task
+    json.Unmarshal(doPost(srv, "/tasks/claim", `{"org":"kinds","agentId":"k1"}`).Body.Bytes(), &claimed)
+    if claimed.Kind != "shell" || claimed.Text != "make test" { t.Fatalf("claimed %+v", claimed) }
+
+    rr = doPost(srv, "/tasks/update", `{"id":"`+claimed.ID+`","status":"failed","result":{"exitCode":2,"error":"exit status 2","stderr":"make: *** [test] Error 2","durationMs":1500}}`)
+    var updated Task
+    json.Unmarshal(rr.Body.Bytes(), &updated)
+    if rr.Code != 200 || updated.Status != "failed" || updated.Result == nil || updated.Result.ExitCode != 2 || updated.Result.Stderr == "" || updated.Result.DurationMs != 1500 { t.Fatalf("update: %d %s", rr.Code, rr.Body) }
+    tasksMu.Lock(); delete(tasks, claimed.ID); tasksMu.Unlock()
+}
+
+func TestTaskUpdateFromNonOwner(t *testing.T) {
+    srv := newServer()
+    doPost(srv, "/agents/register", `{"name":"own-1","org":"owners"}`)
+    doPost(srv, "/agents/register", `{"name":"own-2","org":"owners"}`)
+    doPost(srv, "/schedule", `{"org":"owners","task":"build"}`)
+    var claimed Task
+    json.Unmarshal(doPost(srv, "/tasks/claim", `{"org":"owners","agentId":"own-1"}`).Body.Bytes(), &claimed)
+    if claimed.ID == "" { t.Fatal("nothing claimed") }
+    defer func() { tasksMu.Lock(); delete(tasks, claimed.ID); tasksMu.Unlock(); agentsMu.Lock(); delete(agents, "own-1"); delete(agents, "own-2"); agentsMu.Unlock() }()
+    update := func(agent, status string) *httptest.ResponseRecorder {
+        return doPost(srv, "/tasks/update", `{"id":"`+claimed.ID+`","agent":"`+agent+`","status":"`+status+`","result":{"exitCode":1}}`)
+    }
+
+    // another agent can't close a task it doesn't hold
+    rr := update("own-2", "failed")
+    var conflict struct{ Error, Agent string }
+    json.Unmarshal(rr.Body.Bytes(), &conflict)
+    if rr.Code != 409 || conflict.Agent != "own-1" { t.Fatalf("update from non-owner: %d %s", rr.Code, rr.Body) }
+    tasksMu.RLock(); tk := tasks[claimed.ID]; tasksMu.RUnlock()
+    if tk.Status != "running" || tk.Result != nil { t.Fatalf("task changed by non-owner: %+v", tk) }
+
+    // once handed back and given to another agent, the old owner's
+    // reports are refused too
+    if rr := update("own-1", "scheduled"); rr.Code != 200 { t.Fatalf("hand back: %d %s", rr.Code, rr.Body) }
+    json.Unmarshal(doPost(srv, "/tasks/claim", `{"org":"owners","agentId":"own-2"}`).Body.Bytes(), &claimed)
+    if rr := update("own-1", "completed"); rr.Code != 409 { t.Fatalf("update from old owner: %d %s", rr.Code, rr.Body) }
+    if rr := update("own-2", "completed"); rr.Code != 200 { t.Fatalf("update from owner: %d %s", rr.Code, rr.Body) }
+    tasksMu.RLock(); tk = tasks[claimed.ID]; tasksMu.RUnlock()
+    if tk.Status != "completed" || tk.AgentID != "own-2" { t.Fatalf("task after owner's update: %+v", tk) }
+}
+
+func TestHeartbeatProgress(t *testing.T) {
+    srv := newServer()
+    sub := events.subscribe(eventFilter{types: []string{EventTaskProgress}})
+    defer events.unsubscribe(sub)
+    doPost(srv, "/agents/register", `{"name":"hb1","org":"beats"}`)
+    doPost(srv, "/agents/register", `{"name":"hb2","org":"beats"}`)
+    doPost(srv, "/schedule", `{"org":"beats","task":"build"}`)
+    var claimed Task
+    json.Unmarshal(doPost(srv, "/tasks/claim", `{"org":"beats","agentId":"hb1"}`).Body.Bytes(), &claimed)
+    if claimed.ID == "" { t.Fatal("nothing claimed") }
+    defer func() { tasksMu.Lock(); delete(tasks, claimed.ID); tasksMu.Unlock(); agentsMu.Lock(); delete(agents, "hb1"); delete(agents, "hb2"); agentsMu.Unlock() }()
+
+    beat := `{"name":"hb1","org":"beats","status":"running","tasks":[{"taskId":"` + claimed.ID + `","phase":"run","percent":40,"step":"compiling"}]}`
+    if rr := doPost(srv, "/agents/heartbeat", beat); rr.Code != 200 { t.Fatalf("heartbeat: %d %s", rr.Code, rr.Body) }
+    // the same progress again is not a new event
+    doPost(srv, "/agents/heartbeat", beat)
+    // another agent can't report on a task it doesn't hold
+    doPost(srv, "/agents/heartbeat", `{"name":"hb2","org":"beats","tasks":[{"taskId":"`+claimed.ID+`","phase":"pr"}]}`)
+
+    tasksMu.RLock(); p := tasks[claimed.ID].Progress; tasksMu.RUnlock()
+    if p == nil || p.Phase != "run" || p.Percent == nil || *p.Percent != 40 || p.Step != "compiling" { t.Fatalf("progress %+v", p) }
+    agentsMu.RLock(); n := len(agents["hb1"].Tasks); agentsMu.RUnlock()
+    if n != 1 { t.Fatalf("agent tasks: %d", n) }
+    select {
+    case <-sub.ch:
+    case <-time.After(time.Second):
+        t.Fatal("no task.progress event")
+    }
+    select {
+    case ev := <-sub.ch:
+        t.Fatalf("unexpected event %+v", ev)
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    // idle with no tasks clears the agent's list
+    doPost(srv, "/agents/heartbeat", `{"name":"hb1","status":"idle","tasks":[]}`)
+    agentsMu.RLock(); n = len(agents["hb1"].Tasks); agentsMu.RUnlock()
+    if n != 0 { t.Fatalf("agent tasks after idle: %d", n) }
+}
+
+func TestAgentDeregisterReleasesTasks(t *testing.T) {
+    srv := newServer()
+    doPost(srv, "/agents/register", `{"name":"bye-1","org":"bye","capacity":2}`)
+    doPost(srv, "/schedule", `{"org":"bye","task":"one"}`)
+    time.Sleep(time.Millisecond) // task ids are timestamps
+    doPost(srv, "/schedule", `{"org":"bye","task":"two"}`)
+    var first, second Task
+    json.Unmarshal(doPost(srv, "/tasks/claim", `{"org":"bye","agentId":"bye-1"}`).Body.Bytes(), &first)
+    json.Unmarshal(doPost(srv, "/tasks/claim", `{"org":"bye","agentId":"bye-1"}`).Body.Bytes(), &second)
+    if first.ID == "" || second.ID == "" { t.Fatalf("claims: %q %q", first.ID, second.ID) }
+    defer func() { tasksMu.Lock(); delete(tasks, first.ID); delete(tasks, second.ID); tasksMu.Unlock() }()
+
+    // the agent hands one back itself on shutdown...
+    if rr := doPost(srv, "/tasks/update", `{"id":"`+first.ID+`","status":"scheduled"}`); rr.Code != 200 { t.Fatalf("release: %d", rr.Code) }
+    // ...and deregistering releases whatever it still held
+    rr := doPost(srv, "/agents/deregister", `{"name":"bye-1"}`)
+    var resp struct{ Released int }
+    json.Unmarshal(rr.Body.Bytes(), &resp)
+    if rr.Code != 200 || resp.Released != 1 { t.Fatalf("deregister: %d %s", rr.Code, rr.Body) }
+    tasksMu.RLock()
+    for _, id := range []string{first.ID, second.ID} {
+        if tk := tasks[id]; tk.Status != "scheduled" || tk.AgentID != "" { tasksMu.RUnlock(); t.Fatalf("task %s not released: %+v", id, tk) }
+    }
+    tasksMu.RUnlock()
+    agentsMu.RLock(); _, still := agents["bye-1"]; agentsMu.RUnlock()
+    if still { t.Fatal("agent still registered") }
+    if rr := doPost(srv, "/agents/deregister", `{"name":"bye-1"}`); rr.Code != 404 { t.Fatalf("second deregister: %d", rr.Code) }
+
+    // with a token set, only token holders can deregister an agent
+    t.Setenv("ORCHESTRATOR_TOKEN", "secret")
+    srv = newServer()
+    doPost(srv, "/agents/register", `{"name":"bye-2","org":"bye"}`)
+    defer func() { agentsMu.Lock(); delete(agents, "bye-2"); agentsMu.Unlock() }()
+    if rr := doPost(srv, "/agents/deregister", `{"name":"bye-2"}`); rr.Code != 401 { t.Fatalf("deregister without token: %d", rr.Code) }
+    rr = httptest.NewRecorder()
+    req := httptest.NewRequest("POST", "/agents/deregister", bytes.NewBufferString(`{"name":"bye-2"}`))
+    req.Header.Set("X-Auth-Token", "secret")
+    srv.ServeHTTP(rr, req)
+    if rr.Code != 200 { t.Fatalf("deregister with token: %d %s", rr.Code, rr.Body) }
+}
+
+func TestAgentRegisterIdentity(t *testing.T) {
+    srv := newServer()
+    defer func() { agentsMu.Lock(); delete(agents, "id-1"); agentsMu.Unlock() }()
+    if rr := doPost(srv, "/agents/register", `{"name":"id-1","org":"ident","instance":"a","hostname":"pod-1"}`); rr.Code != 200 { t.Fatalf("register: %d %s", rr.Code, rr.Body) }
+    doPost(srv, "/schedule", `{"org":"ident","task":"held"}`)
+    var held Task
+    json.Unmarshal(doPost(srv, "/tasks/claim", `{"org":"ident","agentId":"id-1"}`).Body.Bytes(), &held)
+    if held.ID == "" { t.Fatal("no task claimed") }
+    defer func() { tasksMu.Lock(); delete(tasks, held.ID); tasksMu.Unlock() }()
+
+    // another host using the same ID while it is live is refused
+    rr := doPost(srv, "/agents/register", `{"name":"id-1","org":"ident","instance":"b","hostname":"pod-2"}`)
+    var conflict struct{ Error string; Agent Agent }
+    json.Unmarshal(rr.Body.Bytes(), &conflict)
+    if rr.Code != 409 || conflict.Agent.Hostname != "pod-1" || conflict.Error == "" { t.Fatalf("duplicate: %d %s", rr.Code, rr.Body) }
+    if rr := doPost(srv, "/agents/register", `{"name":"id-1","org":"other","instance":"b","hostname":"pod-1"}`); rr.Code != 409 { t.Fatalf("other org: %d", rr.Code) }
+    tasksMu.RLock(); tk := tasks[held.ID]; tasksMu.RUnlock()
+    if tk.AgentID != "id-1" { t.Fatalf("refused registration touched the task: %+v", tk) }
+
+    // the same host with a new instance is a restart: its tasks are released
+    rr = doPost(srv, "/agents/register", `{"name":"id-1","org":"ident","instance":"c","hostname":"pod-1"}`)
+    var a Agent
+    json.Unmarshal(rr.Body.Bytes(), &a)
+    if rr.Code != 200 || a.Name != "id-1" || a.Instance != "c" { t.Fatalf("restart: %d %s", rr.Code, rr.Body) }
+    tasksMu.RLock(); tk = tasks[held.ID]; tasksMu.RUnlock()
+    if tk.Status != "scheduled" || tk.AgentID != "" { t.Fatalf("task not released on restart: %+v", tk) }
+
+    // an offline record can be taken over
+    agentsMu.Lock(); prev := agents["id-1"]; prev.Status = "offline"; agents["id-1"] = prev; agentsMu.Unlock()
+    if rr := doPost(srv, "/agents/register", `{"name":"id-1","org":"ident","instance":"d","hostname":"pod-3"}`); rr.Code != 200 { t.Fatalf("takeover: %d", rr.Code) }
+}
+
+func TestAgentReregistersAfterRestart(t *testing.T) {
+    srv := newServer()
+    defer func() {
+        agentsMu.Lock(); delete(agents, "rr-1"); delete(agents, "rr-2"); agentsMu.Unlock()
+        tasksMu.Lock(); for _, id := range []string{"rr-lost", "rr-taken", "rr-done", "rr-closed"} { delete(tasks, id) }; tasksMu.Unlock()
+    }()
+    // a restarted orchestrator doesn't know the agent: it is told to register
+    for _, path := range []string{"/agents/heartbeat", "/tasks/claim"} {
+        rr := doPost(srv, path, `{"name":"rr-1","org":"rr","agentId":"rr-1"}`)
+        var resp struct{ Register bool }
+        json.Unmarshal(rr.Body.Bytes(), &resp)
+        if rr.Code != 404 || !resp.Register { t.Fatalf("%s from unknown agent: %d %s", path, rr.Code, rr.Body) }
+    }
+    agentsMu.RLock(); _, created := agents["rr-1"]; agentsMu.RUnlock()
+    if created { t.Fatal("heartbeat created an agent record") }
+
+    // meanwhile another agent got one of its tasks
+    doPost(srv, "/agents/register", `{"name":"rr-2","org":"rr"}`)
+    tasksMu.Lock(); tasks["rr-taken"] = Task{ID: "rr-taken", Org: "rr", Text: "b", Status: "running", AgentID: "rr-2"}; tasksMu.Unlock()
+    // and one it finished was closed before the orchestrator went away
+    tasksMu.Lock(); tasks["rr-closed"] = Task{ID: "rr-closed", Org: "rr", Text: "d", Status: "completed", AgentID: "rr-1"}; tasksMu.Unlock()
+
+    rr := doPost(srv, "/agents/register", `{"name":"rr-1","org":"rr","labels":{"gpu":"true"},"capacity":2,"tasks":[
+        {"taskId":"rr-lost","kind":"shell","text":"make","phase":"run","percent":30},
+        {"taskId":"rr-taken","text":"b","phase":"run"},
+        {"taskId":"rr-done","text":"c","phase":"pr","status":"completed"},
+        {"taskId":"rr-closed","text":"d","phase":"pr","status":"completed"}]}`)
+    var reg struct{ Agent; Resumed, Rejected []string }
+    json.Unmarshal(rr.Body.Bytes(), &reg)
+    if rr.Code != 200 || reg.Labels["gpu"] != "true" || reg.Status != "running" { t.Fatalf("register: %d %s", rr.Code, rr.Body) }
+    if len(reg.Resumed) != 2 || reg.Resumed[0] != "rr-lost" || reg.Resumed[1] != "rr-done" || len(reg.Rejected) != 1 || reg.Rejected[0] != "rr-taken" { t.Fatalf("resumed %v rejected %v", reg.Resumed, reg.Rejected) }
+    if len(reg.Tasks) != 2 { t.Fatalf("finished tasks reported as in progress: %+v", reg.Tasks) }
+    tasksMu.RLock(); lost, taken, done := tasks["rr-lost"], tasks["rr-taken"], tasks["rr-done"]; tasksMu.RUnlock()
+    if done.Status != "completed" || done.AgentID != "rr-1" || done.Progress != nil { t.Fatalf("finished task not recreated closed: %+v", done) }
+    // the final update the agent still had queued now lands
+    if rr := doPost(srv, "/tasks/update", `{"id":"rr-done","status":"completed","result":{"exitCode":0,"durationMs":7}}`); rr.Code != 200 { t.Fatalf("final update: %d %s", rr.Code, rr.Body) }
+    if lost.Status != "running" || lost.AgentID != "rr-1" || lost.Kind != "shell" || lost.Org != "rr" || lost.Progress == nil || *lost.Progress.Percent != 30 { t.Fatalf("forgotten task not resumed: %+v", lost) }
+    if taken.AgentID != "rr-2" { t.Fatalf("task taken from its new agent: %+v", taken) }
+    if rr := doPost(srv, "/agents/heartbeat", `{"name":"rr-1","status":"running"}`); rr.Code != 200 { t.Fatalf("heartbeat after register: %d", rr.Code) }
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+)
+
+// Agents register under a persistent ID they generate once and keep in
+// their state directory, not their hostname, so a restarted agent is the
+// same agent. Each run of the process also sends a fresh instance ID and
+// its hostname. That tells the cases apart when a known name registers:
+//
+//   - same hostname, new instance: the agent restarted. Tasks the old
+//     process held are put back in the queue, since it can't finish them.
+//   - another host (or org) while the record is live: two agents claim the
+//     same ID, e.g. a copied state volume. The newcomer is refused with
+//     409 and picks a new ID.
+//
+// A record that has gone offline may be taken over by anyone.
+//
+// Agents and tasks are only kept in memory, so an orchestrator restart
+// forgets both. Heartbeats and claims from an agent it doesn't know are
+// answered 404 {register: true}; the agent registers again with its full
+// metadata and the tasks it is still running, which are taken back as
+// running under it, and the ones it finished whose final update hasn't
+// been delivered yet, which are closed.
+
+// heldTask is a task an agent reports when it registers: still running,
+// or finished with Status when the final update is still on its way.
+type heldTask struct {
+    TaskProgress
+    Kind   string `json:"kind,omitempty"`
+    Text   string `json:"text"`
+    Status string `json:"status,omitempty"`
+}
+
+// finished reports whether the agent is done with the task.
+func (h heldTask) finished() bool { return h.Status != "" && h.Status != "running" }
+
+// registerAgent records a registration. conflict is the live agent already
+// holding the name when it belongs to someone else.
+func registerAgent(a Agent, held []heldTask) (reg Agent, resumed, rejected []string, conflict *Agent) {
+    now := time.Now()
+    a.Status, a.LastSeen = "idle", now
+    for _, h := range held {
+        if !h.finished() { a.Tasks = append(a.Tasks, h.TaskProgress) }
+    }
+    if len(a.Tasks) > 0 { a.Status = "running" }
+    a.markIdle()
+    agentsMu.Lock()
+    prev, known := agents[a.Name]
+    live := known && prev.Status != "offline" && now.Sub(prev.LastSeen) < agentOfflineAfter()
+    if live && (prev.Org != a.Org || (prev.Hostname != "" && a.Hostname != "" && prev.Hostname != a.Hostname)) {
+        agentsMu.Unlock()
+        return Agent{}, nil, nil, &prev
+    }
+    agents[a.Name] = a
+    agentsMu.Unlock()
+    if known && prev.Instance != "" && prev.Instance != a.Instance {
+        if released := releaseAgentTasks(a.Name); len(released) > 0 { log.Printf("agent %s restarted; released %d tasks", a.Name, len(released)) }
+    }
+    resumed, rejected = resumeAgentTasks(a, held)
+    return a, resumed, rejected, nil
+}
+
+// resumeAgentTasks takes back the tasks a registering agent still runs:
+// ones this orchestrator has forgotten are recreated, and ones that are
+// queued or already its own are assigned to it. A task finished or given
+// to another agent meanwhile is rejected. Tasks the agent reports finished
+// are recreated or updated with the status it reports, so the final
+// update it delivers next finds them; one already in that status is left
+// alone.
+func resumeAgentTasks(a Agent, held []heldTask) (resumed, rejected []string) {
+    now := time.Now()
+    var changed []Task
+    tasksMu.Lock()
+    for _, h := range held {
+        if h.TaskID == "" { continue }
+        t, known := tasks[h.TaskID]
+        if known && h.finished() && t.Status == h.Status && t.Org == a.Org { continue }
+        if !known { t = Task{ID: h.TaskID, Org: a.Org, Kind: h.Kind, Text: h.Text, CreatedAt: now} }
+        ours := t.Org == a.Org && (t.Status == "running" && t.AgentID == a.Name || t.Status == "scheduled" || !known)
+        if !ours { rejected = append(rejected, h.TaskID); continue }
+        switch {
+        case h.Status == "scheduled":
+            // handed back on shutdown
+            t.Status, t.AgentID, t.Progress = "scheduled", "", nil
+        case h.finished():
+            t.Status, t.AgentID, t.Progress = h.Status, a.Name, nil
+        default:
+            p := h.TaskProgress
+            p.UpdatedAt = now
+            t.Status, t.AgentID, t.Progress = "running", a.Name, &p
+        }
+        tasks[t.ID] = t
+        resumed = append(resumed, t.ID)
+        changed = append(changed, t)
+    }
+    tasksMu.Unlock()
+    for _, t := range changed {
+        log.Printf("task id=%s %s by agent %s on register", t.ID, t.Status, a.Name)
+        publishEvent(EventTaskStatus, t.Org, t)
+        if t.Status != "running" { claimWaiters.notify(t.Org) }
+    }
+    return resumed, rejected
+}
+
+// agentKnown reports whether name is registered.
+func agentKnown(name string) bool {
+    agentsMu.RLock(); defer agentsMu.RUnlock()
+    _, ok := agents[name]
+    return ok
+}
+
+// unknownAgent tells an agent the orchestrator has no record of it, e.g.
+// after a restart, so it registers again.
+func unknownAgent(w http.ResponseWriter, name string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusNotFound)
+    writeJSON(w, map[string]any{"error": "unknown agent " + name, "register": true})
+}
+
+// handleAgentRegister serves POST /agents/register {name, org, deployment?,
+// instance?, hostname?, labels?, capacity?, tasks?} and answers with the
+// agent as registered plus the held tasks resumed and rejected, or 409
+// {error, agent} when the name is taken.
+func handleAgentRegister(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost { http.Error(w, "method", 405); return }
+    var req struct{ Name, Org, Deployment, Instance, Hostname string; Labels map[string]string; Capacity int; Tasks []heldTask }
+    if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+    if req.Name == "" || req.Org == "" { http.Error(w, "missing name/org", 400); return }
+    if req.Capacity < 0 { http.Error(w, "bad capacity", 400); return }
+    a, resumed, rejected, conflict := registerAgent(Agent{Name: req.Name, Org: req.Org, Deployment: req.Deployment, Instance: req.Instance, Hostname: req.Hostname, Labels: req.Labels, Capacity: req.Capacity}, req.Tasks)
+    if conflict != nil {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusConflict)
+        writeJSON(w, map[string]any{"error": fmt.Sprintf("agent %s is already registered from %s (org %s)", req.Name, conflict.Hostname, conflict.Org), "agent": conflict})
+        return
+    }
+    publishEvent(EventAgentRegistered, a.Org, a)
+    writeJSON(w, struct {
+        Agent
+        Resumed  []string `json:"resumed,omitempty"`
+        Rejected []string `json:"rejected,omitempty"`
+    }{a, resumed, rejected})
+}
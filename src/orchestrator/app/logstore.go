@@ -0,0 +1,310 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// logStore keeps append-only, per-stream (task or agent) logs on disk.
+// Each stream is a directory of segment files named by the byte offset of
+// their first record, so any record can be addressed by a stable offset.
+// Records are JSON lines, which keeps embedded newlines from breaking framing.
+type logStore struct {
+    dir          string
+    segmentBytes int64
+    retention    func(org string) int64
+
+    mu      sync.Mutex
+    streams map[string]*logStream
+}
+
+type logStream struct {
+    id       string
+    org      string
+    segments []logSegment // ordered by base offset; last one is active
+}
+
+type logSegment struct {
+    base    int64
+    size    int64
+    created time.Time
+}
+
+// logEntry is a single record read back from a stream. Offset is the byte
+// offset of the record and Next the offset immediately after it.
+type logEntry struct {
+    Offset int64     `json:"offset"`
+    Next   int64     `json:"next"`
+    TS     time.Time `json:"ts"`
+    Line   string    `json:"line"`
+}
+
+// String renders the entry the way the in-memory buffer used to.
+func (e logEntry) String() string { return e.TS.Format(time.RFC3339) + " " + e.Line }
+
+// logPage is the result of a range read.
+type logPage struct {
+    Start   int64      `json:"start"` // first offset still retained
+    End     int64      `json:"end"`   // offset the next append will get
+    Next    int64      `json:"next"`  // where to continue reading
+    Entries []logEntry `json:"entries"`
+}
+
+type logRecord struct {
+    TS   time.Time `json:"ts"`
+    Line string    `json:"line"`
+}
+
+const (
+    defaultLogSegmentBytes   = 4 << 20
+    defaultLogRetentionBytes = 256 << 20
+    defaultLogReadLimit      = 200
+    maxLogReadLimit          = 5000
+)
+
+func newLogStore(dir string, segmentBytes int64, retention func(org string) int64) *logStore {
+    if segmentBytes <= 0 { segmentBytes = defaultLogSegmentBytes }
+    s := &logStore{dir: dir, segmentBytes: segmentBytes, retention: retention, streams: make(map[string]*logStream)}
+    if err := s.load(); err != nil {
+        log.Printf("log store %s: %v", dir, err)
+    }
+    return s
+}
+
+// load indexes streams already on disk so offsets and retention survive restarts.
+func (s *logStore) load() error {
+    ents, err := os.ReadDir(s.dir)
+    if err != nil {
+        if os.IsNotExist(err) { return nil }
+        return err
+    }
+    for _, e := range ents {
+        if !e.IsDir() { continue }
+        id, err := url.PathUnescape(e.Name())
+        if err != nil { continue }
+        st := &logStream{id: id}
+        if b, err := os.ReadFile(filepath.Join(s.dir, e.Name(), "org")); err == nil {
+            st.org = strings.TrimSpace(string(b))
+        }
+        segs, _ := os.ReadDir(filepath.Join(s.dir, e.Name()))
+        for _, f := range segs {
+            name := f.Name()
+            if !strings.HasSuffix(name, ".log") { continue }
+            base, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+            if err != nil { continue }
+            info, err := f.Info()
+            if err != nil { continue }
+            st.segments = append(st.segments, logSegment{base: base, size: info.Size(), created: info.ModTime()})
+        }
+        sort.Slice(st.segments, func(i, j int) bool { return st.segments[i].base < st.segments[j].base })
+        s.streams[id] = st
+    }
+    return nil
+}
+
+func (s *logStore) streamDir(id string) string {
+    name := url.PathEscape(id)
+    if strings.HasPrefix(name, ".") { name = "%2E" + name[1:] }
+    return filepath.Join(s.dir, name)
+}
+
+func segmentName(base int64) string { return fmt.Sprintf("%020d.log", base) }
+
+// Append writes a line to the stream and returns the entry as stored.
+func (s *logStore) Append(id, org, line string) (logEntry, error) {
+    rec := logRecord{TS: time.Now().UTC(), Line: line}
+    b, err := json.Marshal(rec)
+    if err != nil { return logEntry{}, err }
+    b = append(b, '\n')
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    st := s.streams[id]
+    dir := s.streamDir(id)
+    if st == nil {
+        if err := os.MkdirAll(dir, 0o755); err != nil { return logEntry{}, err }
+        st = &logStream{id: id}
+        s.streams[id] = st
+    }
+    if org != "" && st.org != org {
+        st.org = org
+        _ = os.WriteFile(filepath.Join(dir, "org"), []byte(org+"\n"), 0o644)
+    }
+    end := st.end()
+    if n := len(st.segments); n == 0 || st.segments[n-1].size >= s.segmentBytes {
+        st.segments = append(st.segments, logSegment{base: end, created: time.Now()})
+    }
+    seg := &st.segments[len(st.segments)-1]
+    f, err := os.OpenFile(filepath.Join(dir, segmentName(seg.base)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil { return logEntry{}, err }
+    _, werr := f.Write(b)
+    cerr := f.Close()
+    if werr != nil { return logEntry{}, werr }
+    if cerr != nil { return logEntry{}, cerr }
+    seg.size += int64(len(b))
+    s.enforceRetention(st.org)
+    return logEntry{Offset: end, Next: end + int64(len(b)), TS: rec.TS, Line: line}, nil
+}
+
+func (st *logStream) end() int64 {
+    if len(st.segments) == 0 { return 0 }
+    last := st.segments[len(st.segments)-1]
+    return last.base + last.size
+}
+
+// enforceRetention drops the oldest sealed segments of an org until its
+// streams fit in the org's byte budget. Active segments are never removed.
+// Caller holds s.mu.
+func (s *logStore) enforceRetention(org string) {
+    if s.retention == nil { return }
+    limit := s.retention(org)
+    if limit <= 0 { return }
+    var total int64
+    for _, st := range s.streams {
+        if st.org != org { continue }
+        for _, seg := range st.segments { total += seg.size }
+    }
+    for total > limit {
+        var victim *logStream
+        for _, st := range s.streams {
+            if st.org != org || len(st.segments) < 2 { continue }
+            if victim == nil || st.segments[0].created.Before(victim.segments[0].created) { victim = st }
+        }
+        if victim == nil { return }
+        seg := victim.segments[0]
+        if err := os.Remove(filepath.Join(s.streamDir(victim.id), segmentName(seg.base))); err != nil && !os.IsNotExist(err) {
+            log.Printf("log retention: %v", err)
+            return
+        }
+        victim.segments = victim.segments[1:]
+        total -= seg.size
+    }
+}
+
+func (s *logStore) snapshot(id string) ([]logSegment, string, bool) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    st := s.streams[id]
+    if st == nil { return nil, "", false }
+    return append([]logSegment(nil), st.segments...), s.streamDir(id), true
+}
+
+// Bounds reports the first retained offset and the current end of a stream.
+func (s *logStore) Bounds(id string) (int64, int64) {
+    segs, _, _ := s.snapshot(id)
+    if len(segs) == 0 { return 0, 0 }
+    last := segs[len(segs)-1]
+    return segs[0].base, last.base + last.size
+}
+
+// Read returns up to limit entries starting at byte offset from. Only the
+// requested window is held in memory, regardless of the stream's size.
+func (s *logStore) Read(id string, from int64, limit int) (logPage, error) {
+    if limit <= 0 { limit = defaultLogReadLimit }
+    if limit > maxLogReadLimit { limit = maxLogReadLimit }
+    segs, dir, ok := s.snapshot(id)
+    page := logPage{Entries: []logEntry{}}
+    if !ok || len(segs) == 0 { return page, nil }
+    page.Start = segs[0].base
+    page.End = segs[len(segs)-1].base + segs[len(segs)-1].size
+    if from < page.Start { from = page.Start }
+    page.Next = from
+    for _, seg := range segs {
+        if from >= seg.base+seg.size { continue }
+        off := from
+        if off < seg.base { off = seg.base }
+        err := scanSegment(filepath.Join(dir, segmentName(seg.base)), seg.base, off, seg.base+seg.size, func(e logEntry) bool {
+            page.Entries = append(page.Entries, e)
+            page.Next = e.Next
+            return len(page.Entries) < limit
+        })
+        if err != nil { return page, err }
+        if len(page.Entries) >= limit { break }
+    }
+    return page, nil
+}
+
+// Tail returns the last n entries of a stream, walking segments backwards
+// and keeping at most n entries in memory.
+func (s *logStore) Tail(id string, n int) ([]logEntry, error) {
+    if n <= 0 { return nil, nil }
+    segs, dir, ok := s.snapshot(id)
+    if !ok { return nil, nil }
+    var out []logEntry
+    for i := len(segs) - 1; i >= 0 && len(out) < n; i-- {
+        seg := segs[i]
+        ring := make([]logEntry, 0, n)
+        err := scanSegment(filepath.Join(dir, segmentName(seg.base)), seg.base, seg.base, seg.base+seg.size, func(e logEntry) bool {
+            if len(ring) == n { ring = ring[1:] }
+            ring = append(ring, e)
+            return true
+        })
+        if err != nil { return out, err }
+        if need := n - len(out); len(ring) > need { ring = ring[len(ring)-need:] }
+        out = append(ring, out...)
+    }
+    return out, nil
+}
+
+// scanSegment decodes records from a segment file between byte offsets from
+// and to (absolute stream offsets). A segment removed by retention while
+// being read is treated as empty.
+func scanSegment(path string, base, from, to int64, fn func(logEntry) bool) error {
+    f, err := os.Open(path)
+    if err != nil {
+        if os.IsNotExist(err) { return nil }
+        return err
+    }
+    defer f.Close()
+    if _, err := f.Seek(from-base, 0); err != nil { return err }
+    r := bufio.NewReader(f)
+    off := from
+    for off < to {
+        b, err := r.ReadBytes('\n')
+        if err != nil {
+            // EOF, or a partial trailing record still being written
+            if errors.Is(err, io.EOF) { return nil }
+            return err
+        }
+        next := off + int64(len(b))
+        var rec logRecord
+        if jerr := json.Unmarshal(b, &rec); jerr == nil {
+            if !fn(logEntry{Offset: off, Next: next, TS: rec.TS, Line: rec.Line}) { return nil }
+        }
+        off = next
+    }
+    return nil
+}
+
+// retentionFromEnv reads LOG_RETENTION_BYTES as the default per-org budget
+// and LOG_RETENTION_BYTES_<ORG> (upper-cased, '-' as '_') as overrides.
+func retentionFromEnv(org string) int64 {
+    if org != "" {
+        key := "LOG_RETENTION_BYTES_" + strings.ToUpper(strings.ReplaceAll(org, "-", "_"))
+        if n, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil { return n }
+    }
+    if n, err := strconv.ParseInt(os.Getenv("LOG_RETENTION_BYTES"), 10, 64); err == nil { return n }
+    return defaultLogRetentionBytes
+}
+
+func envInt64(key string, def int64) int64 {
+    if n, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil { return n }
+    return def
+}
+
+// stateDir is where the orchestrator keeps data that must survive restarts.
+func stateDir() string {
+    if d := os.Getenv("STATE_DIR"); d != "" { return d }
+    return "/state"
+}
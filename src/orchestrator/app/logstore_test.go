@@ -0,0 +1,132 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestLogStoreAppendReadAcrossSegments(t *testing.T) {
+    s := newLogStore(t.TempDir(), 256, nil)
+    var offsets []int64
+    for i := 0; i < 50; i++ {
+        e, err := s.Append("t1", "acme", fmt.Sprintf("line %d", i))
+        if err != nil { t.Fatal(err) }
+        offsets = append(offsets, e.Offset)
+    }
+    segs, _, _ := s.snapshot("t1")
+    if len(segs) < 2 { t.Fatalf("expected rotation into several segments, got %d", len(segs)) }
+
+    page, err := s.Read("t1", offsets[10], 5)
+    if err != nil { t.Fatal(err) }
+    if len(page.Entries) != 5 { t.Fatalf("expected 5 entries, got %d", len(page.Entries)) }
+    if page.Entries[0].Line != "line 10" || page.Entries[4].Line != "line 14" {
+        t.Fatalf("unexpected window: %q..%q", page.Entries[0].Line, page.Entries[4].Line)
+    }
+    if page.Next != offsets[15] { t.Fatalf("next=%d want %d", page.Next, offsets[15]) }
+
+    // read everything page by page
+    var all []string
+    for from := int64(0); ; {
+        p, err := s.Read("t1", from, 7)
+        if err != nil { t.Fatal(err) }
+        if len(p.Entries) == 0 { break }
+        for _, e := range p.Entries { all = append(all, e.Line) }
+        from = p.Next
+    }
+    if len(all) != 50 || all[49] != "line 49" { t.Fatalf("paged read returned %d lines", len(all)) }
+
+    tail, err := s.Tail("t1", 3)
+    if err != nil { t.Fatal(err) }
+    if len(tail) != 3 || tail[0].Line != "line 47" || tail[2].Line != "line 49" {
+        t.Fatalf("unexpected tail: %+v", tail)
+    }
+}
+
+func TestLogStorePersistsAndKeepsMultilineRecords(t *testing.T) {
+    dir := t.TempDir()
+    s := newLogStore(dir, 0, nil)
+    s.Append("t1", "acme", "first\nsecond")
+    e, _ := s.Append("t1", "acme", "third")
+
+    reopened := newLogStore(dir, 0, nil)
+    page, err := reopened.Read("t1", 0, 10)
+    if err != nil { t.Fatal(err) }
+    if len(page.Entries) != 2 || page.Entries[0].Line != "first\nsecond" { t.Fatalf("unexpected entries: %+v", page.Entries) }
+    next, _ := reopened.Append("t1", "acme", "fourth")
+    if next.Offset != e.Next { t.Fatalf("offset not continued after reopen: %d want %d", next.Offset, e.Next) }
+}
+
+func TestLogStoreRetentionPerOrg(t *testing.T) {
+    limits := map[string]int64{"acme": 1024}
+    s := newLogStore(t.TempDir(), 200, func(org string) int64 { return limits[org] })
+    for i := 0; i < 100; i++ {
+        s.Append("a1", "acme", strings.Repeat("x", 40))
+        s.Append("d1", "devrel", strings.Repeat("y", 40))
+    }
+    start, end := s.Bounds("a1")
+    if start == 0 || end-start > 1024+200 { t.Fatalf("acme not trimmed: start=%d end=%d", start, end) }
+    if start, _ := s.Bounds("d1"); start != 0 { t.Fatalf("devrel has no limit but was trimmed from %d", start) }
+    // reads before the retained window start at the first kept record
+    page, _ := s.Read("a1", 0, 1)
+    if page.Entries[0].Offset != start { t.Fatalf("read started at %d, want %d", page.Entries[0].Offset, start) }
+    files, _ := filepath.Glob(filepath.Join(s.streamDir("a1"), "*.log"))
+    segs, _, _ := s.snapshot("a1")
+    if len(files) != len(segs) { t.Fatalf("%d segment files on disk, %d indexed", len(files), len(segs)) }
+}
+
+func TestTaskLogsRangeEndpoint(t *testing.T) {
+    os.Unsetenv("ORCHESTRATOR_TOKEN")
+    srv := newServer()
+    id := uniq("range")
+    for i := 0; i < 5; i++ { appendTaskLog(id, fmt.Sprintf("l%d", i)) }
+
+    rr := httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/tasks/logs?id="+id+"&limit=2", nil))
+    var tail struct { Lines []string; Next int64 }
+    if err := json.Unmarshal(rr.Body.Bytes(), &tail); err != nil { t.Fatal(err) }
+    if len(tail.Lines) != 2 || !strings.HasSuffix(tail.Lines[1], " l4") { t.Fatalf("unexpected tail: %v", tail.Lines) }
+
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/tasks/logs?id="+id+"&from=0&limit=3", nil))
+    var page struct { Lines []string; Next int64 }
+    json.Unmarshal(rr.Body.Bytes(), &page)
+    if len(page.Lines) != 3 || !strings.HasSuffix(page.Lines[0], " l0") { t.Fatalf("unexpected page: %v", page.Lines) }
+
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/tasks/logs?id=%s&from=%d", id, page.Next), nil))
+    json.Unmarshal(rr.Body.Bytes(), &page)
+    if len(page.Lines) != 2 || !strings.HasSuffix(page.Lines[1], " l4") { t.Fatalf("unexpected continuation: %v", page.Lines) }
+
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/tasks/logs?id="+id+"&from=-1", nil))
+    if rr.Code != 400 { t.Fatalf("expected 400 for bad from, got %d", rr.Code) }
+}
+
+func TestTaskLogBatchTagged(t *testing.T) {
+    os.Unsetenv("ORCHESTRATOR_TOKEN")
+    srv := newServer()
+    id := uniq("batch")
+    body := `{"id":"`+id+`","lines":[{"line":"building","phase":"run","stream":"stdout"},{"line":"warning: x","phase":"run","stream":"stderr"},{"line":"` + strings.Repeat("y", maxTaskLogLine+10) + `","phase":"pr","stream":"stdout"},{"line":"done"}]}`
+    rr := httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("POST", "/tasks/log", strings.NewReader(body)))
+    if rr.Code != 204 { t.Fatalf("batch: %d %s", rr.Code, rr.Body) }
+
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/tasks/logs?id="+id+"&from=0", nil))
+    var page struct { Entries []logEntry }
+    json.Unmarshal(rr.Body.Bytes(), &page)
+    if len(page.Entries) != 4 { t.Fatalf("entries: %+v", page.Entries) }
+    if page.Entries[0].Line != "[run/stdout] building" || page.Entries[1].Line != "[run/stderr] warning: x" || page.Entries[3].Line != "done" { t.Fatalf("tags: %+v", page.Entries) }
+    if long := page.Entries[2].Line; !strings.HasPrefix(long, "[pr/stdout] yyy") || !strings.HasSuffix(long, "…[truncated]") || len(long) > maxTaskLogLine+64 { t.Fatalf("long line not capped: %d bytes", len(long)) }
+
+    lines := make([]string, maxTaskLogBatch+1)
+    for i := range lines { lines[i] = `{"line":"x"}` }
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("POST", "/tasks/log", strings.NewReader(`{"id":"`+id+`","lines":[`+strings.Join(lines, ",")+`]}`)))
+    if rr.Code != 413 { t.Fatalf("oversized batch: %d", rr.Code) }
+}
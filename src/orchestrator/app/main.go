@@ -1,14 +1,23 @@
 package main
 
 import (
+    "context"
     "log"
     "net/http"
+    "os"
 )
 
 func main() {
+    cfg, err := loadConfig(os.Getenv("ORCHESTRATOR_CONFIG"))
+    if err != nil { log.Fatalf("config: %v", err) }
+    setConfig(cfg)
     mux := http.NewServeMux()
     // prefer consolidated handlers in this package
     registerHandlers(mux)
+    startAgentMonitor()
+    startEditorReaper(context.Background())
+    startWebhookDispatcher(context.Background(), webhooks)
+    pools.start(context.Background(), reconcileInterval())
     addr := ":8080"
     log.Printf("orchestrator starting on %s", addr)
     if err := http.ListenAndServe(addr, mux); err != nil {
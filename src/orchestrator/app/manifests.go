@@ -0,0 +1,276 @@
+package main
+
+import (
+    "bytes"
+    "embed"
+    "encoding/json"
+    "fmt"
+    "io/fs"
+    "net"
+    "sort"
+    "strings"
+    "text/template"
+
+    appsv1 "k8s.io/api/apps/v1"
+    corev1 "k8s.io/api/core/v1"
+    networkingv1 "k8s.io/api/networking/v1"
+    "k8s.io/apimachinery/pkg/api/resource"
+    "sigs.k8s.io/yaml"
+)
+
+// Agent manifests are rendered from the Go templates under
+// manifests/<version>/. A new version is a new directory, so orgs can pin
+// the one they run (manifests.version) while another rolls out. v1 runs
+// agents as a Deployment with ephemeral state; v2 as a StatefulSet giving
+// each replica its own state volume, so a recreated pod keeps its identity
+// and undelivered reports.
+//
+//go:embed manifests
+var manifestFS embed.FS
+
+const (
+    defaultManifestVersion = "v2"
+    labelManifestVersion   = "mvp.agents/manifest-version"
+    redactedValue          = "<redacted>"
+)
+
+// ManifestConfig holds per-org overrides for rendered agent manifests.
+type ManifestConfig struct {
+    Version   string         `json:"version,omitempty"`
+    Resources ResourceConfig `json:"resources,omitempty"`
+    // NodeSelector is merged over the one derived from the org's labels.
+    NodeSelector  map[string]string   `json:"nodeSelector,omitempty"`
+    RunAsUser     *int64              `json:"runAsUser,omitempty"`
+    NetworkPolicy NetworkPolicyConfig `json:"networkPolicy,omitempty"`
+    // TerminationGracePeriodSeconds is how long an agent gets to hand back
+    // its work after SIGTERM; the agent is told the same (AGENT_SHUTDOWN_GRACE).
+    TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+    // State is the per-replica volume for the agent's state (v2 manifests).
+    State StateConfig `json:"state,omitempty"`
+}
+
+// StateConfig sizes the agent state volume; StorageClassName defaults to
+// the cluster's default class.
+type StateConfig struct {
+    Size             string `json:"size,omitempty"`
+    StorageClassName string `json:"storageClassName,omitempty"`
+}
+
+type ResourceConfig struct {
+    Requests ResourceList `json:"requests,omitempty"`
+    Limits   ResourceList `json:"limits,omitempty"`
+}
+
+type ResourceList struct {
+    CPU    string `json:"cpu,omitempty"`
+    Memory string `json:"memory,omitempty"`
+}
+
+// NetworkPolicyConfig controls the default-deny policy put on each agent.
+// Only OrchestratorCIDRs (default: the tailnet range) and pods in
+// MeshNamespaces (default: tailscale) may reach the editor, and the agent
+// may only reach those, DNS, EgressCIDRs and any host on EgressPorts.
+// EgressPorts defaults to 443 so agents can reach the model API and clone
+// over HTTPS; set it to [] to shut that off too.
+type NetworkPolicyConfig struct {
+    Disabled          bool     `json:"disabled,omitempty"`
+    OrchestratorCIDRs []string `json:"orchestratorCIDRs,omitempty"`
+    MeshNamespaces    []string `json:"meshNamespaces,omitempty"`
+    EgressCIDRs       []string `json:"egressCIDRs,omitempty"`
+    EgressPorts       []int32  `json:"egressPorts,omitempty"`
+}
+
+// warnings are problems with a policy that still renders, e.g. one that
+// leaves the agent no way to reach the model API or git remote.
+func (np NetworkPolicyConfig) warnings() []string {
+    if np.Disabled || len(np.EgressCIDRs) > 0 || len(np.EgressPorts) > 0 { return nil }
+    return []string{"networkPolicy allows no internet egress: agents can't reach the model API or git remote (set egressPorts or egressCIDRs)"}
+}
+
+// withDefaults fills unset fields and derives the node selector from org
+// labels ("region:x", "zone:x" map to the topology.kubernetes.io labels;
+// any other "key:value" is used as is).
+func (m ManifestConfig) withDefaults(orgLabels []string) ManifestConfig {
+    if m.Version == "" { m.Version = defaultManifestVersion }
+    def := func(v *string, d string) { if *v == "" { *v = d } }
+    def(&m.Resources.Requests.CPU, "250m")
+    def(&m.Resources.Requests.Memory, "512Mi")
+    def(&m.Resources.Limits.CPU, "2")
+    def(&m.Resources.Limits.Memory, "2Gi")
+    def(&m.State.Size, "1Gi")
+    if m.RunAsUser == nil { uid := int64(1000); m.RunAsUser = &uid }
+    if m.TerminationGracePeriodSeconds == nil { g := int64(60); m.TerminationGracePeriodSeconds = &g }
+    if m.NetworkPolicy.OrchestratorCIDRs == nil { m.NetworkPolicy.OrchestratorCIDRs = []string{"100.64.0.0/10"} }
+    if m.NetworkPolicy.MeshNamespaces == nil { m.NetworkPolicy.MeshNamespaces = []string{"tailscale"} }
+    if m.NetworkPolicy.EgressPorts == nil { m.NetworkPolicy.EgressPorts = []int32{443} }
+    sel := map[string]string{}
+    for _, l := range orgLabels {
+        k, v, ok := strings.Cut(l, ":")
+        if !ok || k == "" { continue }
+        switch k {
+        case "region", "zone":
+            k = "topology.kubernetes.io/" + k
+        }
+        sel[k] = v
+    }
+    for k, v := range m.NodeSelector { sel[k] = v }
+    m.NodeSelector = sel
+    return m
+}
+
+func (m ManifestConfig) validate() error {
+    m = m.withDefaults(nil)
+    if _, err := fs.Stat(manifestFS, "manifests/"+m.Version); err != nil { return fmt.Errorf("unknown manifest version %q", m.Version) }
+    for name, q := range map[string]string{
+        "requests.cpu": m.Resources.Requests.CPU, "requests.memory": m.Resources.Requests.Memory,
+        "limits.cpu": m.Resources.Limits.CPU, "limits.memory": m.Resources.Limits.Memory,
+        "state.size": m.State.Size,
+    } {
+        if _, err := resource.ParseQuantity(q); err != nil { return fmt.Errorf("%s: %w", name, err) }
+    }
+    if *m.TerminationGracePeriodSeconds < 1 { return fmt.Errorf("terminationGracePeriodSeconds must be at least 1") }
+    np := m.NetworkPolicy
+    for _, c := range append(append([]string{}, np.OrchestratorCIDRs...), np.EgressCIDRs...) {
+        if _, _, err := net.ParseCIDR(c); err != nil { return fmt.Errorf("networkPolicy: %w", err) }
+    }
+    for _, p := range np.EgressPorts {
+        if p < 1 || p > 65535 { return fmt.Errorf("networkPolicy: egress port %d out of range", p) }
+    }
+    if !np.Disabled && len(np.OrchestratorCIDRs) == 0 && len(np.MeshNamespaces) == 0 {
+        // an ingress rule without peers would allow everyone
+        return fmt.Errorf("networkPolicy needs orchestratorCIDRs or meshNamespaces")
+    }
+    return nil
+}
+
+// RenderedManifest is one rendered object, as served by /deployments/render.
+type RenderedManifest struct {
+    Kind string `json:"kind"`
+    Name string `json:"name"`
+    YAML string `json:"yaml"`
+}
+
+// agentManifests are the typed objects for one agent deployment plus the
+// YAML they were decoded from. The workload is either a Deployment or a
+// StatefulSet, whichever the version has. NetworkPolicy is nil when
+// disabled.
+type agentManifests struct {
+    Version       string
+    Secret        *corev1.Secret
+    Deployment    *appsv1.Deployment
+    StatefulSet   *appsv1.StatefulSet
+    Service       *corev1.Service
+    NetworkPolicy *networkingv1.NetworkPolicy
+    Docs          []RenderedManifest
+}
+
+type manifestEnv struct{ Name, Value string }
+
+// manifestData is what the templates see.
+type manifestData struct {
+    Name, Namespace, Image string
+    Replicas               int32
+    Labels                 map[string]string
+    NodeSelector           map[string]string
+    Env                    []manifestEnv
+    SecretEnv              []string // keys of Secrets, exposed as env from the Secret
+    Secrets                map[string]string
+    EditorPort             int
+    RunAsUser              int64
+    GracePeriodSeconds     int64
+    Resources              ResourceConfig
+    NetworkPolicy          NetworkPolicyConfig
+    State                  StateConfig
+}
+
+var manifestFuncs = template.FuncMap{
+    // quote emits a YAML double-quoted scalar; JSON strings are valid YAML
+    "quote": func(s string) string { b, _ := json.Marshal(s); return string(b) },
+}
+
+// renderAgentManifests renders spec (already normalized) with the org's
+// overrides. With redact set, Secret values are replaced so the output is
+// safe to show.
+func renderAgentManifests(spec AgentSpec, namespace string, mc ManifestConfig, orgLabels []string, redact bool) (*agentManifests, error) {
+    mc = mc.withDefaults(orgLabels)
+    tmpl, err := template.New("").Funcs(manifestFuncs).Option("missingkey=error").ParseFS(manifestFS, "manifests/"+mc.Version+"/*.yaml.tmpl")
+    if err != nil { return nil, fmt.Errorf("manifest version %s: %w", mc.Version, err) }
+
+    labels := spec.ownerLabels()
+    labels[labelManifestVersion] = mc.Version
+    data := manifestData{
+        Name: spec.Name, Namespace: namespace, Image: spec.Image, Replicas: spec.Replicas,
+        Labels: labels, NodeSelector: mc.NodeSelector,
+        Env: []manifestEnv{
+            {"ORG_NAME", spec.Org},
+            {"ORCHESTRATOR_URL", spec.OrchestratorURL},
+            {"AGENT_DEPLOYMENT", spec.Name},
+            {"CODE_SERVER_AUTH_HEADER", envWithDefault("CODE_SERVER_AUTH_HEADER", "X-Agent-Auth")},
+            {"AGENT_SHUTDOWN_GRACE", fmt.Sprintf("%ds", *mc.TerminationGracePeriodSeconds)},
+        },
+        Secrets: map[string]string{
+            "ORCHESTRATOR_TOKEN":   spec.OrchestratorToken,
+            "CODE_SERVER_PASSWORD": codeServerSecret("CODE_SERVER_PASSWORD"),
+            "CODE_SERVER_TOKEN":    codeServerSecret("CODE_SERVER_TOKEN"),
+        },
+        EditorPort: agentEditorPort, RunAsUser: *mc.RunAsUser,
+        GracePeriodSeconds: *mc.TerminationGracePeriodSeconds,
+        Resources: mc.Resources, NetworkPolicy: mc.NetworkPolicy, State: mc.State,
+    }
+    keys := make([]string, 0, len(spec.Env))
+    for k := range spec.Env { keys = append(keys, k) }
+    sort.Strings(keys)
+    for _, k := range keys { data.Env = append(data.Env, manifestEnv{k, spec.Env[k]}) }
+    for k := range data.Secrets {
+        data.SecretEnv = append(data.SecretEnv, k)
+        if redact { data.Secrets[k] = redactedValue }
+    }
+    sort.Strings(data.SecretEnv)
+
+    out := &agentManifests{Version: mc.Version}
+    render := func(file string, obj any) error {
+        var buf bytes.Buffer
+        if err := tmpl.ExecuteTemplate(&buf, file, data); err != nil { return err }
+        if err := yaml.UnmarshalStrict(buf.Bytes(), obj); err != nil { return fmt.Errorf("%s/%s: %w", mc.Version, file, err) }
+        return nil
+    }
+    out.Secret, out.Service = &corev1.Secret{}, &corev1.Service{}
+    workload := struct {
+        file string
+        obj  any
+    }{"deployment.yaml.tmpl", nil}
+    if tmpl.Lookup("statefulset.yaml.tmpl") != nil {
+        out.StatefulSet = &appsv1.StatefulSet{}
+        workload.file, workload.obj = "statefulset.yaml.tmpl", out.StatefulSet
+    } else {
+        out.Deployment = &appsv1.Deployment{}
+        workload.obj = out.Deployment
+    }
+    docs := []struct {
+        file string
+        obj  any
+    }{
+        {"secret.yaml.tmpl", out.Secret},
+        workload,
+        {"service.yaml.tmpl", out.Service},
+    }
+    if !mc.NetworkPolicy.Disabled {
+        out.NetworkPolicy = &networkingv1.NetworkPolicy{}
+        docs = append(docs, struct {
+            file string
+            obj  any
+        }{"networkpolicy.yaml.tmpl", out.NetworkPolicy})
+    }
+    for _, d := range docs {
+        if err := render(d.file, d.obj); err != nil { return nil, err }
+        b, err := yaml.Marshal(d.obj)
+        if err != nil { return nil, err }
+        var meta struct {
+            Kind     string `json:"kind"`
+            Metadata struct{ Name string } `json:"metadata"`
+        }
+        _ = yaml.Unmarshal(b, &meta)
+        out.Docs = append(out.Docs, RenderedManifest{Kind: meta.Kind, Name: meta.Metadata.Name, YAML: string(b)})
+    }
+    return out, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+func TestRenderAgentManifestsDefaults(t *testing.T) {
+    spec := AgentSpec{Org: "acme", Name: "agent-acme-1", OrchestratorToken: "tok", Env: map[string]string{"B": "2", "A": "1"}}.normalize()
+    m, err := renderAgentManifests(spec, agentNamespace, ManifestConfig{}, []string{"region:ap-southeast-2", "gpu:true", "nolabel"}, false)
+    if err != nil { t.Fatal(err) }
+    if m.Version != defaultManifestVersion || m.StatefulSet.Labels[labelManifestVersion] != defaultManifestVersion { t.Fatalf("version not recorded: %s %v", m.Version, m.StatefulSet.Labels) }
+    // each replica gets its own state volume
+    if vct := m.StatefulSet.Spec.VolumeClaimTemplates; len(vct) != 1 || vct[0].Name != "state" || vct[0].Spec.Resources.Requests.Storage().String() != "1Gi" || vct[0].Spec.StorageClassName != nil { t.Fatalf("state volume: %+v", vct) }
+    if p := m.StatefulSet.Spec.PersistentVolumeClaimRetentionPolicy; p == nil || p.WhenDeleted != "Delete" || p.WhenScaled != "Retain" { t.Fatalf("retention: %+v", p) }
+
+    pod := m.StatefulSet.Spec.Template.Spec
+    for _, v := range pod.Volumes {
+        if v.Name == "state" { t.Fatalf("state is a pod volume: %+v", v) }
+    }
+    if sc := pod.SecurityContext; sc == nil || sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot || *sc.RunAsUser != 1000 { t.Fatalf("pod must run as non-root: %+v", sc) }
+    want := map[string]string{"topology.kubernetes.io/region": "ap-southeast-2", "gpu": "true"}
+    if len(pod.NodeSelector) != len(want) { t.Fatalf("node selector %v, want %v", pod.NodeSelector, want) }
+    for k, v := range want {
+        if pod.NodeSelector[k] != v { t.Fatalf("node selector %v, want %v", pod.NodeSelector, want) }
+    }
+    c := pod.Containers[0]
+    if c.SecurityContext == nil || *c.SecurityContext.AllowPrivilegeEscalation || c.SecurityContext.Capabilities.Drop[0] != "ALL" { t.Fatalf("container securityContext: %+v", c.SecurityContext) }
+    if c.Resources.Requests.Cpu().String() != "250m" || c.Resources.Limits.Memory().String() != "2Gi" { t.Fatalf("default resources: %+v", c.Resources) }
+    var names []string
+    for _, e := range c.Env { names = append(names, e.Name) }
+    if got := strings.Join(names, ","); !strings.Contains(got, "A,B,CODE_SERVER_PASSWORD") { t.Fatalf("env not sorted: %s", got) }
+    // the pod's grace period and what the agent is told must agree
+    grace := ""
+    for _, e := range c.Env { if e.Name == "AGENT_SHUTDOWN_GRACE" { grace = e.Value } }
+    if g := pod.TerminationGracePeriodSeconds; g == nil || *g != 60 || grace != "60s" { t.Fatalf("grace period %v, AGENT_SHUTDOWN_GRACE=%q", g, grace) }
+    if m.Secret.StringData["ORCHESTRATOR_TOKEN"] != "tok" { t.Fatalf("secret: %+v", m.Secret.StringData) }
+
+    np := m.NetworkPolicy
+    if np == nil || len(np.Spec.PolicyTypes) != 2 { t.Fatalf("expected a default-deny NetworkPolicy: %+v", np) }
+    from := np.Spec.Ingress[0].From
+    if len(from) != 2 || from[0].IPBlock.CIDR != "100.64.0.0/10" || from[1].NamespaceSelector.MatchLabels["kubernetes.io/metadata.name"] != "tailscale" { t.Fatalf("ingress peers: %+v", from) }
+    // HTTPS anywhere by default, for the model API and git remote
+    var https bool
+    for _, e := range np.Spec.Egress {
+        if len(e.To) == 0 && len(e.Ports) == 1 && e.Ports[0].Port.IntValue() == 443 { https = true }
+    }
+    if !https { t.Fatalf("no default 443 egress: %+v", np.Spec.Egress) }
+    if len(m.Docs) != 4 || m.Docs[3].Kind != "NetworkPolicy" { t.Fatalf("docs: %+v", m.Docs) }
+}
+
+func TestRenderAgentManifestsOverrides(t *testing.T) {
+    uid, grace := int64(2000), int64(300)
+    mc := ManifestConfig{
+        Resources:     ResourceConfig{Limits: ResourceList{CPU: "4", Memory: "8Gi"}},
+        NodeSelector:  map[string]string{"topology.kubernetes.io/region": "us-east"},
+        RunAsUser:     &uid,
+        NetworkPolicy: NetworkPolicyConfig{Disabled: true},
+        TerminationGracePeriodSeconds: &grace,
+        State: StateConfig{Size: "5Gi", StorageClassName: "fast"},
+    }
+    spec := AgentSpec{Org: "acme", Name: "agent-acme-2", OrchestratorToken: "tok"}.normalize()
+    m, err := renderAgentManifests(spec, agentNamespace, mc, []string{"region:ap-southeast-2"}, true)
+    if err != nil { t.Fatal(err) }
+    if vct := m.StatefulSet.Spec.VolumeClaimTemplates[0].Spec; vct.Resources.Requests.Storage().String() != "5Gi" || *vct.StorageClassName != "fast" { t.Fatalf("state volume: %+v", vct) }
+    pod := m.StatefulSet.Spec.Template.Spec
+    if pod.NodeSelector["topology.kubernetes.io/region"] != "us-east" { t.Fatalf("config should win over org labels: %v", pod.NodeSelector) }
+    if *pod.SecurityContext.RunAsUser != 2000 { t.Fatal("runAsUser override ignored") }
+    if *pod.TerminationGracePeriodSeconds != 300 { t.Fatal("grace period override ignored") }
+    if pod.Containers[0].Resources.Limits.Cpu().String() != "4" || pod.Containers[0].Resources.Requests.Memory().String() != "512Mi" { t.Fatalf("resources: %+v", pod.Containers[0].Resources) }
+    if m.NetworkPolicy != nil { t.Fatal("NetworkPolicy should be disabled") }
+    if m.Secret.StringData["ORCHESTRATOR_TOKEN"] != redactedValue { t.Fatal("secret not redacted") }
+    for _, d := range m.Docs {
+        if strings.Contains(d.YAML, "tok\n") { t.Fatalf("token leaked into %s", d.Kind) }
+    }
+}
+
+func TestRenderAgentManifestsV1(t *testing.T) {
+    spec := AgentSpec{Org: "acme", Name: "agent-acme-3"}.normalize()
+    m, err := renderAgentManifests(spec, agentNamespace, ManifestConfig{Version: "v1"}, nil, true)
+    if err != nil { t.Fatal(err) }
+    if m.Deployment == nil || m.StatefulSet != nil || m.Docs[1].Kind != "Deployment" { t.Fatalf("v1 workload: %+v", m.Docs) }
+}
+
+func TestManifestConfigValidate(t *testing.T) {
+    cases := map[string]ManifestConfig{
+        "version":  {Version: "v0"},
+        "quantity": {Resources: ResourceConfig{Requests: ResourceList{CPU: "lots"}}},
+        "cidr":     {NetworkPolicy: NetworkPolicyConfig{EgressCIDRs: []string{"10.0.0.0"}}},
+        "no peers": {NetworkPolicy: NetworkPolicyConfig{OrchestratorCIDRs: []string{}, MeshNamespaces: []string{}}},
+        "grace":    {TerminationGracePeriodSeconds: new(int64)},
+        "port":     {NetworkPolicy: NetworkPolicyConfig{EgressPorts: []int32{70000}}},
+        "state":    {State: StateConfig{Size: "big"}},
+    }
+    for name, mc := range cases {
+        if err := mc.validate(); err == nil { t.Errorf("%s: expected an error", name) }
+    }
+    if err := (ManifestConfig{}).validate(); err != nil { t.Fatalf("defaults should validate: %v", err) }
+    c := &Config{Orgs: []OrgConfig{{Name: "acme", Manifests: ManifestConfig{Version: "v0"}}}}
+    if err := c.validate(); err == nil || !strings.Contains(err.Error(), "manifests") { t.Fatalf("config validate: %v", err) }
+}
+
+func TestDeploymentRenderEndpoint(t *testing.T) {
+    setConfig(&Config{Orgs: []OrgConfig{{Name: "render-org", Labels: []string{"zone:a"}, Pool: &PoolConfig{Replicas: 1, Image: "mvp-agent:v3"}}}})
+    defer setConfig(&Config{})
+    srv := newServer()
+
+    rr := deploymentsRequest(t, srv, "POST", "/deployments/render", `{"org":"render-org","name":"agent-render-1"}`)
+    if rr.Code != 200 { t.Fatalf("render: %d %s", rr.Code, rr.Body) }
+    var resp struct {
+        Name, Version string
+        Manifests     []RenderedManifest
+    }
+    if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil { t.Fatal(err) }
+    if resp.Name != "agent-render-1" || resp.Version != "v2" || len(resp.Manifests) != 4 { t.Fatalf("unexpected render: %+v", resp) }
+    if !strings.Contains(resp.Manifests[1].YAML, "topology.kubernetes.io/zone: a") { t.Fatalf("node selector missing:\n%s", resp.Manifests[1].YAML) }
+    if !strings.Contains(resp.Manifests[0].YAML, redactedValue) { t.Fatalf("secret not redacted:\n%s", resp.Manifests[0].YAML) }
+
+    rr = deploymentsRequest(t, srv, "POST", "/deployments/render?format=yaml", `{"org":"render-org","pool":true}`)
+    if rr.Code != 200 || !strings.Contains(rr.Body.String(), "image: mvp-agent:v3") || strings.Count(rr.Body.String(), "\n---\n") != 3 { t.Fatalf("pool render: %d %s", rr.Code, rr.Body) }
+
+    // egress shut off entirely renders, with a warning
+    rr = deploymentsRequest(t, srv, "POST", "/deployments/render", `{"org":"render-org","manifests":{"networkPolicy":{"egressPorts":[]}}}`)
+    var warned struct{ Manifests []RenderedManifest; Warnings []string }
+    json.Unmarshal(rr.Body.Bytes(), &warned)
+    if rr.Code != 200 || len(warned.Warnings) != 1 || strings.Contains(warned.Manifests[3].YAML, "port: 443") { t.Fatalf("no-egress render: %d %s", rr.Code, rr.Body) }
+    if len(resp.Manifests) == 4 && !strings.Contains(resp.Manifests[3].YAML, "port: 443") { t.Fatalf("default policy:\n%s", resp.Manifests[3].YAML) }
+
+    rr = deploymentsRequest(t, srv, "POST", "/deployments/render", `{"org":"render-org","manifests":{"version":"v9"}}`)
+    if rr.Code != 400 { t.Fatalf("bad override: %d", rr.Code) }
+    rr = deploymentsRequest(t, srv, "POST", "/deployments/render", `{}`)
+    if rr.Code != 400 { t.Fatalf("missing org: %d", rr.Code) }
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "os/exec"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Operation is a long-running job (agent deploy, kubeconfig generation)
+// started by an API call. Its combined output is kept in the operation log
+// store and streamed at /operations/{id}/events.
+type Operation struct {
+    ID         string     `json:"id"`
+    Kind       string     `json:"kind"`
+    Org        string     `json:"org,omitempty"`
+    Status     string     `json:"status"` // queued | running | succeeded | failed | canceled
+    ExitCode   *int       `json:"exitCode,omitempty"`
+    Error      string     `json:"error,omitempty"`
+    Result     any        `json:"result,omitempty"`
+    CreatedAt  time.Time  `json:"createdAt"`
+    StartedAt  *time.Time `json:"startedAt,omitempty"`
+    FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (o Operation) done() bool {
+    return o.Status == "succeeded" || o.Status == "failed" || o.Status == "canceled"
+}
+
+// opFunc does the work of an operation. Output written to out is appended
+// to the operation log line by line.
+type opFunc func(ctx context.Context, out io.Writer) (any, error)
+
+type opEntry struct {
+    op     Operation
+    fn     opFunc
+    cancel context.CancelFunc
+    ctx    context.Context
+}
+
+// opRunner executes operations on a fixed number of workers so a burst of
+// deploy requests can't spawn unbounded subprocesses.
+type opRunner struct {
+    mu    sync.Mutex
+    ops   map[string]*opEntry
+    queue chan *opEntry
+    logs  *logStore
+    hub   *logHub
+    // finished operations are forgotten after keepFor, and beyond the
+    // newest keepDone; their logs stay in the log store
+    keepDone int
+    keepFor  time.Duration
+}
+
+const (
+    defaultOpKeepDone = 500
+    defaultOpKeepFor  = 24 * time.Hour
+)
+
+var (
+    operations     *opRunner
+    errOpQueueFull = errors.New("operation queue full")
+)
+
+func newOpRunner(workers, queueSize int, logs *logStore) *opRunner {
+    if workers <= 0 { workers = 1 }
+    r := &opRunner{ops: make(map[string]*opEntry), queue: make(chan *opEntry, queueSize), logs: logs, hub: newLogHub(), keepDone: defaultOpKeepDone, keepFor: defaultOpKeepFor}
+    for i := 0; i < workers; i++ { go r.worker() }
+    return r
+}
+
+func (r *opRunner) worker() {
+    for e := range r.queue { r.run(e) }
+}
+
+// submit queues an operation and returns it in the queued state.
+func (r *opRunner) submit(kind, org string, fn opFunc) (Operation, error) {
+    ctx, cancel := context.WithCancel(context.Background())
+    e := &opEntry{op: Operation{ID: newID(), Kind: kind, Org: org, Status: "queued", CreatedAt: time.Now().UTC()}, fn: fn, ctx: ctx, cancel: cancel}
+    r.mu.Lock()
+    select {
+    case r.queue <- e:
+        r.ops[e.op.ID] = e
+    default:
+        r.mu.Unlock()
+        cancel()
+        return Operation{}, errOpQueueFull
+    }
+    op := e.op
+    r.mu.Unlock()
+    publishEvent(EventOperationStatus, org, op)
+    return op, nil
+}
+
+func (r *opRunner) run(e *opEntry) {
+    r.mu.Lock()
+    if e.op.Status != "queued" { r.mu.Unlock(); return } // canceled while queued
+    now := time.Now().UTC()
+    e.op.Status = "running"; e.op.StartedAt = &now
+    op := e.op
+    r.mu.Unlock()
+    publishEvent(EventOperationStatus, op.Org, op)
+
+    w := &opLogWriter{r: r, id: op.ID, org: op.Org}
+    res, err := e.fn(e.ctx, w)
+    w.flush()
+
+    r.mu.Lock()
+    fin := time.Now().UTC()
+    e.op.FinishedAt = &fin
+    e.op.Result = res
+    code := 0
+    switch {
+    case e.ctx.Err() != nil:
+        e.op.Status = "canceled"; e.op.Error = "canceled"
+        code = -1
+    case err != nil:
+        e.op.Status = "failed"; e.op.Error = err.Error()
+        code = 1
+        var ee *exec.ExitError
+        if errors.As(err, &ee) { code = ee.ExitCode() }
+    default:
+        e.op.Status = "succeeded"
+    }
+    e.op.ExitCode = &code
+    op = e.op
+    r.pruneLocked(fin)
+    r.mu.Unlock()
+    e.cancel()
+    r.appendLine(op.ID, op.Org, "operation "+op.Status)
+    publishEvent(EventOperationStatus, op.Org, op)
+}
+
+func (r *opRunner) get(id string) (Operation, bool) {
+    r.mu.Lock(); defer r.mu.Unlock()
+    e, ok := r.ops[id]
+    if !ok { return Operation{}, false }
+    return e.op, true
+}
+
+func (r *opRunner) list(org string) []Operation {
+    r.mu.Lock(); defer r.mu.Unlock()
+    out := []Operation{}
+    for _, e := range r.ops {
+        if org == "" || e.op.Org == org { out = append(out, e.op) }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+    return out
+}
+
+// pruneLocked drops finished operations older than keepFor, then the
+// oldest beyond keepDone. r.mu must be held.
+func (r *opRunner) pruneLocked(now time.Time) {
+    var done []*opEntry
+    for id, e := range r.ops {
+        if !e.op.done() || e.op.FinishedAt == nil { continue }
+        if now.Sub(*e.op.FinishedAt) > r.keepFor { delete(r.ops, id); continue }
+        done = append(done, e)
+    }
+    if len(done) <= r.keepDone { return }
+    sort.Slice(done, func(i, j int) bool { return done[i].op.FinishedAt.Before(*done[j].op.FinishedAt) })
+    for _, e := range done[:len(done)-r.keepDone] { delete(r.ops, e.op.ID) }
+}
+
+// cancelOp stops a queued or running operation. Finished ones are left as is.
+func (r *opRunner) cancelOp(id string) (Operation, bool) {
+    r.mu.Lock()
+    e, ok := r.ops[id]
+    if !ok { r.mu.Unlock(); return Operation{}, false }
+    queued := e.op.Status == "queued"
+    if queued {
+        fin := time.Now().UTC()
+        code := -1
+        e.op.Status = "canceled"; e.op.Error = "canceled"; e.op.FinishedAt = &fin; e.op.ExitCode = &code
+        r.pruneLocked(fin)
+    }
+    op := e.op
+    r.mu.Unlock()
+    e.cancel()
+    if queued { publishEvent(EventOperationStatus, op.Org, op) }
+    return op, true
+}
+
+// wait blocks until the operation finishes or ctx ends.
+func (r *opRunner) wait(ctx context.Context, id string) (Operation, error) {
+    for {
+        op, ok := r.get(id)
+        if !ok { return op, errors.New("not found") }
+        if op.done() { return op, nil }
+        select {
+        case <-ctx.Done():
+            return op, ctx.Err()
+        case <-time.After(50 * time.Millisecond):
+        }
+    }
+}
+
+func (r *opRunner) appendLine(id, org, line string) {
+    e, err := r.logs.Append(id, org, line)
+    if err != nil {
+        log.Printf("operation[%s] log append: %v", id, err)
+        e = logEntry{TS: time.Now().UTC(), Line: line}
+    }
+    r.hub.broadcast(id, e)
+}
+
+// opLogWriter splits subprocess output into lines for the operation log.
+type opLogWriter struct {
+    r       *opRunner
+    id, org string
+    mu      sync.Mutex
+    buf     []byte
+}
+
+func (w *opLogWriter) Write(p []byte) (int, error) {
+    w.mu.Lock(); defer w.mu.Unlock()
+    w.buf = append(w.buf, p...)
+    for {
+        i := bytes.IndexByte(w.buf, '\n')
+        if i < 0 { break }
+        w.r.appendLine(w.id, w.org, strings.TrimRight(string(w.buf[:i]), "\r"))
+        w.buf = w.buf[i+1:]
+    }
+    return len(p), nil
+}
+
+func (w *opLogWriter) flush() {
+    w.mu.Lock(); defer w.mu.Unlock()
+    if len(w.buf) > 0 { w.r.appendLine(w.id, w.org, string(w.buf)); w.buf = nil }
+}
+
+// runCommand runs cmd with its output going to out, killing it if ctx ends.
+func runCommand(ctx context.Context, out io.Writer, name string, args []string, env []string) error {
+    cmd := exec.CommandContext(ctx, name, args...)
+    cmd.Env = env
+    cmd.Stdout = out
+    cmd.Stderr = out
+    return cmd.Run()
+}
+
+func envInt(key string, def int) int {
+    if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 { return n }
+    return def
+}
+
+// handleOperations serves GET /operations?org=.
+func handleOperations(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
+    writeJSON(w, operations.list(r.URL.Query().Get("org")))
+}
+
+// handleOperation serves /operations/{id} (GET status, DELETE cancel),
+// POST /operations/{id}/cancel, GET /operations/{id}/logs and the SSE
+// output stream at /operations/{id}/events.
+func handleOperation(w http.ResponseWriter, r *http.Request) {
+    p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/operations/"), "/")
+    seg := strings.Split(p, "/")
+    id := seg[0]
+    if id == "" { handleOperations(w, r); return }
+    op, ok := operations.get(id)
+    if !ok { http.Error(w, "not found", 404); return }
+    action := ""
+    if len(seg) > 1 { action = seg[1] }
+    switch {
+    case action == "" && r.Method == http.MethodGet:
+        writeJSON(w, op)
+    case (action == "" && r.Method == http.MethodDelete) || (action == "cancel" && r.Method == http.MethodPost):
+        op, _ = operations.cancelOp(id)
+        writeJSON(w, op)
+    case action == "logs" && r.Method == http.MethodGet:
+        page, err := readLogPage(operations.logs, id, r)
+        if err != nil { http.Error(w, err.Error(), 400); return }
+        writeJSON(w, map[string]any{"id": id, "lines": page.lines(), "entries": page.Entries, "start": page.Start, "end": page.End, "next": page.Next})
+    case action == "events" && r.Method == http.MethodGet:
+        serveLogStream(w, r, operations.logs, operations.hub, id)
+    case action == "" || action == "cancel" || action == "logs" || action == "events":
+        http.Error(w, "method", 405)
+    default:
+        http.Error(w, "not found", 404)
+    }
+}
+
+// acceptOperation submits an operation and answers 202 with its id, or
+// waits for it when the caller passes ?wait=<duration> (capped at 10m).
+func acceptOperation(w http.ResponseWriter, r *http.Request, kind, org string, fn opFunc) {
+    op, err := operations.submit(kind, org, fn)
+    if err != nil { http.Error(w, err.Error(), http.StatusServiceUnavailable); return }
+    if v := r.URL.Query().Get("wait"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err == nil && d > 0 {
+            if d > 10*time.Minute { d = 10 * time.Minute }
+            ctx, cancel := context.WithTimeout(r.Context(), d)
+            op, _ = operations.wait(ctx, op.ID)
+            cancel()
+        }
+    }
+    w.Header().Set("Location", "/operations/"+op.ID)
+    if !op.done() { w.Header().Set("Content-Type", "application/json"); w.WriteHeader(http.StatusAccepted) }
+    writeJSON(w, map[string]any{"ok": op.Status != "failed" && op.Status != "canceled", "operationId": op.ID, "operation": op})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func testOpRunner(t *testing.T, workers int) *opRunner {
+    t.Helper()
+    return newOpRunner(workers, 8, newLogStore(filepath.Join(t.TempDir(), "ops"), 0, nil))
+}
+
+func TestOperationCapturesOutputAndExitCode(t *testing.T) {
+    r := testOpRunner(t, 1)
+    op, err := r.submit("test", "acme", func(ctx context.Context, out io.Writer) (any, error) {
+        return nil, runCommand(ctx, out, "sh", []string{"-c", "echo one; echo two >&2; exit 3"}, nil)
+    })
+    if err != nil { t.Fatal(err) }
+    if op.Status != "queued" { t.Fatalf("submit returned status %s", op.Status) }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    op, err = r.wait(ctx, op.ID)
+    if err != nil { t.Fatal(err) }
+    if op.Status != "failed" || op.ExitCode == nil || *op.ExitCode != 3 { t.Fatalf("unexpected result: %+v", op) }
+    page, _ := r.logs.Read(op.ID, 0, 10)
+    var lines []string
+    for _, e := range page.Entries { lines = append(lines, e.Line) }
+    if strings.Join(lines, "|") != "one|two|operation failed" { t.Fatalf("unexpected output: %v", lines) }
+}
+
+func TestOperationBoundedPoolAndCancel(t *testing.T) {
+    r := testOpRunner(t, 1)
+    started := make(chan struct{})
+    block := func(ctx context.Context, out io.Writer) (any, error) {
+        close(started)
+        <-ctx.Done()
+        return nil, ctx.Err()
+    }
+    first, _ := r.submit("test", "acme", block)
+    second, _ := r.submit("test", "acme", func(ctx context.Context, out io.Writer) (any, error) { return nil, nil })
+    <-started
+    if op, _ := r.get(second.ID); op.Status != "queued" { t.Fatalf("second op should wait for a free worker, got %s", op.Status) }
+
+    // canceling a queued op finishes it immediately and it never runs
+    if op, _ := r.cancelOp(second.ID); op.Status != "canceled" { t.Fatalf("queued cancel: %s", op.Status) }
+    r.cancelOp(first.ID)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    op, err := r.wait(ctx, first.ID)
+    if err != nil || op.Status != "canceled" { t.Fatalf("running cancel: %+v %v", op, err) }
+    time.Sleep(20 * time.Millisecond)
+    if op, _ := r.get(second.ID); op.Status != "canceled" || op.StartedAt != nil { t.Fatalf("canceled op ran: %+v", op) }
+}
+
+func TestOperationsPruned(t *testing.T) {
+    r := testOpRunner(t, 1)
+    r.keepDone = 2
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    var ids []string
+    for i := 0; i < 4; i++ {
+        op, _ := r.submit("test", "acme", func(ctx context.Context, out io.Writer) (any, error) { return nil, nil })
+        r.wait(ctx, op.ID)
+        ids = append(ids, op.ID)
+    }
+    if got := r.list(""); len(got) != 2 || got[0].ID != ids[3] || got[1].ID != ids[2] { t.Fatalf("kept %+v", got) }
+    if _, ok := r.get(ids[0]); ok { t.Fatal("oldest operation kept") }
+
+    // past keepFor they go regardless of count
+    r.keepFor = time.Millisecond
+    time.Sleep(5 * time.Millisecond)
+    op, _ := r.submit("test", "acme", func(ctx context.Context, out io.Writer) (any, error) { return nil, nil })
+    r.wait(ctx, op.ID)
+    if got := r.list(""); len(got) != 1 || got[0].ID != op.ID { t.Fatalf("after keepFor: %+v", got) }
+}
+
+func TestOperationEndpoints(t *testing.T) {
+    srv := newServer()
+    op, _ := operations.submit("test", "acme", func(ctx context.Context, out io.Writer) (any, error) {
+        fmt.Fprintln(out, "hello")
+        return map[string]any{"path": "/tmp/x"}, nil
+    })
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    operations.wait(ctx, op.ID)
+
+    rr := httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/operations/"+op.ID, nil))
+    var got Operation
+    json.Unmarshal(rr.Body.Bytes(), &got)
+    if got.Status != "succeeded" || got.Result.(map[string]any)["path"] != "/tmp/x" || *got.ExitCode != 0 { t.Fatalf("unexpected op: %s", rr.Body.String()) }
+
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/operations/"+op.ID+"/logs?from=0", nil))
+    if !strings.Contains(rr.Body.String(), "hello") { t.Fatalf("logs missing output: %s", rr.Body.String()) }
+
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/operations/nope", nil))
+    if rr.Code != 404 { t.Fatalf("expected 404, got %d", rr.Code) }
+}
+
+func TestDeployReturnsOperationImmediately(t *testing.T) {
+    dir := t.TempDir()
+    t.Setenv("WORKSPACE_DIR", dir)
+    t.Setenv("AGENT_DEPLOYER", "script")
+    writeFileAtomic(filepath.Join(dir, "scripts", "deploy_agent_talos.sh"), []byte("echo deploying $1 $2\nsleep 5\n"), 0o755)
+    srv := newServer()
+    start := time.Now()
+    rr := httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("POST", "/agents/deploy", strings.NewReader(`{"org":"acme"}`)))
+    if rr.Code != 202 { t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String()) }
+    if time.Since(start) > 2*time.Second { t.Fatal("deploy blocked the request") }
+    var resp struct{ OK bool; OperationID string }
+    json.Unmarshal(rr.Body.Bytes(), &resp)
+    if !resp.OK || resp.OperationID == "" { t.Fatalf("unexpected response: %s", rr.Body.String()) }
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("POST", "/operations/"+resp.OperationID+"/cancel", nil))
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if op, _ := operations.wait(ctx, resp.OperationID); op.Status != "canceled" { t.Fatalf("status %s", op.Status) }
+}
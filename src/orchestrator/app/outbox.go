@@ -0,0 +1,80 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Agents deliver task status and log batches from an on-disk outbox,
+// retrying until a request is accepted. Each request names the outbox and
+// carries its sequence number; delivery is in order, so anything at or
+// below the last accepted number is a redelivery (the agent never saw our
+// response) and is acknowledged without being applied again. Requests
+// without the headers are handled as before.
+
+const (
+    agentOutboxHeader = "X-Agent-Outbox"
+    agentSeqHeader    = "X-Agent-Seq"
+    // outboxes not heard from for this long are forgotten
+    outboxSeenTTL = 24 * time.Hour
+)
+
+type outboxState struct {
+    mu       sync.Mutex
+    seq      uint64
+    lastSeen time.Time
+}
+
+var (
+    outboxesMu sync.Mutex
+    outboxes   = make(map[string]*outboxState)
+)
+
+func outboxFor(id string, now time.Time) *outboxState {
+    outboxesMu.Lock(); defer outboxesMu.Unlock()
+    st, ok := outboxes[id]
+    if !ok {
+        for k, o := range outboxes {
+            o.mu.Lock()
+            stale := now.Sub(o.lastSeen) > outboxSeenTTL
+            o.mu.Unlock()
+            if stale { delete(outboxes, k) }
+        }
+        st = &outboxState{lastSeen: now}
+        outboxes[id] = st
+    }
+    return st
+}
+
+// statusRecorder remembers the status a handler wrote.
+type statusRecorder struct {
+    http.ResponseWriter
+    code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+    s.code = code
+    s.ResponseWriter.WriteHeader(code)
+}
+
+// sequenced applies outbox deduplication to an agent reporting endpoint.
+func sequenced(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(agentOutboxHeader)
+        seq, err := strconv.ParseUint(r.Header.Get(agentSeqHeader), 10, 64)
+        if id == "" || err != nil || seq == 0 { h(w, r); return }
+        now := time.Now()
+        st := outboxFor(id, now)
+        st.mu.Lock(); defer st.mu.Unlock()
+        st.lastSeen = now
+        if seq <= st.seq {
+            writeJSON(w, map[string]any{"duplicate": true, "seq": seq})
+            return
+        }
+        rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+        h(rec, r)
+        if rec.code < 300 { st.seq = seq }
+    }
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestOutboxRedeliveryAppliedOnce(t *testing.T) {
+    os.Unsetenv("ORCHESTRATOR_TOKEN")
+    srv := newServer()
+    id, boxA, boxB := uniq("ob"), uniq("box-a"), uniq("box-b")
+    post := func(path, outbox string, seq, body string) *httptest.ResponseRecorder {
+        rr := httptest.NewRecorder()
+        req := httptest.NewRequest("POST", path, strings.NewReader(body))
+        if outbox != "" { req.Header.Set(agentOutboxHeader, outbox); req.Header.Set(agentSeqHeader, seq) }
+        srv.ServeHTTP(rr, req)
+        return rr
+    }
+    tasksMu.Lock(); tasks[id] = Task{ID: id, Org: "acme", Status: "running", CreatedAt: time.Now()}; tasksMu.Unlock()
+    defer func() { tasksMu.Lock(); delete(tasks, id); tasksMu.Unlock() }()
+
+    batch := `{"id":"`+id+`","lines":[{"line":"one","phase":"run","stream":"stdout"}]}`
+    if rr := post("/tasks/log", boxA, "1", batch); rr.Code != 204 { t.Fatalf("first delivery: %d", rr.Code) }
+    // the agent didn't see the response and sends it again
+    rr := post("/tasks/log", boxA, "1", batch)
+    var dup struct{ Duplicate bool }
+    json.Unmarshal(rr.Body.Bytes(), &dup)
+    if rr.Code != 200 || !dup.Duplicate { t.Fatalf("redelivery: %d %s", rr.Code, rr.Body) }
+    // another outbox has its own sequence
+    if rr := post("/tasks/log", boxB, "1", `{"id":"`+id+`","line":"from b"}`); rr.Code != 204 { t.Fatalf("other outbox: %d", rr.Code) }
+    // without the headers nothing is deduplicated
+    if rr := post("/tasks/log", "", "", `{"id":"`+id+`","line":"plain"}`); rr.Code != 204 { t.Fatalf("plain: %d", rr.Code) }
+    if rr := post("/tasks/log", "", "", `{"id":"`+id+`","line":"plain"}`); rr.Code != 204 { t.Fatalf("plain again: %d", rr.Code) }
+    entries, _ := taskLogs.Tail(id, 10)
+    var lines []string
+    for _, e := range entries { lines = append(lines, e.Line) }
+    if strings.Join(lines, "|") != "[run/stdout] one|from b|plain|plain" { t.Fatalf("log: %q", lines) }
+
+    // a rejected request doesn't consume its sequence number
+    if rr := post("/tasks/update", boxA, "2", `{"id":"`+id+`"}`); rr.Code != 400 { t.Fatalf("bad update: %d", rr.Code) }
+    rr = post("/tasks/update", boxA, "2", `{"id":"`+id+`","status":"completed","result":{"exitCode":0,"durationMs":5}}`)
+    var updated Task
+    json.Unmarshal(rr.Body.Bytes(), &updated)
+    if rr.Code != 200 || updated.Status != "completed" { t.Fatalf("update: %d %s", rr.Code, rr.Body) }
+    // a stale redelivery can't roll the status back
+    if rr := post("/tasks/update", boxA, "2", `{"id":"`+id+`","status":"running"}`); !strings.Contains(rr.Body.String(), `"duplicate":true`) { t.Fatalf("stale update applied: %s", rr.Body) }
+    tasksMu.RLock(); st := tasks[id].Status; tasksMu.RUnlock()
+    if st != "completed" { t.Fatalf("status=%s", st) }
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// EventPoolReconciled is published when a reconcile pass took any action.
+const EventPoolReconciled = "pool.reconciled"
+
+// PoolDrift is one difference between an org's desired pool and what is
+// deployed or registered.
+type PoolDrift struct {
+    Kind   string `json:"kind"` // missing | outdated | excess | scaled | unregistered | orphaned
+    Name   string `json:"name,omitempty"`
+    Detail string `json:"detail"`
+}
+
+// PoolAction is something the reconciler did (or failed to do).
+type PoolAction struct {
+    Time        time.Time `json:"time"`
+    Action      string    `json:"action"` // deploy | remove | scale
+    Name        string    `json:"name"`
+    Reason      string    `json:"reason"`
+    OperationID string    `json:"operationId,omitempty"`
+    Error       string    `json:"error,omitempty"`
+}
+
+// PoolStatus is the reconciler's view of one org, served at /pools/{org}.
+// Observed and Drift are as found at the start of the last pass; Pending
+// and Actions show what it did about them.
+type PoolStatus struct {
+    Org      string     `json:"org"`
+    Desired  PoolConfig `json:"desired"`
+    Observed struct {
+        Agents     int `json:"agents"`     // pool deployments, including ones still being created
+        UpToDate   int `json:"upToDate"`   // created from the current template
+        Ready      int `json:"ready"`      // running or registered
+        Registered int `json:"registered"` // registered agent records linked to pool deployments
+    } `json:"observed"`
+    Autoscale *AutoscaleStatus `json:"autoscale,omitempty"`
+    Converged bool         `json:"converged"`
+    Drift     []PoolDrift  `json:"drift"`
+    Pending   []string     `json:"pending,omitempty"` // deployments being created
+    Actions   []PoolAction `json:"actions"`           // most recent last
+    LastRun   *time.Time   `json:"lastRun,omitempty"`
+    LastError string       `json:"lastError,omitempty"`
+}
+
+const poolActionHistory = 50
+
+// reconciler converges each org with a pool in config to its desired
+// state. Agents it owns carry labelPool; anything else in the org (manual
+// /agents/deploy) is left alone.
+type reconciler struct {
+    runMu sync.Mutex // one pass at a time
+
+    mu      sync.Mutex
+    status  map[string]*PoolStatus
+    pending map[string]map[string]string // org -> operation id -> deployment name
+    scale   map[string]*AutoscaleStatus      // autoscaled orgs (see autoscale.go)
+    trigger chan struct{}
+}
+
+var pools = newReconciler()
+
+func newReconciler() *reconciler {
+    return &reconciler{status: map[string]*PoolStatus{}, pending: map[string]map[string]string{}, scale: map[string]*AutoscaleStatus{}, trigger: make(chan struct{}, 1)}
+}
+
+func (p PoolConfig) maxSurge() int {
+    if p.MaxSurge == nil { return 1 }
+    return int(*p.MaxSurge)
+}
+
+// hash identifies the template agents are created from; agents with a
+// different hash are replaced.
+func (p PoolConfig) hash() string {
+    var b strings.Builder
+    b.WriteString(AgentSpec{Image: p.Image}.normalize().Image)
+    for _, m := range []map[string]string{p.Labels, p.Env} {
+        keys := make([]string, 0, len(m))
+        for k := range m { keys = append(keys, k) }
+        sort.Strings(keys)
+        b.WriteString("\x00")
+        for _, k := range keys { b.WriteString(k + "=" + m[k] + "\x01") }
+    }
+    sum := sha256.Sum256([]byte(b.String()))
+    return hex.EncodeToString(sum[:])[:10]
+}
+
+func (p PoolConfig) spec(org string) AgentSpec {
+    labels := map[string]string{}
+    for k, v := range p.Labels { labels[k] = v }
+    labels[labelPool] = org
+    labels[labelPoolHash] = p.hash()
+    return AgentSpec{
+        Org:      org,
+        Name:     fmt.Sprintf("agent-%s-%s", org, newID()[:6]),
+        Image:    p.Image,
+        Replicas: 1,
+        Labels:   labels,
+        Env:      p.Env,
+    }
+}
+
+// poolOrgs returns the orgs that declare a pool.
+func poolOrgs() map[string]PoolConfig {
+    out := map[string]PoolConfig{}
+    for _, o := range currentConfig().Orgs {
+        if o.Pool != nil { out[o.Name] = *o.Pool }
+    }
+    return out
+}
+
+func reconcileInterval() time.Duration {
+    if d, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil && d > 0 { return d }
+    return 30 * time.Second
+}
+
+// start runs reconcile passes every interval, and immediately when kicked,
+// until ctx ends.
+func (r *reconciler) start(ctx context.Context, interval time.Duration) {
+    go func() {
+        t := time.NewTicker(interval)
+        defer t.Stop()
+        for {
+            r.reconcileAll(ctx)
+            select {
+            case <-ctx.Done():
+                return
+            case <-t.C:
+            case <-r.trigger:
+            }
+        }
+    }()
+}
+
+// kick requests a pass soon without waiting for it.
+func (r *reconciler) kick() {
+    select {
+    case r.trigger <- struct{}{}:
+    default:
+    }
+}
+
+func (r *reconciler) reconcileAll(ctx context.Context) {
+    for org, pc := range poolOrgs() {
+        if _, err := r.reconcile(ctx, org, pc); err != nil { log.Printf("pool[%s]: %v", org, err) }
+    }
+}
+
+// reconcile runs one pass for an org and returns its status.
+func (r *reconciler) reconcile(ctx context.Context, org string, pc PoolConfig) (PoolStatus, error) {
+    r.runMu.Lock(); defer r.runMu.Unlock()
+    ctx, cancel := context.WithTimeout(ctx, deploymentTimeout)
+    defer cancel()
+    now := time.Now().UTC()
+    st := PoolStatus{Org: org, Desired: pc, LastRun: &now, Drift: []PoolDrift{}}
+    actions, err := r.pass(ctx, org, pc, &st)
+    if err != nil { st.LastError = err.Error() }
+
+    r.mu.Lock()
+    prev := r.status[org]
+    if prev != nil { st.Actions = prev.Actions }
+    st.Actions = append(st.Actions, actions...)
+    if n := len(st.Actions); n > poolActionHistory { st.Actions = st.Actions[n-poolActionHistory:] }
+    if st.Actions == nil { st.Actions = []PoolAction{} }
+    r.status[org] = &st
+    for _, name := range r.pending[org] { st.Pending = append(st.Pending, name) }
+    sort.Strings(st.Pending)
+    r.mu.Unlock()
+    if len(actions) > 0 { publishEvent(EventPoolReconciled, org, st) }
+    return st, err
+}
+
+// pass compares the org's pool with its deployments and registered agents,
+// fills in st and makes the changes. Agents are replaced surge-first: new
+// ones are created (up to desired+maxSurge in total) and outdated or
+// excess ones removed once enough ready agents remain without them.
+func (r *reconciler) pass(ctx context.Context, org string, pc PoolConfig, st *PoolStatus) ([]PoolAction, error) {
+    d, err := deployerFor(org)
+    if err != nil { return nil, err }
+    if _, ok := d.(scriptDeployer); ok { return nil, fmt.Errorf("pool needs a deployer that can label agents, not script") }
+    all, err := d.List(ctx, org)
+    if err != nil { return nil, err }
+
+    // operations still creating agents count towards the pool
+    listed := map[string]bool{}
+    for _, da := range all { listed[da.Name] = true }
+    var creating []string
+    r.mu.Lock()
+    for id, name := range r.pending[org] {
+        op, ok := operations.get(id)
+        if !ok || op.done() || listed[name] {
+            delete(r.pending[org], id)
+            continue
+        }
+        creating = append(creating, name)
+    }
+    r.mu.Unlock()
+
+    registered := agentsByDeployment(org)
+    held := inFlightTasks()
+    hash := pc.hash()
+    desired := int(pc.Replicas)
+    var current, outdated []poolMember
+    readyTotal := 0
+    for _, da := range all {
+        if da.Labels[labelPool] != org { continue }
+        m := poolMember{DeployedAgent: da, upToDate: da.Labels[labelPoolHash] == hash, idleSince: da.CreatedAt}
+        live := 0
+        for _, a := range registered[da.Name] {
+            if a.Status != "offline" { live++; m.slots += max(a.Capacity, 1); m.inFlight += held[a.Name] }
+            if a.Status == "running" || a.Status == "busy" { m.busy = true }
+            if a.IdleSince != nil && a.IdleSince.After(m.idleSince) { m.idleSince = *a.IdleSince }
+        }
+        m.idle = !m.busy && live > 0
+        st.Observed.Registered += len(registered[da.Name])
+        m.ready = (da.Replicas > 0 && da.Ready >= da.Replicas) || live > 0
+        if m.ready { readyTotal++; st.Observed.Ready++ }
+        if da.Replicas != 1 {
+            st.Drift = append(st.Drift, PoolDrift{Kind: "scaled", Name: da.Name, Detail: fmt.Sprintf("has %d replicas, pool agents run 1", da.Replicas)})
+        }
+        if m.ready && live == 0 && len(registered[da.Name]) == 0 {
+            st.Drift = append(st.Drift, PoolDrift{Kind: "unregistered", Name: da.Name, Detail: "running but no agent has registered from it"})
+        }
+        if m.upToDate { current = append(current, m) } else { outdated = append(outdated, m) }
+    }
+    for name, list := range registered {
+        if listed[name] { continue }
+        for _, a := range list {
+            st.Drift = append(st.Drift, PoolDrift{Kind: "orphaned", Name: a.Name, Detail: "registered from deployment " + name + ", which no longer exists"})
+        }
+    }
+    for _, m := range outdated {
+        st.Drift = append(st.Drift, PoolDrift{Kind: "outdated", Name: m.Name, Detail: "created from an older pool template"})
+    }
+    total := len(current) + len(outdated) + len(creating)
+    upToDate := len(current) + len(creating)
+    st.Observed.Agents, st.Observed.UpToDate = total, upToDate
+    if pc.Autoscale != nil {
+        desired = r.autoscale(org, pc, append(append([]poolMember{}, current...), outdated...), st)
+    }
+    if upToDate < desired {
+        st.Drift = append(st.Drift, PoolDrift{Kind: "missing", Detail: fmt.Sprintf("%d of %d agents up to date", upToDate, desired)})
+    }
+    if upToDate > desired {
+        st.Drift = append(st.Drift, PoolDrift{Kind: "excess", Detail: fmt.Sprintf("%d agents, %d desired", upToDate, desired)})
+    }
+
+    var actions []PoolAction
+    act := func(a PoolAction) {
+        a.Time = time.Now().UTC()
+        actions = append(actions, a)
+    }
+
+    // scale back agents someone scaled by hand
+    for _, m := range append(append([]poolMember{}, current...), outdated...) {
+        if m.Replicas == 1 { continue }
+        err := d.Scale(ctx, m.Name, 1)
+        a := PoolAction{Action: "scale", Name: m.Name, Reason: fmt.Sprintf("had %d replicas", m.Replicas)}
+        if err != nil { a.Error = err.Error() }
+        act(a)
+    }
+
+    // create missing agents within the surge budget
+    create := desired - upToDate
+    if budget := desired + pc.maxSurge() - total; create > budget { create = budget }
+    for i := 0; i < create; i++ {
+        spec := pc.spec(org)
+        op, err := operations.submit("agent.deploy", org, deployAgentOp(d, spec))
+        a := PoolAction{Action: "deploy", Name: spec.Name, Reason: fmt.Sprintf("%d of %d agents up to date", upToDate, desired)}
+        if err != nil {
+            a.Error = err.Error()
+            act(a)
+            break
+        }
+        a.OperationID = op.ID
+        act(a)
+        r.mu.Lock()
+        if r.pending[org] == nil { r.pending[org] = map[string]string{} }
+        r.pending[org][op.ID] = spec.Name
+        r.mu.Unlock()
+        total++; upToDate++
+    }
+    unavailable := len(creating) + max(create, 0)
+    for _, m := range current {
+        if !m.ready { unavailable++ }
+    }
+
+    // remove outdated agents, then excess up-to-date ones; not-ready ones
+    // go first, then the longest idle. Ready ones only go while enough
+    // ready agents remain, and agents working on a task are never removed.
+    sort.SliceStable(outdated, func(i, j int) bool {
+        if outdated[i].ready != outdated[j].ready { return !outdated[i].ready }
+        return outdated[i].CreatedAt.Before(outdated[j].CreatedAt)
+    })
+    sort.SliceStable(current, func(i, j int) bool {
+        a, b := current[i], current[j]
+        if a.ready != b.ready { return !a.ready }
+        if a.busy != b.busy { return !a.busy }
+        return a.idleSince.Before(b.idleSince)
+    })
+    excess := upToDate - desired
+    var candidates []poolMember
+    candidates = append(candidates, outdated...)
+    if excess > 0 {
+        if excess > len(current) { excess = len(current) }
+        candidates = append(candidates, current[:excess]...)
+    }
+    for _, m := range candidates {
+        // without surge, one outdated agent at a time makes room for its
+        // replacement, once nothing else is on its way up
+        noSurgeRoom := pc.maxSurge() == 0 && !m.upToDate && upToDate < desired && unavailable == 0
+        if m.busy || (m.ready && readyTotal-1 < desired && !noSurgeRoom) { continue }
+        reason := "outdated"
+        if m.upToDate { reason = "excess" }
+        a := PoolAction{Action: "remove", Name: m.Name, Reason: reason}
+        if err := d.Stop(ctx, m.Name); err != nil && err != errDeploymentNotFound {
+            a.Error = err.Error()
+            act(a)
+            continue
+        }
+        forgetDeploymentAgents(m.Name)
+        act(a)
+        if m.ready { readyTotal-- }
+        if noSurgeRoom { unavailable++ } // replaced on the next pass
+    }
+    st.Converged = len(st.Drift) == 0
+    return actions, nil
+}
+
+// poolMember is a pool deployment as seen by one reconcile pass.
+type poolMember struct {
+    DeployedAgent
+    upToDate, ready bool
+    busy            bool      // a registered agent is running a task
+    idle            bool      // registered, live and not busy
+    idleSince       time.Time // when its agent went idle, or when it was created
+    slots, inFlight int       // task slots of its live agents, and tasks they hold
+}
+
+func (r *reconciler) get(org string) (PoolStatus, bool) {
+    pc, ok := poolOrgs()[org]
+    if !ok { return PoolStatus{}, false }
+    r.mu.Lock(); defer r.mu.Unlock()
+    if st, ok := r.status[org]; ok {
+        out := *st
+        out.Desired = pc
+        return out, true
+    }
+    return PoolStatus{Org: org, Desired: pc, Drift: []PoolDrift{}, Actions: []PoolAction{}}, true
+}
+
+// handlePools serves GET /pools: the status of every org with a pool.
+func handlePools(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
+    out := []PoolStatus{}
+    for org := range poolOrgs() {
+        if st, ok := pools.get(org); ok { out = append(out, st) }
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Org < out[j].Org })
+    writeJSON(w, out)
+}
+
+// handlePool serves GET /pools/{org} (desired vs observed, drift, recent
+// actions) and POST /pools/{org}/reconcile, which runs a pass right away.
+func handlePool(w http.ResponseWriter, r *http.Request) {
+    seg := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/pools/"), "/"), "/")
+    org := seg[0]
+    if org == "" { handlePools(w, r); return }
+    pc, ok := poolOrgs()[org]
+    if !ok { http.Error(w, "no pool configured for org", 404); return }
+    switch {
+    case len(seg) == 1 && r.Method == http.MethodGet:
+        st, _ := pools.get(org)
+        writeJSON(w, st)
+    case len(seg) == 2 && seg[1] == "reconcile" && r.Method == http.MethodPost:
+        st, err := pools.reconcile(r.Context(), org, pc)
+        if err != nil { http.Error(w, err.Error(), 502); return }
+        writeJSON(w, st)
+    case len(seg) == 1 || (len(seg) == 2 && seg[1] == "reconcile"):
+        http.Error(w, "method", 405)
+    default:
+        http.Error(w, "not found", 404)
+    }
+}
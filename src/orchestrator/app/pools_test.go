@@ -0,0 +1,144 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// settle waits for the pool's deploy operations to finish and the new
+// processes to come up, then registers an agent for every deployment the
+// way a started agent would.
+func settle(t *testing.T, r *reconciler, org string) []DeployedAgent {
+    t.Helper()
+    r.mu.Lock()
+    var ids []string
+    for id := range r.pending[org] { ids = append(ids, id) }
+    r.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    for _, id := range ids {
+        if op, err := operations.wait(ctx, id); err != nil || op.Status != "succeeded" { t.Fatalf("deploy op %s: %+v %v", id, op, err) }
+    }
+    d, _ := deployerFor(org)
+    for {
+        list, err := d.List(ctx, org)
+        if err != nil { t.Fatal(err) }
+        ready := true
+        for _, da := range list {
+            if da.Ready < da.Replicas { ready = false }
+        }
+        if ready {
+            agentsMu.Lock()
+            for _, da := range list {
+                if _, ok := agents[da.Name+"-0"]; ok { continue }
+                a := Agent{Name: da.Name + "-0", Org: org, Deployment: da.Name, Status: "idle", LastSeen: time.Now()}
+                a.markIdle()
+                agents[a.Name] = a
+            }
+            agentsMu.Unlock()
+            return list
+        }
+        if ctx.Err() != nil { t.Fatalf("agents never became ready: %+v", list) }
+        time.Sleep(20 * time.Millisecond)
+    }
+}
+
+func TestPoolReconcilerConvergesWithSurge(t *testing.T) {
+    newServer() // operations runner
+    dir := t.TempDir()
+    bin := filepath.Join(dir, "fake-agent")
+    os.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755)
+    pool := &PoolConfig{Replicas: 2, Image: "mvp-agent:v1", Labels: map[string]string{"tier": "gpu"}}
+    cfg := &Config{Orgs: []OrgConfig{{Name: "pool-org", Deployer: backendLocal, Local: LocalDeployerConfig{Binary: bin, WorkDir: dir}, Pool: pool}}}
+    setConfig(cfg)
+    defer setConfig(&Config{})
+    d, _ := deployerFor("pool-org")
+    defer func() {
+        list, _ := d.List(context.Background(), "pool-org")
+        for _, da := range list { d.Stop(context.Background(), da.Name) }
+    }()
+    r := newReconciler()
+    ctx := context.Background()
+
+    converge := func(maxAgents int) PoolStatus {
+        t.Helper()
+        for i := 0; i < 20; i++ {
+            st, err := r.reconcile(ctx, "pool-org", *pool)
+            if err != nil { t.Fatal(err) }
+            list := settle(t, r, "pool-org")
+            if len(list) > maxAgents { t.Fatalf("pass %d: %d agents exceeds desired+surge %d", i, len(list), maxAgents) }
+            if st.Converged { return st }
+        }
+        t.Fatal("pool did not converge")
+        return PoolStatus{}
+    }
+
+    st := converge(3)
+    if st.Observed.UpToDate != 2 || st.Observed.Registered != 2 || len(st.Drift) != 0 { t.Fatalf("unexpected status: %+v", st) }
+    list, _ := d.List(ctx, "pool-org")
+    for _, da := range list {
+        if da.Labels["tier"] != "gpu" || da.Labels[labelPool] != "pool-org" { t.Fatalf("pool labels missing: %+v", da.Labels) }
+    }
+
+    // a template change rolls agents one at a time, never below 2 ready
+    pool.Image = "mvp-agent:v2"
+    st, _ = r.reconcile(ctx, "pool-org", *pool)
+    if st.Observed.UpToDate != 0 || st.Observed.Ready != 2 || len(st.Pending) != 1 || st.Drift[0].Kind != "outdated" { t.Fatalf("expected surge of one with outdated drift: %+v", st) }
+    st = converge(3)
+    list, _ = d.List(ctx, "pool-org")
+    if len(list) != 2 { t.Fatalf("expected 2 agents after rollout, got %+v", list) }
+    for _, da := range list {
+        if da.Labels[labelPoolHash] != pool.hash() { t.Fatalf("outdated agent left: %s", da.Name) }
+    }
+    agentsMu.RLock()
+    for _, a := range agents {
+        if a.Org == "pool-org" && a.Deployment != list[0].Name && a.Deployment != list[1].Name { t.Fatalf("agent record of removed deployment kept: %+v", a) }
+    }
+    agentsMu.RUnlock()
+
+    // scale to zero removes everything
+    pool.Replicas = 0
+    converge(2)
+    if list, _ := d.List(ctx, "pool-org"); len(list) != 0 { t.Fatalf("agents left at replicas 0: %+v", list) }
+}
+
+func TestPoolEndpoints(t *testing.T) {
+    srv := newServer()
+    setConfig(&Config{Orgs: []OrgConfig{{Name: "acme"}, {Name: "pooled", Deployer: backendDocker, Docker: DockerDeployerConfig{Host: "tcp://127.0.0.1:1"}, Pool: &PoolConfig{Replicas: 1}}}})
+    defer setConfig(&Config{})
+
+    rr := httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/pools/acme", nil))
+    if rr.Code != 404 { t.Fatalf("org without pool: %d", rr.Code) }
+
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/pools", nil))
+    var list []PoolStatus
+    json.Unmarshal(rr.Body.Bytes(), &list)
+    if len(list) != 1 || list[0].Org != "pooled" || list[0].Desired.Replicas != 1 { t.Fatalf("unexpected pools: %s", rr.Body) }
+
+    // an unreachable backend is reported, not hidden
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("POST", "/pools/pooled/reconcile", nil))
+    if rr.Code != 502 { t.Fatalf("expected 502 for unreachable docker, got %d", rr.Code) }
+    rr = httptest.NewRecorder()
+    srv.ServeHTTP(rr, httptest.NewRequest("GET", "/pools/pooled", nil))
+    var st PoolStatus
+    json.Unmarshal(rr.Body.Bytes(), &st)
+    if st.LastError == "" || st.LastRun == nil { t.Fatalf("expected lastError after failed pass: %s", rr.Body) }
+}
+
+func TestLoadConfigValidatesPool(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "orchestrator.yaml")
+    os.WriteFile(path, []byte("orgs:\n  - name: acme\n    pool: { replicas: -1 }\n"), 0o644)
+    if _, err := loadConfig(path); err == nil { t.Fatal("negative replicas accepted") }
+    os.WriteFile(path, []byte("orgs:\n  - name: acme\n    pool: { replicas: 3, image: mvp-agent:v1, labels: { tier: gpu }, maxSurge: 0 }\n"), 0o644)
+    cfg, err := loadConfig(path)
+    if err != nil { t.Fatal(err) }
+    if p := cfg.Orgs[0].Pool; p == nil || p.Replicas != 3 || p.maxSurge() != 0 || p.Labels["tier"] != "gpu" { t.Fatalf("unexpected pool: %+v", p) }
+}
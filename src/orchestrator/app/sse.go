@@ -0,0 +1,148 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// sseKeepAlive is how often an idle stream gets a comment line so proxies
+// and browsers don't time the connection out.
+var sseKeepAlive = 15 * time.Second
+
+// logSub is one SSE client following a log stream. When its buffer is full
+// the broadcaster drops the entry and signals lag; the client then catches
+// up from the durable log store instead of silently missing lines.
+type logSub struct {
+    ch  chan logEntry
+    lag chan struct{}
+}
+
+// logHub fans out appended log entries to subscribers by stream key.
+type logHub struct {
+    mu   sync.Mutex
+    subs map[string]map[*logSub]struct{}
+}
+
+func newLogHub() *logHub { return &logHub{subs: make(map[string]map[*logSub]struct{})} }
+
+func (h *logHub) add(key string) *logSub {
+    s := &logSub{ch: make(chan logEntry, 64), lag: make(chan struct{}, 1)}
+    h.mu.Lock(); defer h.mu.Unlock()
+    m := h.subs[key]; if m == nil { m = make(map[*logSub]struct{}); h.subs[key] = m }
+    m[s] = struct{}{}
+    return s
+}
+
+func (h *logHub) remove(key string, s *logSub) {
+    h.mu.Lock(); defer h.mu.Unlock()
+    if m := h.subs[key]; m != nil {
+        delete(m, s)
+        if len(m) == 0 { delete(h.subs, key) }
+    }
+}
+
+func (h *logHub) broadcast(key string, e logEntry) {
+    h.mu.Lock(); defer h.mu.Unlock()
+    for s := range h.subs[key] {
+        select {
+        case s.ch <- e:
+        default:
+            select { case s.lag <- struct{}{}: default: }
+        }
+    }
+}
+
+// writeSSE writes one event. Data is split on newlines into several data:
+// fields so embedded line breaks can't terminate the event early.
+func writeSSE(w io.Writer, id, event, data string) {
+    var b strings.Builder
+    if id != "" { b.WriteString("id: " + id + "\n") }
+    if event != "" { b.WriteString("event: " + event + "\n") }
+    data = strings.ReplaceAll(data, "\r\n", "\n")
+    data = strings.ReplaceAll(data, "\r", "\n")
+    for _, ln := range strings.Split(data, "\n") { b.WriteString("data: " + ln + "\n") }
+    b.WriteString("\n")
+    io.WriteString(w, b.String())
+}
+
+// lastEventID returns the resume offset from the Last-Event-ID header, or
+// the lastEventId query parameter for clients that can't set headers.
+func lastEventID(r *http.Request) (int64, bool) {
+    v := r.Header.Get("Last-Event-ID")
+    if v == "" { v = r.URL.Query().Get("lastEventId") }
+    if v == "" { return 0, false }
+    n, err := strconv.ParseInt(v, 10, 64)
+    if err != nil || n < 0 { return 0, false }
+    return n, true
+}
+
+func writeLogEvent(w io.Writer, e logEntry) {
+    id := ""
+    if e.Next > 0 { id = strconv.FormatInt(e.Next, 10) }
+    writeSSE(w, id, "", e.String())
+}
+
+// serveLogStream streams a durable log over SSE. Event IDs are the byte
+// offset just past each record, so a reconnecting client resumes exactly
+// where it left off via Last-Event-ID. Without one it gets the recent tail.
+func serveLogStream(w http.ResponseWriter, r *http.Request, store *logStore, hub *logHub, key string) {
+    flusher, ok := w.(http.Flusher); if !ok { http.Error(w, "no flusher", 500); return }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+
+    // subscribe before reading the backlog so nothing appended in between is lost
+    sub := hub.add(key); defer hub.remove(key, sub)
+    var next int64
+    // replay sends stored entries from offset next until caught up
+    replay := func() error {
+        for {
+            page, err := store.Read(key, next, maxLogReadLimit)
+            if err != nil { return err }
+            for _, e := range page.Entries { writeLogEvent(w, e) }
+            if len(page.Entries) == 0 || page.Next >= page.End {
+                if page.Next > next { next = page.Next }
+                return nil
+            }
+            next = page.Next
+        }
+    }
+    if from, ok := lastEventID(r); ok {
+        next = from
+        if err := replay(); err != nil { writeSSE(w, "", "error", err.Error()) }
+    } else {
+        backlog, _ := store.Tail(key, defaultLogReadLimit)
+        for _, e := range backlog { writeLogEvent(w, e) }
+        // resume from what was actually sent: a line appended after Tail
+        // read the store must still go out from sub.ch
+        if len(backlog) > 0 { next = backlog[len(backlog)-1].Next } else { next, _ = store.Bounds(key) }
+    }
+    flusher.Flush()
+
+    keepAlive := time.NewTicker(sseKeepAlive)
+    defer keepAlive.Stop()
+    for {
+        select {
+        case e := <-sub.ch:
+            // already sent during replay
+            if e.Next > 0 && e.Next <= next { continue }
+            writeLogEvent(w, e)
+            if e.Next > next { next = e.Next }
+            flusher.Flush()
+        case <-sub.lag:
+            writeSSE(w, "", "lagged", fmt.Sprintf(`{"resumeFrom":%d}`, next))
+            if err := replay(); err != nil { writeSSE(w, "", "error", err.Error()) }
+            flusher.Flush()
+        case <-keepAlive.C:
+            io.WriteString(w, ": keepalive\n\n")
+            flusher.Flush()
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+type sseEvent struct{ id, event, data string }
+
+// readEvents collects n events (comments excluded) from an SSE body.
+func readEvents(t *testing.T, br *bufio.Reader, n int) []sseEvent {
+    t.Helper()
+    var out []sseEvent
+    var cur sseEvent
+    var data []string
+    for len(out) < n {
+        ln, err := br.ReadString('\n')
+        if err != nil { t.Fatalf("read after %d events: %v", len(out), err) }
+        ln = strings.TrimSuffix(ln, "\n")
+        switch {
+        case ln == "":
+            if data != nil || cur.event != "" {
+                cur.data = strings.Join(data, "\n")
+                out = append(out, cur)
+            }
+            cur, data = sseEvent{}, nil
+        case strings.HasPrefix(ln, ":"):
+        case strings.HasPrefix(ln, "id: "):
+            cur.id = ln[4:]
+        case strings.HasPrefix(ln, "event: "):
+            cur.event = ln[7:]
+        case strings.HasPrefix(ln, "data: "):
+            data = append(data, ln[6:])
+        }
+    }
+    return out
+}
+
+func openStream(t *testing.T, ctx context.Context, url, lastID string) *bufio.Reader {
+    t.Helper()
+    req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if lastID != "" { req.Header.Set("Last-Event-ID", lastID) }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { resp.Body.Close() })
+    if resp.StatusCode != 200 { t.Fatalf("status %d", resp.StatusCode) }
+    return bufio.NewReader(resp.Body)
+}
+
+func TestWriteSSEMultiline(t *testing.T) {
+    var b bytes.Buffer
+    writeSSE(&b, "42", "", "one\ntwo\r\nthree")
+    want := "id: 42\ndata: one\ndata: two\ndata: three\n\n"
+    if b.String() != want { t.Fatalf("got %q want %q", b.String(), want) }
+}
+
+func TestTaskStreamResumesFromLastEventID(t *testing.T) {
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    for _, ln := range []string{"a", "b\nb2", "c"} { taskHub.broadcast("sse-1", appendTaskLog("sse-1", ln)) }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    evs := readEvents(t, openStream(t, ctx, srv.URL+"/events/tasks?id=sse-1", ""), 3)
+    if !strings.HasSuffix(evs[1].data, " b\nb2") { t.Fatalf("multi-line data not preserved: %q", evs[1].data) }
+
+    // reconnect after the first event: only later lines, then live ones
+    br := openStream(t, ctx, srv.URL+"/events/tasks?id=sse-1", evs[0].id)
+    got := readEvents(t, br, 2)
+    if got[0].id != evs[1].id || got[1].id != evs[2].id { t.Fatalf("resume replayed wrong events: %+v", got) }
+    taskHub.broadcast("sse-1", appendTaskLog("sse-1", "d"))
+    live := readEvents(t, br, 1)
+    if !strings.HasSuffix(live[0].data, " d") || live[0].id <= evs[2].id { t.Fatalf("unexpected live event: %+v", live[0]) }
+}
+
+func TestLogStreamKeepAlive(t *testing.T) {
+    old := sseKeepAlive
+    sseKeepAlive = 20 * time.Millisecond
+    defer func() { sseKeepAlive = old }()
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    br := openStream(t, ctx, srv.URL+"/events/agents?name=quiet", "")
+    for {
+        ln, err := br.ReadString('\n')
+        if err != nil { t.Fatal(err) }
+        if ln == ": keepalive\n" { return }
+    }
+}
+
+func TestLogHubSignalsLag(t *testing.T) {
+    h := newLogHub()
+    s := h.add("k")
+    for i := 0; i < cap(s.ch)+5; i++ { h.broadcast("k", logEntry{Line: "x"}) }
+    select {
+    case <-s.lag:
+    default:
+        t.Fatal("expected lag signal for a full subscriber")
+    }
+    h.remove("k", s)
+    if len(h.subs) != 0 { t.Fatal("subscriber not removed") }
+}
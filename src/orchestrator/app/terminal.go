@@ -0,0 +1,280 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gorilla/websocket"
+)
+
+// Web terminals: /terminal/{agent} is a WebSocket to a shell in the agent's
+// workspace, served by the agent binary on its tunnel. Access follows the
+// editor rules (operator token or a signed editor link; read-only shares
+// are refused). Binary frames carry terminal bytes, text frames JSON control
+// messages: {"type":"resize","cols","rows"} from the client and
+// {"type":"exit","code"} from the agent. Every session is recorded to the
+// audit log store as an asciicast v2 stream.
+
+const (
+    EventTerminalOpened = "terminal.opened"
+    EventTerminalClosed = "terminal.closed"
+    // served by the agent on tunnel streams
+    agentTerminalPath = "/_agent/terminal"
+)
+
+// auditLogs holds terminal recordings, one stream per session.
+var auditLogs *logStore
+
+type TerminalSession struct {
+    ID        string     `json:"id"`
+    Agent     string     `json:"agent"`
+    Org       string     `json:"org"`
+    User      string     `json:"user"`
+    Cols      int        `json:"cols"`
+    Rows      int        `json:"rows"`
+    StartedAt time.Time  `json:"startedAt"`
+    EndedAt   *time.Time `json:"endedAt,omitempty"`
+    ExitCode  *int       `json:"exitCode,omitempty"`
+}
+
+type terminalControl struct {
+    Type string `json:"type"`
+    Cols int    `json:"cols,omitempty"`
+    Rows int    `json:"rows,omitempty"`
+    Code int    `json:"code"`
+}
+
+type terminalStore struct {
+    mu   sync.Mutex
+    byID map[string]*TerminalSession
+}
+
+var terminals = &terminalStore{byID: map[string]*TerminalSession{}}
+
+func (s *terminalStore) start(agent, org, user string, cols, rows int) TerminalSession {
+    t := &TerminalSession{ID: newID(), Agent: agent, Org: org, User: user, Cols: cols, Rows: rows, StartedAt: time.Now().UTC()}
+    s.mu.Lock()
+    s.byID[t.ID] = t
+    s.mu.Unlock()
+    return *t
+}
+
+func (s *terminalStore) resize(id string, cols, rows int) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    if t, ok := s.byID[id]; ok { t.Cols, t.Rows = cols, rows }
+}
+
+func (s *terminalStore) finish(id string, code *int) TerminalSession {
+    s.mu.Lock(); defer s.mu.Unlock()
+    t := s.byID[id]
+    now := time.Now().UTC()
+    t.EndedAt = &now
+    t.ExitCode = code
+    return *t
+}
+
+func (s *terminalStore) get(id string) (TerminalSession, bool) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    t, ok := s.byID[id]
+    if !ok { return TerminalSession{}, false }
+    return *t, true
+}
+
+// list returns sessions since startup, newest first.
+func (s *terminalStore) list(org, agent string) []TerminalSession {
+    s.mu.Lock()
+    out := []TerminalSession{}
+    for _, t := range s.byID {
+        if (org == "" || t.Org == org) && (agent == "" || t.Agent == agent) { out = append(out, *t) }
+    }
+    s.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+    return out
+}
+
+// terminalRecorder appends asciicast v2 events ([seconds, code, data]) to
+// the session's audit stream. Codes: "o" output, "i" input, "r" resize.
+type terminalRecorder struct {
+    sess  TerminalSession
+    start time.Time
+    mu    sync.Mutex
+    // a rune split across frames is held back until it is complete
+    pending map[string][]byte
+}
+
+func newTerminalRecorder(sess TerminalSession) *terminalRecorder {
+    rec := &terminalRecorder{sess: sess, start: time.Now(), pending: map[string][]byte{}}
+    hdr, _ := json.Marshal(map[string]any{
+        "version": 2, "width": sess.Cols, "height": sess.Rows, "timestamp": sess.StartedAt.Unix(),
+        "title": sess.Agent + " (" + sess.User + ")", "env": map[string]string{"TERM": "xterm-256color"},
+        "session": sess.ID, "agent": sess.Agent, "org": sess.Org, "user": sess.User,
+    })
+    rec.append(string(hdr))
+    return rec
+}
+
+func (rec *terminalRecorder) append(line string) {
+    if _, err := auditLogs.Append(rec.sess.ID, rec.sess.Org, line); err != nil { log.Printf("terminal[%s] record: %v", rec.sess.ID, err) }
+}
+
+func (rec *terminalRecorder) event(code string, data []byte) {
+    rec.mu.Lock(); defer rec.mu.Unlock()
+    b := append(rec.pending[code], data...)
+    cut := len(b)
+    for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+        if utf8.RuneStart(b[i]) {
+            if !utf8.FullRune(b[i:]) { cut = i }
+            break
+        }
+    }
+    rec.pending[code] = append([]byte(nil), b[cut:]...)
+    if cut == 0 { return }
+    line, _ := json.Marshal([]any{float64(time.Since(rec.start).Microseconds()) / 1e6, code, string(b[:cut])})
+    rec.append(string(line))
+}
+
+// dialTerminal opens the agent's terminal through its tunnel, presenting
+// the orchestrator token the agent registered with.
+func dialTerminal(name string, cols, rows int) (*websocket.Conn, error) {
+    c, err := dialAgent(name)
+    if err != nil { return nil, err }
+    u := url.URL{Scheme: "ws", Host: name + editorHostSuffix, Path: agentTerminalPath, RawQuery: url.Values{"cols": {itoa(cols)}, "rows": {itoa(rows)}}.Encode()}
+    h := http.Header{}
+    if tok := os.Getenv("ORCHESTRATOR_TOKEN"); tok != "" { h.Set("X-Auth-Token", tok) }
+    c.SetDeadline(time.Now().Add(10 * time.Second))
+    ws, resp, err := websocket.NewClient(c, &u, h, 32<<10, 32<<10)
+    if err != nil {
+        c.Close()
+        if resp != nil { return nil, fmt.Errorf("agent terminal: %s", resp.Status) }
+        return nil, err
+    }
+    c.SetDeadline(time.Time{})
+    return ws, nil
+}
+
+func terminalDim(v string, def int) int {
+    n, err := strconv.Atoi(v)
+    if err != nil || n <= 0 || n > 1000 { return def }
+    return n
+}
+
+// handleTerminal serves GET /terminal/{agent}?cols=&rows= (WebSocket).
+func handleTerminal(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/terminal/"), "/")
+    if name == "" || strings.Contains(name, "/") { http.Error(w, "not found", 404); return }
+    user, readOnly, ok := authorizeEditor(w, r, name)
+    if !ok { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+    if readOnly { http.Error(w, "read-only share", http.StatusForbidden); return }
+    agentsMu.RLock()
+    a, ok := agents[name]
+    agentsMu.RUnlock()
+    if !ok { http.Error(w, "unknown agent", 404); return }
+    if !websocket.IsWebSocketUpgrade(r) { http.Error(w, "websocket upgrade required", 400); return }
+    cols, rows := terminalDim(r.URL.Query().Get("cols"), 80), terminalDim(r.URL.Query().Get("rows"), 24)
+    up, err := dialTerminal(name, cols, rows)
+    if err != nil { http.Error(w, err.Error(), 502); return }
+    defer up.Close()
+    conn, err := wsUpgrader.Upgrade(w, r, nil)
+    if err != nil { log.Printf("terminal ws upgrade: %v", err); return }
+    defer conn.Close()
+    defer editorSessions.touch(name)()
+
+    sess := terminals.start(name, a.Org, user, cols, rows)
+    rec := newTerminalRecorder(sess)
+    log.Printf("terminal %s opened on %s by %s", sess.ID, name, user)
+    publishEvent(EventTerminalOpened, sess.Org, sess)
+
+    var exit *int
+    done := make(chan struct{}, 2)
+    // client -> agent
+    go func() {
+        defer func() { done <- struct{}{} }()
+        for {
+            typ, b, err := conn.ReadMessage()
+            if err != nil { up.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); return }
+            switch typ {
+            case websocket.BinaryMessage:
+                rec.event("i", b)
+                if up.WriteMessage(websocket.BinaryMessage, b) != nil { return }
+            case websocket.TextMessage:
+                var c terminalControl
+                if json.Unmarshal(b, &c) != nil || c.Type != "resize" { continue }
+                c.Cols, c.Rows = terminalDim(itoa(c.Cols), 80), terminalDim(itoa(c.Rows), 24)
+                terminals.resize(sess.ID, c.Cols, c.Rows)
+                rec.event("r", []byte(itoa(c.Cols)+"x"+itoa(c.Rows)))
+                out, _ := json.Marshal(terminalControl{Type: "resize", Cols: c.Cols, Rows: c.Rows})
+                if up.WriteMessage(websocket.TextMessage, out) != nil { return }
+            }
+        }
+    }()
+    // agent -> client
+    go func() {
+        defer func() { done <- struct{}{} }()
+        for {
+            typ, b, err := up.ReadMessage()
+            if err != nil { conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); return }
+            switch typ {
+            case websocket.BinaryMessage:
+                rec.event("o", b)
+            case websocket.TextMessage:
+                var c terminalControl
+                if json.Unmarshal(b, &c) == nil && c.Type == "exit" { code := c.Code; exit = &code }
+            }
+            if conn.WriteMessage(typ, b) != nil { return }
+        }
+    }()
+    <-done
+    conn.Close(); up.Close()
+    <-done
+
+    sess = terminals.finish(sess.ID, exit)
+    log.Printf("terminal %s on %s closed", sess.ID, name)
+    publishEvent(EventTerminalClosed, sess.Org, sess)
+}
+
+// handleTerminalSessions serves GET /terminal/sessions?org=&agent=.
+func handleTerminalSessions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
+    q := r.URL.Query()
+    writeJSON(w, terminals.list(strings.TrimSpace(q.Get("org")), strings.TrimSpace(q.Get("agent"))))
+}
+
+// handleTerminalSession serves GET /terminal/sessions/{id} and
+// /terminal/sessions/{id}/recording, the asciicast file. Recordings outlive
+// a restart; session metadata does not.
+func handleTerminalSession(w http.ResponseWriter, r *http.Request) {
+    p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/terminal/sessions/"), "/")
+    seg := strings.Split(p, "/")
+    id := seg[0]
+    if id == "" { handleTerminalSessions(w, r); return }
+    if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
+    switch {
+    case len(seg) == 1:
+        sess, ok := terminals.get(id)
+        if !ok { http.Error(w, "not found", 404); return }
+        writeJSON(w, sess)
+    case len(seg) == 2 && seg[1] == "recording":
+        if _, end := auditLogs.Bounds(id); end == 0 { http.Error(w, "not found", 404); return }
+        w.Header().Set("Content-Type", "application/x-asciicast")
+        w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.cast"`)
+        for from := int64(0); ; {
+            page, err := auditLogs.Read(id, from, maxLogReadLimit)
+            if err != nil { log.Printf("terminal[%s] recording: %v", id, err); return }
+            for _, e := range page.Entries { fmt.Fprintln(w, e.Line) }
+            if len(page.Entries) == 0 || page.Next >= page.End { return }
+            from = page.Next
+        }
+    default:
+        http.Error(w, "not found", 404)
+    }
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// fakeAgentTerminal stands in for the agent's PTY: it echoes input, reports
+// resizes and exits with code 7 on "exit".
+func fakeAgentTerminal(t *testing.T) *httptest.Server {
+    up := websocket.Upgrader{}
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != agentTerminalPath || r.Header.Get("X-Auth-Token") != "op-secret" { http.Error(w, "no", 401); return }
+        conn, err := up.Upgrade(w, r, nil)
+        if err != nil { return }
+        defer conn.Close()
+        conn.WriteMessage(websocket.BinaryMessage, []byte("size "+r.URL.Query().Get("cols")+"x"+r.URL.Query().Get("rows")+"\r\n"))
+        for {
+            typ, b, err := conn.ReadMessage()
+            if err != nil { return }
+            if typ == websocket.TextMessage {
+                var c terminalControl
+                json.Unmarshal(b, &c)
+                conn.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("resized %dx%d\r\n", c.Cols, c.Rows)))
+                continue
+            }
+            if string(b) == "exit\n" {
+                conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"exit","code":7}`))
+                return
+            }
+            conn.WriteMessage(websocket.BinaryMessage, append([]byte("echo: "), b...))
+        }
+    }))
+}
+
+func TestTerminalThroughTunnel(t *testing.T) {
+    t.Setenv("ORCHESTRATOR_TOKEN", "op-secret")
+    name := uniq("term-a1")
+    agent := fakeAgentTerminal(t)
+    defer agent.Close()
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    agentsMu.Lock(); agents[name] = Agent{Name: name, Org: "acme", Status: "idle"}; agentsMu.Unlock()
+    defer func() { agentsMu.Lock(); delete(agents, name); agentsMu.Unlock() }()
+    sub := events.subscribe(eventFilter{types: []string{"terminal.*"}})
+    defer events.unsubscribe(sub)
+
+    wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/terminal/"+name+"?cols=100&rows=30"
+    if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != 401 { t.Fatalf("anonymous terminal: %v", err) }
+    op := http.Header{"X-Auth-Token": {"op-secret"}, "X-User": {"alice"}}
+    if _, resp, err := websocket.DefaultDialer.Dial(wsURL, op); err == nil || resp.StatusCode != 502 { t.Fatalf("terminal without a tunnel: %v", err) }
+
+    tun := fakeTunnelAgent(t, srv.URL, name, agent.Listener.Addr().String())
+    defer tun.Close()
+    waitFor(t, "tunnel", func() bool { return tunnelFor(name) != nil })
+
+    conn, _, err := websocket.DefaultDialer.Dial(wsURL, op)
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    read := func() string {
+        t.Helper()
+        _, b, err := conn.ReadMessage()
+        if err != nil { t.Fatal(err) }
+        return string(b)
+    }
+    if got := read(); got != "size 100x30\r\n" { t.Fatalf("initial size: %q", got) }
+    conn.WriteMessage(websocket.BinaryMessage, []byte("ls ☃\n"))
+    if got := read(); got != "echo: ls ☃\n" { t.Fatalf("echo: %q", got) }
+    conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"resize","cols":120,"rows":40}`))
+    if got := read(); got != "resized 120x40\r\n" { t.Fatalf("resize: %q", got) }
+    conn.WriteMessage(websocket.BinaryMessage, []byte("exit\n"))
+    if got := read(); got != `{"type":"exit","code":7}` { t.Fatalf("exit: %q", got) }
+
+    var sess TerminalSession
+    for _, want := range []string{EventTerminalOpened, EventTerminalClosed} {
+        select {
+        case e := <-sub.ch:
+            if e.Type != want { t.Fatalf("event %s, want %s", e.Type, want) }
+            sess = e.Data.(TerminalSession)
+        case <-time.After(5 * time.Second):
+            t.Fatalf("no %s event", want)
+        }
+    }
+    if sess.User != "alice" || sess.Agent != name || sess.Cols != 120 || sess.ExitCode == nil || *sess.ExitCode != 7 || sess.EndedAt == nil { t.Fatalf("closed session: %+v", sess) }
+
+    get := func(path string) (int, string) {
+        req, _ := http.NewRequest("GET", srv.URL+path, nil)
+        req.Header.Set("X-Auth-Token", "op-secret")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil { t.Fatal(err) }
+        b, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        return resp.StatusCode, string(b)
+    }
+    code, body := get("/terminal/sessions?agent="+name)
+    var list []TerminalSession
+    json.Unmarshal([]byte(body), &list)
+    if code != 200 || len(list) != 1 || list[0].ID != sess.ID { t.Fatalf("list: %d %s", code, body) }
+
+    code, body = get("/terminal/sessions/" + sess.ID + "/recording")
+    lines := strings.Split(strings.TrimSpace(body), "\n")
+    if code != 200 || len(lines) != 7 { t.Fatalf("recording: %d %q", code, body) }
+    var hdr struct{ Version, Width, Height int; User, Agent string }
+    if json.Unmarshal([]byte(lines[0]), &hdr); hdr.Version != 2 || hdr.Width != 100 || hdr.Height != 30 || hdr.User != "alice" { t.Fatalf("header: %s", lines[0]) }
+    var kinds, data []string
+    for _, l := range lines[1:] {
+        var ev []any
+        if err := json.Unmarshal([]byte(l), &ev); err != nil || len(ev) != 3 { t.Fatalf("event line %q: %v", l, err) }
+        kinds = append(kinds, ev[1].(string))
+        data = append(data, ev[2].(string))
+    }
+    if strings.Join(kinds, "") != "oioroi" || data[1] != "ls ☃\n" || data[3] != "120x40" { t.Fatalf("recorded events %v %q", kinds, data) }
+    if code, _ := get("/terminal/sessions/nope/recording"); code != 404 { t.Fatalf("missing recording: %d", code) }
+}
+
+func TestTerminalRefusesReadOnlyShares(t *testing.T) {
+    t.Setenv("ORCHESTRATOR_TOKEN", "op-secret")
+    agent := fakeAgentTerminal(t)
+    defer agent.Close()
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    agentsMu.Lock(); agents["term-a2"] = Agent{Name: "term-a2", Org: "acme", Status: "idle"}; agentsMu.Unlock()
+    defer func() { agentsMu.Lock(); delete(agents, "term-a2"); agentsMu.Unlock(); stopEditorForward("term-a2") }()
+    tun := fakeTunnelAgent(t, srv.URL, "term-a2", agent.Listener.Addr().String())
+    defer tun.Close()
+    waitFor(t, "tunnel", func() bool { return tunnelFor("term-a2") != nil })
+
+    sess, err := editorSessions.open("term-a2", "acme", "alice")
+    if err != nil { t.Fatal(err) }
+    base := "ws" + strings.TrimPrefix(srv.URL, "http") + "/terminal/term-a2?"
+    link := func(user string, readOnly bool) string {
+        editorSessions.share("term-a2", user, readOnly)
+        return base + editorSessionParam + "=" + editorSessionLink(sess, user, time.Minute)["token"].(string)
+    }
+    if _, resp, err := websocket.DefaultDialer.Dial(link("bob", true), nil); err == nil || resp.StatusCode != 403 { t.Fatalf("read-only share: %v", err) }
+    conn, _, err := websocket.DefaultDialer.Dial(link("carol", false), nil)
+    if err != nil { t.Fatalf("shared link: %v", err) }
+    conn.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "errors"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/hashicorp/yamux"
+)
+
+// Agents open a reverse tunnel on startup: a WebSocket to /agents/tunnel
+// carrying a yamux session. The orchestrator is the yamux client and opens
+// one stream per connection, each carrying HTTP: the agent serves its
+// terminal (see terminal.go) and proxies everything else to code-server.
+// This works across NAT and needs no kubeconfig; agents without a tunnel
+// (older images) still get a kubectl port-forward for the editor.
+
+// Event types for tunnel state changes.
+const (
+    EventTunnelConnected = "tunnel.connected"
+    EventTunnelClosed    = "tunnel.closed"
+)
+
+var errNoTunnel = errors.New("agent has no tunnel")
+
+type agentTunnel struct {
+    name, org string
+    session   *yamux.Session
+    since     time.Time
+}
+
+var (
+    tunnelsMu sync.Mutex
+    tunnels   = make(map[string]*agentTunnel)
+)
+
+func tunnelFor(name string) *agentTunnel {
+    tunnelsMu.Lock(); defer tunnelsMu.Unlock()
+    t := tunnels[name]
+    if t == nil || t.session.IsClosed() { return nil }
+    return t
+}
+
+// dialAgent opens a stream to the agent's editor through its tunnel.
+func dialAgent(name string) (net.Conn, error) {
+    t := tunnelFor(name)
+    if t == nil { return nil, errNoTunnel }
+    return t.session.Open()
+}
+
+func tunnelConfig() *yamux.Config {
+    cfg := yamux.DefaultConfig()
+    cfg.KeepAliveInterval = 15 * time.Second
+    cfg.LogOutput = io.Discard
+    return cfg
+}
+
+// handleAgentTunnel serves GET /agents/tunnel?name=&org= (WebSocket). It
+// holds the request until the tunnel closes; a reconnecting agent replaces
+// its previous tunnel.
+func handleAgentTunnel(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimSpace(r.URL.Query().Get("name"))
+    org := strings.TrimSpace(r.URL.Query().Get("org"))
+    if name == "" { http.Error(w, "missing name", 400); return }
+    if !websocket.IsWebSocketUpgrade(r) { http.Error(w, "websocket upgrade required", 400); return }
+    conn, err := wsUpgrader.Upgrade(w, r, nil)
+    if err != nil { log.Printf("tunnel ws upgrade: %v", err); return }
+    sess, err := yamux.Client(&wsConn{Conn: conn}, tunnelConfig())
+    if err != nil { conn.Close(); return }
+    t := &agentTunnel{name: name, org: org, session: sess, since: time.Now()}
+    tunnelsMu.Lock()
+    old := tunnels[name]
+    tunnels[name] = t
+    tunnelsMu.Unlock()
+    if old != nil { old.session.Close() }
+    log.Printf("tunnel connected for agent %s (%s)", name, r.RemoteAddr)
+    publishEvent(EventTunnelConnected, org, map[string]any{"agent": name, "org": org})
+    // switch an open kubectl forward over to the tunnel
+    if editorForwardPort(name) != 0 { go func() { _, _ = ensureEditorForward(name, org) }() }
+
+    <-sess.CloseChan()
+    tunnelsMu.Lock()
+    current := tunnels[name] == t
+    if current { delete(tunnels, name) }
+    tunnelsMu.Unlock()
+    if !current { return }
+    editorMu.Lock()
+    pf := editorPF[name]
+    editorMu.Unlock()
+    if pf != nil && pf.ln != nil { stopEditorForward(name) }
+    log.Printf("tunnel closed for agent %s", name)
+    publishEvent(EventTunnelClosed, org, map[string]any{"agent": name, "org": org})
+}
+
+// openTunnelForward listens on a loopback port and pipes each connection
+// through the agent's tunnel, so /agents/editor/open keeps handing out
+// ports whichever way the editor is reached.
+func openTunnelForward(name, org string) (int, error) {
+    var ln net.Listener
+    for attempt := 0; attempt < 8 && ln == nil; attempt++ {
+        port := pickPort()
+        if port == 0 { break }
+        ln, _ = net.Listen("tcp", "127.0.0.1:"+itoa(port))
+    }
+    if ln == nil { return 0, errors.New("no free port") }
+    port := ln.Addr().(*net.TCPAddr).Port
+    editorMu.Lock()
+    editorPF[name] = &portFwd{Port: port, ln: ln}
+    editorMu.Unlock()
+    setEditorPort(name, port, "tunnel")
+    log.Printf("opening editor forward for %s via tunnel on 127.0.0.1:%d", name, port)
+    publishEvent(EventEditorOpened, org, map[string]any{"agent": name, "org": org, "port": port})
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func() {
+                s, err := dialAgent(name)
+                if err != nil { c.Close(); return }
+                pipe(c, s)
+            }()
+        }
+    }()
+    return port, nil
+}
+
+func setEditorPort(name string, port int, via string) {
+    agentsMu.Lock(); defer agentsMu.Unlock()
+    if a, ok := agents[name]; ok {
+        a.EditorPort = port
+        a.EditorVia = via
+        agents[name] = a
+    }
+}
+
+// pipe copies both ways and closes both ends once either side is done.
+func pipe(a, b net.Conn) {
+    done := make(chan struct{}, 2)
+    go func() { io.Copy(a, b); done <- struct{}{} }()
+    go func() { io.Copy(b, a); done <- struct{}{} }()
+    <-done
+    a.Close(); b.Close()
+}
+
+// wsConn adapts a WebSocket to net.Conn, one binary message per Write, so
+// a yamux session can run over it.
+type wsConn struct {
+    *websocket.Conn
+    r   io.Reader
+    wmu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+    for {
+        if c.r == nil {
+            typ, r, err := c.Conn.NextReader()
+            if err != nil { return 0, err }
+            if typ != websocket.BinaryMessage { continue }
+            c.r = r
+        }
+        n, err := c.r.Read(p)
+        if err == io.EOF {
+            c.r = nil
+            if n > 0 { return n, nil }
+            continue
+        }
+        return n, err
+    }
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+    c.wmu.Lock(); defer c.wmu.Unlock()
+    if err := c.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil { return 0, err }
+    return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+    if err := c.Conn.SetReadDeadline(t); err != nil { return err }
+    return c.Conn.SetWriteDeadline(t)
+}
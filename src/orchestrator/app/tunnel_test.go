@@ -0,0 +1,102 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/hashicorp/yamux"
+)
+
+// fakeTunnelAgent dials /agents/tunnel like the agent does and pipes each
+// stream to editor.
+func fakeTunnelAgent(t *testing.T, srvURL, name, editor string) *yamux.Session {
+    t.Helper()
+    u := "ws" + strings.TrimPrefix(srvURL, "http") + "/agents/tunnel?name=" + name + "&org=acme"
+    h := http.Header{}
+    if tok := os.Getenv("ORCHESTRATOR_TOKEN"); tok != "" { h.Set("X-Auth-Token", tok) }
+    conn, _, err := websocket.DefaultDialer.Dial(u, h)
+    if err != nil { t.Fatal(err) }
+    sess, err := yamux.Server(&wsConn{Conn: conn}, tunnelConfig())
+    if err != nil { t.Fatal(err) }
+    go func() {
+        for {
+            st, err := sess.Accept()
+            if err != nil { return }
+            c, err := net.Dial("tcp", editor)
+            if err != nil { st.Close(); continue }
+            go pipe(st, c)
+        }
+    }()
+    return sess
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) { t.Fatalf("timed out waiting for %s", what) }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestEditorThroughTunnel(t *testing.T) {
+    editor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "code-server %s", r.URL.Path)
+    }))
+    defer editor.Close()
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+
+    if _, err := dialAgent("tun-a1"); err != errNoTunnel { t.Fatalf("expected errNoTunnel, got %v", err) }
+    agentsMu.Lock(); agents["tun-a1"] = Agent{Name: "tun-a1", Org: "acme", Status: "idle"}; agentsMu.Unlock()
+    defer func() { agentsMu.Lock(); delete(agents, "tun-a1"); agentsMu.Unlock() }()
+
+    sess := fakeTunnelAgent(t, srv.URL, "tun-a1", editor.Listener.Addr().String())
+    waitFor(t, "tunnel", func() bool { return tunnelFor("tun-a1") != nil })
+
+    port, err := ensureEditorForward("tun-a1", "acme")
+    if err != nil { t.Fatal(err) }
+    agentsMu.RLock(); a := agents["tun-a1"]; agentsMu.RUnlock()
+    if a.EditorPort != port || a.EditorVia != "tunnel" { t.Fatalf("agent not updated: %+v", a) }
+    if again, _ := ensureEditorForward("tun-a1", "acme"); again != port { t.Fatalf("forward reopened: %d != %d", again, port) }
+    // only the orchestrator itself may use the forward
+    editorMu.Lock(); addr := editorPF["tun-a1"].ln.Addr().(*net.TCPAddr); editorMu.Unlock()
+    if !addr.IP.IsLoopback() { t.Fatalf("forward listens on %s", addr) }
+
+    resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/healthz", port))
+    if err != nil { t.Fatal(err) }
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if string(body) != "code-server /healthz" { t.Fatalf("unexpected editor response %q", body) }
+
+    // the forward goes away with the tunnel
+    sess.Close()
+    waitFor(t, "tunnel close", func() bool { return tunnelFor("tun-a1") == nil })
+    waitFor(t, "forward close", func() bool {
+        editorMu.Lock(); defer editorMu.Unlock()
+        return editorPF["tun-a1"] == nil
+    })
+}
+
+func TestTunnelReconnectReplacesSession(t *testing.T) {
+    srv := httptest.NewServer(newServer())
+    defer srv.Close()
+    first := fakeTunnelAgent(t, srv.URL, "tun-a2", "127.0.0.1:1")
+    waitFor(t, "first tunnel", func() bool { return tunnelFor("tun-a2") != nil })
+    second := fakeTunnelAgent(t, srv.URL, "tun-a2", "127.0.0.1:1")
+    defer second.Close()
+    waitFor(t, "old session closed", first.IsClosed)
+    if tun := tunnelFor("tun-a2"); tun == nil || tun.session.IsClosed() { t.Fatal("replacement tunnel missing") }
+
+    rr := httptest.NewRecorder()
+    newServer().ServeHTTP(rr, httptest.NewRequest("GET", "/agents/tunnel?name=x", nil))
+    if rr.Code != 400 { t.Fatalf("plain GET should be rejected, got %d", rr.Code) }
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Webhook is an outbound subscription to lifecycle events. Events may use
+// the same "task.*" family syntax as the /events filter; empty Orgs means all.
+type Webhook struct {
+    ID        string    `json:"id"`
+    URL       string    `json:"url"`
+    Secret    string    `json:"secret,omitempty"`
+    Events    []string  `json:"events"`
+    Orgs      []string  `json:"orgs,omitempty"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+func (h Webhook) filter() eventFilter {
+    f := eventFilter{types: h.Events}
+    for _, o := range h.Orgs {
+        if f.orgs == nil { f.orgs = make(map[string]bool) }
+        f.orgs[o] = true
+    }
+    return f
+}
+
+// redacted hides the signing secret in list/get responses.
+func (h Webhook) redacted() Webhook {
+    if h.Secret != "" { h.Secret = "********" }
+    return h
+}
+
+// WebhookDelivery records one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+    ID         string    `json:"id"`
+    WebhookID  string    `json:"webhookId"`
+    EventID    int64     `json:"eventId"`
+    EventType  string    `json:"eventType"`
+    Attempt    int       `json:"attempt"`
+    Status     string    `json:"status"` // delivered | retrying | failed
+    StatusCode int       `json:"statusCode,omitempty"`
+    Error      string    `json:"error,omitempty"`
+    Time       time.Time `json:"time"`
+    DurationMs int64     `json:"durationMs"`
+}
+
+const (
+    webhookMaxAttempts   = 6
+    webhookDeliveryLimit = 200 // per subscription
+    webhookSignatureHdr  = "X-Orchestrator-Signature"
+)
+
+// webhookRetryBase is the first retry delay; each further attempt doubles it.
+var webhookRetryBase = 2 * time.Second
+
+// webhookStore persists subscriptions as JSON in the state dir and keeps a
+// bounded in-memory delivery log per subscription.
+type webhookStore struct {
+    path string
+
+    mu         sync.Mutex
+    hooks      map[string]Webhook
+    deliveries map[string][]WebhookDelivery
+}
+
+var webhooks *webhookStore
+
+func newWebhookStore(path string) *webhookStore {
+    s := &webhookStore{path: path, hooks: make(map[string]Webhook), deliveries: make(map[string][]WebhookDelivery)}
+    b, err := os.ReadFile(path)
+    if err != nil {
+        if !os.IsNotExist(err) { log.Printf("webhooks load: %v", err) }
+        return s
+    }
+    var list []Webhook
+    if err := json.Unmarshal(b, &list); err != nil {
+        log.Printf("webhooks load %s: %v", path, err)
+        return s
+    }
+    for _, h := range list { s.hooks[h.ID] = h }
+    return s
+}
+
+// save writes all subscriptions atomically. Caller holds s.mu.
+func (s *webhookStore) save() error {
+    list := make([]Webhook, 0, len(s.hooks))
+    for _, h := range s.hooks { list = append(list, h) }
+    sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+    b, err := json.MarshalIndent(list, "", "  ")
+    if err != nil { return err }
+    return writeFileAtomic(s.path, b, 0o600)
+}
+
+func (s *webhookStore) list() []Webhook {
+    s.mu.Lock(); defer s.mu.Unlock()
+    out := make([]Webhook, 0, len(s.hooks))
+    for _, h := range s.hooks { out = append(out, h) }
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+    return out
+}
+
+func (s *webhookStore) get(id string) (Webhook, bool) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    h, ok := s.hooks[id]
+    return h, ok
+}
+
+func (s *webhookStore) put(h Webhook) error {
+    s.mu.Lock(); defer s.mu.Unlock()
+    prev, existed := s.hooks[h.ID]
+    s.hooks[h.ID] = h
+    if err := s.save(); err != nil {
+        if existed { s.hooks[h.ID] = prev } else { delete(s.hooks, h.ID) }
+        return err
+    }
+    return nil
+}
+
+func (s *webhookStore) delete(id string) (bool, error) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    h, ok := s.hooks[id]
+    if !ok { return false, nil }
+    delete(s.hooks, id)
+    if err := s.save(); err != nil {
+        s.hooks[id] = h
+        return false, err
+    }
+    delete(s.deliveries, id)
+    return true, nil
+}
+
+func (s *webhookStore) record(d WebhookDelivery) {
+    s.mu.Lock(); defer s.mu.Unlock()
+    if _, ok := s.hooks[d.WebhookID]; !ok { return }
+    l := append(s.deliveries[d.WebhookID], d)
+    if len(l) > webhookDeliveryLimit { l = l[len(l)-webhookDeliveryLimit:] }
+    s.deliveries[d.WebhookID] = l
+}
+
+// deliveryLog returns the newest deliveries first.
+func (s *webhookStore) deliveryLog(id string) []WebhookDelivery {
+    s.mu.Lock(); defer s.mu.Unlock()
+    l := s.deliveries[id]
+    out := make([]WebhookDelivery, 0, len(l))
+    for i := len(l) - 1; i >= 0; i-- { out = append(out, l[i]) }
+    return out
+}
+
+func (s *webhookStore) matching(e Event) []Webhook {
+    s.mu.Lock(); defer s.mu.Unlock()
+    var out []Webhook
+    for _, h := range s.hooks {
+        if h.filter().match(e) { out = append(out, h) }
+    }
+    return out
+}
+
+// signWebhook returns the X-Orchestrator-Signature value for a payload:
+// "sha256=" followed by the hex HMAC-SHA256 of the body keyed by the secret.
+func signWebhook(secret string, body []byte) string {
+    m := hmac.New(sha256.New, []byte(secret))
+    m.Write(body)
+    return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// deliverWebhook POSTs an event, retrying with exponential backoff until it
+// gets a 2xx, attempts run out, the subscription is deleted or ctx ends.
+func deliverWebhook(ctx context.Context, s *webhookStore, h Webhook, e Event) {
+    body, err := json.Marshal(e)
+    if err != nil { log.Printf("webhook %s: marshal event %d: %v", h.ID, e.ID, err); return }
+    deliveryID := newID()
+    delay := webhookRetryBase
+    for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+        d := WebhookDelivery{ID: deliveryID, WebhookID: h.ID, EventID: e.ID, EventType: e.Type, Attempt: attempt, Time: time.Now().UTC()}
+        start := time.Now()
+        code, err := postWebhook(ctx, h, e, deliveryID, body)
+        d.DurationMs = time.Since(start).Milliseconds()
+        d.StatusCode = code
+        if err == nil {
+            d.Status = "delivered"
+            s.record(d)
+            return
+        }
+        d.Error = err.Error()
+        d.Status = "retrying"
+        if attempt == webhookMaxAttempts { d.Status = "failed" }
+        s.record(d)
+        if d.Status == "failed" {
+            log.Printf("webhook %s: giving up on event %d after %d attempts: %v", h.ID, e.ID, attempt, err)
+            return
+        }
+        select {
+        case <-time.After(delay):
+        case <-ctx.Done():
+            return
+        }
+        delay *= 2
+        if _, ok := s.get(h.ID); !ok { return }
+    }
+}
+
+func postWebhook(ctx context.Context, h Webhook, e Event, deliveryID string, body []byte) (int, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+    if err != nil { return 0, err }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "mvp-orchestrator-webhooks")
+    req.Header.Set("X-Orchestrator-Event", e.Type)
+    req.Header.Set("X-Orchestrator-Delivery", deliveryID)
+    if h.Secret != "" { req.Header.Set(webhookSignatureHdr, signWebhook(h.Secret, body)) }
+    resp, err := webhookClient.Do(req)
+    if err != nil { return 0, err }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 { return resp.StatusCode, fmt.Errorf("status %s", resp.Status) }
+    return resp.StatusCode, nil
+}
+
+// startWebhookDispatcher follows the event bus and fans matching events out
+// to subscriptions. Each delivery retries independently of the others.
+func startWebhookDispatcher(ctx context.Context, s *webhookStore) {
+    sub := events.subscribe(eventFilter{})
+    go func() {
+        defer events.unsubscribe(sub)
+        last, _ := events.resumeFrom(-1)
+        dispatch := func(e Event) {
+            if e.ID <= last { return }
+            last = e.ID
+            for _, h := range s.matching(e) { go deliverWebhook(ctx, s, h, e) }
+        }
+        for {
+            select {
+            case e := <-sub.ch:
+                dispatch(e)
+            case <-sub.lag:
+                missed, complete := events.since(last, eventFilter{})
+                if !complete { log.Printf("webhooks: event history overrun after id %d; some events were not delivered", last) }
+                for _, e := range missed { dispatch(e) }
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+}
+
+type webhookRequest struct {
+    URL    string   `json:"url"`
+    Secret string   `json:"secret"`
+    Events []string `json:"events"`
+    Orgs   []string `json:"orgs"`
+}
+
+func (req webhookRequest) validate() error {
+    u, err := url.Parse(strings.TrimSpace(req.URL))
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" { return fmt.Errorf("url must be an absolute http(s) URL") }
+    if len(req.Events) == 0 { return fmt.Errorf("missing events") }
+    return nil
+}
+
+// handleWebhooks serves GET/POST /webhooks.
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        out := []Webhook{}
+        for _, h := range webhooks.list() { out = append(out, h.redacted()) }
+        writeJSON(w, out)
+    case http.MethodPost:
+        var req webhookRequest
+        if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+        if err := req.validate(); err != nil { http.Error(w, err.Error(), 400); return }
+        h := Webhook{ID: newID(), URL: strings.TrimSpace(req.URL), Secret: req.Secret, Events: req.Events, Orgs: req.Orgs, CreatedAt: time.Now().UTC()}
+        if h.Secret == "" { h.Secret = newID() + newID() }
+        if err := webhooks.put(h); err != nil { http.Error(w, err.Error(), 500); return }
+        // the secret is only returned in full on creation
+        w.WriteHeader(http.StatusCreated)
+        writeJSON(w, h)
+    default:
+        http.Error(w, "method", 405)
+    }
+}
+
+// handleWebhook serves /webhooks/{id} (GET, PUT, DELETE) and
+// /webhooks/{id}/deliveries (GET).
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+    p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+    seg := strings.Split(p, "/")
+    id := seg[0]
+    if id == "" { handleWebhooks(w, r); return }
+    h, ok := webhooks.get(id)
+    if !ok { http.Error(w, "not found", 404); return }
+    if len(seg) == 2 && seg[1] == "deliveries" {
+        if r.Method != http.MethodGet { http.Error(w, "method", 405); return }
+        writeJSON(w, map[string]any{"id": id, "deliveries": webhooks.deliveryLog(id)})
+        return
+    }
+    if len(seg) > 1 { http.Error(w, "not found", 404); return }
+    switch r.Method {
+    case http.MethodGet:
+        writeJSON(w, h.redacted())
+    case http.MethodPut, http.MethodPatch:
+        var req webhookRequest
+        if err := decodeJSON(r, &req); err != nil { http.Error(w, err.Error(), 400); return }
+        if req.URL == "" { req.URL = h.URL }
+        if req.Events == nil { req.Events = h.Events }
+        if err := req.validate(); err != nil { http.Error(w, err.Error(), 400); return }
+        h.URL = strings.TrimSpace(req.URL)
+        h.Events = req.Events
+        if req.Orgs != nil { h.Orgs = req.Orgs }
+        if req.Secret != "" { h.Secret = req.Secret }
+        if err := webhooks.put(h); err != nil { http.Error(w, err.Error(), 500); return }
+        writeJSON(w, h.redacted())
+    case http.MethodDelete:
+        if _, err := webhooks.delete(id); err != nil { http.Error(w, err.Error(), 500); return }
+        writeJSON(w, map[string]any{"id": id, "deleted": true})
+    default:
+        http.Error(w, "method", 405)
+    }
+}
+
+// newID returns a random 16-hex-character identifier.
+func newID() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil { return fmt.Sprintf("%x", time.Now().UnixNano()) }
+    return hex.EncodeToString(b)
+}
+
+// writeFileAtomic writes via a temp file and rename so readers never see a
+// partially written file.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { return err }
+    tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+    if err != nil { return err }
+    if _, err := tmp.Write(b); err != nil { tmp.Close(); os.Remove(tmp.Name()); return err }
+    if err := tmp.Close(); err != nil { os.Remove(tmp.Name()); return err }
+    if err := os.Chmod(tmp.Name(), perm); err != nil { os.Remove(tmp.Name()); return err }
+    return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestWebhookCRUDPersists(t *testing.T) {
+    srv := newServer()
+    do := func(method, path, body string) *httptest.ResponseRecorder {
+        rr := httptest.NewRecorder()
+        srv.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+        return rr
+    }
+    if rr := do("POST", "/webhooks", `{"url":"ftp://x","events":["task.*"]}`); rr.Code != 400 { t.Fatalf("expected 400 for bad url, got %d", rr.Code) }
+    rr := do("POST", "/webhooks", `{"url":"http://example.test/hook","events":["task.status"],"orgs":["acme"]}`)
+    if rr.Code != 201 { t.Fatalf("create: %d %s", rr.Code, rr.Body.String()) }
+    var created Webhook
+    json.Unmarshal(rr.Body.Bytes(), &created)
+    if created.ID == "" || created.Secret == "" { t.Fatalf("expected id and generated secret: %+v", created) }
+
+    if rr := do("PUT", "/webhooks/"+created.ID, `{"events":["task.*","agent.offline"]}`); rr.Code != 200 { t.Fatalf("update: %d", rr.Code) }
+    reloaded := newWebhookStore(filepath.Join(stateDir(), "webhooks.json"))
+    h, ok := reloaded.get(created.ID)
+    if !ok || len(h.Events) != 2 || h.Secret != created.Secret || h.Orgs[0] != "acme" { t.Fatalf("not persisted: %+v", h) }
+
+    rr = do("GET", "/webhooks/"+created.ID, "")
+    var got Webhook
+    json.Unmarshal(rr.Body.Bytes(), &got)
+    if got.Secret == created.Secret { t.Fatal("secret should be redacted on read") }
+
+    if rr := do("DELETE", "/webhooks/"+created.ID, ""); rr.Code != 200 { t.Fatalf("delete: %d", rr.Code) }
+    if rr := do("GET", "/webhooks/"+created.ID, ""); rr.Code != 404 { t.Fatalf("expected 404 after delete, got %d", rr.Code) }
+}
+
+func TestWebhookDeliverySignedWithRetry(t *testing.T) {
+    old := webhookRetryBase
+    webhookRetryBase = 10 * time.Millisecond
+    defer func() { webhookRetryBase = old }()
+
+    var mu sync.Mutex
+    calls := 0
+    got := make(chan *http.Request, 4)
+    bodies := make(chan []byte, 4)
+    recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock(); calls++; n := calls; mu.Unlock()
+        b, _ := io.ReadAll(r.Body)
+        if n == 1 { w.WriteHeader(503); return }
+        got <- r; bodies <- b
+    }))
+    defer recv.Close()
+
+    store := newWebhookStore(filepath.Join(t.TempDir(), "webhooks.json"))
+    hook := Webhook{ID: "h1", URL: recv.URL, Secret: "s3cret", Events: []string{EventTaskStatus}, Orgs: []string{"hook-acme"}}
+    if err := store.put(hook); err != nil { t.Fatal(err) }
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    startWebhookDispatcher(ctx, store)
+    time.Sleep(20 * time.Millisecond)
+
+    publishEvent(EventTaskStatus, "other-org", Task{ID: "x"})
+    publishEvent(EventTaskScheduled, "hook-acme", Task{ID: "y"})
+    publishEvent(EventTaskStatus, "hook-acme", Task{ID: "t1", Status: "completed"})
+
+    select {
+    case r := <-got:
+        body := <-bodies
+        if r.Header.Get(webhookSignatureHdr) != signWebhook("s3cret", body) { t.Fatal("bad signature") }
+        if r.Header.Get("X-Orchestrator-Event") != EventTaskStatus { t.Fatalf("event header %q", r.Header.Get("X-Orchestrator-Event")) }
+        var e Event
+        json.Unmarshal(body, &e)
+        if task, _ := e.Data.(map[string]any); task["id"] != "t1" { t.Fatalf("unexpected payload %s", body) }
+    case <-time.After(5 * time.Second):
+        t.Fatal("webhook not delivered")
+    }
+
+    var log []WebhookDelivery
+    for i := 0; i < 100; i++ {
+        if log = store.deliveryLog("h1"); len(log) == 2 { break }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if len(log) != 2 || log[0].Status != "delivered" || log[0].Attempt != 2 || log[1].Status != "retrying" || log[1].StatusCode != 503 {
+        t.Fatalf("unexpected delivery log: %+v", log)
+    }
+    mu.Lock(); defer mu.Unlock()
+    if calls != 2 { t.Fatalf("receiver called %d times, want 2", calls) }
+}
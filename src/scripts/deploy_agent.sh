@@ -27,9 +27,9 @@ spec:
         - { name: TASK_TEXT, value: "${TASK}" }
         - { name: ORCHESTRATOR_URL, value: "http://orchestrator.tailnet:18080" }
         - { name: ORCHESTRATOR_TOKEN, valueFrom: { secretKeyRef: { name: orchestrator-token, key: token } } }
-        - { name: CODE_SERVER_PASSWORD, value: "password" }
+        - { name: CODE_SERVER_PASSWORD, valueFrom: { secretKeyRef: { name: code-server, key: password } } }
         - { name: CODE_SERVER_AUTH_HEADER, value: "X-Agent-Auth" }
-        - { name: CODE_SERVER_TOKEN, value: "agent-secret" }
+        - { name: CODE_SERVER_TOKEN, valueFrom: { secretKeyRef: { name: code-server, key: token } } }
         ports:
         - containerPort: 8443
         readinessProbe:
@@ -108,9 +108,9 @@ spec:
     - { name: ORCHESTRATOR_URL, value: "http://orchestrator.tailnet:18080" }
 exit 1
         - { name: ORCHESTRATOR_TOKEN, valueFrom: { secretKeyRef: { name: orchestrator-token, key: token } } }
-        - { name: CODE_SERVER_PASSWORD, value: "password" }
+        - { name: CODE_SERVER_PASSWORD, valueFrom: { secretKeyRef: { name: code-server, key: password } } }
         - { name: CODE_SERVER_AUTH_HEADER, value: "X-Agent-Auth" }
-        - { name: CODE_SERVER_TOKEN, value: "agent-secret" }
+        - { name: CODE_SERVER_TOKEN, valueFrom: { secretKeyRef: { name: code-server, key: token } } }
         ports:
         - containerPort: 8443
         readinessProbe:
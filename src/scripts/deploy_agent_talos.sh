@@ -6,9 +6,9 @@ set -euo pipefail
 # Env (or .env in repo root):
 #   ORCHESTRATOR_URL    e.g. http://<orchestrator-host>:18080 (reachable from cluster nodes)
 #   ORCHESTRATOR_TOKEN  must match orchestrator's token
-#   CODE_SERVER_PASSWORD (default: password)
+#   CODE_SERVER_PASSWORD (default: random, printed once)
 #   CODE_SERVER_AUTH_HEADER (default: X-Agent-Auth)
-#   CODE_SERVER_TOKEN (default: password)
+#   CODE_SERVER_TOKEN (default: random)
 
 ROOT_DIR=$(cd "$(dirname "$0")/.." && pwd)
 [[ -f "$ROOT_DIR/.env" ]] && set -a && source "$ROOT_DIR/.env" && set +a
@@ -22,9 +22,11 @@ fi
 
 : "${ORCHESTRATOR_URL:?ORCHESTRATOR_URL is required (reachable from cluster)}"
 : "${ORCHESTRATOR_TOKEN:?ORCHESTRATOR_TOKEN is required}"
-CS_PASS=${CODE_SERVER_PASSWORD:-password}
+random_secret() { head -c 16 /dev/urandom | od -An -tx1 | tr -d ' \n'; }
+CS_PASS=${CODE_SERVER_PASSWORD:-$(random_secret)}
 CS_HDR=${CODE_SERVER_AUTH_HEADER:-X-Agent-Auth}
-CS_TOK=${CODE_SERVER_TOKEN:-password}
+CS_TOK=${CODE_SERVER_TOKEN:-$(random_secret)}
+[[ -n "${CODE_SERVER_PASSWORD:-}" ]] || echo "Generated code-server password: ${CS_PASS}"
 
 # Resolve kubeconfig: prefer provided KUBECONFIG, then /state/kube/<org>.config, then ~/.kube/<org>.config
 if [[ -n "${KUBECONFIG:-}" && -f "${KUBECONFIG}" ]]; then
@@ -53,6 +55,12 @@ kind: Deployment
 metadata:
   name: ${NAME}
   namespace: ${NS}
+  labels:
+    app: ${NAME}
+    app.kubernetes.io/managed-by: mvp-orchestrator
+    app.kubernetes.io/name: mvp-agent
+    app.kubernetes.io/instance: ${NAME}
+    mvp.agents/org: "${ORG}"
 spec:
   replicas: 1
   selector:
@@ -62,6 +70,10 @@ spec:
     metadata:
       labels:
         app: ${NAME}
+        app.kubernetes.io/managed-by: mvp-orchestrator
+        app.kubernetes.io/name: mvp-agent
+        app.kubernetes.io/instance: ${NAME}
+        mvp.agents/org: "${ORG}"
     spec:
       containers:
       - name: agent
@@ -70,6 +82,8 @@ spec:
         env:
         - name: ORG_NAME
           value: "${ORG}"
+        - name: AGENT_DEPLOYMENT
+          value: "${NAME}"
         - name: ORCHESTRATOR_URL
           value: "${ORCHESTRATOR_URL}"
         - name: ORCHESTRATOR_TOKEN